@@ -35,13 +35,14 @@ import (
 
 	"golang.org/x/xerrors"
 
-	"github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/luks2"
 )
 
 var (
-	luks2Activate   = luks2.Activate
-	luks2Deactivate = luks2.Deactivate
+	luks2Activate        = luks2.Activate
+	luks2Deactivate      = luks2.Deactivate
+	luks2Reencrypt       = luks2.Reencrypt
+	luks2SetSlotPriority = luks2.SetSlotPriority
 )
 
 // RecoveryKey corresponds to a 16-byte recovery key in its binary form.
@@ -189,6 +190,8 @@ type activateWithKeyDataState struct {
 	volumeName       string
 	sourceDevicePath string
 	keyringPrefix    string
+	keyringOptions   *KeyringOptions
+	activateOptions  *luks2.ActivateOptions
 
 	keys []*keyDataAndError
 
@@ -211,18 +214,24 @@ func (s *activateWithKeyDataState) snapModelChecker() *snapModelCheckerImpl {
 }
 
 func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(keyData *KeyData, key DiskUnlockKey, auxKey AuxiliaryKey) error {
-	if err := luks2Activate(s.volumeName, s.sourceDevicePath, key); err != nil {
+	if err := luks2Activate(s.volumeName, s.sourceDevicePath, key, s.activateOptions); err != nil {
 		return xerrors.Errorf("cannot activate volume: %w", err)
 	}
 
 	s.keyData = keyData
 	s.auxKey = auxKey
 
-	if err := keyring.AddKeyToUserKeyring(key, s.sourceDevicePath, keyringPurposeDiskUnlock, s.keyringPrefix); err != nil {
+	var detachedHeaderPath string
+	if s.activateOptions != nil {
+		detachedHeaderPath = s.activateOptions.DetachedHeaderPath
+	}
+	name := volumeKeyringName(s.sourceDevicePath, s.keyringOptions.headerPath(s.sourceDevicePath, detachedHeaderPath))
+
+	if err := addKeyToKernel(key, name, keyringPurposeDiskUnlock, s.keyringPrefix, s.keyringOptions); err != nil {
 		fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
 	}
 
-	if err := keyring.AddKeyToUserKeyring(auxKey, s.sourceDevicePath, keyringPurposeAuxiliary, s.keyringPrefix); err != nil {
+	if err := addKeyToKernel(auxKey, name, keyringPurposeAuxiliary, s.keyringPrefix, s.keyringOptions); err != nil {
 		fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
 	}
 
@@ -259,18 +268,21 @@ func (s *activateWithKeyDataState) run() (success bool) {
 	return false
 }
 
-func newActivateWithKeyDataState(volumeName, sourceDevicePath string, keyringPrefix string, keys []*KeyData) *activateWithKeyDataState {
+func newActivateWithKeyDataState(volumeName, sourceDevicePath string, options *ActivateVolumeOptions, keys []*KeyData) *activateWithKeyDataState {
 	s := &activateWithKeyDataState{
 		volumeName:       volumeName,
 		sourceDevicePath: sourceDevicePath,
-		keyringPrefix:    keyringPrefixOrDefault(keyringPrefix)}
+		keyringPrefix:    keyringPrefixOrDefault(options.KeyringPrefix),
+		keyringOptions:   options.KeyringOptions,
+		activateOptions:  options.luks2ActivateOptions()}
 	for _, k := range keys {
 		s.keys = append(s.keys, &keyDataAndError{KeyData: k})
 	}
 	return s
 }
 
-func activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, tries int, keyringPrefix string) error {
+func activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, options *ActivateVolumeOptions) error {
+	tries := options.RecoveryKeyTries
 	if tries == 0 {
 		return errors.New("no recovery key tries permitted")
 	}
@@ -294,12 +306,13 @@ func activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.R
 			continue
 		}
 
-		if err := luks2Activate(volumeName, sourceDevicePath, key[:]); err != nil {
+		if err := luks2Activate(volumeName, sourceDevicePath, key[:], options.luks2ActivateOptions()); err != nil {
 			lastErr = xerrors.Errorf("cannot activate volume: %w", err)
 			continue
 		}
 
-		if err := keyring.AddKeyToUserKeyring(key[:], sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix)); err != nil {
+		name := volumeKeyringName(sourceDevicePath, options.KeyringOptions.headerPath(sourceDevicePath, options.DetachedHeaderPath))
+		if err := addKeyToKernel(key[:], name, keyringPurposeDiskUnlock, keyringPrefixOrDefault(options.KeyringPrefix), options.KeyringOptions); err != nil {
 			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
 		}
 
@@ -338,8 +351,60 @@ type ActivateVolumeOptions struct {
 	// KeyringPrefix is the prefix used for the description of any
 	// kernel keys created during activation.
 	KeyringPrefix string
+
+	// KeyringOptions customizes how kernel keys created during
+	// activation are stored. If this is nil, keys are stored as
+	// readable keys in the user keyring and don't expire.
+	KeyringOptions *KeyringOptions
+
+	// DetachedHeaderPath is the path of the file or block device
+	// containing the detached LUKS2 header for the volume. If this
+	// is not set, the header is expected to be stored on the
+	// device being activated.
+	DetachedHeaderPath string
+
+	// Backend specifies the mechanism used to activate the volume.
+	// The default is LUKS2ActivationBackendAuto.
+	Backend LUKS2ActivationBackend
+}
+
+// luks2ActivateOptions converts these options in to the options used for activating
+// LUKS2 volumes, and returns nil if o is nil.
+func (o *ActivateVolumeOptions) luks2ActivateOptions() *luks2.ActivateOptions {
+	if o == nil {
+		return nil
+	}
+	opts := &luks2.ActivateOptions{DetachedHeaderPath: o.DetachedHeaderPath}
+	switch o.Backend {
+	case LUKS2ActivationBackendSystemd:
+		opts.Backend = luks2.ActivateBackendSystemd
+	case LUKS2ActivationBackendNative:
+		opts.Backend = luks2.ActivateBackendNative
+	default:
+		opts.Backend = luks2.ActivateBackendAuto
+	}
+	return opts
 }
 
+// LUKS2ActivationBackend specifies the mechanism used to activate LUKS2 volumes.
+type LUKS2ActivationBackend int
+
+const (
+	// LUKS2ActivationBackendAuto uses systemd-cryptsetup if it is available,
+	// and falls back to LUKS2ActivationBackendNative if it isn't.
+	LUKS2ActivationBackendAuto LUKS2ActivationBackend = iota
+
+	// LUKS2ActivationBackendSystemd uses systemd-cryptsetup to activate
+	// volumes.
+	LUKS2ActivationBackendSystemd
+
+	// LUKS2ActivationBackendNative recovers the volume key from the LUKS2
+	// header directly and creates the dm-crypt device using the
+	// device-mapper ioctl interface, without depending on any external
+	// tools. Only a subset of LUKS2 features are supported.
+	LUKS2ActivationBackendNative
+)
+
 type activateVolumeWithKeyDataError struct {
 	keyDataErrs         []error
 	recoveryKeyUsageErr error
@@ -390,12 +455,12 @@ func ActivateVolumeWithMultipleKeyData(volumeName, sourceDevicePath string, keys
 		return nil, errors.New("invalid RecoveryKeyTries")
 	}
 
-	s := newActivateWithKeyDataState(volumeName, sourceDevicePath, options.KeyringPrefix, keys)
+	s := newActivateWithKeyDataState(volumeName, sourceDevicePath, options, keys)
 	switch s.run() {
 	case true: // success!
 		return s.snapModelChecker(), nil
 	default: // failed - try recovery key
-		if rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, nil, options.RecoveryKeyTries, options.KeyringPrefix); rErr != nil {
+		if rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, nil, options); rErr != nil {
 			// failed with recovery key - return errors
 			var kdErrs []error
 			for _, e := range s.errors() {
@@ -442,14 +507,19 @@ func ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, keyReade
 		return errors.New("invalid RecoveryKeyTries")
 	}
 
-	return activateWithRecoveryKey(volumeName, sourceDevicePath, keyReader, options.RecoveryKeyTries, options.KeyringPrefix)
+	return activateWithRecoveryKey(volumeName, sourceDevicePath, keyReader, options)
 }
 
 // ActivateVolumeWithKey attempts to activate the LUKS encrypted volume at
 // sourceDevicePath and create a mapping with the name volumeName, using the
 // provided key. This makes use of systemd-cryptsetup.
+//
+// The DetachedHeaderPath field of options can be used to activate a volume
+// with a detached header, and the Backend field selects the activation
+// mechanism. Other fields of options are ignored, and options
+// may be nil.
 func ActivateVolumeWithKey(volumeName, sourceDevicePath string, key []byte, options *ActivateVolumeOptions) error {
-	return luks2Activate(volumeName, sourceDevicePath, key)
+	return luks2Activate(volumeName, sourceDevicePath, key, options.luks2ActivateOptions())
 }
 
 // DeactivateVolume attempts to deactivate the LUKS encrypted volumeName.
@@ -471,6 +541,154 @@ type InitializeLUKS2ContainerOptions struct {
 	// expressed in multiples of 1024 bytes. The value must be aligned to
 	// 4096 bytes, with the maximum size of 128MB.
 	KeyslotsAreaKiBSize int
+
+	// Cipher sets the cipher used to encrypt data, in dm-crypt
+	// notation (eg, "aes-xts-plain64"). The default is
+	// aes-xts-plain64. AEAD ciphers such as aes-gcm-random or
+	// aegis256-random can only be used with Integrity set to "aead",
+	// and chacha20-random can only be used with Integrity set to
+	// "poly1305".
+	Cipher string
+
+	// KeySize sets the size of the volume encryption key in bytes,
+	// excluding any integrity key. The default is 64 bytes, which
+	// corresponds to AES-256 in XTS mode, or 32 bytes for AEAD
+	// ciphers (16 bytes for aegis128 variants). Must be 16, 32 or
+	// 64. XTS mode uses 2 keys, so 16 bytes can't be used with it.
+	KeySize int
+
+	// SectorSize sets the encryption sector size in bytes. The
+	// default is the cryptsetup default (512 bytes). Must be a
+	// power of 2 between 512 and 4096 bytes. Using 4096 byte
+	// sectors on devices with a 4KiB physical sector size
+	// improves performance. Sector sizes larger than 512 bytes
+	// require kernel 4.12 or later.
+	SectorSize int
+
+	// Integrity enables authenticated encryption with dm-integrity
+	// using the specified algorithm. It must be one of "aead" (for
+	// AEAD ciphers such as aes-gcm-random), "poly1305" (for
+	// chacha20-random), "hmac-sha256" or "hmac-sha512". Note that
+	// enabling integrity protection wipes the entire device during
+	// initialization, which may take a long time. Integrity
+	// protection requires a kernel with dm-integrity support (4.12
+	// or later), and an error is returned before the device is
+	// modified if it isn't available.
+	Integrity string
+
+	// DetachedHeaderPath is the path of a file or block device in
+	// which to store the LUKS2 header. If this is set, the header is
+	// not stored on the container device, which will only contain
+	// encrypted data. The header path should then be used in place
+	// of the device path for any subsequent operations that modify
+	// the header, such as AddRecoveryKeyToLUKS2Container.
+	DetachedHeaderPath string
+}
+
+// aeadIntegrityAlgorithm returns the integrity algorithm that the supplied cipher in
+// dm-crypt notation must be paired with if it is an AEAD cipher, or an empty string
+// if it isn't an AEAD cipher. chacha20-random is only authenticated when combined
+// with poly1305, and every other AEAD cipher uses the "aead" integrity algorithm.
+func aeadIntegrityAlgorithm(cipher string) string {
+	components := strings.Split(cipher, "-")
+	if len(components) < 2 {
+		return ""
+	}
+	switch {
+	case components[0] == "chacha20" && components[1] == "random":
+		return "poly1305"
+	case strings.HasPrefix(components[0], "aegis") && components[1] == "random":
+		return "aead"
+	case components[1] == "gcm" || components[1] == "ccm":
+		return "aead"
+	default:
+		return ""
+	}
+}
+
+// isAEADCipher indicates whether the supplied cipher in dm-crypt notation is an
+// AEAD cipher, which can only be used with authenticated encryption.
+func isAEADCipher(cipher string) bool {
+	return aeadIntegrityAlgorithm(cipher) != ""
+}
+
+// defaultAEADKeySize returns the default size in bytes of the volume encryption
+// key for the supplied AEAD cipher in dm-crypt notation.
+func defaultAEADKeySize(cipher string) int {
+	if strings.HasPrefix(cipher, "aegis128") {
+		return 16
+	}
+	return 32
+}
+
+// isXTSCipher indicates whether the supplied cipher in dm-crypt notation uses XTS
+// mode. An empty cipher corresponds to the default, which is aes-xts-plain64.
+func isXTSCipher(cipher string) bool {
+	if cipher == "" {
+		return true
+	}
+	components := strings.Split(cipher, "-")
+	return len(components) >= 2 && components[1] == "xts"
+}
+
+func validateCipherOptions(options *InitializeLUKS2ContainerOptions) error {
+	if options.Cipher != "" {
+		// The cipher is recorded in the "encryption" property of the
+		// segment and keyslot area objects in the LUKS2 metadata, in the
+		// form cipher-mode-iv.
+		components := strings.Split(options.Cipher, "-")
+		if len(components) < 2 || len(components) > 3 {
+			return fmt.Errorf("cannot set cipher to %q", options.Cipher)
+		}
+		for _, c := range components {
+			if c == "" || strings.ContainsAny(c, ", \t") {
+				return fmt.Errorf("cannot set cipher to %q", options.Cipher)
+			}
+		}
+	}
+
+	switch options.KeySize {
+	case 0, 16, 32, 64:
+	default:
+		return fmt.Errorf("cannot set key size to %d bytes", options.KeySize)
+	}
+	if options.KeySize == 16 && isXTSCipher(options.Cipher) {
+		return fmt.Errorf("cannot use key size of %d bytes with XTS mode", options.KeySize)
+	}
+
+	if options.SectorSize != 0 {
+		// sector size is a power of 2 between 512 and 4096 bytes
+		sz := options.SectorSize
+		if sz < 512 || sz > 4096 || sz&(sz-1) != 0 {
+			return fmt.Errorf("cannot set sector size to %d bytes", options.SectorSize)
+		}
+	}
+
+	aeadIntegrity := aeadIntegrityAlgorithm(options.Cipher)
+	switch options.Integrity {
+	case "":
+		if aeadIntegrity != "" {
+			return fmt.Errorf("cannot use AEAD cipher %q without integrity protection", options.Cipher)
+		}
+	case "aead", "poly1305":
+		switch {
+		case aeadIntegrity == "":
+			return fmt.Errorf("cannot use integrity algorithm %q with non-AEAD cipher %q", options.Integrity, options.Cipher)
+		case aeadIntegrity != options.Integrity:
+			return fmt.Errorf("cannot use integrity algorithm %q with AEAD cipher %q, which requires %q", options.Integrity, options.Cipher, aeadIntegrity)
+		}
+		if options.KeySize == 64 {
+			return fmt.Errorf("cannot use key size of %d bytes with AEAD cipher %q", options.KeySize, options.Cipher)
+		}
+	case "hmac-sha256", "hmac-sha512":
+		if aeadIntegrity != "" {
+			return fmt.Errorf("cannot use integrity algorithm %q with AEAD cipher %q", options.Integrity, options.Cipher)
+		}
+	default:
+		return fmt.Errorf("cannot set integrity algorithm to %q", options.Integrity)
+	}
+
+	return nil
 }
 
 func validateInitializeLUKS2Options(options *InitializeLUKS2ContainerOptions) error {
@@ -503,7 +721,7 @@ func validateInitializeLUKS2Options(options *InitializeLUKS2ContainerOptions) er
 				options.KeyslotsAreaKiBSize)
 		}
 	}
-	return nil
+	return validateCipherOptions(options)
 }
 
 // InitializeLUKS2Container will initialize the partition at the specified devicePath as a new LUKS2 container. This can only
@@ -512,7 +730,12 @@ func validateInitializeLUKS2Options(options *InitializeLUKS2ContainerOptions) er
 // The initial key used for unlocking the container is provided via the key argument, and must be a cryptographically secure
 // random number of at least 32-bytes. The key should be encrypted by using SealKeyToTPM.
 //
-// The container will be configured to encrypt data with AES-256 and XTS block cipher mode.
+// By default, the container will be configured to encrypt data with AES-256 and XTS block cipher mode. This can be
+// customized with the Cipher, KeySize and SectorSize fields of options, and authenticated encryption with dm-integrity
+// can be enabled with the Integrity field.
+//
+// If the DetachedHeaderPath field of options is set, the LUKS2 header is stored at the specified path instead of on the
+// partition, so that the partition only contains encrypted data.
 //
 // On failure, this will return an error containing the output of the cryptsetup command.
 //
@@ -532,16 +755,29 @@ func InitializeLUKS2Container(devicePath, label string, key []byte, options *Ini
 	// cost here only slows down unlocking.
 	opts := luks2.FormatOptions{
 		KDFOptions: luks2.KDFOptions{TargetDuration: 100 * time.Millisecond}}
+	headerPath := devicePath
 	if options != nil {
 		opts.MetadataKiBSize = options.MetadataKiBSize
 		opts.KeyslotsAreaKiBSize = options.KeyslotsAreaKiBSize
+		opts.DetachedHeaderPath = options.DetachedHeaderPath
+		opts.Cipher = options.Cipher
+		opts.KeySize = options.KeySize
+		opts.SectorSize = options.SectorSize
+		opts.Integrity = options.Integrity
+		if opts.KeySize == 0 && isAEADCipher(opts.Cipher) {
+			// The default key size is too large for AEAD ciphers.
+			opts.KeySize = defaultAEADKeySize(opts.Cipher)
+		}
+		if options.DetachedHeaderPath != "" {
+			headerPath = options.DetachedHeaderPath
+		}
 	}
 
 	if err := luks2.Format(devicePath, label, key, &opts); err != nil {
 		return xerrors.Errorf("cannot format %s: %w", err)
 	}
 
-	if err := luks2.SetSlotPriority(devicePath, 0, luks2.SlotPriorityHigh); err != nil {
+	if err := luks2SetSlotPriority(headerPath, 0, luks2.SlotPriorityHigh); err != nil {
 		return xerrors.Errorf("cannot change keyslot priority: %w", err)
 	}
 
@@ -555,6 +791,8 @@ func InitializeLUKS2Container(devicePath, label string, key []byte, options *Ini
 // key argument.
 //
 // The recovery key is provided via the recoveryKey argument and must be a cryptographically secure 16-byte number.
+//
+// For a LUKS2 container with a detached header, devicePath should be the path of the header.
 func AddRecoveryKeyToLUKS2Container(devicePath string, key []byte, recoveryKey RecoveryKey) error {
 	options := luks2.AddKeyOptions{
 		KDFOptions: luks2.KDFOptions{TargetDuration: 5 * time.Second},
@@ -572,6 +810,8 @@ func AddRecoveryKeyToLUKS2Container(devicePath string, key []byte, recoveryKey R
 // Note that this operation is not atomic. It will delete the existing key from the container before configuring the keyslot with
 // the new key. This is not a problem, because this function is intended to be called in the scenario that the default key cannot
 // be used to activate the LUKS2 container.
+//
+// For a LUKS2 container with a detached header, devicePath should be the path of the header.
 func ChangeLUKS2KeyUsingRecoveryKey(devicePath string, recoveryKey RecoveryKey, key []byte) error {
 	if len(key) < 32 {
 		return fmt.Errorf("expected a key length of at least 256-bits (got %d)", len(key)*8)
@@ -592,9 +832,54 @@ func ChangeLUKS2KeyUsingRecoveryKey(devicePath string, recoveryKey RecoveryKey,
 		return xerrors.Errorf("cannot add key: %w", err)
 	}
 
-	if err := luks2.SetSlotPriority(devicePath, 0, luks2.SlotPriorityHigh); err != nil {
+	if err := luks2SetSlotPriority(devicePath, 0, luks2.SlotPriorityHigh); err != nil {
 		return xerrors.Errorf("cannot change keyslot priority: %w", err)
 	}
 
 	return nil
 }
+
+// ReencryptLUKS2ContainerOptions carries options for reencrypting LUKS2 containers.
+type ReencryptLUKS2ContainerOptions struct {
+	// DetachedHeaderPath is the path of the LUKS2 header for a
+	// container with a detached header.
+	DetachedHeaderPath string
+
+	// ProgressFunc is called periodically from a separate goroutine
+	// with the number of bytes that have been reencrypted and the
+	// total number of bytes to reencrypt.
+	ProgressFunc func(processed, total uint64)
+}
+
+// ReencryptLUKS2Container reencrypts the data in the LUKS2 container at devicePath with a new volume key. This is
+// intended to be used in the scenario that the volume key may have been leaked, which can't be fixed by only
+// changing the keys used to unlock the container. The container can be active, in which case it is reencrypted
+// online. This can take a long time, depending on the size of the container.
+//
+// The existing key for the container, created with InitializeLUKS2Container, is provided via the key argument,
+// and is used to protect the new volume key. The keyslot that this key unlocks is looked up from the container
+// metadata, so it doesn't need to be the first keyslot. Other keyslots, such as the one containing the recovery key, are
+// bound to the old volume key and cannot be used once reencryption has completed. The recovery key must be
+// added again with AddRecoveryKeyToLUKS2Container afterwards.
+//
+// If a previous call was interrupted, the container metadata records the reencryption as being in progress,
+// and calling this function again resumes it from where it was interrupted. The container can still be
+// activated with the existing key in this state.
+//
+// On failure, this will return an error containing the output of the cryptsetup command.
+func ReencryptLUKS2Container(devicePath string, key []byte, options *ReencryptLUKS2ContainerOptions) error {
+	// Configure the KDF with reduced cost, for the same reason as InitializeLUKS2Container.
+	opts := luks2.ReencryptOptions{
+		KDFOptions: luks2.KDFOptions{TargetDuration: 100 * time.Millisecond},
+		Slot:       luks2.AnySlot}
+	if options != nil {
+		opts.DetachedHeaderPath = options.DetachedHeaderPath
+		opts.ProgressFunc = options.ProgressFunc
+	}
+
+	if err := luks2Reencrypt(devicePath, key, &opts); err != nil {
+		return xerrors.Errorf("cannot reencrypt container: %w", err)
+	}
+
+	return nil
+}
@@ -28,6 +28,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,6 +37,7 @@ import (
 	. "gopkg.in/check.v1"
 
 	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/luks2/luks2test"
 	"github.com/snapcore/secboot/internal/paths"
@@ -68,11 +70,19 @@ type cryptSuite struct {
 	mockKeyslotsCount int
 
 	mockLUKS2ActivateCalls []struct {
-		volumeName       string
-		sourceDevicePath string
+		volumeName         string
+		sourceDevicePath   string
+		detachedHeaderPath string
+		backend            luks2.ActivateBackend
 	}
 	mockLUKS2DeactivateCalls int
 
+	mockLUKS2SetSlotPriorityCalls []struct {
+		devicePath string
+		slot       int
+		priority   luks2.SlotPriority
+	}
+
 	cryptsetupInvocationCountDir string
 	cryptsetupKey                string // The file in which the mock cryptsetup dumps the provided key
 	cryptsetupNewkey             string // The file in which the mock cryptsetup dumps the provided new key
@@ -93,6 +103,7 @@ func (s *cryptSuite) SetUpTest(c *C) {
 	s.KeyringTestBase.SetUpTest(c)
 
 	s.AddCleanup(pathstest.MockRunDir(c.MkDir()))
+	s.AddCleanup(mockLUKS2Headers(nil))
 
 	dir := c.MkDir()
 	s.passwordFile = filepath.Join(dir, "password") // passwords to be returned by the mock sd-ask-password
@@ -101,11 +112,19 @@ func (s *cryptSuite) SetUpTest(c *C) {
 	s.mockKeyslotsDir = c.MkDir()
 
 	s.mockLUKS2ActivateCalls = nil
-	s.AddCleanup(MockLUKS2Activate(func(volumeName, sourceDevicePath string, key []byte) error {
+	s.AddCleanup(MockLUKS2Activate(func(volumeName, sourceDevicePath string, key []byte, options *luks2.ActivateOptions) error {
+		var detachedHeaderPath string
+		var backend luks2.ActivateBackend
+		if options != nil {
+			detachedHeaderPath = options.DetachedHeaderPath
+			backend = options.Backend
+		}
 		s.mockLUKS2ActivateCalls = append(s.mockLUKS2ActivateCalls, struct {
-			volumeName       string
-			sourceDevicePath string
-		}{volumeName, sourceDevicePath})
+			volumeName         string
+			sourceDevicePath   string
+			detachedHeaderPath string
+			backend            luks2.ActivateBackend
+		}{volumeName, sourceDevicePath, detachedHeaderPath, backend})
 
 		f, err := os.Open(s.mockKeyslotsDir)
 		if err != nil {
@@ -140,11 +159,26 @@ func (s *cryptSuite) SetUpTest(c *C) {
 		return nil
 	}))
 
+	s.mockLUKS2SetSlotPriorityCalls = nil
+	s.AddCleanup(MockLUKS2SetSlotPriority(func(devicePath string, slot int, priority luks2.SlotPriority) error {
+		s.mockLUKS2SetSlotPriorityCalls = append(s.mockLUKS2SetSlotPriorityCalls, struct {
+			devicePath string
+			slot       int
+			priority   luks2.SlotPriority
+		}{devicePath, slot, priority})
+		return nil
+	}))
+
 	s.cryptsetupKey = filepath.Join(dir, "cryptsetupkey")       // File in which the mock cryptsetup records the passed in key
 	s.cryptsetupNewkey = filepath.Join(dir, "cryptsetupnewkey") // File in which the mock cryptsetup records the passed in new key
 	s.cryptsetupInvocationCountDir = c.MkDir()
 
 	cryptsetupBottom := `
+if [ "$1" = "--help" ]; then
+    echo "cryptsetup 2.2.2"
+    exit 0
+fi
+
 keyfile=""
 action=""
 
@@ -234,18 +268,18 @@ func (s *cryptSuite) checkRecoveryKeyInKeyring(c *C, prefix, path string, expect
 	c.Check(key, DeepEquals, DiskUnlockKey(expected[:]))
 }
 
-func (s *cryptSuite) checkKeyDataKeysInKeyring(c *C, prefix, path string, expectedKey DiskUnlockKey, expectedAuxKey AuxiliaryKey) {
+func (s *cryptSuite) checkKeyDataKeysInKeyring(c *C, prefix, path string, options *KeyringOptions, expectedKey DiskUnlockKey, expectedAuxKey AuxiliaryKey) {
 	// The following test will fail if the user keyring isn't reachable from the session keyring. If the test have succeeded
 	// so far, mark the current test as expected to fail.
 	if !s.ProcessPossessesUserKeyringKeys && !c.Failed() {
 		c.ExpectFailure("Cannot possess user keys because the user keyring isn't reachable from the session keyring")
 	}
 
-	key, err := GetDiskUnlockKeyFromKernel(prefix, path, false)
+	key, err := GetDiskUnlockKeyFromKernelWithOptions(prefix, path, false, options)
 	c.Check(err, IsNil)
 	c.Check(key, DeepEquals, expectedKey)
 
-	auxKey, err := GetAuxiliaryKeyFromKernel(prefix, path, false)
+	auxKey, err := GetAuxiliaryKeyFromKernelWithOptions(prefix, path, false, options)
 	c.Check(err, IsNil)
 	c.Check(auxKey, DeepEquals, expectedAuxKey)
 }
@@ -284,6 +318,7 @@ type testActivateVolumeWithRecoveryKeyData struct {
 	sourceDevicePath    string
 	tries               int
 	keyringPrefix       string
+	detachedHeaderPath  string
 	recoveryPassphrases []string
 	activateTries       int
 }
@@ -292,7 +327,7 @@ func (s *cryptSuite) testActivateVolumeWithRecoveryKey(c *C, data *testActivateV
 	s.addMockKeyslot(c, data.recoveryKey[:])
 	s.addTryPassphrases(c, data.recoveryPassphrases)
 
-	options := ActivateVolumeOptions{RecoveryKeyTries: data.tries, KeyringPrefix: data.keyringPrefix}
+	options := ActivateVolumeOptions{RecoveryKeyTries: data.tries, KeyringPrefix: data.keyringPrefix, DetachedHeaderPath: data.detachedHeaderPath}
 	c.Assert(ActivateVolumeWithRecoveryKey(data.volumeName, data.sourceDevicePath, nil, &options), IsNil)
 
 	c.Check(len(s.mockSdAskPassword.Calls()), Equals, len(data.recoveryPassphrases))
@@ -305,12 +340,116 @@ func (s *cryptSuite) testActivateVolumeWithRecoveryKey(c *C, data *testActivateV
 	for _, call := range s.mockLUKS2ActivateCalls {
 		c.Check(call.volumeName, Equals, data.volumeName)
 		c.Check(call.sourceDevicePath, Equals, data.sourceDevicePath)
+		c.Check(call.detachedHeaderPath, Equals, data.detachedHeaderPath)
 	}
 
 	// This should be done last because it may fail in some circumstances.
 	s.checkRecoveryKeyInKeyring(c, data.keyringPrefix, data.sourceDevicePath, data.recoveryKey)
 }
 
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyDetachedHeader(c *C) {
+	// Test with a detached header.
+	recoveryKey := s.newRecoveryKey()
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:         recoveryKey,
+		volumeName:          "data",
+		sourceDevicePath:    "/dev/sda1",
+		tries:               1,
+		detachedHeaderPath:  "/boot/luks/data.hdr",
+		recoveryPassphrases: []string{recoveryKey.String()},
+		activateTries:       1,
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyStoresKeyByUUID(c *C) {
+	s.AddCleanup(mockLUKS2Headers(map[string]string{"/dev/sda1": "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4"}))
+
+	recoveryKey := s.newRecoveryKey()
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:         recoveryKey,
+		volumeName:          "data",
+		sourceDevicePath:    "/dev/sda1",
+		tries:               1,
+		recoveryPassphrases: []string{recoveryKey.String()},
+		activateTries:       1,
+	})
+
+	key, err := keyring.GetKeyFromUserKeyring("b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4", "unlock", "ubuntu-fde")
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, recoveryKey[:])
+
+	_, err = keyring.GetKeyFromUserKeyring("/dev/sda1", "unlock", "ubuntu-fde")
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataStoresKeysByUUIDFromDetachedHeader(c *C) {
+	s.AddCleanup(mockLUKS2Headers(map[string]string{"/boot/luks/data.hdr": "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4"}))
+
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot(c, key)
+
+	_, err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, &ActivateVolumeOptions{DetachedHeaderPath: "/boot/luks/data.hdr"})
+	c.Assert(err, IsNil)
+
+	key2, err := keyring.GetKeyFromUserKeyring("b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4", "unlock", "ubuntu-fde")
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, []byte(key))
+
+	auxKey2, err := keyring.GetKeyFromUserKeyring("b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4", "aux", "ubuntu-fde")
+	c.Check(err, IsNil)
+	c.Check(auxKey2, DeepEquals, []byte(auxKey))
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDetachedHeaderGetKeysFromKernel(c *C) {
+	s.AddCleanup(mockLUKS2Headers(map[string]string{"/boot/luks/data.hdr": "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4"}))
+
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot(c, key)
+
+	_, err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, &ActivateVolumeOptions{DetachedHeaderPath: "/boot/luks/data.hdr"})
+	c.Assert(err, IsNil)
+
+	// The UUID can't be obtained from the data device.
+	_, err = GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	options := &KeyringOptions{DetachedHeaderPath: "/boot/luks/data.hdr"}
+
+	key2, err := GetDiskUnlockKeyFromKernelWithOptions("", "/dev/sda1", false, options)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	auxKey2, err := GetAuxiliaryKeyFromKernelWithOptions("", "/dev/sda1", true, options)
+	c.Check(err, IsNil)
+	c.Check(auxKey2, DeepEquals, auxKey)
+
+	_, err = GetAuxiliaryKeyFromKernelWithOptions("", "/dev/sda1", false, options)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataKeyringOptionsDetachedHeader(c *C) {
+	// Test that the header path in KeyringOptions is used when adding
+	// keys, consistent with how it is used when retrieving them.
+	s.AddCleanup(mockLUKS2Headers(map[string]string{"/run/data.hdr": "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4"}))
+
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot(c, key)
+
+	keyringOptions := &KeyringOptions{DetachedHeaderPath: "/run/data.hdr"}
+	_, err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, &ActivateVolumeOptions{
+		DetachedHeaderPath: "/boot/luks/data.hdr",
+		KeyringOptions:     keyringOptions})
+	c.Assert(err, IsNil)
+
+	key2, err := GetDiskUnlockKeyFromKernelWithOptions("", "/dev/sda1", false, keyringOptions)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	auxKey2, err := GetAuxiliaryKeyFromKernelWithOptions("", "/dev/sda1", false, keyringOptions)
+	c.Check(err, IsNil)
+	c.Check(auxKey2, DeepEquals, auxKey)
+}
+
 func (s *cryptSuite) TestActivateVolumeWithRecoveryKey1(c *C) {
 	// Test with a recovery key which is entered with a hyphen between each group of 5 digits.
 	recoveryKey := s.newRecoveryKey()
@@ -712,12 +851,14 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandling7(c *C) {
 }
 
 type testActivateVolumeWithKeyDataData struct {
-	authorizedModels []SnapModel
-	volumeName       string
-	sourceDevicePath string
-	keyringPrefix    string
-	model            SnapModel
-	authorized       bool
+	authorizedModels   []SnapModel
+	volumeName         string
+	sourceDevicePath   string
+	keyringPrefix      string
+	keyringOptions     *KeyringOptions
+	detachedHeaderPath string
+	model              SnapModel
+	authorized         bool
 }
 
 func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolumeWithKeyDataData) {
@@ -726,7 +867,10 @@ func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolum
 
 	c.Check(keyData.SetAuthorizedSnapModels(auxKey, data.authorizedModels...), IsNil)
 
-	options := &ActivateVolumeOptions{KeyringPrefix: data.keyringPrefix}
+	options := &ActivateVolumeOptions{
+		KeyringPrefix:      data.keyringPrefix,
+		KeyringOptions:     data.keyringOptions,
+		DetachedHeaderPath: data.detachedHeaderPath}
 	modelChecker, err := ActivateVolumeWithKeyData(data.volumeName, data.sourceDevicePath, keyData, options)
 	c.Assert(err, IsNil)
 
@@ -739,9 +883,10 @@ func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolum
 	c.Assert(s.mockLUKS2ActivateCalls, HasLen, 1)
 	c.Check(s.mockLUKS2ActivateCalls[0].volumeName, Equals, data.volumeName)
 	c.Check(s.mockLUKS2ActivateCalls[0].sourceDevicePath, Equals, data.sourceDevicePath)
+	c.Check(s.mockLUKS2ActivateCalls[0].detachedHeaderPath, Equals, data.detachedHeaderPath)
 
 	// This should be done last because it may fail in some circumstances.
-	s.checkKeyDataKeysInKeyring(c, data.keyringPrefix, data.sourceDevicePath, key, auxKey)
+	s.checkKeyDataKeysInKeyring(c, data.keyringPrefix, data.sourceDevicePath, data.keyringOptions, key, auxKey)
 }
 
 func (s *cryptSuite) TestActivateVolumeWithKeyData1(c *C) {
@@ -781,6 +926,46 @@ func (s *cryptSuite) TestActivateVolumeWithKeyData2(c *C) {
 		authorized:       true})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDetachedHeader(c *C) {
+	// Test with a detached header
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		authorizedModels:   models,
+		volumeName:         "data",
+		sourceDevicePath:   "/dev/sda1",
+		detachedHeaderPath: "/boot/luks/data.hdr",
+		model:              models[0],
+		authorized:         true})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataKeyringOptions(c *C) {
+	// Test with keys stored in a named keyring with a timeout
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		authorizedModels: models,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		keyringOptions:   &KeyringOptions{Timeout: time.Hour, KeyringName: "secboot-test"},
+		model:            models[0],
+		authorized:       true})
+}
+
 func (s *cryptSuite) TestActivateVolumeWithKeyData3(c *C) {
 	// Test with different authorized models
 	models := []SnapModel{
@@ -1059,7 +1244,7 @@ func (s *cryptSuite) testActivateVolumeWithMultipleKeyData(c *C, data *testActiv
 	}
 
 	// This should be done last because it may fail in some circumstances.
-	s.checkKeyDataKeysInKeyring(c, data.keyringPrefix, data.sourceDevicePath, data.key, data.auxKey)
+	s.checkKeyDataKeysInKeyring(c, data.keyringPrefix, data.sourceDevicePath, nil, data.key, data.auxKey)
 }
 
 func (s *cryptSuite) TestActivateVolumeWithMultipleKeyData1(c *C) {
@@ -1333,10 +1518,13 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling8(c *C) {
 }
 
 type testActivateVolumeWithKeyData struct {
-	keyData         []byte
-	expectedKeyData []byte
-	errMatch        string
-	cmdCalled       bool
+	keyData            []byte
+	expectedKeyData    []byte
+	detachedHeaderPath string
+	backend            LUKS2ActivationBackend
+	expectedBackend    luks2.ActivateBackend
+	errMatch           string
+	cmdCalled          bool
 }
 
 func (s *cryptSuite) testActivateVolumeWithKey(c *C, data *testActivateVolumeWithKeyData) {
@@ -1348,7 +1536,7 @@ func (s *cryptSuite) testActivateVolumeWithKey(c *C, data *testActivateVolumeWit
 	}
 	s.addMockKeyslot(c, expectedKeyData)
 
-	options := ActivateVolumeOptions{}
+	options := ActivateVolumeOptions{DetachedHeaderPath: data.detachedHeaderPath, Backend: data.backend}
 	err := ActivateVolumeWithKey("luks-volume", "/dev/sda1", data.keyData, &options)
 	if data.errMatch == "" {
 		c.Check(err, IsNil)
@@ -1362,6 +1550,8 @@ func (s *cryptSuite) testActivateVolumeWithKey(c *C, data *testActivateVolumeWit
 		c.Assert(s.mockLUKS2ActivateCalls, HasLen, 1)
 		c.Check(s.mockLUKS2ActivateCalls[0].volumeName, Equals, "luks-volume")
 		c.Check(s.mockLUKS2ActivateCalls[0].sourceDevicePath, Equals, "/dev/sda1")
+		c.Check(s.mockLUKS2ActivateCalls[0].detachedHeaderPath, Equals, data.detachedHeaderPath)
+		c.Check(s.mockLUKS2ActivateCalls[0].backend, Equals, data.expectedBackend)
 	} else {
 		c.Check(len(s.mockSdAskPassword.Calls()), Equals, 0)
 		c.Check(s.mockLUKS2ActivateCalls, HasLen, 0)
@@ -1375,6 +1565,49 @@ func (s *cryptSuite) TestActivateVolumeWithKey(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyDetachedHeader(c *C) {
+	s.testActivateVolumeWithKey(c, &testActivateVolumeWithKeyData{
+		keyData:            []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		detachedHeaderPath: "/boot/luks/data.hdr",
+		cmdCalled:          true,
+	})
+}
+
+func (s *cryptSuite) TestLUKS2ActivateOptions(c *C) {
+	var options *ActivateVolumeOptions
+	c.Check(options.LUKS2ActivateOptions(), IsNil)
+
+	for _, data := range []struct {
+		backend  LUKS2ActivationBackend
+		expected luks2.ActivateBackend
+	}{
+		{backend: LUKS2ActivationBackendAuto, expected: luks2.ActivateBackendAuto},
+		{backend: LUKS2ActivationBackendSystemd, expected: luks2.ActivateBackendSystemd},
+		{backend: LUKS2ActivationBackendNative, expected: luks2.ActivateBackendNative},
+	} {
+		options = &ActivateVolumeOptions{DetachedHeaderPath: "/dev/sdb1", Backend: data.backend}
+		c.Check(options.LUKS2ActivateOptions(), DeepEquals, &luks2.ActivateOptions{DetachedHeaderPath: "/dev/sdb1", Backend: data.expected})
+	}
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeySystemdBackend(c *C) {
+	s.testActivateVolumeWithKey(c, &testActivateVolumeWithKeyData{
+		keyData:         []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		backend:         LUKS2ActivationBackendSystemd,
+		expectedBackend: luks2.ActivateBackendSystemd,
+		cmdCalled:       true,
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyNativeBackend(c *C) {
+	s.testActivateVolumeWithKey(c, &testActivateVolumeWithKeyData{
+		keyData:         []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		backend:         LUKS2ActivationBackendNative,
+		expectedBackend: luks2.ActivateBackendNative,
+		cmdCalled:       true,
+	})
+}
+
 func (s *cryptSuite) TestActivateVolumeWithKeyMismatchErr(c *C) {
 	s.testActivateVolumeWithKey(c, &testActivateVolumeWithKeyData{
 		keyData:         []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
@@ -1402,22 +1635,41 @@ type testInitializeLUKS2ContainerData struct {
 	key             []byte
 	opts            *InitializeLUKS2ContainerOptions
 	extraFormatArgs []string
+	headerPath      string
+	cipher          string
+	keySize         int
 }
 
 func (s *cryptSuite) testInitializeLUKS2Container(c *C, data *testInitializeLUKS2ContainerData) {
 	c.Check(InitializeLUKS2Container(data.devicePath, data.label, data.key, data.opts), IsNil)
+
+	cipher := data.cipher
+	if cipher == "" {
+		cipher = "aes-xts-plain64"
+	}
+	keySize := data.keySize
+	if keySize == 0 {
+		keySize = 64
+	}
+
 	formatArgs := []string{"cryptsetup",
 		"-q", "luksFormat", "--type", "luks2",
-		"--key-file", "-", "--cipher", "aes-xts-plain64",
-		"--key-size", "512", "--label", data.label,
+		"--key-file", "-", "--cipher", cipher,
+		"--key-size", strconv.Itoa(keySize * 8), "--label", data.label,
 		"--pbkdf", "argon2i", "--iter-time", "100",
 	}
 	formatArgs = append(formatArgs, data.extraFormatArgs...)
 	formatArgs = append(formatArgs, data.devicePath)
 
-	c.Check(s.mockCryptsetup.Calls(), DeepEquals, [][]string{
-		formatArgs,
-		{"cryptsetup", "config", "--priority", "prefer", "--key-slot", "0", data.devicePath}})
+	c.Check(s.mockCryptsetup.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}, formatArgs})
+	c.Assert(s.mockLUKS2SetSlotPriorityCalls, HasLen, 1)
+	headerPath := data.headerPath
+	if headerPath == "" {
+		headerPath = data.devicePath
+	}
+	c.Check(s.mockLUKS2SetSlotPriorityCalls[0].devicePath, Equals, headerPath)
+	c.Check(s.mockLUKS2SetSlotPriorityCalls[0].slot, Equals, 0)
+	c.Check(s.mockLUKS2SetSlotPriorityCalls[0].priority, Equals, luks2.SlotPriorityHigh)
 	key, err := ioutil.ReadFile(s.cryptsetupKey + ".1")
 	c.Assert(err, IsNil)
 	c.Check(key, DeepEquals, data.key)
@@ -1467,6 +1719,230 @@ func (s *cryptSuite) TestInitializeLUKS2ContainerWithOptions(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithDetachedHeader(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/vdc2",
+		label:      "test",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			DetachedHeaderPath: "/boot/luks/test.hdr",
+		},
+		extraFormatArgs: []string{
+			"--header", "/boot/luks/test.hdr",
+		},
+		headerPath: "/boot/luks/test.hdr",
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithCipher(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/vdc2",
+		label:      "test",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Cipher:  "aes-cbc-essiv:sha256",
+			KeySize: 32,
+		},
+		cipher:  "aes-cbc-essiv:sha256",
+		keySize: 32,
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWith4KSectors(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/nvme0n1p3",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			SectorSize: 4096,
+		},
+		extraFormatArgs: []string{
+			"--sector-size", "4096",
+		},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithAEADIntegrity(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/vdc2",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Cipher:     "aes-gcm-random",
+			SectorSize: 4096,
+			Integrity:  "aead",
+		},
+		extraFormatArgs: []string{
+			"--sector-size", "4096",
+			"--integrity", "aead",
+		},
+		cipher:  "aes-gcm-random",
+		keySize: 32,
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithAEGIS128Integrity(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/vdc2",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Cipher:    "aegis128-random",
+			Integrity: "aead",
+		},
+		extraFormatArgs: []string{
+			"--integrity", "aead",
+		},
+		cipher:  "aegis128-random",
+		keySize: 16,
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithChaCha20Poly1305Integrity(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/vdc2",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Cipher:    "chacha20-random",
+			Integrity: "poly1305",
+		},
+		extraFormatArgs: []string{
+			"--integrity", "poly1305",
+		},
+		cipher:  "chacha20-random",
+		keySize: 32,
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithHMACIntegrity(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/vdc2",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Cipher:    "aes-xts-random",
+			Integrity: "hmac-sha256",
+		},
+		extraFormatArgs: []string{
+			"--integrity", "hmac-sha256",
+		},
+		cipher: "aes-xts-random",
+	})
+}
+
+type testInitializeLUKS2ContainerInvalidCipherOptionsData struct {
+	opts     InitializeLUKS2ContainerOptions
+	errMatch string
+}
+
+func (s *cryptSuite) testInitializeLUKS2ContainerInvalidCipherOptions(c *C, data *testInitializeLUKS2ContainerInvalidCipherOptionsData) {
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &data.opts), ErrorMatches, data.errMatch)
+	c.Check(s.mockCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidCipher1(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "aes"},
+		errMatch: `cannot set cipher to \"aes\"`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidCipher2(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "aes-xts-plain64,foo"},
+		errMatch: `cannot set cipher to \"aes-xts-plain64,foo\"`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidVolumeKeySize(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{KeySize: 48},
+		errMatch: `cannot set key size to 48 bytes`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerXTSWithSmallKey1(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{KeySize: 16},
+		errMatch: `cannot use key size of 16 bytes with XTS mode`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerXTSWithSmallKey2(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "aes-xts-random", KeySize: 16, Integrity: "hmac-sha256"},
+		errMatch: `cannot use key size of 16 bytes with XTS mode`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerAEGISCipherWithoutIntegrity(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "aegis256-random"},
+		errMatch: `cannot use AEAD cipher \"aegis256-random\" without integrity protection`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerSectorSize(c *C) {
+	key := make([]byte, 32)
+	for _, validSz := range []int{0, 512, 1024, 2048, 4096} {
+		opts := InitializeLUKS2ContainerOptions{
+			SectorSize: validSz,
+		}
+		c.Check(InitializeLUKS2Container("/dev/sda1", "data", key, &opts), IsNil)
+	}
+
+	for _, invalidSz := range []int{1, 256, 513, 3072, 8192} {
+		opts := InitializeLUKS2ContainerOptions{
+			SectorSize: invalidSz,
+		}
+		c.Check(InitializeLUKS2Container("/dev/sda1", "data", key, &opts), ErrorMatches,
+			fmt.Sprintf("cannot set sector size to %d bytes", invalidSz))
+	}
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidIntegrity(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Integrity: "crc32"},
+		errMatch: `cannot set integrity algorithm to \"crc32\"`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerAEADCipherWithoutIntegrity(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "aes-gcm-random"},
+		errMatch: `cannot use AEAD cipher \"aes-gcm-random\" without integrity protection`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerAEADIntegrityWithNonAEADCipher(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Integrity: "aead"},
+		errMatch: `cannot use integrity algorithm \"aead\" with non-AEAD cipher \"\"`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerHMACIntegrityWithAEADCipher(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "aes-gcm-random", Integrity: "hmac-sha256"},
+		errMatch: `cannot use integrity algorithm \"hmac-sha256\" with AEAD cipher \"aes-gcm-random\"`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerChaCha20WithAEADIntegrity(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "chacha20-random", Integrity: "aead"},
+		errMatch: `cannot use integrity algorithm \"aead\" with AEAD cipher \"chacha20-random\", which requires \"poly1305\"`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerPoly1305IntegrityWithGCM(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "aes-gcm-random", Integrity: "poly1305"},
+		errMatch: `cannot use integrity algorithm \"poly1305\" with AEAD cipher \"aes-gcm-random\", which requires \"aead\"`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerPoly1305IntegrityWithNonAEADCipher(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "aes-xts-random", KeySize: 32, Integrity: "poly1305"},
+		errMatch: `cannot use integrity algorithm \"poly1305\" with non-AEAD cipher \"aes-xts-random\"`})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerAEADCipherWithLargeKey(c *C) {
+	s.testInitializeLUKS2ContainerInvalidCipherOptions(c, &testInitializeLUKS2ContainerInvalidCipherOptionsData{
+		opts:     InitializeLUKS2ContainerOptions{Cipher: "aes-gcm-random", KeySize: 64, Integrity: "aead"},
+		errMatch: `cannot use key size of 64 bytes with AEAD cipher \"aes-gcm-random\"`})
+}
+
 func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidKeySize(c *C) {
 	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey()[0:16], nil), ErrorMatches, "expected a key length of at least 256-bits \\(got 128\\)")
 }
@@ -1527,9 +2003,10 @@ type testAddRecoveryKeyToLUKS2ContainerData struct {
 
 func (s *cryptSuite) testAddRecoveryKeyToLUKS2Container(c *C, data *testAddRecoveryKeyToLUKS2ContainerData) {
 	c.Check(AddRecoveryKeyToLUKS2Container(data.devicePath, data.key, data.recoveryKey), IsNil)
-	c.Assert(len(s.mockCryptsetup.Calls()), Equals, 1)
+	c.Assert(len(s.mockCryptsetup.Calls()), Equals, 2)
+	c.Check(s.mockCryptsetup.Calls()[0], DeepEquals, []string{"cryptsetup", "--help"})
 
-	call := s.mockCryptsetup.Calls()[0]
+	call := s.mockCryptsetup.Calls()[1]
 	c.Assert(len(call), Equals, 12)
 	c.Check(call[0:5], DeepEquals, []string{"cryptsetup", "luksAddKey", "--type", "luks2", "--key-file"})
 	c.Check(call[5], Matches, filepath.Join(paths.RunDir, filepath.Base(os.Args[0]))+"\\.[0-9]+/fifo")
@@ -1587,15 +2064,19 @@ type testChangeLUKS2KeyUsingRecoveryKeyData struct {
 func (s *cryptSuite) testChangeLUKS2KeyUsingRecoveryKey(c *C, data *testChangeLUKS2KeyUsingRecoveryKeyData) {
 	c.Check(ChangeLUKS2KeyUsingRecoveryKey(data.devicePath, data.recoveryKey, data.key), IsNil)
 	c.Assert(len(s.mockCryptsetup.Calls()), Equals, 3)
-	c.Check(s.mockCryptsetup.Calls()[0], DeepEquals, []string{"cryptsetup", "luksKillSlot", "--type", "luks2", "--key-file", "-", data.devicePath, "0"})
+	c.Check(s.mockCryptsetup.Calls()[0], DeepEquals, []string{"cryptsetup", "--help"})
+	c.Check(s.mockCryptsetup.Calls()[1], DeepEquals, []string{"cryptsetup", "luksKillSlot", "--type", "luks2", "--key-file", "-", data.devicePath, "0"})
 
-	call := s.mockCryptsetup.Calls()[1]
+	call := s.mockCryptsetup.Calls()[2]
 	c.Assert(len(call), Equals, 14)
 	c.Check(call[0:5], DeepEquals, []string{"cryptsetup", "luksAddKey", "--type", "luks2", "--key-file"})
 	c.Check(call[5], Matches, filepath.Join(paths.RunDir, filepath.Base(os.Args[0]))+"\\.[0-9]+/fifo")
 	c.Check(call[6:14], DeepEquals, []string{"--pbkdf", "argon2i", "--iter-time", "100", "--key-slot", "0", data.devicePath, "-"})
 
-	c.Check(s.mockCryptsetup.Calls()[2], DeepEquals, []string{"cryptsetup", "config", "--priority", "prefer", "--key-slot", "0", data.devicePath})
+	c.Assert(s.mockLUKS2SetSlotPriorityCalls, HasLen, 1)
+	c.Check(s.mockLUKS2SetSlotPriorityCalls[0].devicePath, Equals, data.devicePath)
+	c.Check(s.mockLUKS2SetSlotPriorityCalls[0].slot, Equals, 0)
+	c.Check(s.mockLUKS2SetSlotPriorityCalls[0].priority, Equals, luks2.SlotPriorityHigh)
 
 	key, err := ioutil.ReadFile(s.cryptsetupKey + ".1")
 	c.Assert(err, IsNil)
@@ -1641,6 +2122,54 @@ func (s *cryptSuite) TestChangeLUKS2KeyUsingRecoveryKey4(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestReencryptLUKS2Container(c *C) {
+	key := s.newPrimaryKey()
+
+	var progress []uint64
+	restore := MockLUKS2Reencrypt(func(devicePath string, k []byte, options *luks2.ReencryptOptions) error {
+		c.Check(devicePath, Equals, "/dev/sda1")
+		c.Check(k, DeepEquals, key)
+		c.Check(options.Slot, Equals, luks2.AnySlot)
+		c.Check(options.KDFOptions, Equals, luks2.KDFOptions{TargetDuration: 100 * time.Millisecond})
+		c.Check(options.DetachedHeaderPath, Equals, "/dev/sdb1")
+		c.Assert(options.ProgressFunc, NotNil)
+		options.ProgressFunc(1024, 4096)
+		return nil
+	})
+	defer restore()
+
+	c.Check(ReencryptLUKS2Container("/dev/sda1", key, &ReencryptLUKS2ContainerOptions{
+		DetachedHeaderPath: "/dev/sdb1",
+		ProgressFunc: func(processed, total uint64) {
+			progress = append(progress, processed, total)
+		}}), IsNil)
+	c.Check(progress, DeepEquals, []uint64{1024, 4096})
+}
+
+func (s *cryptSuite) TestReencryptLUKS2ContainerNilOptions(c *C) {
+	key := s.newPrimaryKey()
+
+	restore := MockLUKS2Reencrypt(func(devicePath string, k []byte, options *luks2.ReencryptOptions) error {
+		c.Check(devicePath, Equals, "/dev/sda1")
+		c.Check(options.DetachedHeaderPath, Equals, "")
+		c.Check(options.ProgressFunc, IsNil)
+		return nil
+	})
+	defer restore()
+
+	c.Check(ReencryptLUKS2Container("/dev/sda1", key, nil), IsNil)
+}
+
+func (s *cryptSuite) TestReencryptLUKS2ContainerError(c *C) {
+	restore := MockLUKS2Reencrypt(func(string, []byte, *luks2.ReencryptOptions) error {
+		return errors.New("cryptsetup failed with: exit status 1")
+	})
+	defer restore()
+
+	c.Check(ReencryptLUKS2Container("/dev/sda1", s.newPrimaryKey(), nil), ErrorMatches,
+		"cannot reencrypt container: cryptsetup failed with: exit status 1")
+}
+
 type cryptSuiteExpensive struct {
 	snapd_testutil.BaseTest
 	cryptTestBase
@@ -19,7 +19,15 @@
 
 package secboot
 
-func MockLUKS2Activate(fn func(string, string, []byte) error) (restore func()) {
+import (
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+func (o *ActivateVolumeOptions) LUKS2ActivateOptions() *luks2.ActivateOptions {
+	return o.luks2ActivateOptions()
+}
+
+func MockLUKS2Activate(fn func(string, string, []byte, *luks2.ActivateOptions) error) (restore func()) {
 	origActivate := luks2Activate
 	luks2Activate = fn
 	return func() {
@@ -34,3 +42,43 @@ func MockLUKS2Deactivate(fn func(string) error) (restore func()) {
 		luks2Deactivate = origDeactivate
 	}
 }
+
+func MockLUKS2Reencrypt(fn func(string, []byte, *luks2.ReencryptOptions) error) (restore func()) {
+	origReencrypt := luks2Reencrypt
+	luks2Reencrypt = fn
+	return func() {
+		luks2Reencrypt = origReencrypt
+	}
+}
+
+func MockLUKS2SetSlotPriority(fn func(string, int, luks2.SlotPriority) error) (restore func()) {
+	origSetSlotPriority := luks2SetSlotPriority
+	luks2SetSlotPriority = fn
+	return func() {
+		luks2SetSlotPriority = origSetSlotPriority
+	}
+}
+
+func clearLUKS2UUIDCache() {
+	luks2UUIDs.Lock()
+	defer luks2UUIDs.Unlock()
+	luks2UUIDs.m = make(map[string]string)
+}
+
+func MockLUKS2ReadHeader(fn func(string, luks2.LockMode) (*luks2.HeaderInfo, error)) (restore func()) {
+	origReadHeader := luks2ReadHeader
+	luks2ReadHeader = fn
+	clearLUKS2UUIDCache()
+	return func() {
+		luks2ReadHeader = origReadHeader
+		clearLUKS2UUIDCache()
+	}
+}
+
+func MockLUKS2ConvertKey(fn func(string, int, []byte, *luks2.KDFOptions) error) (restore func()) {
+	origConvertKey := luks2ConvertKey
+	luks2ConvertKey = fn
+	return func() {
+		luks2ConvertKey = origConvertKey
+	}
+}
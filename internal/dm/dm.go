@@ -0,0 +1,436 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package dm provides a minimal interface for creating and removing device-mapper
+// devices using the ioctl interface of the device-mapper control device.
+package dm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+const (
+	ioctlVersionMajor = 4
+	ioctlVersionMinor = 0
+	ioctlVersionPatch = 0
+
+	nameLen = 128
+	uuidLen = 129
+
+	cmdDevCreate  = 3
+	cmdDevRemove  = 4
+	cmdDevSuspend = 6
+	cmdTableLoad  = 9
+
+	flagReadOnly   = 1 << 0
+	flagSecureData = 1 << 15 // Ask the kernel to wipe buffers containing the table
+
+	// ioctlBufferSize is the size of the buffer passed to the kernel for
+	// commands that don't pass a table.
+	ioctlBufferSize = 16 * 1024
+
+	// The udev cookie and flags are passed in the event_nr field of
+	// commands that generate uevents.
+	udevCookieMagic                = 0x0d4d
+	udevCookieBaseMask             = 0xffff
+	udevFlagsShift                 = 16
+	udevDisableLibraryFallbackFlag = 0x0020 // Device nodes are created by udev only
+	udevPrimarySourceFlag          = 0x0040 // The event originates from the device owner
+
+	ipcCreat  = 0x200
+	ipcExcl   = 0x400
+	ipcRmid   = 0
+	semGetVal = 12
+	semSetVal = 16
+)
+
+var (
+	controlPath     = "/dev/mapper/control"
+	udevControlPath = "/run/udev/control"
+
+	udevSyncTimeout      = 30 * time.Second
+	udevSyncPollInterval = 10 * time.Millisecond
+
+	semget = func(key, nsems, flags int) (int, error) {
+		id, _, errno := unix.Syscall(unix.SYS_SEMGET, uintptr(key), uintptr(nsems), uintptr(flags))
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(id), nil
+	}
+	semctl = func(id, cmd, arg int) (int, error) {
+		r, _, errno := unix.Syscall6(unix.SYS_SEMCTL, uintptr(id), 0, uintptr(cmd), uintptr(arg), 0, 0)
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(r), nil
+	}
+
+	ioctl = func(fd uintptr, req uint, buf []byte) error {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, uintptr(req), uintptr(unsafe.Pointer(&buf[0])))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+)
+
+// ioctlHdr corresponds to struct dm_ioctl.
+type ioctlHdr struct {
+	Version     [3]uint32
+	DataSize    uint32
+	DataStart   uint32
+	TargetCount uint32
+	OpenCount   int32
+	Flags       uint32
+	EventNr     uint32
+	Padding     uint32
+	Dev         uint64
+	Name        [nameLen]byte
+	UUID        [uuidLen]byte
+	Data        [7]byte
+}
+
+// targetSpec corresponds to struct dm_target_spec.
+type targetSpec struct {
+	SectorStart uint64
+	Length      uint64
+	Status      int32
+	Next        uint32
+	TargetType  [16]byte
+}
+
+var (
+	ioctlHdrSize = binary.Size(ioctlHdr{})
+
+	nativeEndian binary.ByteOrder
+)
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// ioctlRequest returns the request number for the specified command, which is
+// _IOWR(DM_IOCTL, cmd, struct dm_ioctl).
+func ioctlRequest(cmd uint) uint {
+	const (
+		dmIoctl   = 0xfd
+		iocWrite  = 1
+		iocRead   = 2
+		dirShift  = 30
+		sizeShift = 16
+		typeShift = 8
+	)
+	return ((iocRead | iocWrite) << dirShift) | (uint(ioctlHdrSize) << sizeShift) | (dmIoctl << typeShift) | cmd
+}
+
+// Target describes a single target in a device-mapper table.
+type Target struct {
+	Start  uint64 // The start of this target in the device, in 512-byte sectors
+	Length uint64 // The length of this target, in 512-byte sectors
+	Type   string // The target type, eg, "crypt"
+	Params []byte // The target specific parameters, which may contain sensitive data
+}
+
+func newIoctlHdr(name, uuid string, flags uint32) (*ioctlHdr, error) {
+	if len(name) == 0 || len(name) >= nameLen {
+		return nil, fmt.Errorf("invalid device name %q", name)
+	}
+	if len(uuid) >= uuidLen {
+		return nil, fmt.Errorf("invalid device UUID %q", uuid)
+	}
+
+	hdr := &ioctlHdr{
+		Version:   [3]uint32{ioctlVersionMajor, ioctlVersionMinor, ioctlVersionPatch},
+		DataStart: uint32(ioctlHdrSize),
+		Flags:     flags}
+	copy(hdr.Name[:], name)
+	copy(hdr.UUID[:], uuid)
+	return hdr, nil
+}
+
+// encodeIoctl serializes the supplied header and payload in to a buffer suitable for
+// passing to the kernel. The buffer is at least minSize bytes.
+func encodeIoctl(hdr *ioctlHdr, payload []byte, minSize int) []byte {
+	size := ioctlHdrSize + len(payload)
+	if size < minSize {
+		size = minSize
+	}
+	hdr.DataSize = uint32(size)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, nativeEndian, hdr)
+
+	// Copy the payload directly rather than via buf, as it may
+	// contain sensitive data that the caller will wipe.
+	out := make([]byte, size)
+	copy(out, buf.Bytes())
+	copy(out[ioctlHdrSize:], payload)
+	return out
+}
+
+// encodeTable serializes the supplied targets in the format expected by DM_TABLE_LOAD.
+// The table is serialized directly in to a single buffer so that it can be wiped by
+// the caller.
+func encodeTable(targets []Target) ([]byte, error) {
+	specSize := binary.Size(targetSpec{})
+
+	// The parameters are NULL terminated and each spec must be 8-byte aligned.
+	var sizes []int
+	total := 0
+	for _, t := range targets {
+		if len(t.Type) == 0 || len(t.Type) >= 16 {
+			return nil, fmt.Errorf("invalid target type %q", t.Type)
+		}
+		sz := specSize + len(t.Params) + 1
+		sz += (8 - sz%8) % 8
+		sizes = append(sizes, sz)
+		total += sz
+	}
+
+	out := make([]byte, total)
+	off := 0
+	for i, t := range targets {
+		spec := targetSpec{SectorStart: t.Start, Length: t.Length, Next: uint32(sizes[i])}
+		copy(spec.TargetType[:], t.Type)
+
+		buf := new(bytes.Buffer)
+		binary.Write(buf, nativeEndian, &spec)
+		copy(out[off:], buf.Bytes())
+		copy(out[off+specSize:], t.Params)
+		off += sizes[i]
+	}
+	return out, nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func run(f *os.File, cmd uint, buf []byte) error {
+	return ioctl(f.Fd(), ioctlRequest(cmd), buf)
+}
+
+// udevCookie is used to wait for udev to finish processing the uevent generated by a
+// command, in the same way as libdevmapper. The cookie identifies a SysV semaphore
+// that is passed to the kernel with the command, and the device-mapper udev rules
+// decrement the semaphore once they have finished processing the event.
+type udevCookie struct {
+	key   uint32
+	semid int
+}
+
+// newUdevCookie creates a new cookie, or returns nil if udev isn't running.
+func newUdevCookie() (*udevCookie, error) {
+	if _, err := os.Stat(udevControlPath); err != nil {
+		return nil, nil
+	}
+
+	for i := 0; i < 16; i++ {
+		key := udevCookieMagic<<udevFlagsShift | uint32(rand.Intn(udevCookieBaseMask)+1)
+		semid, err := semget(int(key), 1, ipcCreat|ipcExcl|0600)
+		switch {
+		case err == unix.EEXIST:
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create semaphore: %w", err)
+		}
+
+		if _, err := semctl(semid, semSetVal, 1); err != nil {
+			semctl(semid, ipcRmid, 0)
+			return nil, xerrors.Errorf("cannot initialize semaphore: %w", err)
+		}
+		return &udevCookie{key: key, semid: semid}, nil
+	}
+
+	return nil, errors.New("no unused cookie")
+}
+
+// eventNr returns the value of the event_nr field of the command that should
+// be synchronized with udev.
+func (c *udevCookie) eventNr() uint32 {
+	if c == nil {
+		return 0
+	}
+	return c.key&udevCookieBaseMask | (udevDisableLibraryFallbackFlag|udevPrimarySourceFlag)<<udevFlagsShift
+}
+
+// release removes the semaphore without waiting for udev.
+func (c *udevCookie) release() {
+	if c == nil {
+		return
+	}
+	semctl(c.semid, ipcRmid, 0)
+}
+
+// wait waits for udev to finish processing the event associated with this cookie
+// and then removes the semaphore.
+func (c *udevCookie) wait() error {
+	if c == nil {
+		return nil
+	}
+	defer c.release()
+
+	deadline := time.Now().Add(udevSyncTimeout)
+	for {
+		val, err := semctl(c.semid, semGetVal, 0)
+		switch {
+		case err != nil:
+			return xerrors.Errorf("cannot obtain semaphore value: %w", err)
+		case val == 0:
+			return nil
+		case time.Now().After(deadline):
+			return errors.New("timeout waiting for udev")
+		}
+		time.Sleep(udevSyncPollInterval)
+	}
+}
+
+// runWithUdevSync runs the specified command, which generates a uevent, and then waits for
+// udev to finish processing the event so that the device node is in the expected state when
+// this returns.
+func runWithUdevSync(f *os.File, cmd uint, hdr *ioctlHdr) error {
+	cookie, err := newUdevCookie()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dm: cannot create udev cookie: %v\n", err)
+	}
+
+	hdr.EventNr = cookie.eventNr()
+	if err := run(f, cmd, encodeIoctl(hdr, nil, ioctlBufferSize)); err != nil {
+		cookie.release()
+		return err
+	}
+
+	if err := cookie.wait(); err != nil {
+		fmt.Fprintf(os.Stderr, "dm: cannot synchronize with udev: %v\n", err)
+	}
+	return nil
+}
+
+func openControl() (*os.File, error) {
+	return os.OpenFile(controlPath, os.O_RDWR, 0)
+}
+
+func removeDevice(f *os.File, name string) error {
+	hdr, err := newIoctlHdr(name, "", 0)
+	if err != nil {
+		return err
+	}
+	return runWithUdevSync(f, cmdDevRemove, hdr)
+}
+
+// CreateDevice creates a new device-mapper device with the specified name and UUID, loads
+// the supplied table and then activates it. If readOnly is true, the device is created
+// read-only. The table is treated as sensitive data, and the kernel is asked to wipe any
+// buffers containing it. The caller is responsible for wiping the Params field of the
+// supplied targets.
+//
+// The device node is created by udev in the usual way. If udev is running, this waits for
+// udev to finish processing the device before returning, in the same way as libdevmapper.
+func CreateDevice(name, uuid string, readOnly bool, targets []Target) error {
+	if len(targets) == 0 {
+		return errors.New("no targets")
+	}
+
+	var flags uint32
+	if readOnly {
+		flags |= flagReadOnly
+	}
+
+	createHdr, err := newIoctlHdr(name, uuid, flags)
+	if err != nil {
+		return err
+	}
+
+	table, err := encodeTable(targets)
+	if err != nil {
+		return err
+	}
+	defer wipe(table)
+
+	f, err := openControl()
+	if err != nil {
+		return xerrors.Errorf("cannot open control device: %w", err)
+	}
+	defer f.Close()
+
+	if err := run(f, cmdDevCreate, encodeIoctl(createHdr, nil, ioctlBufferSize)); err != nil {
+		return xerrors.Errorf("cannot create device: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		if err := removeDevice(f, name); err != nil {
+			fmt.Fprintf(os.Stderr, "dm.CreateDevice: cannot remove device after failure: %v\n", err)
+		}
+	}()
+
+	loadHdr, _ := newIoctlHdr(name, "", flags|flagSecureData)
+	loadHdr.TargetCount = uint32(len(targets))
+	loadBuf := encodeIoctl(loadHdr, table, 0)
+	defer wipe(loadBuf)
+	if err := run(f, cmdTableLoad, loadBuf); err != nil {
+		return xerrors.Errorf("cannot load table: %w", err)
+	}
+
+	// DM_DEV_SUSPEND without DM_SUSPEND_FLAG resumes the device, which
+	// makes the loaded table live.
+	resumeHdr, _ := newIoctlHdr(name, "", flags)
+	if err := runWithUdevSync(f, cmdDevSuspend, resumeHdr); err != nil {
+		return xerrors.Errorf("cannot resume device: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
+
+// RemoveDevice removes the device-mapper device with the specified name. If udev is
+// running, this waits for udev to finish processing the removal before returning.
+func RemoveDevice(name string) error {
+	f, err := openControl()
+	if err != nil {
+		return xerrors.Errorf("cannot open control device: %w", err)
+	}
+	defer f.Close()
+
+	if err := removeDevice(f, name); err != nil {
+		return xerrors.Errorf("cannot remove device: %w", err)
+	}
+	return nil
+}
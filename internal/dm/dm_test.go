@@ -0,0 +1,273 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package dm_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	"golang.org/x/sys/unix"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/dm"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ioctlCall struct {
+	cmd     uint
+	hdr     *IoctlHdr
+	payload []byte
+}
+
+type dmSuite struct {
+	snapd_testutil.BaseTest
+
+	calls  []ioctlCall
+	failOn uint
+}
+
+var _ = Suite(&dmSuite{})
+
+func (s *dmSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	dir := c.MkDir()
+	control := filepath.Join(dir, "control")
+	c.Assert(ioutil.WriteFile(control, nil, 0600), IsNil)
+	s.AddCleanup(MockControlPath(control))
+
+	// udev isn't running by default.
+	s.AddCleanup(MockUdev(filepath.Join(dir, "udev-control"), time.Second))
+	s.AddCleanup(MockSemaphores(func(int, int, int) (int, error) {
+		c.Error("unexpected semget")
+		return 0, unix.ENOSYS
+	}, func(int, int, int) (int, error) {
+		c.Error("unexpected semctl")
+		return 0, unix.ENOSYS
+	}))
+
+	s.calls = nil
+	s.failOn = 0
+	s.AddCleanup(MockIoctl(func(fd uintptr, req uint, buf []byte) error {
+		hdr, payload := DecodeIoctl(buf)
+		cmd := req & 0xff
+		c.Check(req, Equals, IoctlRequest(cmd))
+		s.calls = append(s.calls, ioctlCall{cmd: cmd, hdr: hdr, payload: append([]byte(nil), payload...)})
+		if cmd == s.failOn {
+			return unix.EINVAL
+		}
+		return nil
+	}))
+}
+
+func (s *dmSuite) name(hdr *IoctlHdr) string {
+	return string(bytes.TrimRight(hdr.Name[:], "\x00"))
+}
+
+func (s *dmSuite) uuid(hdr *IoctlHdr) string {
+	return string(bytes.TrimRight(hdr.UUID[:], "\x00"))
+}
+
+func (s *dmSuite) TestIoctlRequest(c *C) {
+	c.Check(IoctlRequest(CmdDevCreate), Equals, uint(0xc138fd03))
+	c.Check(IoctlRequest(CmdDevRemove), Equals, uint(0xc138fd04))
+	c.Check(IoctlRequest(CmdDevSuspend), Equals, uint(0xc138fd06))
+	c.Check(IoctlRequest(CmdTableLoad), Equals, uint(0xc138fd09))
+}
+
+func (s *dmSuite) TestEncodeTable(c *C) {
+	table, err := EncodeTable([]Target{
+		{Start: 0, Length: 2048, Type: "crypt", Params: []byte("aes-xts-plain64 0011 0 /dev/sda1 4096")},
+		{Start: 2048, Length: 100, Type: "linear", Params: []byte("/dev/sda2 0")}})
+	c.Assert(err, IsNil)
+
+	// struct dm_target_spec is 40 bytes.
+	c.Assert(table, HasLen, 80+56)
+	c.Check(table[40:77], DeepEquals, []byte("aes-xts-plain64 0011 0 /dev/sda1 4096"))
+	c.Check(table[77:80], DeepEquals, []byte{0, 0, 0})
+	c.Check(table[80+20:80+24], DeepEquals, []byte{56, 0, 0, 0})
+	c.Check(bytes.TrimRight(table[80+24:80+40], "\x00"), DeepEquals, []byte("linear"))
+	c.Check(table[120:], DeepEquals, []byte("/dev/sda2 0\x00\x00\x00\x00\x00"))
+}
+
+func (s *dmSuite) TestEncodeTableInvalidType(c *C) {
+	_, err := EncodeTable([]Target{{Type: "crypt-with-a-long-name"}})
+	c.Check(err, ErrorMatches, `invalid target type "crypt-with-a-long-name"`)
+}
+
+func (s *dmSuite) TestCreateDevice(c *C) {
+	targets := []Target{{Start: 0, Length: 2048, Type: "crypt", Params: []byte("aes-xts-plain64 0011 0 /dev/sda1 4096")}}
+	c.Check(CreateDevice("data", "CRYPT-LUKS2-1234-data", false, targets), IsNil)
+
+	table, err := EncodeTable(targets)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.calls, HasLen, 3)
+	c.Check(s.calls[0].cmd, Equals, uint(CmdDevCreate))
+	c.Check(s.name(s.calls[0].hdr), Equals, "data")
+	c.Check(s.uuid(s.calls[0].hdr), Equals, "CRYPT-LUKS2-1234-data")
+	c.Check(s.calls[0].hdr.Version, Equals, [3]uint32{4, 0, 0})
+	c.Check(s.calls[0].hdr.Flags, Equals, uint32(0))
+
+	c.Check(s.calls[1].cmd, Equals, uint(CmdTableLoad))
+	c.Check(s.name(s.calls[1].hdr), Equals, "data")
+	c.Check(s.calls[1].hdr.TargetCount, Equals, uint32(1))
+	c.Check(s.calls[1].hdr.Flags, Equals, uint32(FlagSecureData))
+	c.Check(s.calls[1].payload, DeepEquals, table)
+
+	c.Check(s.calls[2].cmd, Equals, uint(CmdDevSuspend))
+	c.Check(s.name(s.calls[2].hdr), Equals, "data")
+	c.Check(s.calls[2].hdr.Flags, Equals, uint32(0))
+}
+
+// mockUdev mocks a running udev that processes each event synchronized with a
+// cookie once the command that generates it has been run, in the same way as
+// "dmsetup udevcomplete". The returned slice contains the semaphore keys.
+func (s *dmSuite) mockUdev(c *C, process bool) *[]int {
+	control := filepath.Join(c.MkDir(), "control")
+	c.Assert(ioutil.WriteFile(control, nil, 0600), IsNil)
+	s.AddCleanup(MockUdev(control, 100*time.Millisecond))
+
+	var keys []int
+	values := make(map[int]int)
+	s.AddCleanup(MockSemaphores(func(key, nsems, flags int) (int, error) {
+		c.Check(nsems, Equals, 1)
+		c.Check(flags, Equals, IpcCreat|IpcExcl|0600)
+		if len(keys) == 0 {
+			// Simulate a collision with an existing cookie.
+			keys = append(keys, -1)
+			return 0, unix.EEXIST
+		}
+		keys = append(keys, key)
+		return len(keys), nil
+	}, func(id, cmd, arg int) (int, error) {
+		switch cmd {
+		case SemSetVal:
+			values[id] = arg
+		case SemGetVal:
+			if process {
+				values[id] = 0
+			}
+			return values[id], nil
+		case IpcRmid:
+			delete(values, id)
+		default:
+			c.Errorf("unexpected command %d", cmd)
+		}
+		return 0, nil
+	}))
+	s.AddCleanup(func() {
+		c.Check(values, HasLen, 0)
+	})
+	return &keys
+}
+
+func (s *dmSuite) TestCreateDeviceUdevSync(c *C) {
+	keys := s.mockUdev(c, true)
+
+	c.Check(CreateDevice("data", "", false, []Target{{Length: 1, Type: "zero"}}), IsNil)
+
+	c.Assert(*keys, HasLen, 2)
+	key := (*keys)[1]
+	c.Check(key>>16, Equals, UdevCookieMagic)
+
+	c.Assert(s.calls, HasLen, 3)
+	c.Check(s.calls[0].hdr.EventNr, Equals, uint32(0))
+	c.Check(s.calls[1].hdr.EventNr, Equals, uint32(0))
+	c.Check(s.calls[2].cmd, Equals, uint(CmdDevSuspend))
+	c.Check(s.calls[2].hdr.EventNr, Equals, uint32(key&0xffff)|(UdevDisableLibraryFallbackFlag|UdevPrimarySourceFlag)<<16)
+}
+
+func (s *dmSuite) TestCreateDeviceUdevSyncTimeout(c *C) {
+	s.mockUdev(c, false)
+
+	// The device is still created if udev doesn't process the event.
+	c.Check(CreateDevice("data", "", false, []Target{{Length: 1, Type: "zero"}}), IsNil)
+	c.Check(s.calls, HasLen, 3)
+}
+
+func (s *dmSuite) TestCreateDeviceUdevSyncResumeFails(c *C) {
+	s.mockUdev(c, false)
+	s.failOn = CmdDevSuspend
+
+	c.Check(CreateDevice("data", "", false, []Target{{Length: 1, Type: "zero"}}), ErrorMatches,
+		"cannot resume device: invalid argument")
+}
+
+func (s *dmSuite) TestRemoveDeviceUdevSync(c *C) {
+	keys := s.mockUdev(c, true)
+
+	c.Check(RemoveDevice("data"), IsNil)
+
+	c.Assert(*keys, HasLen, 2)
+	c.Assert(s.calls, HasLen, 1)
+	c.Check(s.calls[0].cmd, Equals, uint(CmdDevRemove))
+	c.Check(s.calls[0].hdr.EventNr, Equals, uint32((*keys)[1]&0xffff)|(UdevDisableLibraryFallbackFlag|UdevPrimarySourceFlag)<<16)
+}
+
+func (s *dmSuite) TestCreateDeviceReadOnly(c *C) {
+	c.Check(CreateDevice("data", "", true, []Target{{Length: 1, Type: "zero"}}), IsNil)
+
+	c.Assert(s.calls, HasLen, 3)
+	c.Check(s.calls[0].hdr.Flags, Equals, uint32(FlagReadOnly))
+	c.Check(s.calls[1].hdr.Flags, Equals, uint32(FlagReadOnly|FlagSecureData))
+	c.Check(s.calls[2].hdr.Flags, Equals, uint32(FlagReadOnly))
+}
+
+func (s *dmSuite) TestCreateDeviceLoadFails(c *C) {
+	s.failOn = CmdTableLoad
+
+	c.Check(CreateDevice("data", "", false, []Target{{Length: 1, Type: "zero"}}), ErrorMatches,
+		"cannot load table: invalid argument")
+
+	c.Assert(s.calls, HasLen, 3)
+	c.Check(s.calls[2].cmd, Equals, uint(CmdDevRemove))
+	c.Check(s.name(s.calls[2].hdr), Equals, "data")
+}
+
+func (s *dmSuite) TestCreateDeviceInvalidName(c *C) {
+	c.Check(CreateDevice("", "", false, []Target{{Length: 1, Type: "zero"}}), ErrorMatches, `invalid device name ""`)
+	c.Check(s.calls, HasLen, 0)
+}
+
+func (s *dmSuite) TestCreateDeviceNoTargets(c *C) {
+	c.Check(CreateDevice("data", "", false, nil), ErrorMatches, "no targets")
+	c.Check(s.calls, HasLen, 0)
+}
+
+func (s *dmSuite) TestRemoveDevice(c *C) {
+	c.Check(RemoveDevice("data"), IsNil)
+
+	c.Assert(s.calls, HasLen, 1)
+	c.Check(s.calls[0].cmd, Equals, uint(CmdDevRemove))
+	c.Check(s.name(s.calls[0].hdr), Equals, "data")
+}
+
+func (s *dmSuite) TestRemoveDeviceError(c *C) {
+	s.failOn = CmdDevRemove
+	c.Check(RemoveDevice("data"), ErrorMatches, "cannot remove device: invalid argument")
+}
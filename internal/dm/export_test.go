@@ -0,0 +1,102 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package dm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	CmdDevCreate  = cmdDevCreate
+	CmdDevRemove  = cmdDevRemove
+	CmdDevSuspend = cmdDevSuspend
+	CmdTableLoad  = cmdTableLoad
+
+	FlagReadOnly   = flagReadOnly
+	FlagSecureData = flagSecureData
+
+	UdevCookieMagic                = udevCookieMagic
+	UdevDisableLibraryFallbackFlag = udevDisableLibraryFallbackFlag
+	UdevPrimarySourceFlag          = udevPrimarySourceFlag
+	SemGetVal                      = semGetVal
+	SemSetVal                      = semSetVal
+	IpcCreat                       = ipcCreat
+	IpcExcl                        = ipcExcl
+	IpcRmid                        = ipcRmid
+)
+
+var (
+	EncodeTable  = encodeTable
+	IoctlRequest = ioctlRequest
+)
+
+type IoctlHdr = ioctlHdr
+
+// DecodeIoctl decodes the header and payload from a buffer passed to the kernel.
+func DecodeIoctl(buf []byte) (*IoctlHdr, []byte) {
+	var hdr ioctlHdr
+	if err := binary.Read(bytes.NewReader(buf), nativeEndian, &hdr); err != nil {
+		panic(err)
+	}
+	return &hdr, buf[hdr.DataStart:hdr.DataSize]
+}
+
+func MockControlPath(path string) (restore func()) {
+	origControlPath := controlPath
+	controlPath = path
+	return func() {
+		controlPath = origControlPath
+	}
+}
+
+func MockIoctl(fn func(fd uintptr, req uint, buf []byte) error) (restore func()) {
+	origIoctl := ioctl
+	ioctl = fn
+	return func() {
+		ioctl = origIoctl
+	}
+}
+
+func MockUdev(controlPath string, timeout time.Duration) (restore func()) {
+	origControlPath := udevControlPath
+	origTimeout := udevSyncTimeout
+	origPollInterval := udevSyncPollInterval
+	udevControlPath = controlPath
+	udevSyncTimeout = timeout
+	udevSyncPollInterval = time.Millisecond
+	return func() {
+		udevControlPath = origControlPath
+		udevSyncTimeout = origTimeout
+		udevSyncPollInterval = origPollInterval
+	}
+}
+
+func MockSemaphores(getFn func(key, nsems, flags int) (int, error), ctlFn func(id, cmd, arg int) (int, error)) (restore func()) {
+	origSemget := semget
+	origSemctl := semctl
+	semget = getFn
+	semctl = ctlFn
+	return func() {
+		semget = origSemget
+		semctl = origSemctl
+	}
+}
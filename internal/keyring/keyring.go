@@ -20,28 +20,378 @@
 package keyring
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+
 	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 )
 
 const (
-	userKeyType = "user"
+	userKeyType    = "user"
+	logonKeyType   = "logon"
+	keyringKeyType = "keyring"
+
 	userKeyring = -4
+
+	// namedKeyringPerm is the permission mask applied to named keyrings
+	// created by this package. Only possessors can read, search or write
+	// to them, and they can't be linked in to other keyrings. Other
+	// processes running as the same user can only view them.
+	namedKeyringPerm = 0x2f010000
+)
+
+// KeyringType specifies the keyring in which keys are stored.
+type KeyringType int
+
+const (
+	// UserKeyring is the user keyring of the calling process.
+	UserKeyring KeyringType = iota
+
+	// SessionKeyring is the session keyring of the calling process.
+	SessionKeyring
+
+	// PersistentKeyring is the persistent keyring of the calling
+	// process's user, which is linked in to the user keyring.
+	PersistentKeyring
 )
 
+// Options customizes how keys are stored in the kernel keyring.
+type Options struct {
+	// Logon indicates that keys should be added as "logon" keys,
+	// which can be used by kernel consumers but which can't be
+	// read from userspace.
+	Logon bool
+
+	// Timeout specifies the time after which keys expire and are
+	// removed by the kernel. Zero means that keys don't expire.
+	Timeout time.Duration
+
+	// Keyring specifies the keyring in which keys are stored.
+	Keyring KeyringType
+
+	// KeyringName is the name of a keyring inside Keyring in which
+	// keys are stored. If it doesn't exist, it is created with
+	// permissions that only grant access to possessors. If this is
+	// empty, keys are stored in Keyring directly.
+	KeyringName string
+}
+
+func (o *Options) keyType() string {
+	if o.Logon {
+		return logonKeyType
+	}
+	return userKeyType
+}
+
+func (o *Options) baseKeyring() (int, error) {
+	switch o.Keyring {
+	case UserKeyring:
+		return userKeyring, nil
+	case SessionKeyring:
+		// Resolve the ID of the session keyring first. Adding a key
+		// to KEY_SPEC_SESSION_KEYRING directly causes the kernel to
+		// join a new anonymous session keyring if the calling thread
+		// doesn't have one, and keys in the user keyring would no
+		// longer be possessed.
+		id, err := unix.KeyctlGetKeyringID(unix.KEY_SPEC_SESSION_KEYRING, false)
+		if err != nil {
+			return 0, xerrors.Errorf("cannot obtain session keyring: %w", err)
+		}
+		return id, nil
+	case PersistentKeyring:
+		id, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, -1, userKeyring, 0, 0)
+		if err != nil {
+			return 0, xerrors.Errorf("cannot obtain persistent keyring: %w", err)
+		}
+		return id, nil
+	default:
+		return 0, errors.New("invalid keyring type")
+	}
+}
+
+// keyring returns the ID of the keyring in which keys are stored. If
+// create is true and the named keyring doesn't exist, it is created.
+func (o *Options) keyring(create bool) (int, error) {
+	base, err := o.baseKeyring()
+	if err != nil {
+		return 0, err
+	}
+	if o.KeyringName == "" {
+		return base, nil
+	}
+
+	id, err := unix.KeyctlSearch(base, keyringKeyType, o.KeyringName, 0)
+	switch {
+	case err == nil:
+		return id, nil
+	case err != unix.ENOKEY || !create:
+		return 0, xerrors.Errorf("cannot find keyring: %w", err)
+	}
+
+	id, err = unix.AddKey(keyringKeyType, o.KeyringName, nil, base)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot create keyring: %w", err)
+	}
+	if err := unix.KeyctlSetperm(id, namedKeyringPerm); err != nil {
+		unix.KeyctlInt(unix.KEYCTL_UNLINK, id, base, 0, 0)
+		return 0, xerrors.Errorf("cannot set keyring permissions: %w", err)
+	}
+	return id, nil
+}
+
 func formatDesc(devicePath, purpose, prefix string) string {
 	return prefix + ":" + devicePath + ":" + purpose
 }
 
-func AddKeyToUserKeyring(key []byte, devicePath, purpose, prefix string) error {
-	_, err := unix.AddKey(userKeyType, formatDesc(devicePath, purpose, prefix), key, userKeyring)
-	return err
+// parseDesc is the inverse of formatDesc. The device path may contain
+// colons, so the purpose is taken from after the last colon.
+func parseDesc(desc, prefix string) (devicePath, purpose string, ok bool) {
+	if !strings.HasPrefix(desc, prefix+":") {
+		return "", "", false
+	}
+	desc = desc[len(prefix)+1:]
+
+	i := strings.LastIndex(desc, ":")
+	if i <= 0 || i == len(desc)-1 {
+		return "", "", false
+	}
+	return desc[:i], desc[i+1:], true
 }
 
-func GetKeyFromUserKeyring(devicePath, purpose, prefix string) ([]byte, error) {
-	id, err := unix.KeyctlSearch(userKeyring, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
+var nativeEndian binary.ByteOrder
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// readKeyring returns the IDs of the keys linked from the specified keyring.
+func readKeyring(id int) ([]int, error) {
+	sz, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, sz)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n < len(buf) {
+		buf = buf[:n]
+	}
+
+	var ids []int
+	for len(buf) >= 4 {
+		ids = append(ids, int(int32(nativeEndian.Uint32(buf))))
+		buf = buf[4:]
+	}
+	return ids, nil
+}
+
+// describeKey returns the type and description of the specified key.
+func describeKey(id int) (keyType, desc string, err error) {
+	// The format is "type;uid;gid;perm;description".
+	str, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.SplitN(str, ";", 5)
+	if len(fields) != 5 {
+		return "", "", fmt.Errorf("invalid key description %q", str)
+	}
+	return fields[0], fields[4], nil
+}
+
+// KeyInfo describes a key added by this package.
+type KeyInfo struct {
+	ID         int
+	Logon      bool // The key is a "logon" key
+	DevicePath string
+	Purpose    string
+}
+
+func listKeys(ringId int, prefix string) (keys []*KeyInfo, err error) {
+	ids, err := readKeyring(ringId)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read keyring: %w", err)
+	}
+
+	for _, id := range ids {
+		keyType, desc, err := describeKey(id)
+		switch {
+		case err == unix.EACCES || err == unix.ENOKEY:
+			// Skip keys we can't view, and keys that have been
+			// removed or have expired since reading the keyring.
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot describe key %d: %w", id, err)
+		case keyType != userKeyType && keyType != logonKeyType:
+			continue
+		}
+
+		devicePath, purpose, ok := parseDesc(desc, prefix)
+		if !ok {
+			continue
+		}
+		keys = append(keys, &KeyInfo{
+			ID:         id,
+			Logon:      keyType == logonKeyType,
+			DevicePath: devicePath,
+			Purpose:    purpose})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].DevicePath != keys[j].DevicePath {
+			return keys[i].DevicePath < keys[j].DevicePath
+		}
+		return keys[i].Purpose < keys[j].Purpose
+	})
+	return keys, nil
+}
+
+// ListKeys returns information about all of the keys with the supplied prefix in
+// the kernel keyring specified by options, sorted by device path and then
+// purpose. Both "user" and "logon" keys are
+// returned, regardless of the Logon option.
+func ListKeys(prefix string, options *Options) ([]*KeyInfo, error) {
+	if options == nil {
+		options = &Options{}
+	}
+
+	ringId, err := options.keyring(false)
+	switch {
+	case xerrors.Is(err, unix.ENOKEY):
+		// The named keyring doesn't exist, so there are no keys.
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return listKeys(ringId, prefix)
+}
+
+// PurgeKeys removes all of the keys with the supplied prefix from the kernel
+// keyring specified by options. Both "user" and "logon" keys are removed,
+// regardless of the Logon option. If options specifies a named keyring and it
+// is empty afterwards, it is removed as well.
+//
+// An attempt is made to remove every key, and the first error is returned.
+func PurgeKeys(prefix string, options *Options) error {
+	if options == nil {
+		options = &Options{}
+	}
+
+	ringId, err := options.keyring(false)
+	switch {
+	case xerrors.Is(err, unix.ENOKEY):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	keys, err := listKeys(ringId, prefix)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, key := range keys {
+		_, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, key.ID, ringId, 0, 0)
+		if err != nil && err != unix.ENOENT && firstErr == nil {
+			firstErr = xerrors.Errorf("cannot remove key %q: %w", formatDesc(key.DevicePath, key.Purpose, prefix), err)
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if options.KeyringName == "" {
+		return nil
+	}
+
+	ids, err := readKeyring(ringId)
+	if err != nil {
+		return xerrors.Errorf("cannot read keyring: %w", err)
+	}
+	if len(ids) > 0 {
+		return nil
+	}
+
+	base, err := options.baseKeyring()
 	if err != nil {
-		return nil, xerrors.Errorf("cannot find key: %w", err)
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, ringId, base, 0, 0); err != nil && err != unix.ENOENT {
+		return xerrors.Errorf("cannot remove keyring: %w", err)
+	}
+	return nil
+}
+
+// AddKey adds the supplied key to the kernel keyring specified by options, with
+// a description built from the supplied device path, purpose and prefix. If
+// options is nil, the key is added as a "user" key to the user keyring.
+func AddKey(key []byte, devicePath, purpose, prefix string, options *Options) error {
+	if options == nil {
+		options = &Options{}
+	}
+
+	ringId, err := options.keyring(true)
+	if err != nil {
+		return err
+	}
+
+	id, err := unix.AddKey(options.keyType(), formatDesc(devicePath, purpose, prefix), key, ringId)
+	if err != nil {
+		return err
+	}
+
+	if options.Timeout > 0 {
+		timeout := int((options.Timeout + time.Second - 1) / time.Second)
+		if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, timeout, 0, 0); err != nil {
+			unix.KeyctlInt(unix.KEYCTL_UNLINK, id, ringId, 0, 0)
+			return xerrors.Errorf("cannot set key timeout: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func findKey(devicePath, purpose, prefix string, options *Options) (id, ringId int, err error) {
+	if options == nil {
+		options = &Options{}
+	}
+
+	ringId, err = options.keyring(false)
+	if err != nil {
+		return 0, 0, xerrors.Errorf("cannot find key: %w", err)
+	}
+
+	id, err = unix.KeyctlSearch(ringId, options.keyType(), formatDesc(devicePath, purpose, prefix), 0)
+	if err != nil {
+		return 0, 0, xerrors.Errorf("cannot find key: %w", err)
+	}
+
+	return id, ringId, nil
+}
+
+// GetKey retrieves the key with the description built from the supplied device
+// path, purpose and prefix from the kernel keyring specified by options. Keys
+// added with the Logon option can't be read from userspace.
+func GetKey(devicePath, purpose, prefix string, options *Options) ([]byte, error) {
+	id, _, err := findKey(devicePath, purpose, prefix, options)
+	if err != nil {
+		return nil, err
 	}
 
 	sz, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
@@ -57,12 +407,26 @@ func GetKeyFromUserKeyring(devicePath, purpose, prefix string) ([]byte, error) {
 	return key, nil
 }
 
-func RemoveKeyFromUserKeyring(devicePath, purpose, prefix string) error {
-	id, err := unix.KeyctlSearch(userKeyring, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
+// RemoveKey removes the key with the description built from the supplied device
+// path, purpose and prefix from the kernel keyring specified by options.
+func RemoveKey(devicePath, purpose, prefix string, options *Options) error {
+	id, ringId, err := findKey(devicePath, purpose, prefix, options)
 	if err != nil {
-		return xerrors.Errorf("cannot find key: %w", err)
+		return err
 	}
 
-	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, userKeyring, 0, 0)
+	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, ringId, 0, 0)
 	return err
 }
+
+func AddKeyToUserKeyring(key []byte, devicePath, purpose, prefix string) error {
+	return AddKey(key, devicePath, purpose, prefix, nil)
+}
+
+func GetKeyFromUserKeyring(devicePath, purpose, prefix string) ([]byte, error) {
+	return GetKey(devicePath, purpose, prefix, nil)
+}
+
+func RemoveKeyFromUserKeyring(devicePath, purpose, prefix string) error {
+	return RemoveKey(devicePath, purpose, prefix, nil)
+}
@@ -23,6 +23,7 @@ import (
 	"math/rand"
 	"syscall"
 	"testing"
+	"time"
 
 	. "github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/testutil"
@@ -183,3 +184,240 @@ func (s *keyringSuite) TestRemoveKeyFromUserKeyringNoKey(c *C) {
 	c.Check(xerrors.As(err, &e), testutil.IsTrue)
 	c.Check(e, Equals, syscall.ENOKEY)
 }
+
+func (s *keyringSuite) TestAddKeyLogon(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(AddKey(key, "/dev/sda1", "unlock", "secboot", &Options{Logon: true}), IsNil)
+
+	id, err := unix.KeyctlSearch(-4, "logon", "secboot:/dev/sda1:unlock", 0)
+	c.Check(err, IsNil)
+
+	desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	c.Check(err, IsNil)
+	c.Check(desc, Matches, "logon;[[:digit:]]+;[[:digit:]]+;3d010000;secboot:/dev/sda1:unlock")
+
+	_, err = GetKey("/dev/sda1", "unlock", "secboot", &Options{Logon: true})
+	c.Check(err, ErrorMatches, "cannot determine size of key payload: operation not supported")
+
+	_, err = GetKey("/dev/sda1", "unlock", "secboot", nil)
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+
+	c.Check(RemoveKey("/dev/sda1", "unlock", "secboot", &Options{Logon: true}), IsNil)
+	_, err = unix.KeyctlSearch(-4, "logon", "secboot:/dev/sda1:unlock", 0)
+	c.Check(err, Equals, unix.ENOKEY)
+}
+
+func (s *keyringSuite) TestAddKeyWithTimeout(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(AddKey(key, "/dev/sda1", "unlock", "secboot", &Options{Timeout: 500 * time.Millisecond}), IsNil)
+
+	key2, err := GetKey("/dev/sda1", "unlock", "secboot", nil)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	// The timeout is rounded up to the nearest second.
+	time.Sleep(1500 * time.Millisecond)
+
+	_, err = GetKey("/dev/sda1", "unlock", "secboot", nil)
+	c.Check(err, ErrorMatches, "cannot find key: .*")
+}
+
+func (s *keyringSuite) TestAddKeyToNamedKeyring(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	options := &Options{KeyringName: "secboot-test"}
+	c.Check(AddKey(key, "/dev/sda1", "unlock", "secboot", options), IsNil)
+
+	ringId, err := unix.KeyctlSearch(-4, "keyring", "secboot-test", 0)
+	c.Assert(err, IsNil)
+	c.Check(ringId, testutil.InSlice(Equals), testutil.GetKeyringKeys(c, testutil.UserKeyring))
+
+	desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, ringId)
+	c.Check(err, IsNil)
+	c.Check(desc, Matches, "keyring;[[:digit:]]+;[[:digit:]]+;2f010000;secboot-test")
+
+	id, err := unix.KeyctlSearch(ringId, "user", "secboot:/dev/sda1:unlock", 0)
+	c.Check(err, IsNil)
+	c.Check(id, testutil.InSlice(Equals), testutil.GetKeyringKeys(c, ringId))
+	c.Check(id, Not(testutil.InSlice(Equals)), testutil.GetKeyringKeys(c, testutil.UserKeyring))
+
+	// Adding a second key should reuse the existing keyring.
+	c.Check(AddKey(key, "/dev/sda1", "aux", "secboot", options), IsNil)
+	c.Check(testutil.GetKeyringKeys(c, ringId), HasLen, 2)
+
+	key2, err := GetKey("/dev/sda1", "unlock", "secboot", options)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	c.Check(RemoveKey("/dev/sda1", "unlock", "secboot", options), IsNil)
+	c.Check(id, Not(testutil.InSlice(Equals)), testutil.GetKeyringKeys(c, ringId))
+
+	_, err = GetKey("/dev/sda1", "unlock", "secboot", options)
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *keyringSuite) TestGetKeyNoNamedKeyring(c *C) {
+	_, err := GetKey("/dev/sda1", "unlock", "secboot", &Options{KeyringName: "secboot-test"})
+	c.Check(err, ErrorMatches, "cannot find key: cannot find keyring: required key not available")
+
+	var e syscall.Errno
+	c.Check(xerrors.As(err, &e), testutil.IsTrue)
+	c.Check(e, Equals, syscall.ENOKEY)
+
+	_, err = unix.KeyctlSearch(-4, "keyring", "secboot-test", 0)
+	c.Check(err, Equals, unix.ENOKEY)
+}
+
+func (s *keyringSuite) TestAddKeyToSessionKeyring(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	sessionId, err := unix.KeyctlGetKeyringID(-3, false)
+	c.Assert(err, IsNil)
+
+	options := &Options{Keyring: SessionKeyring}
+	c.Check(AddKey(key, "/dev/sda1", "unlock", "secboot", options), IsNil)
+
+	id, err := unix.KeyctlSearch(sessionId, "user", "secboot:/dev/sda1:unlock", 0)
+	c.Assert(err, IsNil)
+	defer unix.KeyctlInt(unix.KEYCTL_UNLINK, id, sessionId, 0, 0)
+	c.Check(id, testutil.InSlice(Equals), testutil.GetKeyringKeys(c, sessionId))
+
+	// Keys in the user keyring should still be possessed.
+	c.Check(AddKeyToUserKeyring(key, "/dev/sda1", "aux", "secboot"), IsNil)
+	_, err = GetKeyFromUserKeyring("/dev/sda1", "aux", "secboot")
+	c.Check(err, IsNil)
+
+	key2, err := GetKey("/dev/sda1", "unlock", "secboot", options)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	c.Check(RemoveKey("/dev/sda1", "unlock", "secboot", options), IsNil)
+	c.Check(id, Not(testutil.InSlice(Equals)), testutil.GetKeyringKeys(c, sessionId))
+}
+
+func (s *keyringSuite) TestAddKeyToPersistentKeyring(c *C) {
+	ringId, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, -1, -4, 0, 0)
+	if err != nil {
+		c.Skip("persistent keyrings are not available: " + err.Error())
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	options := &Options{Keyring: PersistentKeyring, KeyringName: "secboot-test"}
+	c.Check(AddKey(key, "/dev/sda1", "unlock", "secboot", options), IsNil)
+
+	namedId, err := unix.KeyctlSearch(ringId, "keyring", "secboot-test", 0)
+	c.Assert(err, IsNil)
+	defer unix.KeyctlInt(unix.KEYCTL_UNLINK, namedId, ringId, 0, 0)
+
+	key2, err := GetKey("/dev/sda1", "unlock", "secboot", options)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	c.Check(RemoveKey("/dev/sda1", "unlock", "secboot", options), IsNil)
+}
+
+func (s *keyringSuite) TestListKeys(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "secboot"), IsNil)
+	c.Check(AddKeyToUserKeyring(key, "/dev/sda1", "aux", "secboot"), IsNil)
+	c.Check(AddKey(key, "/dev/disk/by-path/pci-0000:00:1f.2-ata-1-part2", "unlock", "secboot", &Options{Logon: true}), IsNil)
+	c.Check(AddKeyToUserKeyring(key, "/dev/sda2", "unlock", "foo"), IsNil)
+	c.Check(AddKeyToUserKeyring(key, "/dev/sda3", "unlock", "secboot-foo"), IsNil)
+
+	keys, err := ListKeys("secboot", nil)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 3)
+	for _, k := range keys {
+		c.Check(k.ID, Not(Equals), 0)
+		k.ID = 0
+	}
+	c.Check(keys, DeepEquals, []*KeyInfo{
+		{Logon: true, DevicePath: "/dev/disk/by-path/pci-0000:00:1f.2-ata-1-part2", Purpose: "unlock"},
+		{DevicePath: "/dev/sda1", Purpose: "aux"},
+		{DevicePath: "/dev/sda1", Purpose: "unlock"},
+	})
+}
+
+func (s *keyringSuite) TestListKeysNamedKeyring(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	options := &Options{KeyringName: "secboot-test"}
+	c.Check(AddKey(key, "/dev/sda1", "unlock", "secboot", options), IsNil)
+	c.Check(AddKeyToUserKeyring(key, "/dev/sda2", "unlock", "secboot"), IsNil)
+
+	keys, err := ListKeys("secboot", options)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	c.Check(keys[0].DevicePath, Equals, "/dev/sda1")
+	c.Check(keys[0].Purpose, Equals, "unlock")
+}
+
+func (s *keyringSuite) TestListKeysNoNamedKeyring(c *C) {
+	keys, err := ListKeys("secboot", &Options{KeyringName: "secboot-test"})
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 0)
+}
+
+func (s *keyringSuite) TestPurgeKeys(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "secboot"), IsNil)
+	c.Check(AddKeyToUserKeyring(key, "/dev/sda1", "aux", "secboot"), IsNil)
+	c.Check(AddKey(key, "/dev/sda2", "unlock", "secboot", &Options{Logon: true}), IsNil)
+	c.Check(AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "foo"), IsNil)
+
+	c.Check(PurgeKeys("secboot", nil), IsNil)
+
+	keys, err := ListKeys("secboot", nil)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 0)
+
+	keys, err = ListKeys("foo", nil)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 1)
+}
+
+func (s *keyringSuite) TestPurgeKeysNamedKeyring(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	options := &Options{KeyringName: "secboot-test"}
+	c.Check(AddKey(key, "/dev/sda1", "unlock", "secboot", options), IsNil)
+	c.Check(AddKey(key, "/dev/sda1", "aux", "secboot", options), IsNil)
+
+	c.Check(PurgeKeys("secboot", options), IsNil)
+
+	_, err := unix.KeyctlSearch(-4, "keyring", "secboot-test", 0)
+	c.Check(err, Equals, unix.ENOKEY)
+}
+
+func (s *keyringSuite) TestPurgeKeysNamedKeyringNotEmpty(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	options := &Options{KeyringName: "secboot-test"}
+	c.Check(AddKey(key, "/dev/sda1", "unlock", "secboot", options), IsNil)
+	c.Check(AddKey(key, "/dev/sda1", "unlock", "foo", options), IsNil)
+
+	c.Check(PurgeKeys("secboot", options), IsNil)
+
+	keys, err := ListKeys("foo", options)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 1)
+}
+
+func (s *keyringSuite) TestPurgeKeysNoNamedKeyring(c *C) {
+	c.Check(PurgeKeys("secboot", &Options{KeyringName: "secboot-test"}), IsNil)
+}
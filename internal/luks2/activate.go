@@ -21,21 +21,82 @@ package luks2
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 
 	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/dm"
 )
 
+const dmSectorSize = 512
+
 var (
 	systemdCryptsetupPath = "/lib/systemd/systemd-cryptsetup"
+
+	dmCreateDevice = dm.CreateDevice
+	dmRemoveDevice = dm.RemoveDevice
+)
+
+// ActivateBackend specifies the mechanism used to activate and deactivate volumes.
+type ActivateBackend int
+
+const (
+	// ActivateBackendAuto selects systemd-cryptsetup if it is available, and
+	// the native backend otherwise.
+	ActivateBackendAuto ActivateBackend = iota
+
+	// ActivateBackendSystemd uses systemd-cryptsetup.
+	ActivateBackendSystemd
+
+	// ActivateBackendNative unlocks the volume key from the header directly
+	// and creates the dm-crypt device using device-mapper ioctls. This is
+	// suitable for environments without systemd, such as a minimal initramfs.
+	// It supports volumes with a single crypt segment without integrity
+	// protection, and keyslots protected with aes-xts-plain64.
+	ActivateBackendNative
 )
 
-// Activate unlocks the LUKS device at sourceDevicePath using systemd-cryptsetup and creates a device
-// mapping with the supplied volumeName. The device is unlocked using the supplied key.
-func Activate(volumeName, sourceDevicePath string, key []byte) error {
-	cmd := exec.Command(systemdCryptsetupPath, "attach", volumeName, sourceDevicePath, "/dev/stdin", "luks,tries=1")
+func (b ActivateBackend) resolve() ActivateBackend {
+	if b != ActivateBackendAuto {
+		return b
+	}
+	if _, err := os.Stat(systemdCryptsetupPath); err == nil {
+		return ActivateBackendSystemd
+	}
+	return ActivateBackendNative
+}
+
+// ActivateOptions provides the options for activating a LUKS2 volume.
+type ActivateOptions struct {
+	// DetachedHeaderPath is the path of the detached LUKS2 header for
+	// the volume. If this is not set, the header is expected to be
+	// stored on the device being activated.
+	DetachedHeaderPath string
+
+	// Backend specifies the mechanism used to activate the volume.
+	Backend ActivateBackend
+}
+
+func activateSystemd(volumeName, sourceDevicePath string, key []byte, options *ActivateOptions) error {
+	cryptsetupOpts := []string{"luks"}
+	if options.DetachedHeaderPath != "" {
+		// systemd-cryptsetup's options are comma separated, and there is no way
+		// of escaping a comma in a path.
+		if strings.Contains(options.DetachedHeaderPath, ",") {
+			return fmt.Errorf("invalid detached header path %q", options.DetachedHeaderPath)
+		}
+		cryptsetupOpts = append(cryptsetupOpts, "header="+options.DetachedHeaderPath)
+	}
+	cryptsetupOpts = append(cryptsetupOpts, "tries=1")
+
+	cmd := exec.Command(systemdCryptsetupPath, "attach", volumeName, sourceDevicePath, "/dev/stdin", strings.Join(cryptsetupOpts, ","))
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "SYSTEMD_LOG_TARGET=console")
 	cmd.Stdin = bytes.NewReader(key)
@@ -47,8 +108,148 @@ func Activate(volumeName, sourceDevicePath string, key []byte) error {
 	return nil
 }
 
-// Deactivate detaches the LUKS volume with the supplied name.
+// dmCryptTarget returns the dm-crypt target for the supplied segment and volume key,
+// with the data stored on the specified device. The Params field of the returned target
+// contains the volume key, and should be wiped once it is no longer required.
+func dmCryptTarget(segment *Segment, volumeKey []byte, devicePath string) (*dm.Target, error) {
+	switch {
+	case segment.Type != SegmentTypeCrypt:
+		return nil, fmt.Errorf("unsupported segment type %q", segment.Type)
+	case segment.Integrity != nil:
+		return nil, fmt.Errorf("unsupported segment integrity type %q", segment.Integrity.Type)
+	case segment.Offset%dmSectorSize != 0:
+		return nil, fmt.Errorf("invalid segment offset %d", segment.Offset)
+	}
+
+	size := segment.Size
+	if segment.DynamicSize {
+		sz, err := deviceSize(devicePath)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine device size: %w", err)
+		}
+		if sz < segment.Offset {
+			return nil, fmt.Errorf("device is too small (%d bytes)", sz)
+		}
+		size = sz - segment.Offset
+	}
+
+	// The table contains the volume key, so build it in a buffer that can be
+	// wiped by the caller. The buffer is sized so that appending to it never
+	// reallocates, which would leave copies of the key behind.
+	params := make([]byte, 0, len(segment.Encryption)+hex.EncodedLen(len(volumeKey))+len(devicePath)+128)
+	params = append(params, segment.Encryption...)
+	params = append(params, ' ')
+	keyOffset := len(params)
+	params = params[:keyOffset+hex.EncodedLen(len(volumeKey))]
+	hex.Encode(params[keyOffset:], volumeKey)
+	params = append(params, ' ')
+	params = strconv.AppendUint(params, segment.IVTweak, 10)
+	params = append(params, ' ')
+	params = append(params, devicePath...)
+	params = append(params, ' ')
+	params = strconv.AppendUint(params, segment.Offset/dmSectorSize, 10)
+	if segment.SectorSize > dmSectorSize {
+		// LUKS2 computes the IV from the sector number in units of the
+		// encryption sector size.
+		params = append(params, " 2 sector_size:"...)
+		params = strconv.AppendInt(params, int64(segment.SectorSize), 10)
+		params = append(params, " iv_large_sectors"...)
+	}
+
+	return &dm.Target{
+		Length: size / dmSectorSize,
+		Type:   "crypt",
+		Params: params}, nil
+}
+
+func activateNative(volumeName, sourceDevicePath string, key []byte, options *ActivateOptions) error {
+	headerPath := sourceDevicePath
+	if options.DetachedHeaderPath != "" {
+		headerPath = options.DetachedHeaderPath
+	}
+
+	releaseLock, err := acquireSharedLock(headerPath, LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot acquire shared lock: %w", err)
+	}
+	defer releaseLock()
+
+	f, err := os.Open(headerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	primary, secondary := decodeHeaders(f)
+	hdr, err := selectHeader(primary, secondary)
+	if err != nil {
+		return xerrors.Errorf("cannot decode header: %w", err)
+	}
+
+	metadata := hdr.metadata
+	if len(metadata.Config.Requirements) > 0 {
+		return fmt.Errorf("cannot activate volume with mandatory requirements %q", metadata.Config.Requirements)
+	}
+	if len(metadata.Segments) != 1 {
+		return fmt.Errorf("cannot activate volume with %d segments", len(metadata.Segments))
+	}
+	segmentId := -1
+	for id := range metadata.Segments {
+		segmentId = id
+	}
+
+	volumeKey, err := unlockVolumeKey(f, metadata, segmentId, key)
+	if err != nil {
+		return xerrors.Errorf("cannot unlock volume key: %w", err)
+	}
+	defer wipe(volumeKey)
+
+	target, err := dmCryptTarget(metadata.Segments[segmentId], volumeKey, sourceDevicePath)
+	if err != nil {
+		return xerrors.Errorf("cannot create dm-crypt target: %w", err)
+	}
+	defer wipe(target.Params)
+
+	// Use the same device UUID format as libcryptsetup.
+	uuid := "CRYPT-LUKS2-" + strings.Replace(hdr.hdr.uuid(), "-", "", -1) + "-" + volumeName
+	if err := dmCreateDevice(volumeName, uuid, false, []dm.Target{*target}); err != nil {
+		return xerrors.Errorf("cannot create device-mapper device: %w", err)
+	}
+
+	return nil
+}
+
+// Activate unlocks the LUKS device at sourceDevicePath and creates a device mapping with the
+// supplied volumeName. The device is unlocked using the supplied key. By default, this uses
+// systemd-cryptsetup if it is available. The Backend field of options can be used to select
+// the native backend, which doesn't depend on systemd.
+//
+// If options is nil, default options are used.
+func Activate(volumeName, sourceDevicePath string, key []byte, options *ActivateOptions) error {
+	if options == nil {
+		options = &ActivateOptions{}
+	}
+
+	switch options.Backend.resolve() {
+	case ActivateBackendSystemd:
+		return activateSystemd(volumeName, sourceDevicePath, key, options)
+	case ActivateBackendNative:
+		return activateNative(volumeName, sourceDevicePath, key, options)
+	default:
+		return fmt.Errorf("invalid backend %d", options.Backend)
+	}
+}
+
+// Deactivate detaches the LUKS volume with the supplied name. This uses systemd-cryptsetup
+// if it is available, and removes the device-mapper device directly otherwise.
 func Deactivate(volumeName string) error {
+	if ActivateBackendAuto.resolve() == ActivateBackendNative {
+		if err := dmRemoveDevice(volumeName); err != nil {
+			return xerrors.Errorf("cannot deactivate volume: %w", err)
+		}
+		return nil
+	}
+
 	cmd := exec.Command(systemdCryptsetupPath, "detach", volumeName)
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "SYSTEMD_LOG_TARGET=console")
@@ -20,11 +20,15 @@
 package luks2_test
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"path/filepath"
 
+	"github.com/snapcore/secboot/internal/dm"
 	. "github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/paths/pathstest"
 	snapd_testutil "github.com/snapcore/snapd/testutil"
@@ -84,6 +88,8 @@ var _ = Suite(&activateSuite{})
 type testActivateData struct {
 	volumeName       string
 	sourceDevicePath string
+	options          *ActivateOptions
+	expectedOptions  string
 }
 
 func (s *activateSuite) testActivate(c *C, data *testActivateData) {
@@ -91,11 +97,16 @@ func (s *activateSuite) testActivate(c *C, data *testActivateData) {
 	rand.Read(key)
 	s.addMockKeyslot(c, key)
 
-	c.Check(Activate(data.volumeName, data.sourceDevicePath, key), IsNil)
+	c.Check(Activate(data.volumeName, data.sourceDevicePath, key, data.options), IsNil)
+
+	expectedOptions := data.expectedOptions
+	if expectedOptions == "" {
+		expectedOptions = "luks,tries=1"
+	}
 
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
 	c.Assert(s.mockSdCryptsetup.Calls()[0], HasLen, 6)
-	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", data.volumeName, data.sourceDevicePath, "/dev/stdin", "luks,tries=1"})
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", data.volumeName, data.sourceDevicePath, "/dev/stdin", expectedOptions})
 }
 
 func (s *activateSuite) TestActivate1(c *C) {
@@ -116,12 +127,41 @@ func (s *activateSuite) TestActivate3(c *C) {
 		sourceDevicePath: "/dev/vda2"})
 }
 
+func (s *activateSuite) TestActivateWithEmptyOptions(c *C) {
+	s.testActivate(c, &testActivateData{
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		options:          &ActivateOptions{}})
+}
+
+func (s *activateSuite) TestActivateWithDetachedHeader1(c *C) {
+	s.testActivate(c, &testActivateData{
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		options:          &ActivateOptions{DetachedHeaderPath: "/boot/luks/data.hdr"},
+		expectedOptions:  "luks,header=/boot/luks/data.hdr,tries=1"})
+}
+
+func (s *activateSuite) TestActivateWithDetachedHeader2(c *C) {
+	s.testActivate(c, &testActivateData{
+		volumeName:       "test",
+		sourceDevicePath: "/dev/vda2",
+		options:          &ActivateOptions{DetachedHeaderPath: "/dev/sdb1"},
+		expectedOptions:  "luks,header=/dev/sdb1,tries=1"})
+}
+
+func (s *activateSuite) TestActivateWithInvalidDetachedHeaderPath(c *C) {
+	c.Check(Activate("data", "/dev/sda1", nil, &ActivateOptions{DetachedHeaderPath: "/boot/luks/data,hdr"}), ErrorMatches,
+		`invalid detached header path \"/boot/luks/data,hdr\"`)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
 func (s *activateSuite) TestActivateWrongKey(c *C) {
 	key := make([]byte, 32)
 	rand.Read(key)
 	s.addMockKeyslot(c, key)
 
-	c.Check(Activate("data", "/dev/sda1", nil), ErrorMatches, `systemd-cryptsetup failed with: exit status 5`)
+	c.Check(Activate("data", "/dev/sda1", nil, nil), ErrorMatches, `systemd-cryptsetup failed with: exit status 5`)
 
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
 	c.Assert(s.mockSdCryptsetup.Calls()[0], HasLen, 6)
@@ -144,3 +184,147 @@ func (s *activateSuite) TestDeactivateErr(c *C) {
 		"systemd-cryptsetup", "detach", "bad-volume",
 	})
 }
+
+type mockDMDevice struct {
+	name     string
+	uuid     string
+	readOnly bool
+	targets  []dm.Target
+}
+
+func (s *activateSuite) mockDMCreateDevice(devices *[]mockDMDevice) func() {
+	return MockDMCreateDevice(func(name, uuid string, readOnly bool, targets []dm.Target) error {
+		// The caller wipes the target parameters once this returns.
+		var copied []dm.Target
+		for _, t := range targets {
+			t.Params = append([]byte(nil), t.Params...)
+			copied = append(copied, t)
+		}
+		*devices = append(*devices, mockDMDevice{name, uuid, readOnly, copied})
+		return nil
+	})
+}
+
+func (s *activateSuite) TestActivateNative(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+
+	var devices []mockDMDevice
+	s.AddCleanup(s.mockDMCreateDevice(&devices))
+
+	c.Check(Activate("data", path, []byte("passphrase"), &ActivateOptions{Backend: ActivateBackendNative}), IsNil)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+
+	c.Assert(devices, HasLen, 1)
+	c.Check(devices[0].name, Equals, "data")
+	c.Check(devices[0].uuid, Matches, "CRYPT-LUKS2-[0-9a-f]{32}-data")
+	c.Check(devices[0].readOnly, Equals, false)
+	c.Check(devices[0].targets, DeepEquals, []dm.Target{
+		{
+			Length: uint64(fi.Size()) / 512,
+			Type:   "crypt",
+			Params: []byte(fmt.Sprintf("aes-xts-plain64 %x 0 %s 0", volumeKey, path)),
+		},
+	})
+}
+
+func (s *activateSuite) TestActivateNativeWipesTable(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+
+	var params []byte
+	s.AddCleanup(MockDMCreateDevice(func(_, _ string, _ bool, targets []dm.Target) error {
+		c.Assert(targets, HasLen, 1)
+		c.Check(bytes.Contains(targets[0].Params, []byte(hex.EncodeToString(volumeKey))), Equals, true)
+		params = targets[0].Params
+		return nil
+	}))
+
+	c.Check(Activate("data", path, []byte("passphrase"), &ActivateOptions{Backend: ActivateBackendNative}), IsNil)
+	c.Check(params, DeepEquals, make([]byte, len(params)))
+}
+
+func (s *activateSuite) TestActivateNativeWithDetachedHeader(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+	c.Assert(UpdateHeader(path, LockModeBlocking, func(metadata *Metadata) error {
+		metadata.Segments[0].Offset = 16777216
+		metadata.Segments[0].DynamicSize = false
+		metadata.Segments[0].Size = 1048576
+		metadata.Segments[0].SectorSize = 4096
+		return nil
+	}), IsNil)
+
+	var devices []mockDMDevice
+	s.AddCleanup(s.mockDMCreateDevice(&devices))
+
+	c.Check(Activate("data", "/dev/sda1", []byte("passphrase"), &ActivateOptions{
+		DetachedHeaderPath: path,
+		Backend:            ActivateBackendNative}), IsNil)
+
+	c.Assert(devices, HasLen, 1)
+	c.Check(devices[0].targets, DeepEquals, []dm.Target{
+		{
+			Length: 2048,
+			Type:   "crypt",
+			Params: []byte(fmt.Sprintf("aes-xts-plain64 %x 0 /dev/sda1 32768 2 sector_size:4096 iv_large_sectors", volumeKey)),
+		},
+	})
+}
+
+func (s *activateSuite) TestActivateNativeWrongKey(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+
+	var devices []mockDMDevice
+	s.AddCleanup(s.mockDMCreateDevice(&devices))
+
+	c.Check(Activate("data", path, []byte("foo"), &ActivateOptions{Backend: ActivateBackendNative}), ErrorMatches,
+		"cannot unlock volume key: no keyslot could be unlocked with the supplied key")
+	c.Check(devices, HasLen, 0)
+}
+
+func (s *activateSuite) TestActivateNativeWithIntegrity(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+	c.Assert(UpdateHeader(path, LockModeBlocking, func(metadata *Metadata) error {
+		metadata.Segments[0].Integrity = &Integrity{Type: "hmac(sha256)", JournalEncryption: "none", JournalIntegrity: "none"}
+		return nil
+	}), IsNil)
+
+	var devices []mockDMDevice
+	s.AddCleanup(s.mockDMCreateDevice(&devices))
+
+	c.Check(Activate("data", path, []byte("passphrase"), &ActivateOptions{Backend: ActivateBackendNative}), ErrorMatches,
+		`cannot create dm-crypt target: unsupported segment integrity type "hmac\(sha256\)"`)
+	c.Check(devices, HasLen, 0)
+}
+
+func (s *activateSuite) TestActivateAutoWithoutSystemd(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+	s.AddCleanup(MockSystemdCryptsetupPath(filepath.Join(c.MkDir(), "systemd-cryptsetup")))
+
+	var devices []mockDMDevice
+	s.AddCleanup(s.mockDMCreateDevice(&devices))
+
+	c.Check(Activate("data", path, []byte("passphrase"), nil), IsNil)
+	c.Check(devices, HasLen, 1)
+}
+
+func (s *activateSuite) TestDeactivateWithoutSystemd(c *C) {
+	s.AddCleanup(MockSystemdCryptsetupPath(filepath.Join(c.MkDir(), "systemd-cryptsetup")))
+
+	var removed []string
+	s.AddCleanup(MockDMRemoveDevice(func(name string) error {
+		removed = append(removed, name)
+		return nil
+	}))
+
+	c.Check(Deactivate("data"), IsNil)
+	c.Check(removed, DeepEquals, []string{"data"})
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
@@ -0,0 +1,333 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// HeaderCopyState describes the state of a single copy of the LUKS2 header.
+type HeaderCopyState int
+
+const (
+	// HeaderCopyValid indicates that a header copy is valid and up-to-date.
+	HeaderCopyValid HeaderCopyState = iota
+
+	// HeaderCopyObsolete indicates that a header copy is valid but has a
+	// lower sequence ID than the other copy.
+	HeaderCopyObsolete
+
+	// HeaderCopyInvalid indicates that a header copy is damaged or missing.
+	HeaderCopyInvalid
+)
+
+func (s HeaderCopyState) String() string {
+	switch s {
+	case HeaderCopyValid:
+		return "valid"
+	case HeaderCopyObsolete:
+		return "obsolete"
+	case HeaderCopyInvalid:
+		return "invalid"
+	default:
+		return fmt.Sprintf("HeaderCopyState(%d)", int(s))
+	}
+}
+
+// HeaderCopyStatus describes a single copy of the LUKS2 header.
+type HeaderCopyStatus struct {
+	State  HeaderCopyState
+	Offset uint64 // The offset of this copy, in bytes. Only valid if State is not HeaderCopyInvalid
+	SeqId  uint64 // The sequence ID of this copy. Only valid if State is not HeaderCopyInvalid
+	Err    error  // The error that occurred when decoding this copy, if State is HeaderCopyInvalid
+}
+
+// HeaderStatus describes the state of both copies of the LUKS2 header.
+type HeaderStatus struct {
+	Primary   HeaderCopyStatus
+	Secondary HeaderCopyStatus
+}
+
+// NeedsRepair indicates whether one of the header copies is invalid or obsolete.
+func (s *HeaderStatus) NeedsRepair() bool {
+	return s.Primary.State != HeaderCopyValid || s.Secondary.State != HeaderCopyValid
+}
+
+func newHeaderCopyStatus(hdr, other *decodedHeader) HeaderCopyStatus {
+	switch {
+	case hdr.err != nil:
+		return HeaderCopyStatus{State: HeaderCopyInvalid, Err: hdr.err}
+	case other.err == nil && other.hdr.SeqId > hdr.hdr.SeqId:
+		return HeaderCopyStatus{State: HeaderCopyObsolete, Offset: hdr.hdr.HdrOffset, SeqId: hdr.hdr.SeqId}
+	default:
+		return HeaderCopyStatus{State: HeaderCopyValid, Offset: hdr.hdr.HdrOffset, SeqId: hdr.hdr.SeqId}
+	}
+}
+
+func newHeaderStatus(primary, secondary *decodedHeader) *HeaderStatus {
+	return &HeaderStatus{
+		Primary:   newHeaderCopyStatus(primary, secondary),
+		Secondary: newHeaderCopyStatus(secondary, primary)}
+}
+
+// headerAreaSize returns the size of the entire LUKS2 header area described by the
+// supplied header, which consists of both copies of the binary header and JSON
+// metadata followed by the binary keyslots area.
+func headerAreaSize(hdr *decodedHeader) uint64 {
+	return 2*hdr.hdr.HdrSize + hdr.metadata.Config.KeyslotsSize
+}
+
+// CheckHeader reports the state of the primary and secondary copies of the header of
+// the LUKS2 container at the specified path. An error is returned if neither copy is
+// valid.
+//
+// This function requires an advisory shared lock on the LUKS container associated
+// with the specified path, which is acquired according to the supplied lock mode.
+func CheckHeader(path string, lockMode LockMode) (*HeaderStatus, error) {
+	releaseLock, err := acquireSharedLock(path, lockMode)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot acquire shared lock: %w", err)
+	}
+	defer releaseLock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	primary, secondary := decodeHeaders(f)
+	if _, err := selectHeader(primary, secondary); err != nil {
+		return nil, err
+	}
+
+	return newHeaderStatus(primary, secondary), nil
+}
+
+// BackupHeader writes a snapshot of the entire header area of the LUKS2 container at
+// the specified path to a new file at backupPath. The snapshot contains both copies of
+// the binary header and JSON metadata and the binary keyslots area, in the same format
+// as "cryptsetup luksHeaderBackup". It is an error if backupPath already exists.
+//
+// The snapshot is taken as-is, so a damaged header copy is preserved in the snapshot.
+// At least one of the header copies must be valid.
+//
+// Note that the snapshot contains the keyslots, and so should be protected in the same
+// way as the container.
+//
+// This function requires an advisory shared lock on the LUKS container associated
+// with the specified path, which is acquired according to the supplied lock mode.
+func BackupHeader(path, backupPath string, lockMode LockMode) error {
+	releaseLock, err := acquireSharedLock(path, lockMode)
+	if err != nil {
+		return xerrors.Errorf("cannot acquire shared lock: %w", err)
+	}
+	defer releaseLock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	primary, secondary := decodeHeaders(f)
+	hdr, err := selectHeader(primary, secondary)
+	if err != nil {
+		return err
+	}
+	size := headerAreaSize(hdr)
+
+	backup, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return xerrors.Errorf("cannot create backup file: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		backup.Close()
+		os.Remove(backupPath)
+	}()
+
+	if _, err := io.Copy(backup, io.NewSectionReader(f, 0, int64(size))); err != nil {
+		return xerrors.Errorf("cannot write backup file: %w", err)
+	}
+	if err := backup.Sync(); err != nil {
+		return xerrors.Errorf("cannot sync backup file: %w", err)
+	}
+	if err := backup.Close(); err != nil {
+		return xerrors.Errorf("cannot close backup file: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
+
+// deviceOrFileSize returns the size of the supplied file, which may be a block device.
+func deviceOrFileSize(f *os.File) (int64, error) {
+	return f.Seek(0, io.SeekEnd)
+}
+
+// RestoreHeader restores the header area of the LUKS2 container at the specified path
+// from the snapshot at backupPath, previously created by BackupHeader or by "cryptsetup
+// luksHeaderBackup". Both copies of the header in the snapshot must be valid and must
+// belong to the same container.
+//
+// If the container has a valid header with a different UUID to the one in the snapshot,
+// an error is returned and the container is not modified. A container with no valid
+// header can be restored from any snapshot.
+//
+// WARNING: This function is destructive. Any keyslots added to the container after the
+// snapshot was taken are lost, and if the volume key has changed since the snapshot was
+// taken, the data on the container will be irretrievable.
+//
+// This function requires an advisory exclusive lock on the LUKS container associated
+// with the specified path, which is acquired according to the supplied lock mode.
+func RestoreHeader(path, backupPath string, lockMode LockMode) error {
+	backup, err := os.Open(backupPath)
+	if err != nil {
+		return xerrors.Errorf("cannot open backup file: %w", err)
+	}
+	defer backup.Close()
+
+	backupPrimary, backupSecondary := decodeHeaders(backup)
+	switch {
+	case backupPrimary.err != nil:
+		return xerrors.Errorf("cannot decode primary header from backup file: %w", backupPrimary.err)
+	case backupSecondary.err != nil:
+		return xerrors.Errorf("cannot decode secondary header from backup file: %w", backupSecondary.err)
+	case backupPrimary.hdr.uuid() != backupSecondary.hdr.uuid():
+		return fmt.Errorf("backup file contains headers for different containers (primary UUID %s, secondary UUID %s)",
+			backupPrimary.hdr.uuid(), backupSecondary.hdr.uuid())
+	}
+	size := headerAreaSize(backupPrimary)
+
+	backupSize, err := deviceOrFileSize(backup)
+	if err != nil {
+		return xerrors.Errorf("cannot determine size of backup file: %w", err)
+	}
+	if uint64(backupSize) < size {
+		return fmt.Errorf("backup file is too small (%d bytes, header area is %d bytes)", backupSize, size)
+	}
+
+	releaseLock, err := acquireExclusiveLock(path, lockMode)
+	if err != nil {
+		return xerrors.Errorf("cannot acquire exclusive lock: %w", err)
+	}
+	defer releaseLock()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if current, err := selectHeader(decodeHeaders(f)); err == nil && current.hdr.uuid() != backupPrimary.hdr.uuid() {
+		return fmt.Errorf("backup file is for a different container (UUID %s, container UUID %s)", backupPrimary.hdr.uuid(), current.hdr.uuid())
+	}
+
+	deviceSize, err := deviceOrFileSize(f)
+	if err != nil {
+		return xerrors.Errorf("cannot determine size of device: %w", err)
+	}
+	if uint64(deviceSize) < size {
+		return fmt.Errorf("device is too small (%d bytes, header area is %d bytes)", deviceSize, size)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(backup, 0, int64(size))); err != nil {
+		return xerrors.Errorf("cannot write header area: %w", err)
+	}
+	return f.Sync()
+}
+
+// RepairHeader repairs a damaged or obsolete copy of the header of the LUKS2 container
+// at the specified path, by replacing it with the other, valid copy. The sequence ID is
+// not changed. The returned status describes the header before it was repaired. If both
+// copies are valid and up-to-date, the container is not modified.
+//
+// Unlike updating the header, this does not depend on the JSON metadata being fully
+// understood by this package, as the JSON metadata area is copied verbatim. The binary
+// keyslots area has no redundancy and cannot be repaired.
+//
+// This function requires an advisory exclusive lock on the LUKS container associated
+// with the specified path, which is acquired according to the supplied lock mode.
+func RepairHeader(path string, lockMode LockMode) (*HeaderStatus, error) {
+	releaseLock, err := acquireExclusiveLock(path, lockMode)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot acquire exclusive lock: %w", err)
+	}
+	defer releaseLock()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	primary, secondary := decodeHeaders(f)
+	current, err := selectHeader(primary, secondary)
+	if err != nil {
+		return nil, err
+	}
+
+	status := newHeaderStatus(primary, secondary)
+
+	var damaged *decodedHeader
+	var magic [6]byte
+	var offset uint64
+	switch {
+	case status.Primary.State != HeaderCopyValid:
+		damaged = primary
+		magic = primaryMagic
+		offset = 0
+	case status.Secondary.State != HeaderCopyValid:
+		damaged = secondary
+		magic = secondaryMagic
+		offset = current.hdr.HdrSize
+	default:
+		return status, nil
+	}
+
+	hdr := *current.hdr
+	hdr.Magic = magic
+	hdr.HdrOffset = offset
+	if damaged.err == nil {
+		// Preserve the salt of an obsolete copy.
+		hdr.Salt = damaged.hdr.Salt
+	} else if _, err := rand.Read(hdr.Salt[:]); err != nil {
+		return nil, xerrors.Errorf("cannot create salt: %w", err)
+	}
+
+	if err := writeHeaderCopy(f, &hdr, current.jsonData); err != nil {
+		return nil, xerrors.Errorf("cannot write header: %w", err)
+	}
+
+	return status, nil
+}
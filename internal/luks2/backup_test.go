@@ -0,0 +1,359 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+)
+
+// corruptHeaderCopy overwrites part of the header copy at the specified offset.
+func corruptHeaderCopy(c *C, path string, offset int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteAt(make([]byte, 512), offset)
+	c.Assert(err, IsNil)
+}
+
+// setHeaderCopyUUID changes the UUID of the SHA-256 checksummed header copy at the
+// specified offset, and updates its checksum so that it remains valid.
+func setHeaderCopyUUID(c *C, path string, offset, hdrSize int64, uuid string) {
+	const (
+		uuidOffset = 168
+		csumOffset = 448
+	)
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	hdr := make([]byte, hdrSize)
+	_, err = f.ReadAt(hdr, offset)
+	c.Assert(err, IsNil)
+
+	copy(hdr[uuidOffset:uuidOffset+40], make([]byte, 40))
+	copy(hdr[uuidOffset:], uuid)
+	copy(hdr[csumOffset:csumOffset+64], make([]byte, 64))
+	csum := sha256.Sum256(hdr)
+	copy(hdr[csumOffset:], csum[:])
+
+	_, err = f.WriteAt(hdr, offset)
+	c.Assert(err, IsNil)
+}
+
+type testCheckHeaderData struct {
+	path      string
+	primary   HeaderCopyState
+	secondary HeaderCopyState
+	seqId     uint64
+}
+
+func (s *metadataSuite) testCheckHeader(c *C, data *testCheckHeaderData) {
+	status, err := CheckHeader(s.decompress(c, data.path), LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(status.Primary.State, Equals, data.primary)
+	c.Check(status.Secondary.State, Equals, data.secondary)
+	c.Check(status.NeedsRepair(), Equals, data.primary != HeaderCopyValid || data.secondary != HeaderCopyValid)
+
+	for _, copy := range []HeaderCopyStatus{status.Primary, status.Secondary} {
+		switch copy.State {
+		case HeaderCopyInvalid:
+			c.Check(copy.Err, NotNil)
+		case HeaderCopyValid:
+			c.Check(copy.Err, IsNil)
+			c.Check(copy.SeqId, Equals, data.seqId)
+		case HeaderCopyObsolete:
+			c.Check(copy.Err, IsNil)
+			c.Check(copy.SeqId < data.seqId, Equals, true)
+		}
+	}
+}
+
+func (s *metadataSuite) TestCheckHeaderValid(c *C) {
+	s.testCheckHeader(c, &testCheckHeaderData{
+		path:      "testdata/luks2-valid-hdr.img",
+		primary:   HeaderCopyValid,
+		secondary: HeaderCopyValid,
+		seqId:     7})
+}
+
+func (s *metadataSuite) TestCheckHeaderInvalidPrimary(c *C) {
+	s.testCheckHeader(c, &testCheckHeaderData{
+		path:      "testdata/luks2-hdr-invalid-checksum0.img",
+		primary:   HeaderCopyInvalid,
+		secondary: HeaderCopyValid,
+		seqId:     7})
+}
+
+func (s *metadataSuite) TestCheckHeaderInvalidSecondary(c *C) {
+	s.testCheckHeader(c, &testCheckHeaderData{
+		path:      "testdata/luks2-hdr-invalid-checksum1.img",
+		primary:   HeaderCopyValid,
+		secondary: HeaderCopyInvalid,
+		seqId:     7})
+}
+
+func (s *metadataSuite) TestCheckHeaderObsoletePrimary(c *C) {
+	s.testCheckHeader(c, &testCheckHeaderData{
+		path:      "testdata/luks2-hdr-obsolete0.img",
+		primary:   HeaderCopyObsolete,
+		secondary: HeaderCopyValid,
+		seqId:     8})
+}
+
+func (s *metadataSuite) TestCheckHeaderNoValidHeader(c *C) {
+	_, err := CheckHeader(s.decompress(c, "testdata/luks2-hdr-invalid-magic-both.img"), LockModeBlocking)
+	c.Check(err, ErrorMatches, "no valid header found, error from decoding primary header: invalid magic")
+}
+
+func (s *metadataSuite) TestBackupHeader(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr2.img")
+	backupPath := filepath.Join(c.MkDir(), "backup")
+
+	c.Check(BackupHeader(path, backupPath, LockModeBlocking), IsNil)
+
+	info, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	backup, err := ioutil.ReadFile(backupPath)
+	c.Assert(err, IsNil)
+	c.Check(uint64(len(backup)), Equals, 2*info.HeaderSize+info.Metadata.Config.KeyslotsSize)
+
+	orig, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(backup, orig[:len(backup)]), Equals, true)
+
+	backupInfo, err := ReadHeader(backupPath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(backupInfo, DeepEquals, info)
+}
+
+func (s *metadataSuite) TestBackupHeaderExists(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+	backupPath := filepath.Join(c.MkDir(), "backup")
+	c.Assert(ioutil.WriteFile(backupPath, []byte("foo"), 0600), IsNil)
+
+	c.Check(BackupHeader(path, backupPath, LockModeBlocking), ErrorMatches, "cannot create backup file: .*: file exists")
+
+	data, err := ioutil.ReadFile(backupPath)
+	c.Assert(err, IsNil)
+	c.Check(data, DeepEquals, []byte("foo"))
+}
+
+func (s *metadataSuite) TestRestoreHeader(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+	backupPath := filepath.Join(c.MkDir(), "backup")
+	c.Assert(BackupHeader(path, backupPath, LockModeBlocking), IsNil)
+
+	expected, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	// Modify the header and damage the primary copy.
+	c.Assert(SetSlotPriority(path, 0, SlotPriorityHigh), IsNil)
+	corruptHeaderCopy(c, path, 0)
+
+	c.Check(RestoreHeader(path, backupPath, LockModeBlocking), IsNil)
+
+	status, err := CheckHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(status.NeedsRepair(), Equals, false)
+	c.Check(status.Primary.SeqId, Equals, uint64(7))
+
+	info, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, expected)
+}
+
+func (s *metadataSuite) TestRestoreHeaderNoValidHeader(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+	backupPath := filepath.Join(c.MkDir(), "backup")
+	c.Assert(BackupHeader(path, backupPath, LockModeBlocking), IsNil)
+
+	expected, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	corruptHeaderCopy(c, path, 0)
+	corruptHeaderCopy(c, path, 16384)
+	_, err = CheckHeader(path, LockModeBlocking)
+	c.Assert(err, NotNil)
+
+	c.Check(RestoreHeader(path, backupPath, LockModeBlocking), IsNil)
+
+	info, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, expected)
+}
+
+func (s *metadataSuite) TestRestoreHeaderDifferentUUID(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+	backupPath := filepath.Join(c.MkDir(), "backup")
+	c.Assert(BackupHeader(s.decompress(c, "testdata/luks2-valid-hdr2.img"), backupPath, LockModeBlocking), IsNil)
+
+	orig, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	c.Check(RestoreHeader(path, backupPath, LockModeBlocking), ErrorMatches,
+		"backup file is for a different container \\(UUID 971ccc5f-5843-445b-9cac-65234c203543, container UUID 6503ce5c-c2fb-49e9-a560-71928d8ded0e\\)")
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(data, orig), Equals, true)
+}
+
+func (s *metadataSuite) TestRestoreHeaderInvalidBackup(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	c.Check(RestoreHeader(path, s.decompress(c, "testdata/luks2-hdr-invalid-checksum1.img"), LockModeBlocking), ErrorMatches,
+		"cannot decode secondary header from backup file: invalid header checksum")
+}
+
+func (s *metadataSuite) TestRestoreHeaderMismatchedBackup(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+	backupPath := filepath.Join(c.MkDir(), "backup")
+	c.Assert(BackupHeader(path, backupPath, LockModeBlocking), IsNil)
+
+	// Give the secondary header in the backup a different UUID.
+	setHeaderCopyUUID(c, backupPath, 16384, 16384, "971ccc5f-5843-445b-9cac-65234c203543")
+
+	orig, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	c.Check(RestoreHeader(path, backupPath, LockModeBlocking), ErrorMatches,
+		"backup file contains headers for different containers \\(primary UUID 6503ce5c-c2fb-49e9-a560-71928d8ded0e, secondary UUID 971ccc5f-5843-445b-9cac-65234c203543\\)")
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(data, orig), Equals, true)
+}
+
+func (s *metadataSuite) TestRestoreHeaderDeviceTooSmall(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+	backupPath := filepath.Join(c.MkDir(), "backup")
+	c.Assert(BackupHeader(path, backupPath, LockModeBlocking), IsNil)
+
+	c.Assert(os.Truncate(path, 8*1024*1024), IsNil)
+	corruptHeaderCopy(c, path, 0)
+	corruptHeaderCopy(c, path, 16384)
+
+	c.Check(RestoreHeader(path, backupPath, LockModeBlocking), ErrorMatches,
+		"device is too small \\(8388608 bytes, header area is 16777216 bytes\\)")
+}
+
+type testRepairHeaderData struct {
+	path      string
+	primary   HeaderCopyState
+	secondary HeaderCopyState
+	hdrSize   uint64
+	hdrOffset uint64 // The offset of the header copy that is expected to be selected
+	seqId     uint64 // The sequence ID of the header copy that is expected to be selected
+}
+
+func (s *metadataSuite) testRepairHeader(c *C, data *testRepairHeaderData) {
+	path := s.decompress(c, data.path)
+
+	expectedInfo, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	expectedJSON := readJSONMetadata(c, path, data.hdrOffset, data.hdrSize)
+
+	status, err := RepairHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(status.Primary.State, Equals, data.primary)
+	c.Check(status.Secondary.State, Equals, data.secondary)
+
+	// Both headers should be valid and have the same sequence ID as
+	// the selected copy.
+	primarySeqId, secondarySeqId, err := HeaderSeqIds(path)
+	c.Assert(err, IsNil)
+	c.Check(primarySeqId, Equals, data.seqId)
+	c.Check(secondarySeqId, Equals, data.seqId)
+
+	status, err = CheckHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(status.NeedsRepair(), Equals, false)
+
+	info, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, expectedInfo)
+
+	c.Check(readJSONMetadata(c, path, 0, data.hdrSize), DeepEquals, expectedJSON)
+	c.Check(readJSONMetadata(c, path, data.hdrSize, data.hdrSize), DeepEquals, expectedJSON)
+}
+
+func (s *metadataSuite) TestRepairHeaderInvalidPrimary(c *C) {
+	s.testRepairHeader(c, &testRepairHeaderData{
+		path:      "testdata/luks2-hdr-invalid-checksum0.img",
+		primary:   HeaderCopyInvalid,
+		secondary: HeaderCopyValid,
+		hdrSize:   16384,
+		hdrOffset: 16384,
+		seqId:     7})
+}
+
+func (s *metadataSuite) TestRepairHeaderInvalidSecondary(c *C) {
+	s.testRepairHeader(c, &testRepairHeaderData{
+		path:      "testdata/luks2-hdr-invalid-checksum1.img",
+		primary:   HeaderCopyValid,
+		secondary: HeaderCopyInvalid,
+		hdrSize:   16384,
+		hdrOffset: 0,
+		seqId:     7})
+}
+
+func (s *metadataSuite) TestRepairHeaderObsoletePrimary(c *C) {
+	s.testRepairHeader(c, &testRepairHeaderData{
+		path:      "testdata/luks2-hdr-obsolete0.img",
+		primary:   HeaderCopyObsolete,
+		secondary: HeaderCopyValid,
+		hdrSize:   16384,
+		hdrOffset: 16384,
+		seqId:     8})
+}
+
+func (s *metadataSuite) TestRepairHeaderInvalidPrimaryCustomMetadataSize(c *C) {
+	s.testRepairHeader(c, &testRepairHeaderData{
+		path:      "testdata/luks2-hdr2-invalid-checksum0.img",
+		primary:   HeaderCopyInvalid,
+		secondary: HeaderCopyValid,
+		hdrSize:   65536,
+		hdrOffset: 65536,
+		seqId:     6})
+}
+
+func (s *metadataSuite) TestRepairHeaderNotNeeded(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+	orig, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	status, err := RepairHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(status.NeedsRepair(), Equals, false)
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(data, orig), Equals, true)
+}
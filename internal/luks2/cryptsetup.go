@@ -21,7 +21,7 @@ package luks2
 
 import (
 	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -40,8 +40,9 @@ const (
 	AnySlot = -1
 )
 
-var (
-	keySize = 64
+const (
+	defaultCipher  = "aes-xts-plain64"
+	defaultKeySize = 64
 )
 
 // cryptsetupCmd is a helper for running the cryptsetup command. If stdin is supplied, data read
@@ -78,6 +79,9 @@ func cryptsetupCmd(stdin io.Reader, callback func(cmd *exec.Cmd) error, args ...
 
 // KDFOptions specifies parameters for the Argon2 KDF.
 type KDFOptions struct {
+	// Type specifies the Argon2 variant. If it is empty, argon2i is used.
+	Type KDFType
+
 	// TargetDuration specifies the target time for benchmarking of the
 	// time and memory cost parameters. If it is zero then the cryptsetup
 	// default is used. If ForceIterations is not zero then this is ignored.
@@ -102,8 +106,12 @@ type KDFOptions struct {
 }
 
 func (options *KDFOptions) appendArguments(args []string) []string {
-	// use argon2i as the KDF
-	args = append(args, "--pbkdf", "argon2i")
+	kdfType := options.Type
+	if kdfType == "" {
+		// use argon2i as the KDF by default
+		kdfType = KDFTypeArgon2i
+	}
+	args = append(args, "--pbkdf", string(kdfType))
 
 	switch {
 	case options.ForceIterations != 0:
@@ -143,14 +151,53 @@ type FormatOptions struct {
 	// KDFOptions describes the KDF options for the initial
 	// key slot.
 	KDFOptions KDFOptions
+
+	// Cipher is the cipher used to encrypt data, in dm-crypt notation.
+	// Set to an empty string to use the default, which is
+	// aes-xts-plain64.
+	Cipher string
+
+	// KeySize is the size of the volume key in bytes, excluding any
+	// key used for data integrity protection. Set to zero to use the
+	// default, which is 64 bytes (AES-256 in XTS mode).
+	KeySize int
+
+	// SectorSize is the encryption sector size in bytes. Set to zero
+	// to use the cryptsetup default. Must be a power of 2 between
+	// 512 and 4096 bytes.
+	SectorSize int
+
+	// Integrity enables authenticated encryption with dm-integrity,
+	// using the specified integrity algorithm in cryptsetup notation
+	// (eg, "aead" for AEAD ciphers such as aes-gcm-random, or
+	// "hmac-sha256"). Set to an empty string to disable data
+	// integrity protection. Note that enabling this results in the
+	// entire device being wiped during formatting.
+	Integrity string
+
+	// DetachedHeaderPath is the path of a file or block device in which
+	// the LUKS2 header should be stored. If this is set, the header is
+	// not stored on the device being formatted, which will then only
+	// contain encrypted data starting at offset 0. If the file does not
+	// exist, it will be created.
+	DetachedHeaderPath string
 }
 
 // Format will initialize a LUKS2 container with the specified options and set the primary key to the
 // supplied key. The label for the new container will be set to the supplied label. This can only be
 // called on a device that is not mapped.
 //
-// The container will be configured to encrypt data with AES-256 and XTS block cipher mode. The
-// KDF for the primary keyslot will be configured to use argon2i with the supplied benchmark time.
+// By default, the container will be configured to encrypt data with AES-256 and XTS block cipher
+// mode. This can be customized with the Cipher, KeySize, SectorSize and Integrity fields of opts.
+// The KDF for the primary keyslot will be configured to use argon2i with the supplied benchmark time.
+//
+// If the DetachedHeaderPath field of opts is set, the header is written to the specified path
+// rather than to devicePath. The returned container can only be used with the detached header,
+// which should be supplied in place of devicePath to other functions in this package that
+// operate on the header.
+//
+// If the installed cryptsetup doesn't support the features required to honour opts, an
+// *UnsupportedError is returned before cryptsetup is run.
 //
 // WARNING: This function is destructive. Calling this on an existing LUKS2 container will make the
 // data contained inside of it irretrievable.
@@ -160,6 +207,15 @@ func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
 		opts = &defaultOpts
 	}
 
+	cipher := opts.Cipher
+	if cipher == "" {
+		cipher = defaultCipher
+	}
+	keySize := opts.KeySize
+	if keySize == 0 {
+		keySize = defaultKeySize
+	}
+
 	args := []string{
 		// batch processing, no password verification for formatting an existing LUKS container
 		"-q",
@@ -169,8 +225,9 @@ func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
 		"--type", "luks2",
 		// read the key from stdin
 		"--key-file", "-",
-		// use AES-256 with XTS block cipher mode (XTS requires 2 keys)
-		"--cipher", "aes-xts-plain64", "--key-size", strconv.Itoa(keySize * 8),
+		// use the specified cipher, which defaults to AES-256 with XTS block cipher mode
+		// (XTS requires 2 keys)
+		"--cipher", cipher, "--key-size", strconv.Itoa(keySize * 8),
 		// set LUKS2 label
 		"--label", label}
 
@@ -185,11 +242,37 @@ func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
 		// override the default keyslots area size if specified
 		args = append(args, "--luks2-keyslots-size", fmt.Sprintf("%dk", opts.KeyslotsAreaKiBSize))
 	}
+	if opts.SectorSize != 0 {
+		// override the default encryption sector size if specified
+		args = append(args, "--sector-size", strconv.Itoa(opts.SectorSize))
+	}
+	if opts.Integrity != "" {
+		// enable authenticated encryption with dm-integrity
+		args = append(args, "--integrity", opts.Integrity)
+	}
+	if opts.DetachedHeaderPath != "" {
+		// store the header separately from the data
+		args = append(args, "--header", opts.DetachedHeaderPath)
+	}
 
 	args = append(args,
 		// device to format
 		devicePath)
 
+	features := FeatureLUKS2 | FeatureArgon2
+	if opts.MetadataKiBSize != 0 || opts.KeyslotsAreaKiBSize != 0 {
+		features |= FeatureHeaderSizes
+	}
+	if opts.SectorSize > 512 {
+		features |= FeatureSectorSize
+	}
+	if opts.Integrity != "" {
+		features |= FeatureIntegrity
+	}
+	if err := requireFeatures(features); err != nil {
+		return err
+	}
+
 	return cryptsetupCmd(bytes.NewReader(key), nil, args...)
 }
 
@@ -209,11 +292,19 @@ type AddKeyOptions struct {
 //
 // If options is not supplied, the default KDF benchmark time is used and the command will
 // automatically choose an appropriate slot.
+//
+// For a container with a detached header, devicePath should be the path of the header.
+//
+// If the installed cryptsetup doesn't support argon2, an *UnsupportedError is returned.
 func AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions) error {
 	if options == nil {
 		options = &AddKeyOptions{Slot: AnySlot}
 	}
 
+	if err := requireFeatures(FeatureLUKS2 | FeatureArgon2); err != nil {
+		return err
+	}
+
 	fifoPath, cleanupFifo, err := mkFifo()
 	if err != nil {
 		return xerrors.Errorf("cannot create FIFO for passing existing key to cryptsetup: %w", err)
@@ -278,30 +369,111 @@ func AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions)
 }
 
 // ImportToken imports the supplied token in to the JSON metadata area of the specified LUKS2 container.
+// The token is assigned the first unused token ID. The keyslots referenced by the token must exist.
+//
+// The header is updated directly without using cryptsetup. This requires an exclusive lock on the
+// container, which is acquired in the same way as libcryptsetup.
 func ImportToken(devicePath string, token *Token) error {
-	tokenJSON, err := json.Marshal(token)
-	if err != nil {
-		return xerrors.Errorf("cannot serialize token: %w", err)
-	}
+	return updateHeader(devicePath, LockModeBlocking, func(metadata *Metadata) error {
+		for _, slot := range token.Keyslots {
+			if _, ok := metadata.Keyslots[slot]; !ok {
+				return fmt.Errorf("cannot import token: keyslot %d is not in use", slot)
+			}
+		}
+
+		for id := 0; id < maxTokens; id++ {
+			if _, ok := metadata.Tokens[id]; ok {
+				continue
+			}
+			if metadata.Tokens == nil {
+				metadata.Tokens = make(map[int]*Token)
+			}
+			metadata.Tokens[id] = token
+			return nil
+		}
 
-	return cryptsetupCmd(bytes.NewReader(tokenJSON), nil, "token", "import", devicePath)
+		return errors.New("cannot import token: no free token slots")
+	})
 }
 
 // RemoveToken removes the token with the supplied ID from the JSON metadata area of the specified
 // LUKS2 container.
+//
+// The header is updated directly without using cryptsetup. This requires an exclusive lock on the
+// container, which is acquired in the same way as libcryptsetup.
 func RemoveToken(devicePath string, id int) error {
-	return cryptsetupCmd(nil, nil, "token", "remove", "--token-id", strconv.Itoa(id), devicePath)
+	return updateHeader(devicePath, LockModeBlocking, func(metadata *Metadata) error {
+		if _, ok := metadata.Tokens[id]; !ok {
+			return fmt.Errorf("cannot remove token: token %d is not in use", id)
+		}
+		delete(metadata.Tokens, id)
+		return nil
+	})
 }
 
 // KillSlot erases the keyslot with the supplied slot number from the specified LUKS2 container.
 // Note that a valid key for a remaining keyslot must be supplied, in order to prevent the last
 // keyslot from being erased.
+//
+// For a container with a detached header, devicePath should be the path of the header.
 func KillSlot(devicePath string, slot int, key []byte) error {
+	if err := requireFeatures(FeatureLUKS2); err != nil {
+		return err
+	}
 	return cryptsetupCmd(bytes.NewReader(key), nil, "luksKillSlot", "--type", "luks2", "--key-file", "-", devicePath, strconv.Itoa(slot))
 }
 
+// ConvertKey changes the KDF parameters of the keyslot with the supplied slot number on the
+// specified LUKS2 container, using cryptsetup luksConvertKey. The key for the keyslot must be
+// supplied. The keyslot retains its number and continues to protect the same volume key.
+//
+// If options is not supplied, the keyslot is converted to use argon2i with the default KDF
+// benchmark time.
+//
+// For a container with a detached header, devicePath should be the path of the header.
+//
+// If the installed cryptsetup doesn't support argon2, an *UnsupportedError is returned.
+func ConvertKey(devicePath string, slot int, key []byte, options *KDFOptions) error {
+	if options == nil {
+		options = &KDFOptions{}
+	}
+
+	if err := requireFeatures(FeatureLUKS2 | FeatureArgon2); err != nil {
+		return err
+	}
+
+	args := []string{
+		// change the KDF parameters of a keyslot
+		"luksConvertKey",
+		// LUKS2 only
+		"--type", "luks2",
+		// read the key from stdin
+		"--key-file", "-",
+		// the keyslot to convert
+		"--key-slot", strconv.Itoa(slot)}
+
+	// apply KDF options
+	args = options.appendArguments(args)
+
+	args = append(args,
+		// container to convert the keyslot on
+		devicePath)
+
+	return cryptsetupCmd(bytes.NewReader(key), nil, args...)
+}
+
 // SetSlotPriority sets the priority of the keyslot with the supplied slot number on
 // the specified LUKS2 container.
+//
+// The header is updated directly without using cryptsetup. This requires an exclusive lock on the
+// container, which is acquired in the same way as libcryptsetup.
 func SetSlotPriority(devicePath string, slot int, priority SlotPriority) error {
-	return cryptsetupCmd(nil, nil, "config", "--priority", priority.String(), "--key-slot", strconv.Itoa(slot), devicePath)
+	return updateHeader(devicePath, LockModeBlocking, func(metadata *Metadata) error {
+		keyslot, ok := metadata.Keyslots[slot]
+		if !ok {
+			return fmt.Errorf("cannot set keyslot priority: keyslot %d is not in use", slot)
+		}
+		keyslot.Priority = priority
+		return nil
+	})
 }
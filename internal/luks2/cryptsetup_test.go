@@ -22,9 +22,12 @@ package luks2_test
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	snapd_testutil "github.com/snapcore/snapd/testutil"
@@ -60,12 +63,24 @@ func (s *cryptsetupSuite) checkLUKS2Passphrase(c *C, path string, key []byte) {
 	c.Check(cmd.Run(), IsNil)
 }
 
+// checkHeaderWithCryptsetup checks that cryptsetup considers the header of the
+// container at the specified path to be valid, which ensures that headers written
+// natively by this package can be consumed by cryptsetup.
+func (s *cryptsetupSuite) checkHeaderWithCryptsetup(c *C, path string) {
+	c.Check(exec.Command("cryptsetup", "isLuks", "--type", "luks2", path).Run(), IsNil)
+	out, err := exec.Command("cryptsetup", "luksDump", path).CombinedOutput()
+	c.Check(err, IsNil, Commentf("%s", out))
+}
+
 var _ = Suite(&cryptsetupSuite{})
 
 type testFormatData struct {
 	label   string
 	key     []byte
 	options *FormatOptions
+
+	integrityType    string // The expected integrity type in dm-crypt notation
+	integrityKeySize int    // The expected size of the integrity key
 }
 
 func (s *cryptsetupSuite) testFormat(c *C, data *testFormatData) {
@@ -83,10 +98,23 @@ func (s *cryptsetupSuite) testFormat(c *C, data *testFormatData) {
 
 	c.Check(info.Label, Equals, data.label)
 
+	expectedCipher := "aes-xts-plain64"
+	if options.Cipher != "" {
+		expectedCipher = options.Cipher
+	}
+	expectedKeySize := 64
+	if options.KeySize > 0 {
+		expectedKeySize = options.KeySize
+	}
+	expectedSectorSize := 512
+	if options.SectorSize > 0 {
+		expectedSectorSize = options.SectorSize
+	}
+
 	c.Check(info.Metadata.Keyslots, HasLen, 1)
 	keyslot, ok := info.Metadata.Keyslots[0]
 	c.Assert(ok, Equals, true)
-	c.Check(keyslot.KeySize, Equals, 64)
+	c.Check(keyslot.KeySize, Equals, expectedKeySize+data.integrityKeySize)
 	c.Check(keyslot.Priority, Equals, SlotPriorityNormal)
 	c.Assert(keyslot.KDF, NotNil)
 	c.Check(keyslot.KDF.Type, Equals, KDFTypeArgon2i)
@@ -94,7 +122,14 @@ func (s *cryptsetupSuite) testFormat(c *C, data *testFormatData) {
 	c.Check(info.Metadata.Segments, HasLen, 1)
 	segment, ok := info.Metadata.Segments[0]
 	c.Assert(ok, Equals, true)
-	c.Check(segment.Encryption, Equals, "aes-xts-plain64")
+	c.Check(segment.Encryption, Equals, expectedCipher)
+	c.Check(segment.SectorSize, Equals, expectedSectorSize)
+	if data.integrityType == "" {
+		c.Check(segment.Integrity, IsNil)
+	} else {
+		c.Assert(segment.Integrity, NotNil)
+		c.Check(segment.Integrity.Type, Equals, data.integrityType)
+	}
 
 	c.Check(info.Metadata.Tokens, HasLen, 0)
 
@@ -210,6 +245,104 @@ func (s *cryptsetupSuite) TestFormatWithCustomKeyslotsAreaSize(c *C) {
 			KeyslotsAreaKiBSize: 2 * 1024}})
 }
 
+func (s *cryptsetupSuite) TestFormatWithDetachedHeader(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+	headerPath := filepath.Join(c.MkDir(), "header")
+
+	options := FormatOptions{
+		KDFOptions:         KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		DetachedHeaderPath: headerPath}
+	c.Check(Format(devicePath, "data", key, &options), IsNil)
+
+	info, err := ReadHeader(headerPath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Label, Equals, "data")
+	c.Check(info.Metadata.Keyslots, HasLen, 1)
+	c.Assert(info.Metadata.Segments, HasLen, 1)
+	c.Check(info.Metadata.Segments[0].Offset, Equals, uint64(0))
+
+	// The data device shouldn't contain a header.
+	_, err = ReadHeader(devicePath, LockModeBlocking)
+	c.Check(err, ErrorMatches, "no valid header found, error from decoding primary header: invalid magic")
+
+	luks2test.CheckLUKS2Passphrase(c, headerPath, key)
+}
+
+func (s *cryptsetupSuite) TestAddKeyWithDetachedHeader(c *C) {
+	primaryKey := make([]byte, 32)
+	rand.Read(primaryKey)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+	headerPath := filepath.Join(c.MkDir(), "header")
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", primaryKey, &FormatOptions{KDFOptions: kdfOptions, DetachedHeaderPath: headerPath}), IsNil)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	c.Check(AddKey(headerPath, primaryKey, key, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	info, err := ReadHeader(headerPath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Keyslots, HasLen, 2)
+
+	luks2test.CheckLUKS2Passphrase(c, headerPath, key)
+}
+
+func (s *cryptsetupSuite) TestFormatWithCustomCipher(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.testFormat(c, &testFormatData{
+		label: "test",
+		key:   key,
+		options: &FormatOptions{
+			KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+			Cipher:     "aes-cbc-essiv:sha256",
+			KeySize:    32}})
+}
+
+func (s *cryptsetupSuite) TestFormatWithCustomSectorSize(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.testFormat(c, &testFormatData{
+		label: "test",
+		key:   key,
+		options: &FormatOptions{
+			KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+			SectorSize: 4096}})
+}
+
+func (s *cryptsetupSuite) TestFormatWithAEADIntegrity(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.testFormat(c, &testFormatData{
+		label: "test",
+		key:   key,
+		options: &FormatOptions{
+			KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+			Cipher:     "aes-gcm-random",
+			KeySize:    32,
+			Integrity:  "aead"},
+		integrityType: "aead"})
+}
+
+func (s *cryptsetupSuite) TestFormatWithHMACIntegrity(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.testFormat(c, &testFormatData{
+		label: "test",
+		key:   key,
+		options: &FormatOptions{
+			KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+			Cipher:     "aes-xts-random",
+			Integrity:  "hmac-sha256"},
+		integrityType:    "hmac(sha256)",
+		integrityKeySize: 32})
+}
+
 type testAddKeyData struct {
 	key     []byte
 	options *AddKeyOptions
@@ -386,6 +519,23 @@ func (s *cryptsetupSuite) testImportToken(c *C, data *testImportTokenData) {
 	c.Check(token.Type, Equals, data.token.Type)
 	c.Check(token.Keyslots, DeepEquals, data.token.Keyslots)
 	c.Check(token.Params, DeepEquals, data.expectedParams)
+
+	s.checkHeaderWithCryptsetup(c, devicePath)
+
+	// Check that cryptsetup decodes the same token.
+	out, err := exec.Command("cryptsetup", "token", "export", "--token-id", "0", devicePath).Output()
+	c.Assert(err, IsNil)
+	var exported map[string]interface{}
+	c.Assert(json.Unmarshal(out, &exported), IsNil)
+	c.Check(exported["type"], Equals, data.token.Type)
+	var keyslots []interface{}
+	for _, slot := range data.token.Keyslots {
+		keyslots = append(keyslots, strconv.Itoa(slot))
+	}
+	c.Check(exported["keyslots"], DeepEquals, keyslots)
+	for k, v := range data.expectedParams {
+		c.Check(exported[k], DeepEquals, v)
+	}
 }
 
 func (s *cryptsetupSuite) TestImportToken1(c *C) {
@@ -458,6 +608,8 @@ func (s *cryptsetupSuite) testRemoveToken(c *C, tokenId int) {
 	c.Check(info.Metadata.Tokens, HasLen, 1)
 	_, ok = info.Metadata.Tokens[tokenId]
 	c.Check(ok, Equals, false)
+
+	s.checkHeaderWithCryptsetup(c, devicePath)
 }
 
 func (s *cryptsetupSuite) TestRemoveToken1(c *C) {
@@ -475,7 +627,7 @@ func (s *cryptsetupSuite) TestRemoveNonExistantToken(c *C) {
 	c.Assert(Format(devicePath, "", make([]byte, 32), &options), IsNil)
 	c.Assert(ImportToken(devicePath, &Token{Type: "secboot-foo", Keyslots: []int{0}}), IsNil)
 
-	c.Check(RemoveToken(devicePath, 10), ErrorMatches, "cryptsetup failed with: Token 10 is not in use.")
+	c.Check(RemoveToken(devicePath, 10), ErrorMatches, "cannot remove token: token 10 is not in use")
 
 	info, err := ReadHeader(devicePath, LockModeBlocking)
 	c.Assert(err, IsNil)
@@ -575,6 +727,90 @@ func (s *cryptsetupSuite) TestKillNonExistantSlot(c *C) {
 	luks2test.CheckLUKS2Passphrase(c, devicePath, key)
 }
 
+type testConvertKeyData struct {
+	slotId  int
+	options *KDFOptions
+	kdfType KDFType
+	memory  int
+	time    int
+}
+
+func (s *cryptsetupSuite) testConvertKey(c *C, data *testConvertKeyData) {
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	keys := [][]byte{key1, key2}
+	c.Check(ConvertKey(devicePath, data.slotId, keys[data.slotId], data.options), IsNil)
+
+	info, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Keyslots, HasLen, 2)
+	keyslot, ok := info.Metadata.Keyslots[data.slotId]
+	c.Assert(ok, Equals, true)
+	c.Check(keyslot.KDF.Type, Equals, data.kdfType)
+	if data.memory != 0 {
+		c.Check(keyslot.KDF.Memory, Equals, data.memory)
+	}
+	if data.time != 0 {
+		c.Check(keyslot.KDF.Time, Equals, data.time)
+	}
+
+	for _, key := range keys {
+		luks2test.CheckLUKS2Passphrase(c, devicePath, key)
+	}
+}
+
+func (s *cryptsetupSuite) TestConvertKey1(c *C) {
+	s.testConvertKey(c, &testConvertKeyData{
+		slotId:  0,
+		options: &KDFOptions{Type: KDFTypeArgon2id, MemoryKiB: 64 * 1024, ForceIterations: 4},
+		kdfType: KDFTypeArgon2id,
+		memory:  64 * 1024,
+		time:    4})
+}
+
+func (s *cryptsetupSuite) TestConvertKey2(c *C) {
+	s.testConvertKey(c, &testConvertKeyData{
+		slotId:  1,
+		options: &KDFOptions{Type: KDFTypeArgon2id, MemoryKiB: 64 * 1024, ForceIterations: 4},
+		kdfType: KDFTypeArgon2id,
+		memory:  64 * 1024,
+		time:    4})
+}
+
+func (s *cryptsetupSuite) TestConvertKeyWithBenchmark(c *C) {
+	s.testConvertKey(c, &testConvertKeyData{
+		slotId:  1,
+		options: &KDFOptions{TargetDuration: 100 * time.Millisecond},
+		kdfType: KDFTypeArgon2i})
+}
+
+func (s *cryptsetupSuite) TestConvertKeyWithWrongKey(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+	options := FormatOptions{KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}}
+	c.Assert(Format(devicePath, "", key, &options), IsNil)
+
+	c.Check(ConvertKey(devicePath, 0, make([]byte, 32), &KDFOptions{Type: KDFTypeArgon2id, MemoryKiB: 32 * 1024, ForceIterations: 4}),
+		ErrorMatches, "cryptsetup failed with: No key available with this passphrase.")
+
+	info, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Keyslots[0].KDF.Type, Equals, KDFTypeArgon2i)
+
+	luks2test.CheckLUKS2Passphrase(c, devicePath, key)
+}
+
 type testSetSlotPriorityData struct {
 	slotId   int
 	priority SlotPriority
@@ -600,6 +836,11 @@ func (s *cryptsetupSuite) testSetSlotPriority(c *C, data *testSetSlotPriorityDat
 	keyslot, ok = info.Metadata.Keyslots[data.slotId]
 	c.Assert(ok, Equals, true)
 	c.Check(keyslot.Priority, Equals, data.priority)
+
+	s.checkHeaderWithCryptsetup(c, devicePath)
+	if data.priority != SlotPriorityIgnore {
+		luks2test.CheckLUKS2Passphrase(c, devicePath, make([]byte, 32))
+	}
 }
 
 func (s *cryptsetupSuite) TestSetSlotPriority1(c *C) {
@@ -24,10 +24,13 @@ import (
 	"os"
 
 	"golang.org/x/sys/unix"
+
+	"github.com/snapcore/secboot/internal/dm"
 )
 
 var (
-	AcquireSharedLock = acquireSharedLock
+	AcquireSharedLock   = acquireSharedLock
+	ParseCryptsetupHelp = parseCryptsetupHelp
 )
 
 func MockDataDeviceInfo(stMock *unix.Stat_t) (restore func()) {
@@ -65,6 +68,16 @@ func MockDataDeviceInfo(stMock *unix.Stat_t) (restore func()) {
 	}
 }
 
+func MockKernelRelease(release string) (restore func()) {
+	origKernelRelease := kernelRelease
+	kernelRelease = func() (string, error) {
+		return release, nil
+	}
+	return func() {
+		kernelRelease = origKernelRelease
+	}
+}
+
 func MockSystemdCryptsetupPath(path string) (restore func()) {
 	origSystemdCryptsetupPath := systemdCryptsetupPath
 	systemdCryptsetupPath = path
@@ -80,3 +93,76 @@ func MockStderr(w io.Writer) (restore func()) {
 		stderr = origStderr
 	}
 }
+
+var (
+	AcquireExclusiveLock = acquireExclusiveLock
+	UpdateHeader         = updateHeader
+)
+
+// HeaderSeqIds returns the sequence IDs of the primary and secondary headers of
+// the LUKS2 container at the specified path. Both headers must be valid.
+func HeaderSeqIds(path string) (primary, secondary uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	p, s := decodeHeaders(f)
+	if p.err != nil {
+		return 0, 0, p.err
+	}
+	if s.err != nil {
+		return 0, 0, s.err
+	}
+	return p.hdr.SeqId, s.hdr.SeqId, nil
+}
+
+func MockDMCreateDevice(fn func(string, string, bool, []dm.Target) error) (restore func()) {
+	origCreateDevice := dmCreateDevice
+	dmCreateDevice = fn
+	return func() {
+		dmCreateDevice = origCreateDevice
+	}
+}
+
+func MockDMRemoveDevice(fn func(string) error) (restore func()) {
+	origRemoveDevice := dmRemoveDevice
+	dmRemoveDevice = fn
+	return func() {
+		dmRemoveDevice = origRemoveDevice
+	}
+}
+
+// UnlockVolumeKey recovers the volume key for the first segment of the LUKS2
+// container at the specified path.
+func UnlockVolumeKey(path string, key []byte) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	primary, secondary := decodeHeaders(f)
+	hdr, err := selectHeader(primary, secondary)
+	if err != nil {
+		return nil, err
+	}
+	return unlockVolumeKey(f, hdr.metadata, 0, key)
+}
+
+// UnlockLUKS1VolumeKey recovers the volume key of the LUKS1 container at the
+// specified path using the LUKS2 representation of its header.
+func UnlockLUKS1VolumeKey(path string, key []byte) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hdr, err := decodeLUKS1Header(f)
+	if err != nil {
+		return nil, err
+	}
+	return unlockVolumeKey(f, hdr.metadata(), 0, key)
+}
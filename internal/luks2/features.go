@@ -0,0 +1,324 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// Feature corresponds to a feature of cryptsetup that is used by this package.
+type Feature uint
+
+const (
+	// FeatureLUKS2 indicates that cryptsetup supports the LUKS2 format.
+	// This is required by every operation in this package that runs
+	// cryptsetup.
+	FeatureLUKS2 Feature = 1 << iota
+
+	// FeatureArgon2 indicates that cryptsetup supports the argon2i and
+	// argon2id KDFs.
+	FeatureArgon2
+
+	// FeatureHeaderSizes indicates that cryptsetup supports the
+	// --luks2-metadata-size and --luks2-keyslots-size options.
+	FeatureHeaderSizes
+
+	// FeatureReencrypt indicates that cryptsetup supports the LUKS2
+	// "reencrypt" command.
+	FeatureReencrypt
+
+	// FeatureSectorSize indicates that cryptsetup supports the
+	// --sector-size option and that the running kernel supports
+	// encryption sector sizes larger than 512 bytes.
+	FeatureSectorSize
+
+	// FeatureIntegrity indicates that cryptsetup supports the
+	// --integrity option and that the running kernel supports
+	// authenticated encryption with dm-integrity.
+	FeatureIntegrity
+)
+
+var featureNames = []struct {
+	feature Feature
+	name    string
+}{
+	{FeatureLUKS2, "LUKS2"},
+	{FeatureArgon2, "argon2 KDF"},
+	{FeatureHeaderSizes, "LUKS2 header size options"},
+	{FeatureReencrypt, "LUKS2 reencryption"},
+	{FeatureSectorSize, "encryption sector size"},
+	{FeatureIntegrity, "dm-integrity"},
+}
+
+func (f Feature) String() string {
+	var names []string
+	for _, n := range featureNames {
+		if f&n.feature == 0 {
+			continue
+		}
+		names = append(names, n.name)
+		f &^= n.feature
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint(f)))
+	}
+	return strings.Join(names, ", ")
+}
+
+// Version corresponds to a cryptsetup version.
+type Version struct {
+	Major, Minor, Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Less indicates whether v is an earlier version than other.
+func (v Version) Less(other Version) bool {
+	switch {
+	case v.Major != other.Major:
+		return v.Major < other.Major
+	case v.Minor != other.Minor:
+		return v.Minor < other.Minor
+	default:
+		return v.Patch < other.Patch
+	}
+}
+
+// featureVersions describes the first cryptsetup version that supports each feature.
+var featureVersions = []struct {
+	feature Feature
+	version Version
+}{
+	{FeatureLUKS2, Version{2, 0, 0}},
+	{FeatureArgon2, Version{2, 0, 0}},
+	{FeatureHeaderSizes, Version{2, 1, 0}},
+	{FeatureReencrypt, Version{2, 2, 0}},
+	{FeatureSectorSize, Version{2, 0, 0}},
+	{FeatureIntegrity, Version{2, 0, 0}},
+}
+
+// kernelFeatureVersions describes the first kernel version that supports each
+// feature that also depends on the running kernel.
+var kernelFeatureVersions = []struct {
+	feature Feature
+	version Version
+}{
+	{FeatureSectorSize, Version{4, 12, 0}},
+	{FeatureIntegrity, Version{4, 12, 0}},
+}
+
+// kernelFeatures is the set of features that also depend on the running kernel.
+const kernelFeatures = FeatureSectorSize | FeatureIntegrity
+
+// CryptsetupInfo describes the installed cryptsetup.
+type CryptsetupInfo struct {
+	Path          string  // The path of the cryptsetup binary
+	Version       Version // The version of cryptsetup
+	KernelVersion Version // The version of the running kernel
+	Features      Feature // The features supported by cryptsetup and the running kernel
+}
+
+// Supports indicates whether the installed cryptsetup supports all of the
+// specified features.
+func (i *CryptsetupInfo) Supports(features Feature) bool {
+	return i.Features&features == features
+}
+
+// UnsupportedError is returned from functions in this package when an operation
+// requires features that are not supported by the installed cryptsetup. It is
+// returned before cryptsetup is run.
+type UnsupportedError struct {
+	Features      Feature // The unsupported features
+	Version       Version // The version of the installed cryptsetup
+	KernelVersion Version // The version of the running kernel
+}
+
+func (e *UnsupportedError) Error() string {
+	if e.Features&kernelFeatures != 0 {
+		return fmt.Sprintf("%s unsupported by installed cryptsetup (version %s) or running kernel (version %s)",
+			e.Features, e.Version, e.KernelVersion)
+	}
+	return fmt.Sprintf("%s unsupported by installed cryptsetup (version %s)", e.Features, e.Version)
+}
+
+var (
+	versionRE       = regexp.MustCompile(`^cryptsetup ([0-9]+)\.([0-9]+)\.([0-9]+)`)
+	kernelVersionRE = regexp.MustCompile(`^([0-9]+)\.([0-9]+)(?:\.([0-9]+))?`)
+	defaultPBKDFStr = "Default PBKDF for LUKS2:"
+
+	cryptsetupInfoMu    sync.Mutex
+	cryptsetupInfoCache *CryptsetupInfo
+	cryptsetupModTime   time.Time
+)
+
+// parseCryptsetupHelp obtains the version and features of cryptsetup from the
+// output of "cryptsetup --help". The first line contains the version. Builds
+// without argon2 support (eg, FIPS builds) report a different default PBKDF for
+// LUKS2.
+func parseCryptsetupHelp(out []byte) (*CryptsetupInfo, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	if !scanner.Scan() {
+		return nil, errors.New("no output")
+	}
+
+	m := versionRE.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+	if m == nil {
+		return nil, fmt.Errorf("cannot parse version from %q", scanner.Text())
+	}
+
+	info := new(CryptsetupInfo)
+	info.Version.Major, _ = strconv.Atoi(m[1])
+	info.Version.Minor, _ = strconv.Atoi(m[2])
+	info.Version.Patch, _ = strconv.Atoi(m[3])
+
+	for _, f := range featureVersions {
+		if info.Version.Less(f.version) {
+			continue
+		}
+		info.Features |= f.feature
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, defaultPBKDFStr) {
+			continue
+		}
+		if !strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(line, defaultPBKDFStr)), "argon2") {
+			info.Features &^= FeatureArgon2
+		}
+		break
+	}
+
+	return info, nil
+}
+
+var kernelRelease = func() (string, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", err
+	}
+	release := uts.Release[:]
+	if i := bytes.IndexByte(release, 0); i >= 0 {
+		release = release[:i]
+	}
+	return string(release), nil
+}
+
+// parseKernelRelease obtains the version of the kernel from the supplied
+// release string (eg, "5.4.0-81-generic").
+func parseKernelRelease(release string) (Version, error) {
+	m := kernelVersionRE.FindStringSubmatch(release)
+	if m == nil {
+		return Version{}, fmt.Errorf("cannot parse version from %q", release)
+	}
+
+	var version Version
+	version.Major, _ = strconv.Atoi(m[1])
+	version.Minor, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		version.Patch, _ = strconv.Atoi(m[3])
+	}
+	return version, nil
+}
+
+// DetectCryptsetup returns the version and features of the cryptsetup binary
+// that would be run by this package. Features that also depend on the running
+// kernel are only reported if the kernel supports them. The result is cached,
+// and cryptsetup is only run again if the binary found in PATH changes.
+func DetectCryptsetup() (*CryptsetupInfo, error) {
+	path, err := exec.LookPath("cryptsetup")
+	if err != nil {
+		return nil, xerrors.Errorf("cannot find cryptsetup: %w", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot stat cryptsetup: %w", err)
+	}
+
+	cryptsetupInfoMu.Lock()
+	defer cryptsetupInfoMu.Unlock()
+
+	if cryptsetupInfoCache != nil && cryptsetupInfoCache.Path == path && cryptsetupModTime.Equal(fi.ModTime()) {
+		info := *cryptsetupInfoCache
+		return &info, nil
+	}
+
+	cmd := exec.Command(path, "--help")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot run cryptsetup: %v", osutil.OutputErr(out, err))
+	}
+
+	info, err := parseCryptsetupHelp(out)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine cryptsetup version: %w", err)
+	}
+	info.Path = path
+
+	release, err := kernelRelease()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine kernel release: %w", err)
+	}
+	info.KernelVersion, err = parseKernelRelease(release)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine kernel version: %w", err)
+	}
+	for _, f := range kernelFeatureVersions {
+		if info.KernelVersion.Less(f.version) {
+			info.Features &^= f.feature
+		}
+	}
+
+	cryptsetupInfoCache = info
+	cryptsetupModTime = fi.ModTime()
+
+	result := *info
+	return &result, nil
+}
+
+// requireFeatures returns an *UnsupportedError if the installed cryptsetup
+// doesn't support all of the specified features.
+func requireFeatures(features Feature) error {
+	info, err := DetectCryptsetup()
+	if err != nil {
+		return err
+	}
+	if missing := features &^ info.Features; missing != 0 {
+		return &UnsupportedError{Features: missing, Version: info.Version, KernelVersion: info.KernelVersion}
+	}
+	return nil
+}
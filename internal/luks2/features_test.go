@@ -0,0 +1,240 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"fmt"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+)
+
+type featuresSuite struct {
+	snapd_testutil.BaseTest
+}
+
+var _ = Suite(&featuresSuite{})
+
+func (s *featuresSuite) mockCryptsetup(c *C, help string) *snapd_testutil.MockCmd {
+	cmd := snapd_testutil.MockCommand(c, "cryptsetup", fmt.Sprintf(`
+if [ "$1" = "--help" ]; then
+    cat <<EOF
+%s
+EOF
+fi
+`, help))
+	s.AddCleanup(cmd.Restore)
+	return cmd
+}
+
+const cryptsetupHelp22 = `cryptsetup 2.2.2
+Usage: cryptsetup [OPTION...] <action> <action-specific>
+
+Default compiled-in key and passphrase parameters:
+	Maximum keyfile size: 8192kB, Maximum interactive passphrase length 512 (characters)
+Default PBKDF for LUKS1: pbkdf2, iteration time: 2000 (ms)
+Default PBKDF for LUKS2: argon2i
+	Iteration time: 2000, Memory required: 1048576kB, Parallel threads: 4
+`
+
+type testParseCryptsetupHelpData struct {
+	help     string
+	version  Version
+	features Feature
+}
+
+func (s *featuresSuite) testParseCryptsetupHelp(c *C, data *testParseCryptsetupHelpData) {
+	info, err := ParseCryptsetupHelp([]byte(data.help))
+	c.Assert(err, IsNil)
+	c.Check(info.Version, Equals, data.version)
+	c.Check(info.Features, Equals, data.features)
+}
+
+func (s *featuresSuite) TestParseCryptsetupHelp22(c *C) {
+	s.testParseCryptsetupHelp(c, &testParseCryptsetupHelpData{
+		help:     cryptsetupHelp22,
+		version:  Version{2, 2, 2},
+		features: FeatureLUKS2 | FeatureArgon2 | FeatureHeaderSizes | FeatureReencrypt | FeatureSectorSize | FeatureIntegrity})
+}
+
+func (s *featuresSuite) TestParseCryptsetupHelpWithFlags(c *C) {
+	s.testParseCryptsetupHelp(c, &testParseCryptsetupHelpData{
+		help:     "cryptsetup 2.4.3 flags: UDEV BLKID KEYRING KERNEL_CAPI\nDefault PBKDF for LUKS2: argon2id\n",
+		version:  Version{2, 4, 3},
+		features: FeatureLUKS2 | FeatureArgon2 | FeatureHeaderSizes | FeatureReencrypt | FeatureSectorSize | FeatureIntegrity})
+}
+
+func (s *featuresSuite) TestParseCryptsetupHelp20(c *C) {
+	s.testParseCryptsetupHelp(c, &testParseCryptsetupHelpData{
+		help:     "cryptsetup 2.0.2\nDefault PBKDF for LUKS2: argon2i\n",
+		version:  Version{2, 0, 2},
+		features: FeatureLUKS2 | FeatureArgon2 | FeatureSectorSize | FeatureIntegrity})
+}
+
+func (s *featuresSuite) TestParseCryptsetupHelp21(c *C) {
+	s.testParseCryptsetupHelp(c, &testParseCryptsetupHelpData{
+		help:     "cryptsetup 2.1.0\n",
+		version:  Version{2, 1, 0},
+		features: FeatureLUKS2 | FeatureArgon2 | FeatureHeaderSizes | FeatureSectorSize | FeatureIntegrity})
+}
+
+func (s *featuresSuite) TestParseCryptsetupHelpLUKS1Only(c *C) {
+	s.testParseCryptsetupHelp(c, &testParseCryptsetupHelpData{
+		help:    "cryptsetup 1.7.3\n",
+		version: Version{1, 7, 3}})
+}
+
+func (s *featuresSuite) TestParseCryptsetupHelpNoArgon2(c *C) {
+	s.testParseCryptsetupHelp(c, &testParseCryptsetupHelpData{
+		help:     "cryptsetup 2.3.3\nDefault PBKDF for LUKS2: pbkdf2\n",
+		version:  Version{2, 3, 3},
+		features: FeatureLUKS2 | FeatureHeaderSizes | FeatureReencrypt | FeatureSectorSize | FeatureIntegrity})
+}
+
+func (s *featuresSuite) TestParseCryptsetupHelpInvalid(c *C) {
+	_, err := ParseCryptsetupHelp([]byte("Usage: cryptsetup [OPTION...]\n"))
+	c.Check(err, ErrorMatches, `cannot parse version from "Usage: cryptsetup \[OPTION...\]"`)
+}
+
+func (s *featuresSuite) TestVersionLess(c *C) {
+	c.Check(Version{2, 1, 0}.Less(Version{2, 2, 0}), Equals, true)
+	c.Check(Version{2, 2, 0}.Less(Version{2, 1, 9}), Equals, false)
+	c.Check(Version{1, 9, 9}.Less(Version{2, 0, 0}), Equals, true)
+	c.Check(Version{2, 0, 1}.Less(Version{2, 0, 0}), Equals, false)
+	c.Check(Version{2, 0, 0}.Less(Version{2, 0, 0}), Equals, false)
+}
+
+func (s *featuresSuite) TestDetectCryptsetup(c *C) {
+	s.AddCleanup(MockKernelRelease("5.4.0-81-generic"))
+	cmd := s.mockCryptsetup(c, cryptsetupHelp22)
+
+	info, err := DetectCryptsetup()
+	c.Assert(err, IsNil)
+	c.Check(info.Path, Equals, cmd.Exe())
+	c.Check(info.Version, Equals, Version{2, 2, 2})
+	c.Check(info.KernelVersion, Equals, Version{5, 4, 0})
+	c.Check(info.Supports(FeatureLUKS2|FeatureReencrypt|FeatureSectorSize|FeatureIntegrity), Equals, true)
+
+	// The result should be cached.
+	_, err = DetectCryptsetup()
+	c.Check(err, IsNil)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *featuresSuite) TestDetectCryptsetupChanged(c *C) {
+	s.mockCryptsetup(c, cryptsetupHelp22)
+	_, err := DetectCryptsetup()
+	c.Assert(err, IsNil)
+
+	// A different binary should be probed again.
+	s.mockCryptsetup(c, "cryptsetup 2.0.6\n")
+	info, err := DetectCryptsetup()
+	c.Assert(err, IsNil)
+	c.Check(info.Version, Equals, Version{2, 0, 6})
+	c.Check(info.Supports(FeatureReencrypt), Equals, false)
+}
+
+func (s *featuresSuite) TestDetectCryptsetupOldKernel(c *C) {
+	s.AddCleanup(MockKernelRelease("4.4.0-210-generic"))
+	s.mockCryptsetup(c, cryptsetupHelp22)
+
+	info, err := DetectCryptsetup()
+	c.Assert(err, IsNil)
+	c.Check(info.KernelVersion, Equals, Version{4, 4, 0})
+	c.Check(info.Features, Equals, FeatureLUKS2|FeatureArgon2|FeatureHeaderSizes|FeatureReencrypt)
+}
+
+func (s *featuresSuite) TestDetectCryptsetupInvalidKernelRelease(c *C) {
+	s.AddCleanup(MockKernelRelease("foo"))
+	s.mockCryptsetup(c, cryptsetupHelp22)
+
+	_, err := DetectCryptsetup()
+	c.Check(err, ErrorMatches, `cannot determine kernel version: cannot parse version from "foo"`)
+}
+
+func (s *featuresSuite) TestUnsupportedErrorString(c *C) {
+	err := &UnsupportedError{Features: FeatureHeaderSizes | FeatureReencrypt, Version: Version{2, 0, 6}}
+	c.Check(err, ErrorMatches, `LUKS2 header size options, LUKS2 reencryption unsupported by installed cryptsetup \(version 2.0.6\)`)
+}
+
+func (s *featuresSuite) TestFormatHeaderSizesUnsupported(c *C) {
+	cmd := s.mockCryptsetup(c, "cryptsetup 2.0.6\nDefault PBKDF for LUKS2: argon2i\n")
+
+	err := Format("/dev/sda1", "", make([]byte, 32), &FormatOptions{KeyslotsAreaKiBSize: 2 * 1024})
+	c.Assert(err, FitsTypeOf, &UnsupportedError{})
+	c.Check(err.(*UnsupportedError).Features, Equals, FeatureHeaderSizes)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *featuresSuite) TestFormatIntegrityUnsupportedKernel(c *C) {
+	s.AddCleanup(MockKernelRelease("4.4.0-210-generic"))
+	cmd := s.mockCryptsetup(c, cryptsetupHelp22)
+
+	err := Format("/dev/sda1", "", make([]byte, 32), &FormatOptions{Cipher: "aes-xts-random", Integrity: "hmac-sha256"})
+	c.Assert(err, FitsTypeOf, &UnsupportedError{})
+	c.Check(err.(*UnsupportedError).Features, Equals, FeatureIntegrity)
+	c.Check(err, ErrorMatches, `dm-integrity unsupported by installed cryptsetup \(version 2.2.2\) or running kernel \(version 4.4.0\)`)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *featuresSuite) TestFormatSectorSizeUnsupportedKernel(c *C) {
+	s.AddCleanup(MockKernelRelease("4.4.0-210-generic"))
+	cmd := s.mockCryptsetup(c, cryptsetupHelp22)
+
+	err := Format("/dev/sda1", "", make([]byte, 32), &FormatOptions{SectorSize: 4096})
+	c.Assert(err, FitsTypeOf, &UnsupportedError{})
+	c.Check(err.(*UnsupportedError).Features, Equals, FeatureSectorSize)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *featuresSuite) TestAddKeyArgon2Unsupported(c *C) {
+	cmd := s.mockCryptsetup(c, "cryptsetup 2.3.3\nDefault PBKDF for LUKS2: pbkdf2\n")
+
+	err := AddKey("/dev/sda1", make([]byte, 32), make([]byte, 32), nil)
+	c.Check(err, ErrorMatches, `argon2 KDF unsupported by installed cryptsetup \(version 2.3.3\)`)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *featuresSuite) TestKillSlotLUKS2Unsupported(c *C) {
+	cmd := s.mockCryptsetup(c, "cryptsetup 1.7.3\n")
+
+	err := KillSlot("/dev/sda1", 0, make([]byte, 32))
+	c.Check(err, ErrorMatches, `LUKS2 unsupported by installed cryptsetup \(version 1.7.3\)`)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *featuresSuite) TestReencryptUnsupported(c *C) {
+	cmd := s.mockCryptsetup(c, "cryptsetup 2.1.0\n")
+
+	path := decompressImage(c, "testdata/luks2-valid-hdr.img")
+	err := Reencrypt(path, make([]byte, 32), nil)
+	c.Assert(err, FitsTypeOf, &UnsupportedError{})
+	c.Check(err.(*UnsupportedError).Features, Equals, FeatureReencrypt)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *cryptsetupSuite) TestDetectCryptsetup(c *C) {
+	info, err := DetectCryptsetup()
+	c.Assert(err, IsNil)
+	c.Check(info.Supports(FeatureLUKS2), Equals, true)
+}
@@ -0,0 +1,225 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// maxTokens is the maximum number of tokens supported by libcryptsetup
+	// (LUKS2_TOKENS_MAX).
+	maxTokens = 32
+)
+
+var (
+	primaryMagic   = [6]byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+	secondaryMagic = [6]byte{'S', 'K', 'U', 'L', 0xba, 0xbe}
+)
+
+// checkMetadataIsLossless verifies that the decoded metadata for the supplied header
+// can be serialized again without losing any of the information from the original
+// JSON metadata area. This is important because the JSON metadata may contain objects
+// or properties that aren't represented by Metadata, and we must not silently
+// discard these when updating the header. Numbers are compared using their textual
+// representation so that integers which can't be represented exactly by a float64
+// are detected.
+func checkMetadataIsLossless(hdr *decodedHeader) error {
+	var orig interface{}
+	origDec := json.NewDecoder(bytes.NewReader(hdr.jsonData))
+	origDec.UseNumber()
+	if err := origDec.Decode(&orig); err != nil {
+		return xerrors.Errorf("cannot decode original JSON metadata: %w", err)
+	}
+
+	data, err := json.Marshal(hdr.metadata)
+	if err != nil {
+		return xerrors.Errorf("cannot serialize metadata: %w", err)
+	}
+	var encoded interface{}
+	encodedDec := json.NewDecoder(bytes.NewReader(data))
+	encodedDec.UseNumber()
+	if err := encodedDec.Decode(&encoded); err != nil {
+		return xerrors.Errorf("cannot decode serialized metadata: %w", err)
+	}
+
+	if !reflect.DeepEqual(orig, encoded) {
+		return errors.New("JSON metadata contains properties that are not supported by this package")
+	}
+	return nil
+}
+
+// writeHeaderCopy writes a single copy of the header, consisting of the supplied binary
+// header and JSON metadata area, to the offset indicated by the binary header. The checksum
+// is computed and updated before writing. The supplied JSON metadata area must already be
+// padded to the size of the JSON area.
+func writeHeaderCopy(f *os.File, hdr *binaryHdr, jsonData []byte) error {
+	csumHash := hdr.CsumAlg.GetHash()
+	if csumHash == 0 {
+		return errors.New("unsupported checksum alg")
+	}
+
+	hdr.Csum = [64]byte{}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, hdr); err != nil {
+		return xerrors.Errorf("cannot serialize header: %w", err)
+	}
+	buf.Write(jsonData)
+
+	h := csumHash.New()
+	h.Write(buf.Bytes())
+	copy(hdr.Csum[:], h.Sum(nil))
+
+	buf.Reset()
+	if err := binary.Write(buf, binary.BigEndian, hdr); err != nil {
+		return xerrors.Errorf("cannot serialize header: %w", err)
+	}
+	buf.Write(jsonData)
+
+	if _, err := f.WriteAt(buf.Bytes(), int64(hdr.HdrOffset)); err != nil {
+		return err
+	}
+
+	// Make sure that this copy is on disk before we touch the other one.
+	return f.Sync()
+}
+
+// newHeaderCopy returns a binary header for the copy with the specified magic and
+// offset. If the existing copy is valid, it is used as a template. If it is not valid,
+// the supplied fallback (the other, valid copy) is used as a template instead, with a
+// new salt.
+func newHeaderCopy(existing *decodedHeader, fallback *binaryHdr, magic [6]byte, offset uint64) (*binaryHdr, error) {
+	var hdr binaryHdr
+	if existing.err == nil {
+		hdr = *existing.hdr
+	} else {
+		hdr = *fallback
+		if _, err := rand.Read(hdr.Salt[:]); err != nil {
+			return nil, xerrors.Errorf("cannot create salt: %w", err)
+		}
+	}
+
+	hdr.Magic = magic
+	hdr.HdrOffset = offset
+	return &hdr, nil
+}
+
+// writeHeader serializes the supplied metadata and writes it to both copies of the
+// header with the sequence ID incremented. The current header is the one that the
+// supplied metadata was derived from, and primary and secondary are the original
+// decoded copies.
+func writeHeader(f *os.File, current, primary, secondary *decodedHeader, metadata *Metadata) error {
+	hdrSize := current.hdr.HdrSize
+	jsonSize := hdrSize - uint64(binary.Size(current.hdr))
+	if metadata.Config.JSONSize != jsonSize {
+		return fmt.Errorf("inconsistent JSON area size (%d bytes in metadata, %d bytes in binary header)", metadata.Config.JSONSize, jsonSize)
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return xerrors.Errorf("cannot serialize metadata: %w", err)
+	}
+	if uint64(len(data)) >= jsonSize {
+		// The JSON metadata must be NULL terminated.
+		return fmt.Errorf("serialized metadata is too large (%d bytes, JSON area is %d bytes)", len(data), jsonSize)
+	}
+	jsonData := make([]byte, jsonSize)
+	copy(jsonData, data)
+
+	seqId := current.hdr.SeqId + 1
+
+	primaryHdr, err := newHeaderCopy(primary, current.hdr, primaryMagic, 0)
+	if err != nil {
+		return xerrors.Errorf("cannot create primary header: %w", err)
+	}
+	primaryHdr.SeqId = seqId
+
+	secondaryHdr, err := newHeaderCopy(secondary, current.hdr, secondaryMagic, hdrSize)
+	if err != nil {
+		return xerrors.Errorf("cannot create secondary header: %w", err)
+	}
+	secondaryHdr.SeqId = seqId
+
+	// Update the primary header first, the same as libcryptsetup. If this is
+	// interrupted, the secondary header remains valid with the old metadata.
+	if err := writeHeaderCopy(f, primaryHdr, jsonData); err != nil {
+		return xerrors.Errorf("cannot write primary header: %w", err)
+	}
+	if err := writeHeaderCopy(f, secondaryHdr, jsonData); err != nil {
+		return xerrors.Errorf("cannot write secondary header: %w", err)
+	}
+
+	return nil
+}
+
+// updateHeader updates the header of the LUKS2 container at the specified path
+// without using cryptsetup. The path can either be a block device or file containing
+// a LUKS2 volume with an integral header, or a detached header file.
+//
+// The current metadata is decoded according to the same rules as ReadHeader and
+// passed to the supplied callback, which should make the required modifications to it.
+// On success, the updated metadata is written to both the primary and secondary headers
+// with a new sequence ID. The primary header is written first, as libcryptsetup does.
+// Any invalid or obsolete copy of the header is recovered in the process.
+//
+// This function requires an advisory exclusive lock on the LUKS container associated
+// with the specified path, which is acquired according to the supplied lock mode.
+func updateHeader(path string, lockMode LockMode, fn func(metadata *Metadata) error) error {
+	releaseLock, err := acquireExclusiveLock(path, lockMode)
+	if err != nil {
+		return xerrors.Errorf("cannot acquire exclusive lock: %w", err)
+	}
+	defer releaseLock()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	primary, secondary := decodeHeaders(f)
+	current, err := selectHeader(primary, secondary)
+	if err != nil {
+		return err
+	}
+
+	if len(current.metadata.Config.Requirements) > 0 {
+		return fmt.Errorf("cannot update header with mandatory requirements %q", current.metadata.Config.Requirements)
+	}
+	if err := checkMetadataIsLossless(current); err != nil {
+		return xerrors.Errorf("cannot update header: %w", err)
+	}
+
+	if err := fn(current.metadata); err != nil {
+		return err
+	}
+
+	return writeHeader(f, current, primary, secondary, current.metadata)
+}
@@ -0,0 +1,364 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+
+	"golang.org/x/sys/unix"
+
+	. "gopkg.in/check.v1"
+)
+
+var updateHeaderRandomSeed = flag.Int64("luks2-random-seed", 0, "Seed for TestUpdateHeaderRandomSequence (0 picks one from the current time)")
+
+// readJSONMetadata returns the decoded JSON metadata area of the header copy at the
+// specified offset of the LUKS2 container at the specified path.
+func readJSONMetadata(c *C, path string, offset, hdrSize uint64) interface{} {
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	data := make([]byte, hdrSize-4096)
+	_, err = f.ReadAt(data, int64(offset+4096))
+	c.Assert(err, IsNil)
+
+	var v interface{}
+	c.Assert(json.NewDecoder(bytes.NewReader(data)).Decode(&v), IsNil)
+	return v
+}
+
+func (s *metadataSuite) TestAcquireExclusiveLockOnFile(c *C) {
+	path := filepath.Join(c.MkDir(), "disk")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	release, err := AcquireExclusiveLock(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB)
+	c.Check(err, ErrorMatches, "resource temporarily unavailable")
+
+	release()
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB)
+	c.Check(err, IsNil)
+}
+
+func (s *metadataSuite) TestTryAcquireExclusiveLockOnFile(c *C) {
+	path := filepath.Join(c.MkDir(), "disk")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB)
+	c.Assert(err, IsNil)
+
+	_, err = AcquireExclusiveLock(path, LockModeNonBlocking)
+	c.Check(err, ErrorMatches, "cannot obtain lock: resource temporarily unavailable")
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	c.Assert(err, IsNil)
+
+	release, err := AcquireExclusiveLock(path, LockModeNonBlocking)
+	c.Assert(err, IsNil)
+	release()
+}
+
+type testUpdateHeaderRoundTripData struct {
+	path      string
+	hdrSize   uint64
+	hdrOffset uint64 // The offset of the header copy that is expected to be selected
+	seqId     uint64 // The sequence ID of the header copy that is expected to be selected
+}
+
+func (s *metadataSuite) testUpdateHeaderRoundTrip(c *C, data *testUpdateHeaderRoundTripData) {
+	stderr := new(bytes.Buffer)
+	s.AddCleanup(MockStderr(stderr))
+
+	path := s.decompress(c, data.path)
+
+	expectedInfo, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	stderr.Reset()
+
+	expectedJSON := readJSONMetadata(c, path, data.hdrOffset, data.hdrSize)
+
+	c.Check(UpdateHeader(path, LockModeBlocking, func(*Metadata) error { return nil }), IsNil)
+
+	// Both headers should be valid and up-to-date.
+	primarySeqId, secondarySeqId, err := HeaderSeqIds(path)
+	c.Assert(err, IsNil)
+	c.Check(primarySeqId, Equals, data.seqId+1)
+	c.Check(secondarySeqId, Equals, data.seqId+1)
+
+	info, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, expectedInfo)
+	c.Check(stderr.String(), Equals, "")
+
+	c.Check(readJSONMetadata(c, path, 0, data.hdrSize), DeepEquals, expectedJSON)
+	c.Check(readJSONMetadata(c, path, data.hdrSize, data.hdrSize), DeepEquals, expectedJSON)
+}
+
+func (s *metadataSuite) TestUpdateHeaderRoundTrip(c *C) {
+	s.testUpdateHeaderRoundTrip(c, &testUpdateHeaderRoundTripData{
+		path:      "testdata/luks2-valid-hdr.img",
+		hdrSize:   16384,
+		hdrOffset: 0,
+		seqId:     7})
+}
+
+func (s *metadataSuite) TestUpdateHeaderRoundTripCustomMetadataSize(c *C) {
+	s.testUpdateHeaderRoundTrip(c, &testUpdateHeaderRoundTripData{
+		path:      "testdata/luks2-valid-hdr2.img",
+		hdrSize:   65536,
+		hdrOffset: 0,
+		seqId:     6})
+}
+
+func (s *metadataSuite) TestUpdateHeaderRecoversInvalidPrimary(c *C) {
+	s.testUpdateHeaderRoundTrip(c, &testUpdateHeaderRoundTripData{
+		path:      "testdata/luks2-hdr-invalid-checksum0.img",
+		hdrSize:   16384,
+		hdrOffset: 16384,
+		seqId:     7})
+}
+
+func (s *metadataSuite) TestUpdateHeaderRecoversInvalidSecondary(c *C) {
+	s.testUpdateHeaderRoundTrip(c, &testUpdateHeaderRoundTripData{
+		path:      "testdata/luks2-hdr-invalid-checksum1.img",
+		hdrSize:   16384,
+		hdrOffset: 0,
+		seqId:     7})
+}
+
+func (s *metadataSuite) TestUpdateHeaderRecoversObsoletePrimary(c *C) {
+	s.testUpdateHeaderRoundTrip(c, &testUpdateHeaderRoundTripData{
+		path:      "testdata/luks2-hdr-obsolete0.img",
+		hdrSize:   16384,
+		hdrOffset: 16384,
+		seqId:     8})
+}
+
+func (s *metadataSuite) TestUpdateHeaderCallbackError(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	primarySeqId, secondarySeqId, err := HeaderSeqIds(path)
+	c.Assert(err, IsNil)
+
+	c.Check(UpdateHeader(path, LockModeBlocking, func(*Metadata) error { return errors.New("some error") }), ErrorMatches, "some error")
+
+	newPrimarySeqId, newSecondarySeqId, err := HeaderSeqIds(path)
+	c.Assert(err, IsNil)
+	c.Check(newPrimarySeqId, Equals, primarySeqId)
+	c.Check(newSecondarySeqId, Equals, secondarySeqId)
+}
+
+func (s *metadataSuite) TestUpdateHeaderTooLarge(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	c.Check(UpdateHeader(path, LockModeBlocking, func(metadata *Metadata) error {
+		metadata.Tokens[0] = &Token{
+			Type:     "secboot-test",
+			Keyslots: []int{0},
+			Params:   map[string]interface{}{"secboot-a": make([]byte, 16384)}}
+		return nil
+	}), ErrorMatches, "serialized metadata is too large \\([[:digit:]]+ bytes, JSON area is 12288 bytes\\)")
+}
+
+func (s *metadataSuite) TestUpdateHeaderLargeIntegerTokenParam(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	// 2^53 + 1 can't be represented exactly by a float64, so it can't survive
+	// being decoded into Token.Params and serialized again.
+	c.Assert(ImportToken(path, &Token{
+		Type:     "secboot-test",
+		Keyslots: []int{0},
+		Params:   map[string]interface{}{"secboot-a": uint64(9007199254740993)}}), IsNil)
+
+	primarySeqId, secondarySeqId, err := HeaderSeqIds(path)
+	c.Assert(err, IsNil)
+
+	c.Check(UpdateHeader(path, LockModeBlocking, func(*Metadata) error { return nil }), ErrorMatches,
+		"cannot update header: JSON metadata contains properties that are not supported by this package")
+
+	newPrimarySeqId, newSecondarySeqId, err := HeaderSeqIds(path)
+	c.Assert(err, IsNil)
+	c.Check(newPrimarySeqId, Equals, primarySeqId)
+	c.Check(newSecondarySeqId, Equals, secondarySeqId)
+}
+
+func (s *metadataSuite) TestUpdateHeaderLocked(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	c.Assert(unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB), IsNil)
+
+	c.Check(UpdateHeader(path, LockModeNonBlocking, func(*Metadata) error { return nil }),
+		ErrorMatches, "cannot acquire exclusive lock: cannot obtain lock: resource temporarily unavailable")
+}
+
+func (s *metadataSuite) TestSetSlotPriorityNative(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	c.Check(SetSlotPriority(path, 1, SlotPriorityIgnore), IsNil)
+
+	info, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Keyslots[0].Priority, Equals, SlotPriorityHigh)
+	c.Check(info.Metadata.Keyslots[1].Priority, Equals, SlotPriorityIgnore)
+}
+
+func (s *metadataSuite) TestSetSlotPriorityMissingKeyslot(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+	c.Check(SetSlotPriority(path, 5, SlotPriorityHigh), ErrorMatches, "cannot set keyslot priority: keyslot 5 is not in use")
+}
+
+func (s *metadataSuite) TestImportTokenMissingKeyslot(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+	c.Check(ImportToken(path, &Token{Type: "secboot-test", Keyslots: []int{0, 3}}), ErrorMatches, "cannot import token: keyslot 3 is not in use")
+}
+
+func (s *metadataSuite) TestImportTokenNoFreeSlots(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	info, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	for i := len(info.Metadata.Tokens); i < 32; i++ {
+		c.Assert(ImportToken(path, &Token{Type: "secboot-test", Keyslots: []int{0}}), IsNil)
+	}
+	c.Check(ImportToken(path, &Token{Type: "secboot-test", Keyslots: []int{0}}), ErrorMatches, "cannot import token: no free token slots")
+}
+
+func (s *metadataSuite) TestRemoveTokenNative(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	info, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	_, ok := info.Metadata.Tokens[0]
+	c.Assert(ok, Equals, true)
+
+	c.Check(RemoveToken(path, 0), IsNil)
+
+	info, err = ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	_, ok = info.Metadata.Tokens[0]
+	c.Check(ok, Equals, false)
+
+	c.Check(RemoveToken(path, 0), ErrorMatches, "cannot remove token: token 0 is not in use")
+}
+
+func (s *metadataSuite) TestUpdateHeaderRandomSequence(c *C) {
+	// Apply a random sequence of header modifications, checking after each one
+	// that the header can be decoded with the expected metadata and that both
+	// copies are valid and in sync. The seed is logged so that failures can be
+	// reproduced with -luks2-random-seed.
+	seed := *updateHeaderRandomSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c.Logf("random seed: %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	stderr := new(bytes.Buffer)
+	s.AddCleanup(MockStderr(stderr))
+
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	expected, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	seqId, _, err := HeaderSeqIds(path)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 50; i++ {
+		switch rng.Intn(3) {
+		case 0:
+			slot := rng.Intn(len(expected.Metadata.Keyslots))
+			priority := SlotPriority(rng.Intn(3))
+			c.Assert(SetSlotPriority(path, slot, priority), IsNil)
+			expected.Metadata.Keyslots[slot].Priority = priority
+		case 1:
+			if len(expected.Metadata.Tokens) >= 8 {
+				continue
+			}
+			data := make([]byte, rng.Intn(128))
+			rng.Read(data)
+			c.Assert(ImportToken(path, &Token{
+				Type:     "secboot-test",
+				Keyslots: []int{rng.Intn(len(expected.Metadata.Keyslots))},
+				Params:   map[string]interface{}{"secboot-data": data}}), IsNil)
+
+			info, err := ReadHeader(path, LockModeBlocking)
+			c.Assert(err, IsNil)
+			c.Assert(info.Metadata.Tokens, HasLen, len(expected.Metadata.Tokens)+1)
+			expected.Metadata.Tokens = info.Metadata.Tokens
+		case 2:
+			if len(expected.Metadata.Tokens) == 0 {
+				continue
+			}
+			var ids []int
+			for id := range expected.Metadata.Tokens {
+				ids = append(ids, id)
+			}
+			sort.Ints(ids)
+			id := ids[rng.Intn(len(ids))]
+			c.Assert(RemoveToken(path, id), IsNil)
+			delete(expected.Metadata.Tokens, id)
+		}
+
+		seqId++
+
+		primarySeqId, secondarySeqId, err := HeaderSeqIds(path)
+		c.Assert(err, IsNil)
+		c.Check(primarySeqId, Equals, seqId)
+		c.Check(secondarySeqId, Equals, seqId)
+
+		info, err := ReadHeader(path, LockModeBlocking)
+		c.Assert(err, IsNil)
+		c.Check(info, DeepEquals, expected)
+	}
+
+	c.Check(stderr.String(), Equals, "")
+
+	// Make sure that cryptsetup agrees that the rewritten header is valid.
+	if _, err := exec.LookPath("cryptsetup"); err != nil {
+		c.Log("skipping cryptsetup checks: cryptsetup not available")
+		return
+	}
+	c.Check(exec.Command("cryptsetup", "isLuks", "--type", "luks2", path).Run(), IsNil)
+	out, err := exec.Command("cryptsetup", "luksDump", path).CombinedOutput()
+	c.Check(err, IsNil, Commentf("%s", out))
+}
@@ -0,0 +1,215 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+	"golang.org/x/xerrors"
+
+	"maze.io/x/crypto/afis"
+)
+
+const keyslotAreaSectorSize = 512
+
+// ErrNoMatchingKeyslot is returned when a volume key cannot be recovered from any
+// keyslot with the supplied key.
+var ErrNoMatchingKeyslot = errors.New("no keyslot could be unlocked with the supplied key")
+
+// deriveKey derives a key of the specified size from the supplied passphrase using
+// the parameters of this KDF.
+func (k *KDF) deriveKey(passphrase []byte, keySize int) ([]byte, error) {
+	switch k.Type {
+	case KDFTypePBKDF2:
+		h := k.Hash.GetHash()
+		if h == 0 || !h.Available() {
+			return nil, fmt.Errorf("unsupported hash algorithm %q", k.Hash)
+		}
+		return pbkdf2.Key(passphrase, k.Salt, k.Iterations, keySize, h.New), nil
+	case KDFTypeArgon2i:
+		return argon2.Key(passphrase, k.Salt, uint32(k.Time), uint32(k.Memory), uint8(k.CPUs), uint32(keySize)), nil
+	case KDFTypeArgon2id:
+		return argon2.IDKey(passphrase, k.Salt, uint32(k.Time), uint32(k.Memory), uint8(k.CPUs), uint32(keySize)), nil
+	default:
+		return nil, fmt.Errorf("unsupported KDF type %q", k.Type)
+	}
+}
+
+// verify checks that the supplied volume key matches this digest.
+func (d *Digest) verify(key []byte) (bool, error) {
+	if d.Type != KDFTypePBKDF2 {
+		return false, fmt.Errorf("unsupported digest type %q", d.Type)
+	}
+	h := d.Hash.GetHash()
+	if h == 0 || !h.Available() {
+		return false, fmt.Errorf("unsupported hash algorithm %q", d.Hash)
+	}
+
+	digest := pbkdf2.Key(key, d.Salt, d.Iterations, len(d.Digest), h.New)
+	return subtle.ConstantTimeCompare(digest, d.Digest) == 1, nil
+}
+
+// decryptArea reads and decrypts the specified number of bytes from the supplied keyslot
+// area using the supplied key. The area is encrypted in the same way as a dm-crypt device,
+// with 512-byte sectors and the sector number starting from 0 at the start of the area.
+func decryptArea(r io.ReaderAt, area *Area, key []byte, size int) ([]byte, error) {
+	if area.Type != AreaTypeRaw {
+		return nil, fmt.Errorf("unsupported area type %q", area.Type)
+	}
+	if area.Encryption != "aes-xts-plain64" {
+		return nil, fmt.Errorf("unsupported area encryption %q", area.Encryption)
+	}
+
+	// Round up to the sector size.
+	size = (size + keyslotAreaSectorSize - 1) &^ (keyslotAreaSectorSize - 1)
+	if uint64(size) > area.Size {
+		return nil, errors.New("area is too small")
+	}
+
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, int64(area.Offset)); err != nil {
+		return nil, xerrors.Errorf("cannot read area: %w", err)
+	}
+
+	for i := 0; i < size/keyslotAreaSectorSize; i++ {
+		sector := data[i*keyslotAreaSectorSize : (i+1)*keyslotAreaSectorSize]
+		c.Decrypt(sector, sector, uint64(i))
+	}
+
+	return data, nil
+}
+
+// unlockKeyslot recovers the volume key from the specified keyslot using the supplied
+// passphrase. It doesn't verify the recovered key.
+func unlockKeyslot(r io.ReaderAt, keyslot *Keyslot, passphrase []byte) ([]byte, error) {
+	switch {
+	case keyslot.Type != KeyslotTypeLUKS2:
+		return nil, fmt.Errorf("unsupported keyslot type %q", keyslot.Type)
+	case keyslot.Area == nil || keyslot.KDF == nil || keyslot.AF == nil:
+		return nil, errors.New("invalid keyslot")
+	case keyslot.AF.Type != AFTypeLUKS1:
+		return nil, fmt.Errorf("unsupported AF type %q", keyslot.AF.Type)
+	case keyslot.KeySize <= 0 || keyslot.AF.Stripes <= 0:
+		return nil, errors.New("invalid keyslot")
+	}
+
+	afHash := keyslot.AF.Hash.GetHash()
+	if afHash == 0 || !afHash.Available() {
+		return nil, fmt.Errorf("unsupported AF hash algorithm %q", keyslot.AF.Hash)
+	}
+
+	areaKey, err := keyslot.KDF.deriveKey(passphrase, keyslot.Area.KeySize)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot derive key: %w", err)
+	}
+	defer wipe(areaKey)
+
+	splitSize := keyslot.KeySize * keyslot.AF.Stripes
+	split, err := decryptArea(r, keyslot.Area, areaKey, splitSize)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decrypt keyslot area: %w", err)
+	}
+	defer wipe(split)
+
+	return afis.MergeHash(split[:splitSize], keyslot.AF.Stripes, afHash.New)
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// findKeyslot returns the keyslot that the supplied passphrase unlocks for the specified
+// segment, along with the recovered volume key, by trying each keyslot that is assigned to
+// the same digest as the segment. Keyslots are tried in order of priority, in the same way
+// as libcryptsetup, and keyslots with the ignore priority are skipped. The supplied reader
+// should read from the device containing the keyslots area, which is the header device.
+func findKeyslot(r io.ReaderAt, metadata *Metadata, segment int, passphrase []byte) (int, []byte, error) {
+	var digest *Digest
+	for _, d := range metadata.Digests {
+		for _, s := range d.Segments {
+			if s == segment {
+				digest = d
+				break
+			}
+		}
+	}
+	if digest == nil {
+		return 0, nil, fmt.Errorf("no digest for segment %d", segment)
+	}
+
+	var slots []int
+	for _, slot := range digest.Keyslots {
+		keyslot, ok := metadata.Keyslots[slot]
+		if !ok || keyslot.Priority == SlotPriorityIgnore {
+			continue
+		}
+		slots = append(slots, slot)
+	}
+	sort.SliceStable(slots, func(i, j int) bool {
+		pi := metadata.Keyslots[slots[i]].Priority
+		pj := metadata.Keyslots[slots[j]].Priority
+		if pi != pj {
+			return pi > pj
+		}
+		return slots[i] < slots[j]
+	})
+
+	for _, slot := range slots {
+		key, err := unlockKeyslot(r, metadata.Keyslots[slot], passphrase)
+		if err != nil {
+			fmt.Fprintf(stderr, "luks2.unlockVolumeKey: cannot unlock keyslot %d: %v\n", slot, err)
+			continue
+		}
+
+		ok, err := digest.verify(key)
+		if err != nil {
+			wipe(key)
+			return 0, nil, xerrors.Errorf("cannot verify key: %w", err)
+		}
+		if ok {
+			return slot, key, nil
+		}
+		wipe(key)
+	}
+
+	return 0, nil, ErrNoMatchingKeyslot
+}
+
+// unlockVolumeKey recovers the volume key for the specified segment using the supplied
+// passphrase. See findKeyslot for how keyslots are selected.
+func unlockVolumeKey(r io.ReaderAt, metadata *Metadata, segment int, passphrase []byte) ([]byte, error) {
+	_, key, err := findKeyslot(r, metadata, segment, passphrase)
+	return key, err
+}
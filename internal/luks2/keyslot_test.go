@@ -0,0 +1,208 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+
+	. "gopkg.in/check.v1"
+
+	"maze.io/x/crypto/afis"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+)
+
+// setTestVolumeKey updates the digest of the LUKS2 container at the specified path so
+// that it matches the supplied volume key. This invalidates all existing keyslots.
+func setTestVolumeKey(c *C, path string, volumeKey []byte) {
+	c.Assert(UpdateHeader(path, LockModeBlocking, func(metadata *Metadata) error {
+		digest := metadata.Digests[0]
+		digest.Type = KDFTypePBKDF2
+		digest.Hash = HashSHA256
+		digest.Iterations = 1000
+		digest.Digest = pbkdf2.Key(volumeKey, digest.Salt, digest.Iterations, 32, sha256.New)
+		return nil
+	}), IsNil)
+}
+
+// setTestKeyslot rewrites the specified keyslot of the LUKS2 container at the specified path
+// so that the supplied volume key is protected by the supplied passphrase, using the supplied
+// KDF parameters. The keyslot must already exist and have a raw area.
+func setTestKeyslot(c *C, path string, slot int, passphrase, volumeKey []byte, kdf *KDF) {
+	kdf.Salt = make([]byte, 32)
+	rand.Read(kdf.Salt)
+
+	var area *Area
+	c.Assert(UpdateHeader(path, LockModeBlocking, func(metadata *Metadata) error {
+		keyslot := metadata.Keyslots[slot]
+		keyslot.KeySize = len(volumeKey)
+		keyslot.KDF = kdf
+		keyslot.AF = &AF{Type: AFTypeLUKS1, Stripes: 4000, Hash: HashSHA256}
+		area = keyslot.Area
+		return nil
+	}), IsNil)
+
+	var areaKey []byte
+	switch kdf.Type {
+	case KDFTypePBKDF2:
+		areaKey = pbkdf2.Key(passphrase, kdf.Salt, kdf.Iterations, area.KeySize, sha256.New)
+	case KDFTypeArgon2i:
+		areaKey = argon2.Key(passphrase, kdf.Salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.CPUs), uint32(area.KeySize))
+	case KDFTypeArgon2id:
+		areaKey = argon2.IDKey(passphrase, kdf.Salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.CPUs), uint32(area.KeySize))
+	}
+
+	split, err := afis.SplitHash(volumeKey, 4000, sha256.New)
+	c.Assert(err, IsNil)
+	data := make([]byte, (len(split)+511)&^511)
+	copy(data, split)
+
+	cipher, err := xts.NewCipher(aes.NewCipher, areaKey)
+	c.Assert(err, IsNil)
+	for i := 0; i < len(data)/512; i++ {
+		cipher.Encrypt(data[i*512:(i+1)*512], data[i*512:(i+1)*512], uint64(i))
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteAt(data, int64(area.Offset))
+	c.Assert(err, IsNil)
+}
+
+func newTestContainer(c *C) (path string, volumeKey []byte) {
+	path = decompressImage(c, "testdata/luks2-valid-hdr.img")
+
+	volumeKey = make([]byte, 64)
+	rand.Read(volumeKey)
+	setTestVolumeKey(c, path, volumeKey)
+	return path, volumeKey
+}
+
+func (s *metadataSuite) TestUnlockVolumeKeyPBKDF2(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+
+	key, err := UnlockVolumeKey(path, []byte("passphrase"))
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, volumeKey)
+}
+
+func (s *metadataSuite) TestUnlockVolumeKeyArgon2i(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 0, []byte("1234"), volumeKey, &KDF{Type: KDFTypeArgon2i, Time: 4, Memory: 32, CPUs: 1})
+
+	key, err := UnlockVolumeKey(path, []byte("1234"))
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, volumeKey)
+}
+
+func (s *metadataSuite) TestUnlockVolumeKeyArgon2id(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 0, []byte("1234"), volumeKey, &KDF{Type: KDFTypeArgon2id, Time: 4, Memory: 32, CPUs: 2})
+
+	key, err := UnlockVolumeKey(path, []byte("1234"))
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, volumeKey)
+}
+
+func (s *metadataSuite) TestUnlockVolumeKeyMultipleKeyslots(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 0, []byte("1234"), volumeKey, &KDF{Type: KDFTypeArgon2i, Time: 4, Memory: 32, CPUs: 1})
+	setTestKeyslot(c, path, 1, []byte("5678"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+
+	key, err := UnlockVolumeKey(path, []byte("1234"))
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, volumeKey)
+
+	key, err = UnlockVolumeKey(path, []byte("5678"))
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, volumeKey)
+}
+
+func (s *metadataSuite) TestUnlockVolumeKeyIgnoresKeyslotWithIgnorePriority(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+	c.Assert(SetSlotPriority(path, 1, SlotPriorityIgnore), IsNil)
+
+	_, err := UnlockVolumeKey(path, []byte("passphrase"))
+	c.Check(err, Equals, ErrNoMatchingKeyslot)
+}
+
+func (s *metadataSuite) TestUnlockVolumeKeyWrongPassphrase(c *C) {
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+	setTestKeyslot(c, path, 0, []byte("1234"), volumeKey, &KDF{Type: KDFTypeArgon2i, Time: 4, Memory: 32, CPUs: 1})
+
+	_, err := UnlockVolumeKey(path, []byte("foo"))
+	c.Check(err, Equals, ErrNoMatchingKeyslot)
+}
+
+func (s *cryptsetupSuite) TestUnlockVolumeKeyMatchesCryptsetup(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+	fmtOpts := FormatOptions{KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}}
+	c.Assert(Format(devicePath, "", key, &fmtOpts), IsNil)
+
+	cmd := exec.Command("cryptsetup", "luksDump", "--dump-master-key", "--batch-mode", "--key-file", "-", devicePath)
+	cmd.Stdin = bytes.NewReader(key)
+	out, err := cmd.Output()
+	c.Assert(err, IsNil)
+
+	var expected []byte
+	inKey := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "MK dump:"):
+			inKey = true
+			line = strings.TrimPrefix(line, "MK dump:")
+		case !inKey:
+			continue
+		case !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " "):
+			inKey = false
+			continue
+		}
+		b, err := hex.DecodeString(strings.Replace(strings.TrimSpace(line), " ", "", -1))
+		c.Assert(err, IsNil)
+		expected = append(expected, b...)
+	}
+	c.Assert(expected, HasLen, 64)
+
+	volumeKey, err := UnlockVolumeKey(devicePath, key)
+	c.Check(err, IsNil)
+	c.Check(volumeKey, DeepEquals, expected)
+}
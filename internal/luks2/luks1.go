@@ -0,0 +1,361 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	luks1NumKeys       = 8
+	luks1KeyEnabled    = 0x00ac71f3
+	luks1KeyDisabled   = 0x0000dead
+	luks1SectorSize    = 512
+	luks1AlignKeyslots = 4096
+	luks1DigestSize    = 20
+)
+
+// luks1Keyblock corresponds to a keyslot in the LUKS1 binary header.
+type luks1Keyblock struct {
+	Active            uint32
+	Iterations        uint32
+	Salt              [32]byte
+	KeyMaterialOffset uint32 // In 512-byte sectors
+	Stripes           uint32
+}
+
+// luks1Hdr corresponds to the LUKS1 binary header (see the LUKS1 On-Disk Format
+// specification).
+type luks1Hdr struct {
+	Magic              [6]byte
+	Version            uint16
+	CipherName         [32]byte
+	CipherMode         [32]byte
+	HashSpec           [32]byte
+	PayloadOffset      uint32 // In 512-byte sectors
+	KeyBytes           uint32
+	MKDigest           [luks1DigestSize]byte
+	MKDigestSalt       [32]byte
+	MKDigestIterations uint32
+	Uuid               [40]byte
+	Keyblocks          [luks1NumKeys]luks1Keyblock
+}
+
+func cString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+// keyMaterialSize returns the size of the key material for a keyslot in bytes,
+// rounded up to the sector size.
+func (h *luks1Hdr) keyMaterialSize(kb *luks1Keyblock) uint64 {
+	sz := uint64(h.KeyBytes) * uint64(kb.Stripes)
+	return (sz + luks1SectorSize - 1) &^ (luks1SectorSize - 1)
+}
+
+// headerAreaSize returns the size of the LUKS1 header area, which is the binary
+// header followed by the key material for every keyslot, in the same way as
+// libcryptsetup.
+func (h *luks1Hdr) headerAreaSize() uint64 {
+	size := uint64(binary.Size(h))
+	for i := range h.Keyblocks {
+		kb := &h.Keyblocks[i]
+		end := uint64(kb.KeyMaterialOffset)*luks1SectorSize + h.keyMaterialSize(kb)
+		if end > size {
+			size = end
+		}
+	}
+	return (size + luks1AlignKeyslots - 1) &^ (luks1AlignKeyslots - 1)
+}
+
+func decodeLUKS1Header(r io.Reader) (*luks1Hdr, error) {
+	var hdr luks1Hdr
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, xerrors.Errorf("cannot read header: %w", err)
+	}
+	if hdr.Magic != primaryMagic {
+		return nil, errors.New("invalid magic")
+	}
+	if hdr.Version != 1 {
+		return nil, fmt.Errorf("invalid version %d", hdr.Version)
+	}
+	if hdr.KeyBytes == 0 {
+		return nil, errors.New("invalid key size")
+	}
+	if Hash(cString(hdr.HashSpec[:])).GetHash() == 0 {
+		return nil, fmt.Errorf("unsupported hash algorithm %q", cString(hdr.HashSpec[:]))
+	}
+
+	for i := range hdr.Keyblocks {
+		kb := &hdr.Keyblocks[i]
+		switch kb.Active {
+		case luks1KeyEnabled, luks1KeyDisabled:
+		default:
+			return nil, fmt.Errorf("invalid state for keyslot %d", i)
+		}
+		if kb.Stripes == 0 {
+			return nil, fmt.Errorf("invalid stripes for keyslot %d", i)
+		}
+	}
+
+	return &hdr, nil
+}
+
+// metadata returns a LUKS2 representation of this header, in the same way as
+// "cryptsetup convert". Only active keyslots are included. LUKS1 has no keyslots
+// area, so the Config.JSONSize and Config.KeyslotsSize fields are zero.
+func (h *luks1Hdr) metadata() *Metadata {
+	cipher := cString(h.CipherName[:]) + "-" + cString(h.CipherMode[:])
+	hash := Hash(cString(h.HashSpec[:]))
+
+	metadata := &Metadata{
+		Keyslots: make(map[int]*Keyslot),
+		Segments: map[int]*Segment{
+			0: {
+				Type:        SegmentTypeCrypt,
+				Offset:      uint64(h.PayloadOffset) * luks1SectorSize,
+				DynamicSize: true,
+				Encryption:  cipher,
+				SectorSize:  luks1SectorSize}},
+		Digests: map[int]*Digest{
+			0: {
+				Type:       KDFTypePBKDF2,
+				Segments:   []int{0},
+				Salt:       append([]byte(nil), h.MKDigestSalt[:]...),
+				Digest:     append([]byte(nil), h.MKDigest[:]...),
+				Hash:       hash,
+				Iterations: int(h.MKDigestIterations)}},
+		Tokens: make(map[int]*Token)}
+
+	for i := range h.Keyblocks {
+		kb := &h.Keyblocks[i]
+		if kb.Active != luks1KeyEnabled {
+			continue
+		}
+		metadata.Keyslots[i] = &Keyslot{
+			Type:    KeyslotTypeLUKS2,
+			KeySize: int(h.KeyBytes),
+			Area: &Area{
+				Type:       AreaTypeRaw,
+				Offset:     uint64(kb.KeyMaterialOffset) * luks1SectorSize,
+				Size:       h.keyMaterialSize(kb),
+				Encryption: cipher,
+				KeySize:    int(h.KeyBytes)},
+			KDF: &KDF{
+				Type:       KDFTypePBKDF2,
+				Salt:       append([]byte(nil), kb.Salt[:]...),
+				Hash:       hash,
+				Iterations: int(kb.Iterations)},
+			AF: &AF{
+				Type:    AFTypeLUKS1,
+				Stripes: int(kb.Stripes),
+				Hash:    hash},
+			Priority: SlotPriorityNormal}
+		metadata.Digests[0].Keyslots = append(metadata.Digests[0].Keyslots, i)
+	}
+
+	return metadata
+}
+
+// ReadLUKS1Header will decode the LUKS1 header at the specified path, which can either be
+// a block device or file containing a LUKS1 volume, or a detached LUKS1 header file. The
+// header is returned in the same form as ReadHeader, with the LUKS1 keyslots, volume key
+// digest and payload described by the equivalent LUKS2 metadata objects, and with the
+// HeaderSize field set to the size of the entire LUKS1 header area. LUKS1 headers have no
+// label or JSON metadata area.
+//
+// LUKS1 headers are only supported for reading, and the other functions in this package
+// require a LUKS2 container. A LUKS1 container can be converted to LUKS2 with ConvertToLUKS2.
+//
+// This function requires an advisory shared lock on the LUKS container associated with the
+// specified path, which is acquired according to the supplied lock mode.
+func ReadLUKS1Header(path string, lockMode LockMode) (*HeaderInfo, error) {
+	releaseLock, err := acquireSharedLock(path, lockMode)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot acquire shared lock: %w", err)
+	}
+	defer releaseLock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hdr, err := decodeLUKS1Header(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HeaderInfo{
+		Version:    1,
+		HeaderSize: hdr.headerAreaSize(),
+		UUID:       cString(hdr.Uuid[:]),
+		Metadata:   *hdr.metadata()}, nil
+}
+
+// DetectVersion returns the LUKS version of the container at the specified path, by
+// inspecting the magic and version fields of the primary binary header. It doesn't
+// check that the header is otherwise valid.
+func DetectVersion(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var hdr struct {
+		Magic   [6]byte
+		Version uint16
+	}
+	if err := binary.Read(f, binary.BigEndian, &hdr); err != nil {
+		return 0, xerrors.Errorf("cannot read header: %w", err)
+	}
+	if hdr.Magic != primaryMagic {
+		return 0, errors.New("not a LUKS container")
+	}
+	return int(hdr.Version), nil
+}
+
+// ConvertOptions provides the options for converting a LUKS1 container to LUKS2.
+type ConvertOptions struct {
+	// BackupPath is the path of a new file in which to store a backup of the LUKS1
+	// header area before conversion. The backup can be restored with "cryptsetup
+	// luksHeaderRestore". Set to an empty string to skip the backup, which isn't
+	// recommended.
+	BackupPath string
+}
+
+// backupLUKS1Header writes the LUKS1 header area from the supplied file to a new file at
+// the specified path.
+func backupLUKS1Header(f *os.File, hdr *luks1Hdr, path string) error {
+	backup, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(backup, io.NewSectionReader(f, 0, int64(hdr.headerAreaSize()))); err != nil {
+		backup.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := backup.Sync(); err != nil {
+		backup.Close()
+		os.Remove(path)
+		return err
+	}
+	return backup.Close()
+}
+
+// ConvertToLUKS2 converts the LUKS1 container at the specified path to LUKS2 in place,
+// using "cryptsetup convert". For a container with a detached header, devicePath should
+// be the path of the header. The container must not be active.
+//
+// Before running cryptsetup, this checks that the container is a valid LUKS1 container
+// and that the installed cryptsetup supports LUKS2, and creates a backup of the LUKS1
+// header area if the BackupPath field of options is set. After conversion, it checks that
+// the new LUKS2 header has the same UUID, volume key digest and active keyslots as the
+// original LUKS1 header. Secboot-managed tokens can then be added with ImportToken.
+//
+// The conversion requires enough space between the LUKS1 key material and the start of the
+// encrypted data for the LUKS2 metadata, which is checked by cryptsetup.
+//
+// WARNING: This function modifies the header of the container. If cryptsetup is interrupted,
+// the container may become unusable and must be restored from the backup.
+func ConvertToLUKS2(devicePath string, options *ConvertOptions) error {
+	if options == nil {
+		options = &ConvertOptions{}
+	}
+
+	if err := requireFeatures(FeatureLUKS2); err != nil {
+		return err
+	}
+
+	before, err := func() (*HeaderInfo, error) {
+		releaseLock, err := acquireSharedLock(devicePath, LockModeBlocking)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot acquire shared lock: %w", err)
+		}
+		defer releaseLock()
+
+		f, err := os.Open(devicePath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		hdr, err := decodeLUKS1Header(f)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode LUKS1 header: %w", err)
+		}
+
+		if options.BackupPath != "" {
+			if err := backupLUKS1Header(f, hdr, options.BackupPath); err != nil {
+				return nil, xerrors.Errorf("cannot create header backup: %w", err)
+			}
+		}
+
+		return &HeaderInfo{Version: 1, UUID: cString(hdr.Uuid[:]), Metadata: *hdr.metadata()}, nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := cryptsetupCmd(nil, nil, "convert", "--batch-mode", "--type", "luks2", devicePath); err != nil {
+		return err
+	}
+
+	after, err := ReadHeader(devicePath, LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot read header after conversion: %w", err)
+	}
+	if after.UUID != before.UUID {
+		return fmt.Errorf("unexpected UUID after conversion (got %s, expected %s)", after.UUID, before.UUID)
+	}
+
+	for slot := range before.Metadata.Keyslots {
+		keyslot, ok := after.Metadata.Keyslots[slot]
+		if !ok {
+			return fmt.Errorf("keyslot %d is missing after conversion", slot)
+		}
+		if keyslot.KDF == nil || !bytes.Equal(keyslot.KDF.Salt, before.Metadata.Keyslots[slot].KDF.Salt) {
+			return fmt.Errorf("keyslot %d was modified by conversion", slot)
+		}
+	}
+	if len(after.Metadata.Keyslots) != len(before.Metadata.Keyslots) {
+		return errors.New("unexpected keyslots after conversion")
+	}
+
+	var digest *Digest
+	for _, d := range after.Metadata.Digests {
+		digest = d
+	}
+	if len(after.Metadata.Digests) != 1 || !bytes.Equal(digest.Digest, before.Metadata.Digests[0].Digest) {
+		return errors.New("volume key digest was modified by conversion")
+	}
+
+	return nil
+}
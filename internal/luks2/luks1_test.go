@@ -0,0 +1,307 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+
+	. "gopkg.in/check.v1"
+
+	"maze.io/x/crypto/afis"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+)
+
+type luks1TestKeyblock struct {
+	Active            uint32
+	Iterations        uint32
+	Salt              [32]byte
+	KeyMaterialOffset uint32
+	Stripes           uint32
+}
+
+type luks1TestHdr struct {
+	Magic              [6]byte
+	Version            uint16
+	CipherName         [32]byte
+	CipherMode         [32]byte
+	HashSpec           [32]byte
+	PayloadOffset      uint32
+	KeyBytes           uint32
+	MKDigest           [20]byte
+	MKDigestSalt       [32]byte
+	MKDigestIterations uint32
+	Uuid               [40]byte
+	Keyblocks          [8]luks1TestKeyblock
+}
+
+const (
+	luks1TestUUID    = "2f8cbd9e-8f1c-4a38-8d0e-4b4bc2b2b0a1"
+	luks1TestStripes = 4000
+)
+
+// newTestLUKS1Container creates a LUKS1 container with a 64-byte aes-xts-plain64 volume key
+// and a keyslot for each of the supplied passphrases. Keyslot 1 is left disabled so that
+// the keyslot numbering is preserved.
+func newTestLUKS1Container(c *C, passphrases ...[]byte) (path string, volumeKey []byte) {
+	volumeKey = make([]byte, 64)
+	rand.Read(volumeKey)
+
+	hdr := luks1TestHdr{
+		Magic:              [6]byte{'L', 'U', 'K', 'S', 0xba, 0xbe},
+		Version:            1,
+		PayloadOffset:      4096,
+		KeyBytes:           uint32(len(volumeKey)),
+		MKDigestIterations: 1000}
+	copy(hdr.CipherName[:], "aes")
+	copy(hdr.CipherMode[:], "xts-plain64")
+	copy(hdr.HashSpec[:], "sha256")
+	copy(hdr.Uuid[:], luks1TestUUID)
+	rand.Read(hdr.MKDigestSalt[:])
+	copy(hdr.MKDigest[:], pbkdf2.Key(volumeKey, hdr.MKDigestSalt[:], int(hdr.MKDigestIterations), 20, sha256.New))
+
+	// Each keyslot is 500 sectors, aligned to 8 sectors.
+	for i := range hdr.Keyblocks {
+		hdr.Keyblocks[i] = luks1TestKeyblock{
+			Active:            0x0000dead,
+			Iterations:        1000,
+			KeyMaterialOffset: uint32(8 + i*504),
+			Stripes:           luks1TestStripes}
+	}
+
+	path = luks2test.CreateEmptyDiskImage(c, 4)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	slot := 0
+	for _, passphrase := range passphrases {
+		if slot == 1 {
+			slot++
+		}
+		kb := &hdr.Keyblocks[slot]
+		kb.Active = 0x00ac71f3
+		rand.Read(kb.Salt[:])
+
+		areaKey := pbkdf2.Key(passphrase, kb.Salt[:], int(kb.Iterations), len(volumeKey), sha256.New)
+		split, err := afis.SplitHash(volumeKey, luks1TestStripes, sha256.New)
+		c.Assert(err, IsNil)
+		data := make([]byte, (len(split)+511)&^511)
+		copy(data, split)
+
+		cipher, err := xts.NewCipher(aes.NewCipher, areaKey)
+		c.Assert(err, IsNil)
+		for i := 0; i < len(data)/512; i++ {
+			cipher.Encrypt(data[i*512:(i+1)*512], data[i*512:(i+1)*512], uint64(i))
+		}
+		_, err = f.WriteAt(data, int64(kb.KeyMaterialOffset)*512)
+		c.Assert(err, IsNil)
+
+		slot++
+	}
+
+	buf := new(bytes.Buffer)
+	c.Assert(binary.Write(buf, binary.BigEndian, &hdr), IsNil)
+	_, err = f.WriteAt(buf.Bytes(), 0)
+	c.Assert(err, IsNil)
+
+	return path, volumeKey
+}
+
+type luks1Suite struct {
+	snapd_testutil.BaseTest
+}
+
+var _ = Suite(&luks1Suite{})
+
+func (s *luks1Suite) TestReadLUKS1Header(c *C) {
+	path, _ := newTestLUKS1Container(c, []byte("foo"), []byte("bar"))
+
+	info, err := ReadLUKS1Header(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Version, Equals, 1)
+	c.Check(info.UUID, Equals, luks1TestUUID)
+	c.Check(info.Label, Equals, "")
+	// The header area includes the key material for inactive keyslots.
+	c.Check(info.HeaderSize, Equals, uint64((8+7*504+500)*512+4096-1)&^4095)
+
+	c.Check(info.Metadata.Keyslots, HasLen, 2)
+	c.Check(info.Metadata.Keyslots[1], IsNil)
+	for _, slot := range []int{0, 2} {
+		keyslot := info.Metadata.Keyslots[slot]
+		c.Assert(keyslot, NotNil)
+		c.Check(keyslot.Type, Equals, KeyslotTypeLUKS2)
+		c.Check(keyslot.KeySize, Equals, 64)
+		c.Check(keyslot.Area.Type, Equals, AreaTypeRaw)
+		c.Check(keyslot.Area.Offset, Equals, uint64(8+slot*504)*512)
+		c.Check(keyslot.Area.Size, Equals, uint64(500*512))
+		c.Check(keyslot.Area.Encryption, Equals, "aes-xts-plain64")
+		c.Check(keyslot.KDF.Type, Equals, KDFTypePBKDF2)
+		c.Check(keyslot.KDF.Hash, Equals, HashSHA256)
+		c.Check(keyslot.KDF.Iterations, Equals, 1000)
+		c.Check(keyslot.AF, DeepEquals, &AF{Type: AFTypeLUKS1, Stripes: luks1TestStripes, Hash: HashSHA256})
+	}
+
+	c.Check(info.Metadata.Segments, DeepEquals, map[int]*Segment{
+		0: {
+			Type:        SegmentTypeCrypt,
+			Offset:      4096 * 512,
+			DynamicSize: true,
+			Encryption:  "aes-xts-plain64",
+			SectorSize:  512}})
+
+	c.Assert(info.Metadata.Digests, HasLen, 1)
+	c.Check(info.Metadata.Digests[0].Keyslots, DeepEquals, []int{0, 2})
+	c.Check(info.Metadata.Digests[0].Segments, DeepEquals, []int{0})
+	c.Check(info.Metadata.Digests[0].Digest, HasLen, 20)
+}
+
+func (s *luks1Suite) TestLUKS1MetadataUnlocksVolumeKey(c *C) {
+	path, volumeKey := newTestLUKS1Container(c, []byte("foo"), []byte("bar"))
+
+	key, err := UnlockLUKS1VolumeKey(path, []byte("bar"))
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, volumeKey)
+
+	_, err = UnlockLUKS1VolumeKey(path, []byte("baz"))
+	c.Check(err, Equals, ErrNoMatchingKeyslot)
+}
+
+func (s *luks1Suite) TestReadLUKS1HeaderLUKS2(c *C) {
+	path := decompressImage(c, "testdata/luks2-valid-hdr.img")
+	_, err := ReadLUKS1Header(path, LockModeBlocking)
+	c.Check(err, ErrorMatches, "invalid version 2")
+}
+
+func (s *luks1Suite) TestReadHeaderLUKS1(c *C) {
+	path, _ := newTestLUKS1Container(c, []byte("foo"))
+	_, err := ReadHeader(path, LockModeBlocking)
+	c.Check(err, ErrorMatches, "no valid header found, error from decoding primary header: invalid version")
+}
+
+func (s *luks1Suite) TestDetectVersion(c *C) {
+	path, _ := newTestLUKS1Container(c, []byte("foo"))
+	version, err := DetectVersion(path)
+	c.Check(err, IsNil)
+	c.Check(version, Equals, 1)
+
+	version, err = DetectVersion(decompressImage(c, "testdata/luks2-valid-hdr.img"))
+	c.Check(err, IsNil)
+	c.Check(version, Equals, 2)
+
+	_, err = DetectVersion(luks2test.CreateEmptyDiskImage(c, 1))
+	c.Check(err, ErrorMatches, "not a LUKS container")
+}
+
+func (s *luks1Suite) mockCryptsetup(c *C, help string) *snapd_testutil.MockCmd {
+	cmd := snapd_testutil.MockCommand(c, "cryptsetup", `
+if [ "$1" = "--help" ]; then
+    echo "`+help+`"
+fi
+`)
+	s.AddCleanup(cmd.Restore)
+	return cmd
+}
+
+func (s *luks1Suite) TestConvertToLUKS2NotLUKS1(c *C) {
+	cmd := s.mockCryptsetup(c, "cryptsetup 2.2.2")
+
+	path := decompressImage(c, "testdata/luks2-valid-hdr.img")
+	c.Check(ConvertToLUKS2(path, nil), ErrorMatches, "cannot decode LUKS1 header: invalid version 2")
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *luks1Suite) TestConvertToLUKS2Unsupported(c *C) {
+	cmd := s.mockCryptsetup(c, "cryptsetup 1.7.3")
+
+	path, _ := newTestLUKS1Container(c, []byte("foo"))
+	err := ConvertToLUKS2(path, nil)
+	c.Check(err, FitsTypeOf, &UnsupportedError{})
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *luks1Suite) TestConvertToLUKS2ChecksResult(c *C) {
+	// cryptsetup succeeds but leaves the container unchanged.
+	cmd := s.mockCryptsetup(c, "cryptsetup 2.2.2")
+
+	path, _ := newTestLUKS1Container(c, []byte("foo"))
+	backupPath := filepath.Join(c.MkDir(), "backup")
+
+	c.Check(ConvertToLUKS2(path, &ConvertOptions{BackupPath: backupPath}), ErrorMatches,
+		"cannot read header after conversion: no valid header found, error from decoding primary header: invalid version")
+	c.Check(cmd.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "--help"},
+		{"cryptsetup", "convert", "--batch-mode", "--type", "luks2", path}})
+
+	// The backup should contain the header and all key material.
+	orig, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	backup, err := ioutil.ReadFile(backupPath)
+	c.Assert(err, IsNil)
+	c.Check(backup, HasLen, ((8+7*504+500)*512+4095)&^4095)
+	c.Check(bytes.Equal(backup, orig[:len(backup)]), Equals, true)
+}
+
+func (s *luks1Suite) TestConvertToLUKS2BackupExists(c *C) {
+	cmd := s.mockCryptsetup(c, "cryptsetup 2.2.2")
+
+	path, _ := newTestLUKS1Container(c, []byte("foo"))
+	backupPath := filepath.Join(c.MkDir(), "backup")
+	c.Assert(ioutil.WriteFile(backupPath, nil, 0600), IsNil)
+
+	c.Check(ConvertToLUKS2(path, &ConvertOptions{BackupPath: backupPath}), ErrorMatches,
+		"cannot create header backup: .*: file exists")
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *cryptsetupSuite) TestConvertToLUKS2(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	cmd := exec.Command("cryptsetup", "-q", "luksFormat", "--type", "luks1", "--key-file", "-", "--pbkdf-force-iterations", "1000", devicePath)
+	cmd.Stdin = bytes.NewReader(key)
+	c.Assert(cmd.Run(), IsNil)
+
+	before, err := ReadLUKS1Header(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	c.Check(ConvertToLUKS2(devicePath, &ConvertOptions{BackupPath: filepath.Join(c.MkDir(), "backup")}), IsNil)
+
+	after, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(after.UUID, Equals, before.UUID)
+	c.Check(after.Metadata.Keyslots[0].KDF.Salt, DeepEquals, before.Metadata.Keyslots[0].KDF.Salt)
+	s.checkLUKS2Passphrase(c, devicePath, key)
+}
@@ -73,11 +73,33 @@ const (
 //
 // A shared lock is for read-only access. There can be multiple parallel shared lock holders.
 //
-// This function implements the locking logic implemented by libcryptsetup - see
-// lib/utils_device_locking.c from the cryptsetup source code (tag:v2.3.1).
-//
 // On success, a callback is returned which should be called to release the lock.
 func acquireSharedLock(path string, mode LockMode) (release func(), err error) {
+	return acquireLock(path, mode, unix.LOCK_SH)
+}
+
+// acquireExclusiveLock acquires an advisory exclusive lock on the LUKS volume associated with
+// the specified path. The path can either be a block device or file containing a LUKS2 volume
+// with an integral header, or a detached header file associated with a LUKS device.
+//
+// If the mode parameter is LockModeBlocking, this function will block until the lock can be
+// obtained. If the mode parameter is LockModeNonBlocking, a wrapped syscall.Errno error with
+// the value of syscall.EWOULDBLOCK will be returned if the lock can not be obtained.
+//
+// An exclusive lock is for read-write access. There can only be a single exclusive lock holder,
+// and there can be no shared lock holders at the same time.
+//
+// On success, a callback is returned which should be called to release the lock.
+func acquireExclusiveLock(path string, mode LockMode) (release func(), err error) {
+	return acquireLock(path, mode, unix.LOCK_EX)
+}
+
+// acquireLock acquires an advisory lock of the type specified by the how argument
+// (unix.LOCK_SH or unix.LOCK_EX) on the LUKS volume associated with the specified path.
+//
+// This function implements the locking logic implemented by libcryptsetup - see
+// lib/utils_device_locking.c from the cryptsetup source code (tag:v2.3.1).
+func acquireLock(path string, mode LockMode, how int) (release func(), err error) {
 	// Initially open the device or file for reading
 	f, err := os.Open(path)
 	if err != nil {
@@ -85,7 +107,6 @@ func acquireSharedLock(path string, mode LockMode) (release func(), err error) {
 	}
 	defer f.Close()
 
-	how := unix.LOCK_SH
 	if mode == LockModeNonBlocking {
 		how |= unix.LOCK_NB
 	}
@@ -150,14 +171,12 @@ func acquireSharedLock(path string, mode LockMode) (release func(), err error) {
 		// If we locked a block device then we need to clean up the lock file, being careful
 		// not to race with potential new lock owners.
 
-		// Although this function only supports shared locks for read-only access (where an
-		// implementation bug might cause data inconsistency issues in the decoded data but
-		// doesn't lead to data loss), the following code is responsible for cleaning up the
-		// lock file on release. This is carefully implemented using the same steps as
-		// libcryptsetup to avoid racing with other lock holders, some of whom could be
-		// exclusive lock holders. Implementation bugs here that result in us unlinking a
-		// lock file that another processes has an exclusive lock on could result in data
-		// loss - please be careful when changing any of the code below.
+		// The following code is responsible for cleaning up the lock file on release. This
+		// is carefully implemented using the same steps as libcryptsetup to avoid racing with
+		// other lock holders, some of whom could be exclusive lock holders. Implementation bugs
+		// here that result in us unlinking a lock file that another processes has an exclusive
+		// lock on could result in data loss - please be careful when changing any of the code
+		// below.
 
 		// The lock file should only be cleaned up if we can get an exclusive lock on the
 		// inode we originally opened, and the lock file path still points to this inode.
@@ -166,7 +185,7 @@ func acquireSharedLock(path string, mode LockMode) (release func(), err error) {
 		// on previously, without blocking.
 		if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
 			if errno, ok := err.(syscall.Errno); !ok || errno != syscall.EWOULDBLOCK {
-				fmt.Fprintf(stderr, "luks2.acquireSharedLock: cannot acquire exclusive lock for cleanup: %v\n", err)
+				fmt.Fprintf(stderr, "luks2.acquireLock: cannot acquire exclusive lock for cleanup: %v\n", err)
 			}
 			// Another process has grabbed a lock since we released the lock. There's
 			// nothing else for us to do - the new lock owner is now responsible for
@@ -179,7 +198,7 @@ func acquireSharedLock(path string, mode LockMode) (release func(), err error) {
 		var st unix.Stat_t
 		if err := unix.Stat(lockPath, &st); err != nil {
 			if errno, ok := err.(syscall.Errno); !ok || errno != syscall.ENOENT {
-				fmt.Fprintf(stderr, "luks2.acquireSharedLock: cannot stat() lock file: %v\n", err)
+				fmt.Fprintf(stderr, "luks2.acquireLock: cannot stat() lock file: %v\n", err)
 			}
 			// The lock file we opened has been cleaned up by another process, which acquired
 			// and released it in between us releasing the lock at the start of this function,
@@ -200,7 +219,7 @@ func acquireSharedLock(path string, mode LockMode) (release func(), err error) {
 		// have an exclusive lock on it again. As other processes participating in locking require
 		// an exclusive lock for cleaning it up, it os now safe to unlink it.
 		if err := os.Remove(lockPath); err != nil {
-			fmt.Fprintf(stderr, "luks2.acquireSharedLock: cannot unlink lock file: %v\n", err)
+			fmt.Fprintf(stderr, "luks2.acquireLock: cannot unlink lock file: %v\n", err)
 		}
 	}
 
@@ -244,9 +263,9 @@ func acquireSharedLock(path string, mode LockMode) (release func(), err error) {
 				continue
 			}
 
-			// The lock file path still points to the inode that we opened and have a shared lock
-			// on. As applications participating in locking require an exclusive lock to unlink it,
-			// we know that we have a lock on the inode linked from the lock file path.
+			// The lock file path still points to the inode that we opened and have a lock on. As
+			// applications participating in locking require an exclusive lock to unlink it, we
+			// know that we have a lock on the inode linked from the lock file path.
 		}
 
 		// We've successfully acquired the requested lock - return the release callback.
@@ -295,7 +314,26 @@ func (h Hash) GetHash() crypto.Hash {
 type KeyslotType string
 
 const (
-	KeyslotTypeLUKS2 KeyslotType = "luks2"
+	KeyslotTypeLUKS2     KeyslotType = "luks2"
+	KeyslotTypeReencrypt KeyslotType = "reencrypt" // Keyslot that stores the state of a reencryption operation
+)
+
+// ReencryptMode corresponds to the mode of a reencryption operation.
+type ReencryptMode string
+
+const (
+	ReencryptModeReencrypt ReencryptMode = "reencrypt"
+	ReencryptModeEncrypt   ReencryptMode = "encrypt"
+	ReencryptModeDecrypt   ReencryptMode = "decrypt"
+)
+
+// ReencryptDirection corresponds to the direction in which a reencryption
+// operation processes the data.
+type ReencryptDirection string
+
+const (
+	ReencryptDirectionForward  ReencryptDirection = "forward"
+	ReencryptDirectionBackward ReencryptDirection = "backward"
 )
 
 // AFType corresponds to an anti-forensic splitter algorithm.
@@ -311,8 +349,35 @@ type AreaType string
 
 const (
 	AreaTypeRaw AreaType = "raw"
+
+	// The following area types are used by reencrypt keyslots, and
+	// correspond to the resilience mode of a reencryption operation.
+	AreaTypeNone              AreaType = "none"
+	AreaTypeChecksum          AreaType = "checksum"
+	AreaTypeJournal           AreaType = "journal"
+	AreaTypeDatashift         AreaType = "datashift"
+	AreaTypeDatashiftChecksum AreaType = "datashift-checksum"
+	AreaTypeDatashiftJournal  AreaType = "datashift-journal"
+)
+
+const (
+	SegmentTypeCrypt  = "crypt"
+	SegmentTypeLinear = "linear" // Unencrypted segment, only used during reencryption
+)
+
+// Segment flags used during reencryption.
+const (
+	SegmentFlagInReencryption     = "in-reencryption"      // Segment is being reencrypted
+	SegmentFlagBackupFinal        = "backup-final"         // Backup of the final segment parameters
+	SegmentFlagBackupPrevious     = "backup-previous"      // Backup of the previous segment parameters
+	SegmentFlagBackupMovedSegment = "backup-moved-segment" // Backup of the parameters of a segment moved by a data shift
 )
 
+// RequirementOnlineReencrypt is the mandatory requirement that is set on a container
+// with an online reencryption operation in progress. Newer versions of libcryptsetup
+// append a version suffix to it (eg, "online-reencrypt-v2").
+const RequirementOnlineReencrypt = "online-reencrypt"
+
 type label [48]byte
 
 func (l label) String() string {
@@ -341,6 +406,11 @@ type binaryHdr struct {
 	Padding4096 [7 * 512]byte
 }
 
+// uuid returns the UUID of the container in its string form.
+func (h *binaryHdr) uuid() string {
+	return strings.TrimRight(string(h.Uuid[:]), "\x00")
+}
+
 type luksJsonNumber string
 
 func (n luksJsonNumber) int() (int, error) {
@@ -351,12 +421,69 @@ func (n luksJsonNumber) uint64() (uint64, error) {
 	return strconv.ParseUint(string(n), 10, 64)
 }
 
+func intToLuksJsonNumber(n int) luksJsonNumber {
+	return luksJsonNumber(strconv.Itoa(n))
+}
+
+func uint64ToLuksJsonNumber(n uint64) luksJsonNumber {
+	return luksJsonNumber(strconv.FormatUint(n, 10))
+}
+
+func intsToLuksJsonNumbers(ns []int) []luksJsonNumber {
+	out := make([]luksJsonNumber, 0, len(ns))
+	for _, n := range ns {
+		out = append(out, intToLuksJsonNumber(n))
+	}
+	return out
+}
+
 // Config corresponds to a config object in the JSON metadata of a LUKS2 volume.
 type Config struct {
 	JSONSize     uint64   // Size of the JSON area, in bytes
 	KeyslotsSize uint64   // Size of the keyslots area, in bytes
 	Flags        []string // Optional flags
-	Requirements []string // Optional required features
+	Requirements []string // Optional mandatory required features
+}
+
+type configRequirements struct {
+	Mandatory []string `json:"mandatory,omitempty"`
+}
+
+// OnlineReencryptRequirement indicates whether this config has the mandatory
+// requirement that is set during an online reencryption operation. If it does,
+// the version of the requirement is also returned. The original requirement,
+// without a version suffix, is version 1.
+func (c *Config) OnlineReencryptRequirement() (version int, ok bool) {
+	for _, r := range c.Requirements {
+		switch {
+		case r == RequirementOnlineReencrypt:
+			return 1, true
+		case strings.HasPrefix(r, RequirementOnlineReencrypt+"-v"):
+			v, err := strconv.Atoi(strings.TrimPrefix(r, RequirementOnlineReencrypt+"-v"))
+			if err != nil || v < 2 {
+				continue
+			}
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	d := struct {
+		JSONSize     luksJsonNumber      `json:"json_size"`
+		KeyslotsSize luksJsonNumber      `json:"keyslots_size"`
+		Flags        []string            `json:"flags,omitempty"`
+		Requirements *configRequirements `json:"requirements,omitempty"`
+	}{
+		JSONSize:     uint64ToLuksJsonNumber(c.JSONSize),
+		KeyslotsSize: uint64ToLuksJsonNumber(c.KeyslotsSize),
+		Flags:        c.Flags}
+	if len(c.Requirements) > 0 {
+		d.Requirements = &configRequirements{Mandatory: c.Requirements}
+	}
+
+	return json.Marshal(&d)
 }
 
 func (c *Config) UnmarshalJSON(data []byte) error {
@@ -364,15 +491,16 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 		JSONSize     luksJsonNumber `json:"json_size"`
 		KeyslotsSize luksJsonNumber `json:"keyslots_size"`
 		Flags        []string
-		Requirements []string
+		Requirements *configRequirements
 	}
 	if err := json.Unmarshal(data, &d); err != nil {
 		return err
 	}
 
-	*c = Config{
-		Flags:        d.Flags,
-		Requirements: d.Requirements}
+	*c = Config{Flags: d.Flags}
+	if d.Requirements != nil {
+		c.Requirements = d.Requirements.Mandatory
+	}
 	jsonSize, err := d.JSONSize.uint64()
 	if err != nil {
 		return xerrors.Errorf("invalid json_size value: %w", err)
@@ -389,7 +517,8 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 }
 
 // Token corresponds to a token object in the JSON metadata of a LUKS2 volume. It
-// describes how to retrieve a passphrase or key for a keyslot.
+// describes how to retrieve a passphrase or key for a keyslot. Use Decode to obtain
+// a representation with the type-specific parameters decoded.
 type Token struct {
 	Type     string                 // Token type ("luks2-" prefixed types are reserved for cryptsetup)
 	Keyslots []int                  // Keyslots assigned to this token
@@ -402,11 +531,7 @@ func (t Token) MarshalJSON() ([]byte, error) {
 		m[k] = v
 	}
 	m["type"] = t.Type
-	var keyslots []luksJsonNumber
-	for _, s := range t.Keyslots {
-		keyslots = append(keyslots, luksJsonNumber(strconv.Itoa(s)))
-	}
-	m["keyslots"] = keyslots
+	m["keyslots"] = intsToLuksJsonNumbers(t.Keyslots)
 
 	return json.Marshal(m)
 }
@@ -462,6 +587,27 @@ type Digest struct {
 	Iterations int     // The number of iterations (pbkdf2 only)
 }
 
+func (d Digest) MarshalJSON() ([]byte, error) {
+	t := struct {
+		Type       KDFType          `json:"type"`
+		Keyslots   []luksJsonNumber `json:"keyslots"`
+		Segments   []luksJsonNumber `json:"segments"`
+		Hash       Hash             `json:"hash,omitempty"`
+		Iterations int              `json:"iterations,omitempty"`
+		Salt       []byte           `json:"salt"`
+		Digest     []byte           `json:"digest"`
+	}{
+		Type:       d.Type,
+		Keyslots:   intsToLuksJsonNumbers(d.Keyslots),
+		Segments:   intsToLuksJsonNumbers(d.Segments),
+		Hash:       d.Hash,
+		Iterations: d.Iterations,
+		Salt:       d.Salt,
+		Digest:     d.Digest}
+
+	return json.Marshal(&t)
+}
+
 func (d *Digest) UnmarshalJSON(data []byte) error {
 	var t struct {
 		Type       KDFType
@@ -505,25 +651,76 @@ func (d *Digest) UnmarshalJSON(data []byte) error {
 // Integrity corresponds to an integrity object in the JSON metadata of a LUKS2 volume,
 // and details the data integrity parameters for a segment.
 type Integrity struct {
-	Type              string // Integirty type in dm-crypt notation
-	JournalEncryption string
-	JournalIntegrity  string
+	Type              string `json:"type"` // Integirty type in dm-crypt notation
+	JournalEncryption string `json:"journal_encryption"`
+	JournalIntegrity  string `json:"journal_integrity"`
+	KeySize           int    `json:"key_size,omitempty"` // The size of the integrity key in bytes (optional)
 }
 
 // Segment corresponds to a segment object in the JSON metadata of a LUKS2 volume,
 // and details an encrypted area on disk.
 type Segment struct {
-	Type        string
+	Type        string     // Segment type ("crypt", or "linear" during reencryption)
 	Offset      uint64     // Offset from the device start to the beginning of this segment, in bytes
 	Size        uint64     // Size of this segment, in bytes (only if DynamicSize is false)
 	DynamicSize bool       // The size is the size of the underlying device
-	IVTweak     uint64     // The starting offset of the IV tweak
-	Encryption  string     // The encryption algorithm for this segment in dm-crypt notation
-	SectorSize  int        // The sector size for this segment, in bytes
+	IVTweak     uint64     // The starting offset of the IV tweak (crypt only)
+	Encryption  string     // The encryption algorithm for this segment in dm-crypt notation (crypt only)
+	SectorSize  int        // The sector size for this segment, in bytes (crypt only)
 	Integrity   *Integrity // Data integrity parameters for this segment (optional)
 	Flags       []string   // Additional options for this segment
 }
 
+// HasFlag indicates whether this segment has the specified flag.
+func (s *Segment) HasFlag(flag string) bool {
+	for _, f := range s.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// isBackup indicates whether this segment is a backup segment used during reencryption,
+// rather than one that describes the current layout of the data.
+func (s *Segment) isBackup() bool {
+	for _, f := range s.Flags {
+		if strings.HasPrefix(f, "backup-") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Segment) MarshalJSON() ([]byte, error) {
+	d := struct {
+		Type       string         `json:"type"`
+		Offset     luksJsonNumber `json:"offset"`
+		Size       luksJsonNumber `json:"size"`
+		IVTweak    luksJsonNumber `json:"iv_tweak,omitempty"`
+		Encryption string         `json:"encryption,omitempty"`
+		SectorSize int            `json:"sector_size,omitempty"`
+		Integrity  *Integrity     `json:"integrity,omitempty"`
+		Flags      []string       `json:"flags,omitempty"`
+	}{
+		Type:       s.Type,
+		Offset:     uint64ToLuksJsonNumber(s.Offset),
+		Size:       uint64ToLuksJsonNumber(s.Size),
+		Encryption: s.Encryption,
+		SectorSize: s.SectorSize,
+		Integrity:  s.Integrity,
+		Flags:      s.Flags}
+	if s.DynamicSize {
+		d.Size = "dynamic"
+	}
+	if s.Type != SegmentTypeLinear {
+		// Linear segments don't have an IV tweak.
+		d.IVTweak = uint64ToLuksJsonNumber(s.IVTweak)
+	}
+
+	return json.Marshal(&d)
+}
+
 func (s *Segment) UnmarshalJSON(data []byte) error {
 	var d struct {
 		Type       string
@@ -563,6 +760,10 @@ func (s *Segment) UnmarshalJSON(data []byte) error {
 		s.Size = sz
 	}
 
+	if d.Type == SegmentTypeLinear && d.IVTweak == "" {
+		return nil
+	}
+
 	ivTweak, err := d.IVTweak.uint64()
 	if err != nil {
 		return xerrors.Errorf("invalid iv_tweak value: %w", err)
@@ -579,8 +780,39 @@ type Area struct {
 	Type       AreaType
 	Offset     uint64 // Offset from the device start to the beginning of this area, in bytes
 	Size       uint64 // Size of this area in bytes
-	Encryption string // Encryption algorithm used for this area in dm-crypt notation
-	KeySize    int    // The size of the encryption key for this area, in bytes
+	Encryption string // Encryption algorithm used for this area in dm-crypt notation (raw only)
+	KeySize    int    // The size of the encryption key for this area, in bytes (raw only)
+	Hash       Hash   // Hash algorithm used for resilience checksums (checksum types only)
+	SectorSize int    // Sector size used for resilience checksums, in bytes (checksum types only)
+	ShiftSize  uint64 // Size of the data shift, in bytes (datashift types only)
+}
+
+func (a Area) MarshalJSON() ([]byte, error) {
+	d := struct {
+		Type       AreaType       `json:"type"`
+		Offset     luksJsonNumber `json:"offset"`
+		Size       luksJsonNumber `json:"size"`
+		Encryption string         `json:"encryption,omitempty"`
+		KeySize    *int           `json:"key_size,omitempty"`
+		Hash       Hash           `json:"hash,omitempty"`
+		SectorSize int            `json:"sector_size,omitempty"`
+		ShiftSize  luksJsonNumber `json:"shift_size,omitempty"`
+	}{
+		Type:       a.Type,
+		Offset:     uint64ToLuksJsonNumber(a.Offset),
+		Size:       uint64ToLuksJsonNumber(a.Size),
+		Encryption: a.Encryption,
+		Hash:       a.Hash,
+		SectorSize: a.SectorSize}
+	if a.Type == AreaTypeRaw || a.KeySize != 0 {
+		keySize := a.KeySize
+		d.KeySize = &keySize
+	}
+	if a.ShiftSize != 0 {
+		d.ShiftSize = uint64ToLuksJsonNumber(a.ShiftSize)
+	}
+
+	return json.Marshal(&d)
 }
 
 func (a *Area) UnmarshalJSON(data []byte) error {
@@ -590,6 +822,9 @@ func (a *Area) UnmarshalJSON(data []byte) error {
 		Size       luksJsonNumber
 		Encryption string
 		KeySize    int `json:"key_size"`
+		Hash       Hash
+		SectorSize int            `json:"sector_size"`
+		ShiftSize  luksJsonNumber `json:"shift_size"`
 	}
 	if err := json.Unmarshal(data, &d); err != nil {
 		return err
@@ -598,7 +833,9 @@ func (a *Area) UnmarshalJSON(data []byte) error {
 	*a = Area{
 		Type:       d.Type,
 		Encryption: d.Encryption,
-		KeySize:    d.KeySize}
+		KeySize:    d.KeySize,
+		Hash:       d.Hash,
+		SectorSize: d.SectorSize}
 
 	offset, err := d.Offset.uint64()
 	if err != nil {
@@ -612,27 +849,35 @@ func (a *Area) UnmarshalJSON(data []byte) error {
 	}
 	a.Size = sz
 
+	if d.ShiftSize != "" {
+		shiftSize, err := d.ShiftSize.uint64()
+		if err != nil {
+			return xerrors.Errorf("invalid shift_size value: %w", err)
+		}
+		a.ShiftSize = shiftSize
+	}
+
 	return nil
 }
 
 // AF correspnds to an af object in the JSON metadata of a LUKS2 volume, and details
 // the anti-forensic splitter parameters for a keyslot.
 type AF struct {
-	Type    AFType
-	Stripes int  // Number of stripes
-	Hash    Hash // Hash algorith.
+	Type    AFType `json:"type"`
+	Stripes int    `json:"stripes"` // Number of stripes
+	Hash    Hash   `json:"hash"`    // Hash algorith.
 }
 
 // KDF corresponds to a kdf object in the JSON metadata of a LUKS2 volume, and details
 // the KDF parameters for a keyslot.
 type KDF struct {
-	Type       KDFType // KDF type (pbkdf2, argon2i or argon2id)
-	Salt       []byte  // Salt for the KDF
-	Hash       Hash    // Hash algorithm (pbkdf2 only)
-	Iterations int     // Number of iterations (pbkdf2 only)
-	Time       int     // Number of iterations (argon2 only)
-	Memory     int     // Memory cost in kB (argon2 only)
-	CPUs       int     // Number of threads (argon2 only)
+	Type       KDFType `json:"type"`                 // KDF type (pbkdf2, argon2i or argon2id)
+	Salt       []byte  `json:"salt"`                 // Salt for the KDF
+	Hash       Hash    `json:"hash,omitempty"`       // Hash algorithm (pbkdf2 only)
+	Iterations int     `json:"iterations,omitempty"` // Number of iterations (pbkdf2 only)
+	Time       int     `json:"time,omitempty"`       // Number of iterations (argon2 only)
+	Memory     int     `json:"memory,omitempty"`     // Memory cost in kB (argon2 only)
+	CPUs       int     `json:"cpus,omitempty"`       // Number of threads (argon2 only)
 }
 
 // Keyslot corresponds to a keyslot object in the JSON metadata of a LUKS2 volume, and
@@ -644,27 +889,61 @@ type Keyslot struct {
 	KDF      *KDF         // The KDF parameters used for this keyslot
 	AF       *AF          // The anti-forensic splitter parameters used for this keyslot
 	Priority SlotPriority // Priority of this keyslot (0:ignore, 1:normal, 2:high)
+
+	Mode      ReencryptMode      // The reencryption mode (reencrypt only)
+	Direction ReencryptDirection // The reencryption direction (reencrypt only)
+}
+
+func (s Keyslot) MarshalJSON() ([]byte, error) {
+	d := struct {
+		Type      KeyslotType        `json:"type"`
+		KeySize   int                `json:"key_size"`
+		AF        *AF                `json:"af,omitempty"`
+		Area      *Area              `json:"area,omitempty"`
+		KDF       *KDF               `json:"kdf,omitempty"`
+		Priority  *int               `json:"priority,omitempty"`
+		Mode      ReencryptMode      `json:"mode,omitempty"`
+		Direction ReencryptDirection `json:"direction,omitempty"`
+	}{
+		Type:      s.Type,
+		KeySize:   s.KeySize,
+		AF:        s.AF,
+		Area:      s.Area,
+		KDF:       s.KDF,
+		Mode:      s.Mode,
+		Direction: s.Direction}
+	if s.Priority != SlotPriorityNormal {
+		// libcryptsetup omits the priority for keyslots with the normal priority.
+		priority := int(s.Priority)
+		d.Priority = &priority
+	}
+
+	return json.Marshal(&d)
 }
 
 func (s *Keyslot) UnmarshalJSON(data []byte) error {
 	var d struct {
-		Type     KeyslotType
-		KeySize  int `json:"key_size"`
-		Area     *Area
-		KDF      *KDF
-		AF       *AF
-		Priority *int
+		Type      KeyslotType
+		KeySize   int `json:"key_size"`
+		Area      *Area
+		KDF       *KDF
+		AF        *AF
+		Priority  *int
+		Mode      ReencryptMode
+		Direction ReencryptDirection
 	}
 	if err := json.Unmarshal(data, &d); err != nil {
 		return err
 	}
 
 	*s = Keyslot{
-		Type:    d.Type,
-		KeySize: d.KeySize,
-		Area:    d.Area,
-		KDF:     d.KDF,
-		AF:      d.AF}
+		Type:      d.Type,
+		KeySize:   d.KeySize,
+		Area:      d.Area,
+		KDF:       d.KDF,
+		AF:        d.AF,
+		Mode:      d.Mode,
+		Direction: d.Direction}
 	if d.Priority != nil {
 		s.Priority = SlotPriority(*d.Priority)
 	} else {
@@ -682,6 +961,38 @@ type Metadata struct {
 	Config   Config           // Config object
 }
 
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	d := struct {
+		Keyslots map[int]*Keyslot `json:"keyslots"`
+		Tokens   map[int]*Token   `json:"tokens"`
+		Segments map[int]*Segment `json:"segments"`
+		Digests  map[int]*Digest  `json:"digests"`
+		Config   Config           `json:"config"`
+	}{
+		Keyslots: m.Keyslots,
+		Tokens:   m.Tokens,
+		Segments: m.Segments,
+		Digests:  m.Digests,
+		Config:   m.Config}
+
+	// All of the top-level objects are mandatory, so make sure we don't
+	// serialize any of them as null.
+	if d.Keyslots == nil {
+		d.Keyslots = make(map[int]*Keyslot)
+	}
+	if d.Tokens == nil {
+		d.Tokens = make(map[int]*Token)
+	}
+	if d.Segments == nil {
+		d.Segments = make(map[int]*Segment)
+	}
+	if d.Digests == nil {
+		d.Digests = make(map[int]*Digest)
+	}
+
+	return json.Marshal(&d)
+}
+
 func (m *Metadata) UnmarshalJSON(data []byte) error {
 	var d struct {
 		Keyslots map[luksJsonNumber]*Keyslot
@@ -736,8 +1047,10 @@ func (m *Metadata) UnmarshalJSON(data []byte) error {
 
 // HeaderInfo corresponds to the header (binary header and JSON metadata) for a LUKS2 volume.
 type HeaderInfo struct {
+	Version    int      // The LUKS version (1 for headers returned from ReadLUKS1Header, otherwise 2)
 	HeaderSize uint64   // The total size of the binary header and JSON metadata in bytes
 	Label      string   // The label
+	UUID       string   // The UUID of the container
 	Metadata   Metadata // JSON metadata
 }
 
@@ -799,6 +1112,79 @@ func decodeAndCheckHeader(r io.ReadSeeker, offset int64, primary bool) (*binaryH
 	return &hdr, jsonBuffer, nil
 }
 
+// decodedHeader corresponds to a single decoded copy of the LUKS2 header.
+type decodedHeader struct {
+	hdr      *binaryHdr
+	jsonData []byte    // The verified contents of the JSON metadata area
+	metadata *Metadata // The decoded JSON metadata
+	err      error     // The error that occurred when decoding this header
+}
+
+func decodeHeader(r io.ReadSeeker, offset int64, primary bool) *decodedHeader {
+	hdr, jsonData, err := decodeAndCheckHeader(r, offset, primary)
+	if err != nil {
+		return &decodedHeader{err: err}
+	}
+
+	var metadata Metadata
+	if err := json.NewDecoder(bytes.NewReader(jsonData.Bytes())).Decode(&metadata); err != nil {
+		return &decodedHeader{err: xerrors.Errorf("cannot decode JSON metadata area: %w", err)}
+	}
+
+	return &decodedHeader{
+		hdr:      hdr,
+		jsonData: jsonData.Bytes(),
+		metadata: &metadata}
+}
+
+// decodeHeaders decodes and checks both the primary and secondary headers from the
+// supplied source.
+func decodeHeaders(r io.ReadSeeker) (primary, secondary *decodedHeader) {
+	// Try to decode and check the primary header
+	primary = decodeHeader(r, 0, true)
+
+	if primary.err != nil {
+		// No valid primary header. Try to decode and check a secondary header from one of the
+		// well known offsets (see Table 1: Possible LUKS2 secondary header offsets and JSON area
+		// size in the LUKS2 On-Disk Format specification).
+		for _, off := range []int64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000} {
+			secondary = decodeHeader(r, off, false)
+			if secondary.err == nil {
+				break
+			}
+		}
+	} else {
+		// Try to decode and check the secondary header immediately after the primary header.
+		secondary = decodeHeader(r, int64(primary.hdr.HdrSize), false)
+	}
+
+	return primary, secondary
+}
+
+// selectHeader returns the header that should be used from the supplied primary and
+// secondary headers, according to the rules documented in ReadHeader.
+func selectHeader(primary, secondary *decodedHeader) (*decodedHeader, error) {
+	switch {
+	case primary.err == nil && secondary.err == nil:
+		// Both headers are valid
+		if secondary.hdr.SeqId > primary.hdr.SeqId {
+			// The primary header is obsolete, so use the secondary header. This shouldn't
+			// normally happen as the primary header is updated first.
+			return secondary, nil
+		}
+		return primary, nil
+	case primary.err == nil:
+		// We only have a valid primary header so use that.
+		return primary, nil
+	case secondary.err == nil:
+		// We only have a valid secondary header so use that.
+		return secondary, nil
+	default:
+		// No valid headers :(
+		return nil, xerrors.Errorf("no valid header found, error from decoding primary header: %w", primary.err)
+	}
+}
+
 // ReadHeader will decode the LUKS header at the specified path. The path can either be a block device
 // or file containing a LUKS2 volume with an integral header, or it can be a detached header file.
 // Data is interpreted in accordance with the LUKS2 On-Disk Format specification
@@ -813,19 +1199,44 @@ func decodeAndCheckHeader(r io.ReadSeeker, offset int64, primary bool) (*binaryH
 // libcryptsetup performs some additional validation of the JSON metadata from both the primary
 // and secondary headers, and rejects a header if the JSON metadata isn't correctly formed. We don't
 // duplicate that logic here - we assume that anything that modifies the LUKS2 headers (which should
-// only be libcryptsetup) will write well-formed JSON metadata. Corruption of the JSON metadata outside
-// of modifications by libcryptsetup will be detected by the checksum verification.
+// only be libcryptsetup or the functions in this package) will write well-formed JSON metadata.
+// Corruption of the JSON metadata outside of modifications by libcryptsetup will be detected by the
+// checksum verification.
 //
 // Note that this function does not attempt recovery of either header in the event that one of the
-// headers is not valid - we leave this to libcryptsetup, which happens automatically on any
-// cryptsetup or systemd-cryptsetup invocation. This package does not directly perform any
-// modifications to the header.
+// headers is not valid - this happens automatically on any cryptsetup or systemd-cryptsetup
+// invocation, or on any modification of the header by this package. It can also be performed
+// explicitly with RepairHeader.
 //
 // This function requires an advisory shared lock on the LUKS container associated with the
 // specified path. If the mode parameter is LockModeBlocking, this function will block until the
 // lock can be obtained. If the mode parameter is LockModeNonBlocking, a wrapped syscall.Errno
 // error with the value of syscall.EWOULDBLOCK will be returned if the lock can not be obtained.
 func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
+	return ReadHeaderWithOptions(path, lockMode, nil)
+}
+
+// ReadHeaderOptions provides options for ReadHeaderWithOptions.
+type ReadHeaderOptions struct {
+	// Validate enables validation of the JSON metadata of each header copy with
+	// Metadata.Validate, which should be used for headers from untrusted sources.
+	// A copy that fails validation is treated in the same way as a copy with an
+	// invalid checksum.
+	Validate bool
+
+	// DeviceSize is the size of the device containing the encrypted data in bytes,
+	// which is passed to Metadata.Validate if Validate is true. Set to zero to
+	// skip checking that segments are within the device.
+	DeviceSize uint64
+}
+
+// ReadHeaderWithOptions will decode the LUKS header at the specified path in the same way as
+// ReadHeader, using the supplied options.
+func ReadHeaderWithOptions(path string, lockMode LockMode, options *ReadHeaderOptions) (*HeaderInfo, error) {
+	if options == nil {
+		options = &ReadHeaderOptions{}
+	}
+
 	releaseLock, err := acquireSharedLock(path, lockMode)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot acquire shared lock: %w", err)
@@ -838,75 +1249,35 @@ func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
 	}
 	defer f.Close()
 
-	// Try to decode and check the primary header
-	primaryHdr, primaryJSONData, primaryErr := decodeAndCheckHeader(f, 0, true)
-	var primaryMetadata Metadata
-	if primaryErr == nil {
-		if err := json.NewDecoder(primaryJSONData).Decode(&primaryMetadata); err != nil {
-			primaryErr = xerrors.Errorf("cannot decode JSON metadata area: %w", err)
-		}
+	primary, secondary := decodeHeaders(f)
+	if options.Validate {
+		validateHeader(primary, options.DeviceSize)
+		validateHeader(secondary, options.DeviceSize)
 	}
-
-	var secondaryHdr *binaryHdr
-	var secondaryJSONData *bytes.Buffer
-	var secondaryErr error
-	if primaryErr != nil {
-		// No valid primary header. Try to decode and check a secondary header from one of the
-		// well known offsets (see Table 1: Possible LUKS2 secondary header offsets and JSON area
-		// size in the LUKS2 On-Disk Format specification).
-		for _, off := range []int64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000} {
-			secondaryHdr, secondaryJSONData, secondaryErr = decodeAndCheckHeader(f, off, false)
-			if secondaryErr == nil {
-				break
-			}
-		}
-	} else {
-		// Try to decode and check the secondary header immediately after the primary header.
-		secondaryHdr, secondaryJSONData, secondaryErr = decodeAndCheckHeader(f, int64(primaryHdr.HdrSize), false)
-	}
-	var secondaryMetadata Metadata
-	if secondaryErr == nil {
-		if err := json.NewDecoder(secondaryJSONData).Decode(&secondaryMetadata); err != nil {
-			secondaryErr = xerrors.Errorf("cannot decode JSON metadata area: %w", err)
-		}
+	hdr, err := selectHeader(primary, secondary)
+	if err != nil {
+		return nil, err
 	}
 
-	var hdr *binaryHdr
-	var metadata *Metadata
 	switch {
-	case primaryErr == nil && secondaryErr == nil:
-		// Both headers are valid
-		hdr = primaryHdr
-		metadata = &primaryMetadata
-		switch {
-		case secondaryHdr.SeqId < primaryHdr.SeqId:
-			// The secondary header is obsolete. Cryptsetup will recover this automatically.
-			fmt.Fprintf(stderr, "luks2.ReadHeader: secondary header for %s is obsolete\n", path)
-		case secondaryHdr.SeqId > primaryHdr.SeqId:
-			// The primary header is obsolete, so use the secondary header. This shouldn't
-			// normally happen as the primary header is updated first. Cryptsetup will recover
-			// this automatically.
-			hdr = secondaryHdr
-			metadata = &secondaryMetadata
-			fmt.Fprintf(stderr, "luks2.ReadHeader: primary header for %s is obsolete\n", path)
-		}
-	case primaryErr == nil:
-		// We only have a valid primary header so use that. Cryptsetup will recover this automatically.
-		hdr = primaryHdr
-		metadata = &primaryMetadata
-		fmt.Fprintf(stderr, "luks2.ReadHeader: secondary header for %s is invalid: %v\n", path, secondaryErr)
-	case secondaryErr == nil:
-		// We only have a valid secondary header so use that. Cryptsetup will recover this automatically.
-		hdr = secondaryHdr
-		metadata = &secondaryMetadata
-		fmt.Fprintf(stderr, "luks2.ReadHeader: primary header for %s is invalid: %v\n", path, primaryErr)
-	default:
-		// No valid headers :(
-		return nil, xerrors.Errorf("no valid header found, error from decoding primary header: %w", primaryErr)
+	case primary.err != nil:
+		// Cryptsetup will recover this automatically.
+		fmt.Fprintf(stderr, "luks2.ReadHeader: primary header for %s is invalid: %v\n", path, primary.err)
+	case secondary.err != nil:
+		// Cryptsetup will recover this automatically.
+		fmt.Fprintf(stderr, "luks2.ReadHeader: secondary header for %s is invalid: %v\n", path, secondary.err)
+	case secondary.hdr.SeqId < primary.hdr.SeqId:
+		// Cryptsetup will recover this automatically.
+		fmt.Fprintf(stderr, "luks2.ReadHeader: secondary header for %s is obsolete\n", path)
+	case secondary.hdr.SeqId > primary.hdr.SeqId:
+		// Cryptsetup will recover this automatically.
+		fmt.Fprintf(stderr, "luks2.ReadHeader: primary header for %s is obsolete\n", path)
 	}
 
 	return &HeaderInfo{
-		HeaderSize: hdr.HdrSize,
-		Label:      hdr.Label.String(),
-		Metadata:   *metadata}, nil
+		Version:    2,
+		HeaderSize: hdr.hdr.HdrSize,
+		Label:      hdr.hdr.Label.String(),
+		UUID:       hdr.hdr.uuid(),
+		Metadata:   *hdr.metadata}, nil
 }
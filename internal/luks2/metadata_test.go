@@ -53,6 +53,10 @@ func (s *metadataSuite) SetUpTest(c *C) {
 }
 
 func (s *metadataSuite) decompress(c *C, path string) string {
+	return decompressImage(c, path)
+}
+
+func decompressImage(c *C, path string) string {
 	dir := c.MkDir()
 	name := filepath.Base(path)
 	dst := filepath.Join(dir, name)
@@ -283,6 +287,29 @@ func (s *metadataSuite) TestMarshalToken2(c *C) {
 	})
 }
 
+func (s *metadataSuite) TestUnmarshalSegmentWithIntegrity(c *C) {
+	var segment Segment
+	c.Assert(json.Unmarshal([]byte(`{"type":"crypt","offset":"16777216","size":"dynamic","iv_tweak":"0","encryption":"aes-xts-random","sector_size":4096,`+
+		`"integrity":{"type":"hmac(sha256)","journal_encryption":"none","journal_integrity":"none","key_size":32}}`), &segment), IsNil)
+	c.Check(segment, DeepEquals, Segment{
+		Type:        "crypt",
+		Offset:      16777216,
+		DynamicSize: true,
+		Encryption:  "aes-xts-random",
+		SectorSize:  4096,
+		Integrity: &Integrity{
+			Type:              "hmac(sha256)",
+			JournalEncryption: "none",
+			JournalIntegrity:  "none",
+			KeySize:           32}})
+
+	b, err := json.Marshal(&segment)
+	c.Check(err, IsNil)
+	var segment2 Segment
+	c.Assert(json.Unmarshal(b, &segment2), IsNil)
+	c.Check(segment2, DeepEquals, segment)
+}
+
 type testReadHeaderData struct {
 	path             string
 	hdrSize          uint64
@@ -300,6 +327,7 @@ func (s *metadataSuite) testReadHeader(c *C, data *testReadHeaderData) {
 
 	c.Check(hdr.HeaderSize, Equals, data.hdrSize)
 	c.Check(hdr.Label, Equals, "data")
+	c.Check(hdr.UUID, Matches, "[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}")
 
 	c.Assert(hdr.Metadata.Keyslots, HasLen, 2)
 
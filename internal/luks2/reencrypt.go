@@ -0,0 +1,427 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const defaultReencryptProgressInterval = time.Second
+
+// ReencryptionSegment describes a data segment of a container with a reencryption
+// operation in progress.
+type ReencryptionSegment struct {
+	ID      int      // The segment ID
+	Segment *Segment // The segment object
+	Final   bool     // The data in this segment has already been reencrypted
+}
+
+// ReencryptionState describes the state of an in-progress reencryption operation,
+// as recorded in the metadata of a LUKS2 container.
+type ReencryptionState struct {
+	RequirementVersion int                // The version of the online-reencrypt requirement
+	Keyslot            int                // The ID of the reencrypt keyslot
+	Mode               ReencryptMode      // The reencryption mode
+	Direction          ReencryptDirection // The direction in which the data is processed
+	Resilience         AreaType           // The resilience mode, from the reencrypt keyslot area
+
+	// Segments contains the data segments, ordered by offset. This excludes
+	// the backup segments.
+	Segments []ReencryptionSegment
+}
+
+func segmentSize(segment *Segment, deviceSize uint64) uint64 {
+	if !segment.DynamicSize {
+		return segment.Size
+	}
+	if deviceSize < segment.Offset {
+		return 0
+	}
+	return deviceSize - segment.Offset
+}
+
+// Progress returns the number of bytes that have already been reencrypted and the total
+// number of bytes to reencrypt. The size of the device containing the encrypted data is
+// required in order to compute the size of segments with a dynamic size.
+func (s *ReencryptionState) Progress(deviceSize uint64) (processed, total uint64) {
+	for _, segment := range s.Segments {
+		sz := segmentSize(segment.Segment, deviceSize)
+		total += sz
+		if segment.Final {
+			processed += sz
+		}
+	}
+	return processed, total
+}
+
+// segmentDigest returns the ID of the digest that the specified segment is assigned
+// to, or -1 if it isn't assigned to a digest (eg, if it is a linear segment).
+func (m *Metadata) segmentDigest(segment int) int {
+	for id, digest := range m.Digests {
+		for _, s := range digest.Segments {
+			if s == segment {
+				return id
+			}
+		}
+	}
+	return -1
+}
+
+// ReencryptionState returns the state of the reencryption operation that is in progress
+// on the container associated with this metadata, or nil if there isn't one. An operation
+// is in progress if the online-reencrypt requirement is set. A segment is considered to
+// have been reencrypted already if it is assigned to the same digest as the segment with
+// the backup-final flag.
+func (m *Metadata) ReencryptionState() (*ReencryptionState, error) {
+	version, ok := m.Config.OnlineReencryptRequirement()
+	if !ok {
+		return nil, nil
+	}
+
+	state := &ReencryptionState{RequirementVersion: version, Keyslot: -1}
+
+	for id, keyslot := range m.Keyslots {
+		if keyslot.Type != KeyslotTypeReencrypt {
+			continue
+		}
+		if state.Keyslot != -1 {
+			return nil, errors.New("more than one reencrypt keyslot")
+		}
+		state.Keyslot = id
+		state.Mode = keyslot.Mode
+		state.Direction = keyslot.Direction
+		if keyslot.Area != nil {
+			state.Resilience = keyslot.Area.Type
+		}
+	}
+	if state.Keyslot == -1 {
+		return nil, errors.New("no reencrypt keyslot")
+	}
+
+	finalDigest := -2
+	for id, segment := range m.Segments {
+		if segment.HasFlag(SegmentFlagBackupFinal) {
+			finalDigest = m.segmentDigest(id)
+			break
+		}
+	}
+	if finalDigest == -2 {
+		return nil, errors.New("no backup-final segment")
+	}
+
+	for id, segment := range m.Segments {
+		if segment.isBackup() {
+			continue
+		}
+		state.Segments = append(state.Segments, ReencryptionSegment{
+			ID:      id,
+			Segment: segment,
+			Final:   m.segmentDigest(id) == finalDigest})
+	}
+	if len(state.Segments) == 0 {
+		return nil, errors.New("no data segments")
+	}
+	sort.Slice(state.Segments, func(i, j int) bool {
+		return state.Segments[i].Segment.Offset < state.Segments[j].Segment.Offset
+	})
+
+	return state, nil
+}
+
+// ReencryptOptions provides the options for reencrypting a LUKS2 volume.
+type ReencryptOptions struct {
+	// KDFOptions describes the KDF options for the keyslot protecting
+	// the new volume key.
+	KDFOptions KDFOptions
+
+	// Slot is the keyslot that the supplied key unlocks. Set this to
+	// AnySlot to use the keyslot that the supplied key is found to
+	// unlock. When resuming an interrupted operation with AnySlot,
+	// cryptsetup tries the supplied key with every keyslot.
+	Slot int
+
+	// Resilience specifies the resilience mode, which must be one of
+	// AreaTypeChecksum, AreaTypeJournal or AreaTypeNone. If it is
+	// empty, the cryptsetup default is used. This is ignored when an
+	// interrupted operation is resumed.
+	Resilience AreaType
+
+	// DetachedHeaderPath is the path of the detached header for the
+	// volume, if it has one.
+	DetachedHeaderPath string
+
+	// ProgressFunc is called periodically with the number of bytes that
+	// have been reencrypted and the total number of bytes to reencrypt.
+	// It is called from a separate goroutine.
+	ProgressFunc func(processed, total uint64)
+
+	// ProgressInterval is the interval at which ProgressFunc is called.
+	// If it is zero, a default of 1 second is used.
+	ProgressInterval time.Duration
+}
+
+// findReencryptKeyslot returns the keyslot that the supplied key unlocks for the
+// single data segment of the volume with the specified header.
+func findReencryptKeyslot(headerPath string, metadata *Metadata, key []byte) (int, error) {
+	if len(metadata.Segments) != 1 {
+		return 0, fmt.Errorf("unexpected number of segments (%d)", len(metadata.Segments))
+	}
+	segmentId := -1
+	for id := range metadata.Segments {
+		segmentId = id
+	}
+
+	f, err := os.Open(headerPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	slot, volumeKey, err := findKeyslot(f, metadata, segmentId, key)
+	if err != nil {
+		return 0, err
+	}
+	wipe(volumeKey)
+	return slot, nil
+}
+
+// deviceSize returns the size of the file or block device at the specified path.
+func deviceSize(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sz, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sz), nil
+}
+
+// dataSize returns the total size of the data segments described by the supplied
+// metadata for a container without a reencryption operation in progress.
+func (m *Metadata) dataSize(deviceSize uint64) (total uint64) {
+	for _, segment := range m.Segments {
+		if segment.isBackup() {
+			continue
+		}
+		total += segmentSize(segment, deviceSize)
+	}
+	return total
+}
+
+// reencryptProgressReporter periodically reports the progress of a reencryption
+// operation, using the state recorded in the header.
+type reencryptProgressReporter struct {
+	headerPath string
+	deviceSize uint64
+	fn         func(processed, total uint64)
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (r *reencryptProgressReporter) report() {
+	// Don't block if cryptsetup is updating the header - we'll try
+	// again on the next interval.
+	info, err := ReadHeader(r.headerPath, LockModeNonBlocking)
+	if err != nil {
+		return
+	}
+	state, err := info.Metadata.ReencryptionState()
+	if err != nil || state == nil {
+		return
+	}
+	r.fn(state.Progress(r.deviceSize))
+}
+
+func (r *reencryptProgressReporter) start(interval time.Duration) {
+	r.done = make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				r.report()
+			}
+		}
+	}()
+}
+
+func (r *reencryptProgressReporter) stop() {
+	if r.done == nil {
+		return
+	}
+	close(r.done)
+	r.wg.Wait()
+}
+
+// Reencrypt reencrypts the data of the LUKS2 volume at the specified path with a new
+// volume key, using "cryptsetup reencrypt". This can be used on a volume that is
+// active, in which case the reencryption is performed online.
+//
+// The supplied key must unlock the keyslot specified by the Slot field of options, or
+// any keyslot if it is AnySlot. The new volume key is protected by the same key. Keyslots that are not unlocked during
+// reencryption remain bound to the old volume key, and cannot be used to unlock the
+// volume once reencryption has completed.
+//
+// If the volume already has an interrupted reencryption operation in progress, as
+// indicated by the online-reencrypt requirement in its metadata, then that operation
+// is resumed instead.
+//
+// If the ProgressFunc field of options is set, the progress is reported periodically
+// based on the state recorded in the header.
+//
+// If the installed cryptsetup doesn't support LUKS2 reencryption, an *UnsupportedError
+// is returned before cryptsetup is run. Online reencryption requires cryptsetup 2.2.0 or
+// later.
+func Reencrypt(devicePath string, key []byte, options *ReencryptOptions) error {
+	if options == nil {
+		options = &ReencryptOptions{}
+	}
+
+	switch options.Resilience {
+	case "", AreaTypeChecksum, AreaTypeJournal, AreaTypeNone:
+	default:
+		return fmt.Errorf("invalid resilience mode %q", options.Resilience)
+	}
+
+	headerPath := devicePath
+	if options.DetachedHeaderPath != "" {
+		headerPath = options.DetachedHeaderPath
+	}
+
+	info, err := ReadHeader(headerPath, LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot read header: %w", err)
+	}
+	state, err := info.Metadata.ReencryptionState()
+	if err != nil {
+		return xerrors.Errorf("cannot determine reencryption state: %w", err)
+	}
+
+	features := FeatureLUKS2 | FeatureReencrypt
+	if state == nil {
+		// a new operation configures a new keyslot with argon2i
+		features |= FeatureArgon2
+	}
+	if err := requireFeatures(features); err != nil {
+		return err
+	}
+
+	slot := options.Slot
+	if slot == AnySlot && state == nil {
+		slot, err = findReencryptKeyslot(headerPath, &info.Metadata, key)
+		if err != nil {
+			return xerrors.Errorf("cannot determine keyslot for key: %w", err)
+		}
+	}
+
+	args := []string{"reencrypt"}
+	if state != nil {
+		// resume the interrupted operation
+		args = append(args, "--resume-only")
+	} else {
+		// LUKS2 only
+		args = append(args, "--type", "luks2")
+	}
+	args = append(args,
+		// read key from stdin
+		"--key-file", "-")
+	if slot != AnySlot {
+		// use the specified keyslot
+		args = append(args, "--key-slot", strconv.Itoa(slot))
+	}
+	if state == nil {
+		// apply KDF options
+		args = options.KDFOptions.appendArguments(args)
+
+		if options.Resilience != "" {
+			args = append(args, "--resilience", string(options.Resilience))
+		}
+	}
+	if options.DetachedHeaderPath != "" {
+		args = append(args, "--header", options.DetachedHeaderPath)
+	}
+	args = append(args, devicePath)
+
+	var callback func(*exec.Cmd) error
+	var reporter *reencryptProgressReporter
+	var size uint64
+	if options.ProgressFunc != nil {
+		size, err = deviceSize(devicePath)
+		if err != nil {
+			return xerrors.Errorf("cannot determine device size: %w", err)
+		}
+
+		interval := options.ProgressInterval
+		if interval == 0 {
+			interval = defaultReencryptProgressInterval
+		}
+
+		reporter = &reencryptProgressReporter{
+			headerPath: headerPath,
+			deviceSize: size,
+			fn:         options.ProgressFunc}
+		callback = func(_ *exec.Cmd) error {
+			reporter.start(interval)
+			return nil
+		}
+	}
+
+	err = cryptsetupCmd(bytes.NewReader(key), callback, args...)
+	if reporter != nil {
+		reporter.stop()
+	}
+	if err != nil {
+		return err
+	}
+
+	if options.ProgressFunc != nil {
+		info, err := ReadHeader(headerPath, LockModeBlocking)
+		if err != nil {
+			return xerrors.Errorf("cannot read header: %w", err)
+		}
+		total := info.Metadata.dataSize(size)
+		options.ProgressFunc(total, total)
+	}
+
+	return nil
+}
@@ -0,0 +1,297 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+)
+
+const reencryptInProgressMetadata = `{
+	"keyslots": {
+		"0": {"type":"luks2","key_size":64,"af":{"type":"luks1","stripes":4000,"hash":"sha256"},"area":{"type":"raw","offset":"32768","size":"258048","encryption":"aes-xts-plain64","key_size":64},"kdf":{"type":"argon2i","time":4,"memory":32768,"cpus":4,"salt":"c2FsdA=="},"priority":2},
+		"1": {"type":"luks2","key_size":64,"af":{"type":"luks1","stripes":4000,"hash":"sha256"},"area":{"type":"raw","offset":"290816","size":"258048","encryption":"aes-xts-plain64","key_size":64},"kdf":{"type":"argon2i","time":4,"memory":32768,"cpus":4,"salt":"c2FsdA=="}},
+		"2": {"type":"reencrypt","key_size":1,"area":{"type":"checksum","offset":"548864","size":"8192","hash":"sha256","sector_size":512},"mode":"reencrypt","direction":"forward"}
+	},
+	"tokens": {},
+	"segments": {
+		"0": {"type":"crypt","offset":"16777216","size":"1048576","iv_tweak":"0","encryption":"aes-xts-plain64","sector_size":512},
+		"1": {"type":"crypt","offset":"17825792","size":"dynamic","iv_tweak":"2048","encryption":"aes-xts-plain64","sector_size":512,"flags":["in-reencryption"]},
+		"2": {"type":"crypt","offset":"16777216","size":"dynamic","iv_tweak":"0","encryption":"aes-xts-plain64","sector_size":512,"flags":["backup-final"]},
+		"3": {"type":"crypt","offset":"16777216","size":"dynamic","iv_tweak":"0","encryption":"aes-xts-plain64","sector_size":512,"flags":["backup-previous"]}
+	},
+	"digests": {
+		"0": {"type":"pbkdf2","keyslots":["0"],"segments":["1","3"],"hash":"sha256","iterations":1000,"salt":"c2FsdA==","digest":"ZGlnZXN0"},
+		"1": {"type":"pbkdf2","keyslots":["1"],"segments":["0","2"],"hash":"sha256","iterations":1000,"salt":"c2FsdA==","digest":"ZGlnZXN0"}
+	},
+	"config": {"json_size":"12288","keyslots_size":"16744448","requirements":{"mandatory":["online-reencrypt-v2"]}}
+}`
+
+const encryptInProgressMetadata = `{
+	"keyslots": {
+		"0": {"type":"luks2","key_size":64,"af":{"type":"luks1","stripes":4000,"hash":"sha256"},"area":{"type":"raw","offset":"32768","size":"258048","encryption":"aes-xts-plain64","key_size":64},"kdf":{"type":"argon2i","time":4,"memory":32768,"cpus":4,"salt":"c2FsdA=="}},
+		"1": {"type":"reencrypt","key_size":1,"area":{"type":"datashift","offset":"290816","size":"8192","shift_size":"33554432"},"mode":"encrypt","direction":"backward"}
+	},
+	"tokens": {},
+	"segments": {
+		"0": {"type":"linear","offset":"0","size":"8388608"},
+		"1": {"type":"crypt","offset":"41943040","size":"dynamic","iv_tweak":"16384","encryption":"aes-xts-plain64","sector_size":512,"flags":["in-reencryption"]},
+		"2": {"type":"crypt","offset":"33554432","size":"dynamic","iv_tweak":"0","encryption":"aes-xts-plain64","sector_size":512,"flags":["backup-final"]},
+		"3": {"type":"linear","offset":"0","size":"dynamic","flags":["backup-previous"]},
+		"4": {"type":"linear","offset":"0","size":"33554432","flags":["backup-moved-segment"]}
+	},
+	"digests": {
+		"0": {"type":"pbkdf2","keyslots":["0"],"segments":["1","2"],"hash":"sha256","iterations":1000,"salt":"c2FsdA==","digest":"ZGlnZXN0"}
+	},
+	"config": {"json_size":"12288","keyslots_size":"16744448","requirements":{"mandatory":["online-reencrypt"]}}
+}`
+
+type reencryptSuite struct {
+	snapd_testutil.BaseTest
+}
+
+var _ = Suite(&reencryptSuite{})
+
+func (s *reencryptSuite) checkRoundTrip(c *C, data string, metadata *Metadata) {
+	var orig interface{}
+	c.Assert(json.Unmarshal([]byte(data), &orig), IsNil)
+
+	b, err := json.Marshal(metadata)
+	c.Assert(err, IsNil)
+	var encoded interface{}
+	c.Assert(json.Unmarshal(b, &encoded), IsNil)
+
+	c.Check(encoded, DeepEquals, orig)
+}
+
+func (s *reencryptSuite) TestUnmarshalReencryptInProgress(c *C) {
+	var metadata Metadata
+	c.Assert(json.Unmarshal([]byte(reencryptInProgressMetadata), &metadata), IsNil)
+
+	c.Check(metadata.Keyslots[2], DeepEquals, &Keyslot{
+		Type:    KeyslotTypeReencrypt,
+		KeySize: 1,
+		Area: &Area{
+			Type:       AreaTypeChecksum,
+			Offset:     548864,
+			Size:       8192,
+			Hash:       HashSHA256,
+			SectorSize: 512},
+		Priority:  SlotPriorityNormal,
+		Mode:      ReencryptModeReencrypt,
+		Direction: ReencryptDirectionForward})
+	c.Check(metadata.Segments[1].HasFlag(SegmentFlagInReencryption), Equals, true)
+	c.Check(metadata.Segments[2].HasFlag(SegmentFlagInReencryption), Equals, false)
+	c.Check(metadata.Config.Requirements, DeepEquals, []string{"online-reencrypt-v2"})
+
+	s.checkRoundTrip(c, reencryptInProgressMetadata, &metadata)
+}
+
+func (s *reencryptSuite) TestUnmarshalEncryptInProgress(c *C) {
+	var metadata Metadata
+	c.Assert(json.Unmarshal([]byte(encryptInProgressMetadata), &metadata), IsNil)
+
+	c.Check(metadata.Keyslots[1].Area, DeepEquals, &Area{
+		Type:      AreaTypeDatashift,
+		Offset:    290816,
+		Size:      8192,
+		ShiftSize: 33554432})
+	c.Check(metadata.Segments[0], DeepEquals, &Segment{
+		Type: SegmentTypeLinear,
+		Size: 8388608})
+
+	s.checkRoundTrip(c, encryptInProgressMetadata, &metadata)
+}
+
+func (s *reencryptSuite) TestOnlineReencryptRequirement(c *C) {
+	for _, t := range []struct {
+		requirements []string
+		version      int
+		ok           bool
+	}{
+		{requirements: nil},
+		{requirements: []string{"foo"}},
+		{requirements: []string{"online-reencrypt"}, version: 1, ok: true},
+		{requirements: []string{"foo", "online-reencrypt-v2"}, version: 2, ok: true},
+		{requirements: []string{"online-reencrypt-v3"}, version: 3, ok: true},
+		{requirements: []string{"online-reencrypt-vfoo"}},
+	} {
+		config := Config{Requirements: t.requirements}
+		version, ok := config.OnlineReencryptRequirement()
+		c.Check(version, Equals, t.version, Commentf("%q", t.requirements))
+		c.Check(ok, Equals, t.ok, Commentf("%q", t.requirements))
+	}
+}
+
+func (s *reencryptSuite) TestReencryptionStateForward(c *C) {
+	var metadata Metadata
+	c.Assert(json.Unmarshal([]byte(reencryptInProgressMetadata), &metadata), IsNil)
+
+	state, err := metadata.ReencryptionState()
+	c.Assert(err, IsNil)
+	c.Assert(state, NotNil)
+	c.Check(state.RequirementVersion, Equals, 2)
+	c.Check(state.Keyslot, Equals, 2)
+	c.Check(state.Mode, Equals, ReencryptModeReencrypt)
+	c.Check(state.Direction, Equals, ReencryptDirectionForward)
+	c.Check(state.Resilience, Equals, AreaTypeChecksum)
+	c.Assert(state.Segments, HasLen, 2)
+	c.Check(state.Segments[0].ID, Equals, 0)
+	c.Check(state.Segments[0].Final, Equals, true)
+	c.Check(state.Segments[1].ID, Equals, 1)
+	c.Check(state.Segments[1].Final, Equals, false)
+
+	processed, total := state.Progress(16777216 + 4194304)
+	c.Check(processed, Equals, uint64(1048576))
+	c.Check(total, Equals, uint64(4194304))
+}
+
+func (s *reencryptSuite) TestReencryptionStateEncryptBackward(c *C) {
+	var metadata Metadata
+	c.Assert(json.Unmarshal([]byte(encryptInProgressMetadata), &metadata), IsNil)
+
+	state, err := metadata.ReencryptionState()
+	c.Assert(err, IsNil)
+	c.Assert(state, NotNil)
+	c.Check(state.RequirementVersion, Equals, 1)
+	c.Check(state.Keyslot, Equals, 1)
+	c.Check(state.Mode, Equals, ReencryptModeEncrypt)
+	c.Check(state.Direction, Equals, ReencryptDirectionBackward)
+	c.Check(state.Resilience, Equals, AreaTypeDatashift)
+	c.Assert(state.Segments, HasLen, 2)
+	c.Check(state.Segments[0].ID, Equals, 0)
+	c.Check(state.Segments[0].Final, Equals, false)
+	c.Check(state.Segments[1].ID, Equals, 1)
+	c.Check(state.Segments[1].Final, Equals, true)
+
+	processed, total := state.Progress(41943040 + 25165824)
+	c.Check(processed, Equals, uint64(25165824))
+	c.Check(total, Equals, uint64(33554432))
+}
+
+func (s *reencryptSuite) TestReencryptionStateNotInProgress(c *C) {
+	metadata := Metadata{
+		Keyslots: map[int]*Keyslot{0: &Keyslot{Type: KeyslotTypeLUKS2}},
+		Segments: map[int]*Segment{0: &Segment{Type: SegmentTypeCrypt, DynamicSize: true}}}
+	state, err := metadata.ReencryptionState()
+	c.Check(err, IsNil)
+	c.Check(state, IsNil)
+}
+
+func (s *reencryptSuite) TestReencryptionStateNoKeyslot(c *C) {
+	var metadata Metadata
+	c.Assert(json.Unmarshal([]byte(reencryptInProgressMetadata), &metadata), IsNil)
+	delete(metadata.Keyslots, 2)
+
+	_, err := metadata.ReencryptionState()
+	c.Check(err, ErrorMatches, "no reencrypt keyslot")
+}
+
+func (s *reencryptSuite) TestReencryptionStateNoBackupFinal(c *C) {
+	var metadata Metadata
+	c.Assert(json.Unmarshal([]byte(reencryptInProgressMetadata), &metadata), IsNil)
+	delete(metadata.Segments, 2)
+
+	_, err := metadata.ReencryptionState()
+	c.Check(err, ErrorMatches, "no backup-final segment")
+}
+
+func (s *reencryptSuite) TestReencryptInvalidResilience(c *C) {
+	c.Check(Reencrypt("/dev/sda1", nil, &ReencryptOptions{Resilience: AreaTypeDatashift}), ErrorMatches,
+		"invalid resilience mode \"datashift\"")
+}
+
+func (s *reencryptSuite) TestReencryptAnySlot(c *C) {
+	cmd := snapd_testutil.MockCommand(c, "cryptsetup", `
+if [ "$1" = "--help" ]; then
+    echo "cryptsetup 2.2.2"
+fi
+`)
+	s.AddCleanup(cmd.Restore)
+
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 0, []byte("1234"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+	setTestKeyslot(c, path, 1, []byte("passphrase"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+
+	c.Check(Reencrypt(path, []byte("passphrase"), &ReencryptOptions{Slot: AnySlot}), IsNil)
+	c.Check(cmd.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "--help"},
+		{"cryptsetup", "reencrypt", "--type", "luks2", "--key-file", "-", "--key-slot", "1", "--pbkdf", "argon2i", path}})
+}
+
+func (s *reencryptSuite) TestReencryptAnySlotNoMatchingKeyslot(c *C) {
+	cmd := snapd_testutil.MockCommand(c, "cryptsetup", `
+if [ "$1" = "--help" ]; then
+    echo "cryptsetup 2.2.2"
+fi
+`)
+	s.AddCleanup(cmd.Restore)
+
+	path, volumeKey := newTestContainer(c)
+	setTestKeyslot(c, path, 0, []byte("1234"), volumeKey, &KDF{Type: KDFTypePBKDF2, Hash: HashSHA256, Iterations: 1000})
+
+	c.Check(Reencrypt(path, []byte("passphrase"), &ReencryptOptions{Slot: AnySlot}), ErrorMatches,
+		"cannot determine keyslot for key: no keyslot could be unlocked with the supplied key")
+	c.Check(cmd.Calls(), DeepEquals, [][]string{{"cryptsetup", "--help"}})
+}
+
+func (s *cryptsetupSuite) TestReencrypt(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+	fmtOpts := FormatOptions{KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}}
+	c.Assert(Format(devicePath, "", key, &fmtOpts), IsNil)
+
+	startInfo, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	var lastProcessed, lastTotal uint64
+	options := ReencryptOptions{
+		KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		ProgressFunc: func(processed, total uint64) {
+			c.Check(processed >= lastProcessed, Equals, true)
+			lastProcessed = processed
+			lastTotal = total
+		}}
+	c.Check(Reencrypt(devicePath, key, &options), IsNil)
+
+	c.Check(lastTotal, Not(Equals), uint64(0))
+	c.Check(lastProcessed, Equals, lastTotal)
+
+	endInfo, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(endInfo.Metadata.Config.Requirements, HasLen, 0)
+	c.Assert(endInfo.Metadata.Digests, HasLen, 1)
+	for _, digest := range endInfo.Metadata.Digests {
+		for _, origDigest := range startInfo.Metadata.Digests {
+			c.Check(digest.Digest, Not(DeepEquals), origDigest.Digest)
+		}
+	}
+
+	luks2test.CheckLUKS2Passphrase(c, devicePath, key)
+}
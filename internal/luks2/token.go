@@ -0,0 +1,235 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// SecbootTokenType is the type of tokens used to store secboot key metadata.
+	SecbootTokenType = "secboot"
+
+	// SecbootTokenVersion is the current format version of SecbootToken.
+	SecbootTokenVersion = 1
+)
+
+// TypedToken is implemented by token objects with their type-specific parameters
+// decoded in to concrete Go types. Implementations must marshal to and from the
+// JSON representation of a token object, including the "type" and "keyslots" fields.
+type TypedToken interface {
+	TokenType() string    // The token type
+	TokenKeyslots() []int // Keyslots assigned to this token
+}
+
+// TokenDecoder decodes the JSON representation of a token object.
+type TokenDecoder func(data []byte) (TypedToken, error)
+
+var (
+	tokenDecodersMu sync.RWMutex
+	tokenDecoders   = make(map[string]TokenDecoder)
+)
+
+// RegisterTokenDecoder registers a decoder for tokens of the specified type, which
+// is used by Token.Decode. This panics if a decoder is already registered for the
+// specified type.
+func RegisterTokenDecoder(typ string, decoder TokenDecoder) {
+	tokenDecodersMu.Lock()
+	defer tokenDecodersMu.Unlock()
+
+	if _, exists := tokenDecoders[typ]; exists {
+		panic(fmt.Sprintf("token decoder for type %q already registered", typ))
+	}
+	tokenDecoders[typ] = decoder
+}
+
+func getTokenDecoder(typ string) TokenDecoder {
+	tokenDecodersMu.RLock()
+	defer tokenDecodersMu.RUnlock()
+	return tokenDecoders[typ]
+}
+
+// Decode decodes this token using the decoder registered for its type. Tokens
+// with a type that has no registered decoder are returned as *UnknownToken.
+func (t *Token) Decode() (TypedToken, error) {
+	decoder := getTokenDecoder(t.Type)
+	if decoder == nil {
+		return &UnknownToken{Token: t.copy()}, nil
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot encode token: %w", err)
+	}
+	token, err := decoder(data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode %s token: %w", t.Type, err)
+	}
+	return token, nil
+}
+
+func (t *Token) copy() Token {
+	out := Token{Type: t.Type}
+	if t.Keyslots != nil {
+		out.Keyslots = make([]int, len(t.Keyslots))
+		copy(out.Keyslots, t.Keyslots)
+	}
+	if t.Params != nil {
+		out.Params = make(map[string]interface{})
+		for k, v := range t.Params {
+			out.Params[k] = v
+		}
+	}
+	return out
+}
+
+// NewToken returns the generic representation of the supplied typed token, which
+// can be passed to ImportToken.
+func NewToken(token TypedToken) (*Token, error) {
+	if t, ok := token.(*UnknownToken); ok {
+		out := t.Token.copy()
+		return &out, nil
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot encode token: %w", err)
+	}
+
+	var out *Token
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, xerrors.Errorf("cannot decode token: %w", err)
+	}
+	if out.Type != token.TokenType() {
+		return nil, fmt.Errorf("encoded token has unexpected type %q", out.Type)
+	}
+	return out, nil
+}
+
+// UnknownToken corresponds to a token with a type that has no registered decoder.
+// It retains all of the fields of the original token so that it can be converted
+// back with NewToken without losing information.
+type UnknownToken struct {
+	Token
+}
+
+func (t *UnknownToken) TokenType() string {
+	return t.Type
+}
+
+func (t *UnknownToken) TokenKeyslots() []int {
+	return t.Keyslots
+}
+
+// SecbootToken corresponds to a token used to store the metadata associated with
+// a secboot managed keyslot.
+type SecbootToken struct {
+	Version  int    // Format version of this token
+	Keyslot  int    // The keyslot that this token is bound to
+	Recovery bool   // The keyslot contains a recovery key
+	KeyData  []byte // Serialized key data for a platform protected key
+}
+
+func (t *SecbootToken) TokenType() string {
+	return SecbootTokenType
+}
+
+func (t *SecbootToken) TokenKeyslots() []int {
+	return []int{t.Keyslot}
+}
+
+func (t *SecbootToken) validate() error {
+	switch {
+	case t.Version < 1 || t.Version > SecbootTokenVersion:
+		return fmt.Errorf("unsupported version %d", t.Version)
+	case t.Keyslot < 0 || t.Keyslot >= maxKeyslots:
+		return fmt.Errorf("invalid keyslot %d", t.Keyslot)
+	case t.Recovery && len(t.KeyData) > 0:
+		return errors.New("recovery key token has key data")
+	case !t.Recovery && len(t.KeyData) == 0:
+		return errors.New("no key data")
+	}
+	return nil
+}
+
+type secbootTokenRaw struct {
+	Type     string           `json:"type"`
+	Keyslots []luksJsonNumber `json:"keyslots"`
+	Version  int              `json:"secboot_version"`
+	Recovery bool             `json:"secboot_recovery,omitempty"`
+	KeyData  []byte           `json:"secboot_key_data,omitempty"`
+}
+
+func (t SecbootToken) MarshalJSON() ([]byte, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&secbootTokenRaw{
+		Type:     SecbootTokenType,
+		Keyslots: intsToLuksJsonNumbers([]int{t.Keyslot}),
+		Version:  t.Version,
+		Recovery: t.Recovery,
+		KeyData:  t.KeyData})
+}
+
+func (t *SecbootToken) UnmarshalJSON(data []byte) error {
+	var d secbootTokenRaw
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+	if d.Type != SecbootTokenType {
+		return fmt.Errorf("invalid type %q", d.Type)
+	}
+	if len(d.Keyslots) != 1 {
+		return fmt.Errorf("invalid number of keyslots (%d)", len(d.Keyslots))
+	}
+	slot, err := d.Keyslots[0].int()
+	if err != nil {
+		return xerrors.Errorf("invalid keyslot id: %w", err)
+	}
+
+	token := SecbootToken{
+		Version:  d.Version,
+		Keyslot:  slot,
+		Recovery: d.Recovery,
+		KeyData:  d.KeyData}
+	if err := token.validate(); err != nil {
+		return err
+	}
+	*t = token
+	return nil
+}
+
+func decodeSecbootToken(data []byte) (TypedToken, error) {
+	var token *SecbootToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func init() {
+	RegisterTokenDecoder(SecbootTokenType, decodeSecbootToken)
+}
@@ -0,0 +1,183 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+)
+
+type tokenSuite struct{}
+
+var _ = Suite(&tokenSuite{})
+
+type testSecbootTokenRoundTripData struct {
+	token          *SecbootToken
+	expectedParams map[string]interface{}
+}
+
+func (s *tokenSuite) testSecbootTokenRoundTrip(c *C, data *testSecbootTokenRoundTripData) {
+	token, err := NewToken(data.token)
+	c.Assert(err, IsNil)
+	c.Check(token.Type, Equals, SecbootTokenType)
+	c.Check(token.Keyslots, DeepEquals, []int{data.token.Keyslot})
+	c.Check(token.Params, DeepEquals, data.expectedParams)
+
+	// Round-trip through the JSON encoding used in the header.
+	b, err := json.Marshal(token)
+	c.Assert(err, IsNil)
+	var decoded *Token
+	c.Assert(json.Unmarshal(b, &decoded), IsNil)
+
+	typed, err := decoded.Decode()
+	c.Assert(err, IsNil)
+	c.Check(typed, DeepEquals, data.token)
+}
+
+func (s *tokenSuite) TestSecbootTokenRoundTripKeyData(c *C) {
+	s.testSecbootTokenRoundTrip(c, &testSecbootTokenRoundTripData{
+		token: &SecbootToken{
+			Version: SecbootTokenVersion,
+			Keyslot: 0,
+			KeyData: []byte("foo")},
+		expectedParams: map[string]interface{}{
+			"secboot_version":  float64(1),
+			"secboot_key_data": "Zm9v"},
+	})
+}
+
+func (s *tokenSuite) TestSecbootTokenRoundTripRecovery(c *C) {
+	s.testSecbootTokenRoundTrip(c, &testSecbootTokenRoundTripData{
+		token: &SecbootToken{
+			Version:  SecbootTokenVersion,
+			Keyslot:  1,
+			Recovery: true},
+		expectedParams: map[string]interface{}{
+			"secboot_version":  float64(1),
+			"secboot_recovery": true},
+	})
+}
+
+func (s *tokenSuite) TestDecodeUnknownToken(c *C) {
+	token := &Token{
+		Type:     "luks2-keyring",
+		Keyslots: []int{0, 3},
+		Params: map[string]interface{}{
+			"key_description": "foo",
+			"bar":             map[string]interface{}{"baz": []interface{}{float64(1), "2"}}}}
+
+	typed, err := token.Decode()
+	c.Assert(err, IsNil)
+	c.Assert(typed, FitsTypeOf, &UnknownToken{})
+	c.Check(typed.TokenType(), Equals, "luks2-keyring")
+	c.Check(typed.TokenKeyslots(), DeepEquals, []int{0, 3})
+
+	// The decoded token must be a copy.
+	token.Params["key_description"] = "bar"
+
+	encoded, err := NewToken(typed)
+	c.Assert(err, IsNil)
+	c.Check(encoded, DeepEquals, &Token{
+		Type:     "luks2-keyring",
+		Keyslots: []int{0, 3},
+		Params: map[string]interface{}{
+			"key_description": "foo",
+			"bar":             map[string]interface{}{"baz": []interface{}{float64(1), "2"}}}})
+}
+
+func (s *tokenSuite) TestDecodeUnknownTokenFromJSON(c *C) {
+	data := []byte(`{"type":"foo","keyslots":["2"],"a":"b","c":[1,2,{"d":null}]}`)
+
+	var token *Token
+	c.Assert(json.Unmarshal(data, &token), IsNil)
+	typed, err := token.Decode()
+	c.Assert(err, IsNil)
+
+	encoded, err := NewToken(typed)
+	c.Assert(err, IsNil)
+	b, err := json.Marshal(encoded)
+	c.Assert(err, IsNil)
+	c.Check(b, DeepEquals, []byte(`{"a":"b","c":[1,2,{"d":null}],"keyslots":["2"],"type":"foo"}`))
+}
+
+func (s *tokenSuite) testDecodeSecbootTokenError(c *C, data string, expected string) {
+	var token *Token
+	c.Assert(json.Unmarshal([]byte(data), &token), IsNil)
+	_, err := token.Decode()
+	c.Check(err, ErrorMatches, expected)
+}
+
+func (s *tokenSuite) TestDecodeSecbootTokenNoKeyData(c *C) {
+	s.testDecodeSecbootTokenError(c, `{"type":"secboot","keyslots":["0"],"secboot_version":1}`,
+		"cannot decode secboot token: no key data")
+}
+
+func (s *tokenSuite) TestDecodeSecbootTokenRecoveryWithKeyData(c *C) {
+	s.testDecodeSecbootTokenError(c, `{"type":"secboot","keyslots":["0"],"secboot_version":1,"secboot_recovery":true,"secboot_key_data":"Zm9v"}`,
+		"cannot decode secboot token: recovery key token has key data")
+}
+
+func (s *tokenSuite) TestDecodeSecbootTokenUnsupportedVersion(c *C) {
+	s.testDecodeSecbootTokenError(c, `{"type":"secboot","keyslots":["0"],"secboot_version":2,"secboot_key_data":"Zm9v"}`,
+		"cannot decode secboot token: unsupported version 2")
+}
+
+func (s *tokenSuite) TestDecodeSecbootTokenMultipleKeyslots(c *C) {
+	s.testDecodeSecbootTokenError(c, `{"type":"secboot","keyslots":["0","1"],"secboot_version":1,"secboot_key_data":"Zm9v"}`,
+		"cannot decode secboot token: invalid number of keyslots \\(2\\)")
+}
+
+func (s *tokenSuite) TestNewTokenInvalidSecbootToken(c *C) {
+	_, err := NewToken(&SecbootToken{Version: SecbootTokenVersion, Keyslot: 32, KeyData: []byte("foo")})
+	c.Check(err, ErrorMatches, "cannot encode token: json: error calling MarshalJSON for type \\*luks2.SecbootToken: invalid keyslot 32")
+}
+
+type testCustomToken struct {
+	Slot int    `json:"-"`
+	Foo  string `json:"foo"`
+}
+
+func (t *testCustomToken) TokenType() string    { return "secboot-test-custom" }
+func (t *testCustomToken) TokenKeyslots() []int { return []int{t.Slot} }
+
+func (s *tokenSuite) TestRegisterTokenDecoder(c *C) {
+	RegisterTokenDecoder("secboot-test-custom", func(data []byte) (TypedToken, error) {
+		var d struct {
+			Keyslots []string `json:"keyslots"`
+			Foo      string   `json:"foo"`
+		}
+		if err := json.Unmarshal(data, &d); err != nil {
+			return nil, err
+		}
+		c.Check(d.Keyslots, DeepEquals, []string{"4"})
+		return &testCustomToken{Slot: 4, Foo: d.Foo}, nil
+	})
+
+	token := &Token{Type: "secboot-test-custom", Keyslots: []int{4}, Params: map[string]interface{}{"foo": "bar"}}
+	typed, err := token.Decode()
+	c.Assert(err, IsNil)
+	c.Check(typed, DeepEquals, &testCustomToken{Slot: 4, Foo: "bar"})
+
+	c.Check(func() { RegisterTokenDecoder("secboot-test-custom", nil) }, PanicMatches,
+		"token decoder for type \"secboot-test-custom\" already registered")
+}
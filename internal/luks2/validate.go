@@ -0,0 +1,395 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// maxKeyslots is the maximum number of keyslots supported by libcryptsetup
+	// (LUKS2_KEYSLOTS_MAX).
+	maxKeyslots = 32
+
+	binaryHdrSize = 4096
+	sectorSize    = 512
+)
+
+// validHdrSizes are the permitted sizes of a single copy of the binary header and
+// JSON metadata area (see Table 1: Possible LUKS2 secondary header offsets and JSON
+// area size in the LUKS2 On-Disk Format specification).
+var validHdrSizes = []uint64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+
+// ValidationError is returned from Metadata.Validate when the metadata is inconsistent.
+type ValidationError struct {
+	err error
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid metadata: " + e.err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.err
+}
+
+func sortedKeys(m interface{}) []int {
+	var keys []int
+	switch v := m.(type) {
+	case map[int]*Keyslot:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[int]*Segment:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[int]*Digest:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[int]*Token:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func (m *Metadata) validateConfig() error {
+	hdrSize := m.Config.JSONSize + binaryHdrSize
+	valid := false
+	for _, sz := range validHdrSizes {
+		if sz == hdrSize {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid JSON area size %d", m.Config.JSONSize)
+	}
+	if m.Config.KeyslotsSize%4096 != 0 {
+		return fmt.Errorf("keyslots area size %d is not aligned to 4096 bytes", m.Config.KeyslotsSize)
+	}
+	return nil
+}
+
+type byteRange struct {
+	id          int
+	start, size uint64
+}
+
+func (r byteRange) end() uint64 {
+	return r.start + r.size
+}
+
+// checkOverlaps returns an error if any of the supplied ranges overlap.
+func checkOverlaps(ranges []byteRange, what string) error {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].start < ranges[i-1].end() {
+			return fmt.Errorf("%s %d overlaps with %s %d", what, ranges[i-1].id, what, ranges[i].id)
+		}
+	}
+	return nil
+}
+
+// validateKDF checks that the supplied KDF has a known type and sensible
+// cost parameters.
+func validateKDF(kdf *KDF) error {
+	switch kdf.Type {
+	case KDFTypePBKDF2:
+		switch {
+		case kdf.Hash.GetHash() == 0:
+			return fmt.Errorf("unknown hash algorithm %q", kdf.Hash)
+		case kdf.Iterations <= 0:
+			return fmt.Errorf("invalid iterations %d", kdf.Iterations)
+		}
+	case KDFTypeArgon2i, KDFTypeArgon2id:
+		switch {
+		case kdf.Time <= 0:
+			return fmt.Errorf("invalid time cost %d", kdf.Time)
+		case kdf.Memory <= 0:
+			return fmt.Errorf("invalid memory cost %d", kdf.Memory)
+		case kdf.CPUs <= 0:
+			return fmt.Errorf("invalid number of threads %d", kdf.CPUs)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", kdf.Type)
+	}
+	return nil
+}
+
+func (m *Metadata) validateKeyslots() error {
+	hdrSize := m.Config.JSONSize + binaryHdrSize
+	areaStart := 2 * hdrSize
+	areaEnd := areaStart + m.Config.KeyslotsSize
+
+	var areas []byteRange
+	for _, id := range sortedKeys(m.Keyslots) {
+		keyslot := m.Keyslots[id]
+		switch {
+		case id < 0 || id >= maxKeyslots:
+			return fmt.Errorf("invalid keyslot ID %d", id)
+		case keyslot == nil:
+			return fmt.Errorf("keyslot %d is null", id)
+		case keyslot.Area == nil:
+			return fmt.Errorf("keyslot %d has no area", id)
+		}
+
+		switch keyslot.Type {
+		case KeyslotTypeLUKS2:
+			switch {
+			case keyslot.KeySize <= 0:
+				return fmt.Errorf("keyslot %d has invalid key size %d", id, keyslot.KeySize)
+			case keyslot.KDF == nil:
+				return fmt.Errorf("keyslot %d has no KDF", id)
+			case keyslot.AF == nil:
+				return fmt.Errorf("keyslot %d has no AF", id)
+			case keyslot.AF.Stripes <= 0:
+				return fmt.Errorf("keyslot %d has invalid AF stripes %d", id, keyslot.AF.Stripes)
+			case keyslot.Area.Type != AreaTypeRaw:
+				return fmt.Errorf("keyslot %d has invalid area type %q", id, keyslot.Area.Type)
+			case keyslot.Area.Size < uint64(keyslot.KeySize)*uint64(keyslot.AF.Stripes):
+				return fmt.Errorf("keyslot %d area is too small", id)
+			}
+			if err := validateKDF(keyslot.KDF); err != nil {
+				return fmt.Errorf("keyslot %d has invalid KDF: %v", id, err)
+			}
+		case KeyslotTypeReencrypt:
+		default:
+			// libcryptsetup rejects headers with unknown keyslot types
+			return fmt.Errorf("keyslot %d has unknown type %q", id, keyslot.Type)
+		}
+
+		area := byteRange{id: id, start: keyslot.Area.Offset, size: keyslot.Area.Size}
+		if area.end() < area.start || area.start < areaStart || area.end() > areaEnd {
+			return fmt.Errorf("keyslot %d area is outside of the keyslots area", id)
+		}
+		if area.size > 0 {
+			areas = append(areas, area)
+		}
+	}
+
+	return checkOverlaps(areas, "keyslot area")
+}
+
+func (m *Metadata) validateSegments(deviceSize uint64) error {
+	ids := sortedKeys(m.Segments)
+	if len(ids) == 0 {
+		return errors.New("no segments")
+	}
+
+	var segments []byteRange
+	dynamic := -1
+	var minOffset uint64
+	haveMinOffset := false
+	for i, id := range ids {
+		segment := m.Segments[id]
+		switch {
+		case id != i:
+			return fmt.Errorf("segment IDs are not contiguous (missing segment %d)", i)
+		case segment == nil:
+			return fmt.Errorf("segment %d is null", id)
+		case segment.Offset%sectorSize != 0:
+			return fmt.Errorf("segment %d offset is not aligned to %d bytes", id, sectorSize)
+		case !segment.DynamicSize && segment.Size%sectorSize != 0:
+			return fmt.Errorf("segment %d size is not aligned to %d bytes", id, sectorSize)
+		}
+
+		switch segment.Type {
+		case SegmentTypeCrypt:
+			switch segment.SectorSize {
+			case 512, 1024, 2048, 4096:
+			default:
+				return fmt.Errorf("segment %d has invalid sector size %d", id, segment.SectorSize)
+			}
+			if segment.Offset%uint64(segment.SectorSize) != 0 {
+				return fmt.Errorf("segment %d offset is not aligned to its sector size", id)
+			}
+		case SegmentTypeLinear:
+		default:
+			return fmt.Errorf("segment %d has unknown type %q", id, segment.Type)
+		}
+
+		if segment.isBackup() {
+			// Backup segments describe the parameters of a reencryption
+			// operation rather than an area of the device.
+			continue
+		}
+
+		if !haveMinOffset || segment.Offset < minOffset {
+			minOffset = segment.Offset
+			haveMinOffset = true
+		}
+
+		if deviceSize > 0 {
+			switch {
+			case segment.Offset > deviceSize:
+				return fmt.Errorf("segment %d starts beyond the end of the device", id)
+			case !segment.DynamicSize && segment.Size > deviceSize-segment.Offset:
+				return fmt.Errorf("segment %d extends beyond the end of the device", id)
+			}
+		}
+
+		if segment.DynamicSize {
+			if dynamic >= 0 {
+				return fmt.Errorf("segments %d and %d both have a dynamic size", dynamic, id)
+			}
+			dynamic = id
+			continue
+		}
+		if segment.Offset+segment.Size < segment.Offset {
+			return fmt.Errorf("segment %d size is too large", id)
+		}
+		segments = append(segments, byteRange{id: id, start: segment.Offset, size: segment.Size})
+	}
+
+	// Data must start after the header and keyslots area. An offset of 0
+	// indicates that the header is detached.
+	areaEnd := 2*(m.Config.JSONSize+binaryHdrSize) + m.Config.KeyslotsSize
+	if minOffset > 0 && minOffset < areaEnd {
+		return fmt.Errorf("segments overlap with the header and keyslots area (data offset %d, keyslots area ends at %d)", minOffset, areaEnd)
+	}
+
+	if dynamic >= 0 {
+		// Only the last segment can have a dynamic size.
+		for _, s := range segments {
+			if s.end() > m.Segments[dynamic].Offset {
+				return fmt.Errorf("segment %d with dynamic size is not the last segment", dynamic)
+			}
+		}
+	}
+
+	return checkOverlaps(segments, "segment")
+}
+
+func (m *Metadata) validateDigests() error {
+	keyslots := make(map[int]int)
+	for _, id := range sortedKeys(m.Digests) {
+		digest := m.Digests[id]
+		switch {
+		case digest == nil:
+			return fmt.Errorf("digest %d is null", id)
+		case digest.Type != KDFTypePBKDF2:
+			// pbkdf2 is the only digest type defined by the specification.
+			return fmt.Errorf("digest %d has unknown type %q", id, digest.Type)
+		case digest.Hash.GetHash() == 0:
+			return fmt.Errorf("digest %d has unknown hash algorithm %q", id, digest.Hash)
+		case digest.Iterations <= 0:
+			return fmt.Errorf("digest %d has invalid iterations %d", id, digest.Iterations)
+		}
+
+		for _, slot := range digest.Keyslots {
+			if _, ok := m.Keyslots[slot]; !ok {
+				return fmt.Errorf("digest %d references missing keyslot %d", id, slot)
+			}
+			if other, ok := keyslots[slot]; ok {
+				return fmt.Errorf("keyslot %d is assigned to digests %d and %d", slot, other, id)
+			}
+			keyslots[slot] = id
+		}
+		for _, segment := range digest.Segments {
+			if _, ok := m.Segments[segment]; !ok {
+				return fmt.Errorf("digest %d references missing segment %d", id, segment)
+			}
+		}
+	}
+
+	for _, id := range sortedKeys(m.Keyslots) {
+		if m.Keyslots[id].Type != KeyslotTypeLUKS2 {
+			continue
+		}
+		if _, ok := keyslots[id]; !ok {
+			return fmt.Errorf("keyslot %d is not assigned to a digest", id)
+		}
+	}
+
+	return nil
+}
+
+func (m *Metadata) validateTokens() error {
+	for _, id := range sortedKeys(m.Tokens) {
+		token := m.Tokens[id]
+		switch {
+		case id < 0 || id >= maxTokens:
+			return fmt.Errorf("invalid token ID %d", id)
+		case token == nil:
+			return fmt.Errorf("token %d is null", id)
+		}
+		for _, slot := range token.Keyslots {
+			if _, ok := m.Keyslots[slot]; !ok {
+				return fmt.Errorf("token %d references missing keyslot %d", id, slot)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks that the metadata is consistent according to the rules of the LUKS2
+// On-Disk Format specification, in a similar way to libcryptsetup. This checks that:
+//   - The JSON and keyslots area sizes are valid.
+//   - Every keyslot area is inside of the keyslots area, and keyslot areas don't overlap.
+//   - Keyslot KDFs have a known type and hash algorithm and non-zero cost parameters.
+//   - Segments have contiguous IDs, are correctly aligned and don't overlap, only
+//     the last segment has a dynamic size, and data starts after the keyslots area
+//     unless the header is detached.
+//   - Digests have a known type and hash algorithm and a non-zero iteration count,
+//     only reference keyslots and segments that exist, and every keyslot is
+//     assigned to exactly one digest.
+//   - Tokens only reference keyslots that exist.
+//
+// If deviceSize is not zero, it is the size of the device containing the encrypted data
+// in bytes, and segments are also checked to be within it.
+//
+// Metadata that fails validation is returned as a *ValidationError.
+func (m *Metadata) Validate(deviceSize uint64) error {
+	for _, fn := range []func() error{
+		m.validateConfig,
+		m.validateKeyslots,
+		func() error { return m.validateSegments(deviceSize) },
+		m.validateDigests,
+		m.validateTokens,
+	} {
+		if err := fn(); err != nil {
+			return &ValidationError{err: err}
+		}
+	}
+	return nil
+}
+
+// validateHeader validates the supplied decoded header copy, marking it as invalid
+// if it fails validation.
+func validateHeader(hdr *decodedHeader, deviceSize uint64) {
+	if hdr.err != nil {
+		return
+	}
+	if hdr.metadata.Config.JSONSize != hdr.hdr.HdrSize-binaryHdrSize {
+		hdr.err = &ValidationError{err: fmt.Errorf("inconsistent JSON area size (%d bytes in metadata, %d bytes in binary header)",
+			hdr.metadata.Config.JSONSize, hdr.hdr.HdrSize-binaryHdrSize)}
+		return
+	}
+	if err := hdr.metadata.Validate(deviceSize); err != nil {
+		hdr.err = err
+	}
+}
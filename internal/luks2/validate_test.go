@@ -0,0 +1,389 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+)
+
+type validateSuite struct{}
+
+var _ = Suite(&validateSuite{})
+
+const validMetadata = `{
+	"keyslots": {
+		"0": {"type":"luks2","key_size":64,"af":{"type":"luks1","stripes":4000,"hash":"sha256"},"area":{"type":"raw","offset":"32768","size":"258048","encryption":"aes-xts-plain64","key_size":64},"kdf":{"type":"argon2i","time":4,"memory":32768,"cpus":4,"salt":"c2FsdA=="},"priority":2},
+		"1": {"type":"luks2","key_size":64,"af":{"type":"luks1","stripes":4000,"hash":"sha256"},"area":{"type":"raw","offset":"290816","size":"258048","encryption":"aes-xts-plain64","key_size":64},"kdf":{"type":"pbkdf2","hash":"sha256","iterations":1000,"salt":"c2FsdA=="}}
+	},
+	"tokens": {
+		"0": {"type":"secboot-test","keyslots":["0"]}
+	},
+	"segments": {
+		"0": {"type":"crypt","offset":"16777216","size":"dynamic","iv_tweak":"0","encryption":"aes-xts-plain64","sector_size":512}
+	},
+	"digests": {
+		"0": {"type":"pbkdf2","keyslots":["0","1"],"segments":["0"],"hash":"sha256","iterations":1000,"salt":"c2FsdA==","digest":"ZGlnZXN0"}
+	},
+	"config": {"json_size":"12288","keyslots_size":"16744448"}
+}`
+
+func (s *validateSuite) decode(c *C, data string) *Metadata {
+	var metadata Metadata
+	c.Assert(json.Unmarshal([]byte(data), &metadata), IsNil)
+	return &metadata
+}
+
+func (s *validateSuite) TestValid(c *C) {
+	c.Check(s.decode(c, validMetadata).Validate(0), IsNil)
+}
+
+func (s *validateSuite) TestValidWithDeviceSize(c *C) {
+	c.Check(s.decode(c, validMetadata).Validate(32*1024*1024), IsNil)
+}
+
+func (s *validateSuite) TestValidReencryptInProgress(c *C) {
+	c.Check(s.decode(c, reencryptInProgressMetadata).Validate(0), IsNil)
+}
+
+func (s *validateSuite) TestValidEncryptInProgress(c *C) {
+	c.Check(s.decode(c, encryptInProgressMetadata).Validate(64*1024*1024), IsNil)
+}
+
+type testValidateInvalidData struct {
+	deviceSize uint64
+	modify     func(metadata *Metadata)
+	err        string
+}
+
+func (s *validateSuite) testValidateInvalid(c *C, data *testValidateInvalidData) {
+	metadata := s.decode(c, validMetadata)
+	data.modify(metadata)
+
+	err := metadata.Validate(data.deviceSize)
+	c.Assert(err, FitsTypeOf, &ValidationError{})
+	c.Check(err, ErrorMatches, "invalid metadata: "+data.err)
+}
+
+func (s *validateSuite) TestInvalidJSONSize(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Config.JSONSize = 10000 },
+		err:    "invalid JSON area size 10000"})
+}
+
+func (s *validateSuite) TestInvalidKeyslotsSize(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Config.KeyslotsSize = 16744449 },
+		err:    "keyslots area size 16744449 is not aligned to 4096 bytes"})
+}
+
+func (s *validateSuite) TestInvalidKeyslotID(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) {
+			metadata.Keyslots[32] = metadata.Keyslots[1]
+			delete(metadata.Keyslots, 1)
+			metadata.Digests[0].Keyslots = []int{0, 32}
+		},
+		err: "invalid keyslot ID 32"})
+}
+
+func (s *validateSuite) TestKeyslotAreaOutsideKeyslotsArea(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[1].Area.Offset = 16384 },
+		err:    "keyslot 1 area is outside of the keyslots area"})
+}
+
+func (s *validateSuite) TestKeyslotAreaBeyondKeyslotsArea(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[1].Area.Offset = 16777216 - 4096 },
+		err:    "keyslot 1 area is outside of the keyslots area"})
+}
+
+func (s *validateSuite) TestKeyslotAreasOverlap(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[1].Area.Offset = 32768 + 4096 },
+		err:    "keyslot area 0 overlaps with keyslot area 1"})
+}
+
+func (s *validateSuite) TestKeyslotAreaTooSmall(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[0].Area.Size = 4096 },
+		err:    "keyslot 0 area is too small"})
+}
+
+func (s *validateSuite) TestKeyslotNoKDF(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[0].KDF = nil },
+		err:    "keyslot 0 has no KDF"})
+}
+
+func (s *validateSuite) TestKeyslotUnknownKDFType(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[0].KDF.Type = "scrypt" },
+		err:    `keyslot 0 has invalid KDF: unknown type "scrypt"`})
+}
+
+func (s *validateSuite) TestKeyslotKDFZeroMemory(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[0].KDF.Memory = 0 },
+		err:    "keyslot 0 has invalid KDF: invalid memory cost 0"})
+}
+
+func (s *validateSuite) TestKeyslotKDFZeroTime(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[0].KDF.Time = 0 },
+		err:    "keyslot 0 has invalid KDF: invalid time cost 0"})
+}
+
+func (s *validateSuite) TestKeyslotKDFZeroIterations(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[1].KDF.Iterations = 0 },
+		err:    "keyslot 1 has invalid KDF: invalid iterations 0"})
+}
+
+func (s *validateSuite) TestKeyslotKDFUnknownHash(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[1].KDF.Hash = "md5" },
+		err:    `keyslot 1 has invalid KDF: unknown hash algorithm "md5"`})
+}
+
+func (s *validateSuite) TestKeyslotUnknownType(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Keyslots[1].Type = "foo" },
+		err:    `keyslot 1 has unknown type "foo"`})
+}
+
+func (s *validateSuite) TestDigestMissingKeyslot(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Digests[0].Keyslots = []int{0, 1, 3} },
+		err:    "digest 0 references missing keyslot 3"})
+}
+
+func (s *validateSuite) TestDigestMissingSegment(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Digests[0].Segments = []int{0, 1} },
+		err:    "digest 0 references missing segment 1"})
+}
+
+func (s *validateSuite) TestKeyslotWithoutDigest(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Digests[0].Keyslots = []int{0} },
+		err:    "keyslot 1 is not assigned to a digest"})
+}
+
+func (s *validateSuite) TestKeyslotWithMultipleDigests(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) {
+			metadata.Digests[1] = &Digest{Type: KDFTypePBKDF2, Keyslots: []int{1}, Segments: []int{0}, Hash: HashSHA256, Iterations: 1000}
+		},
+		err: "keyslot 1 is assigned to digests 0 and 1"})
+}
+
+func (s *validateSuite) TestDigestUnknownType(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Digests[0].Type = KDFTypeArgon2i },
+		err:    `digest 0 has unknown type "argon2i"`})
+}
+
+func (s *validateSuite) TestDigestUnknownHash(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Digests[0].Hash = "md5" },
+		err:    `digest 0 has unknown hash algorithm "md5"`})
+}
+
+func (s *validateSuite) TestDigestZeroIterations(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Digests[0].Iterations = 0 },
+		err:    "digest 0 has invalid iterations 0"})
+}
+
+func (s *validateSuite) TestTokenMissingKeyslot(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Tokens[0].Keyslots = []int{5} },
+		err:    "token 0 references missing keyslot 5"})
+}
+
+func (s *validateSuite) TestInvalidTokenID(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Tokens[40] = &Token{Type: "foo"} },
+		err:    "invalid token ID 40"})
+}
+
+func (s *validateSuite) TestNoSegments(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) {
+			metadata.Segments = nil
+			metadata.Digests[0].Segments = nil
+		},
+		err: "no segments"})
+}
+
+func (s *validateSuite) TestSegmentIDGap(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) {
+			metadata.Segments[2] = metadata.Segments[0]
+			delete(metadata.Segments, 0)
+			metadata.Digests[0].Segments = []int{2}
+		},
+		err: `segment IDs are not contiguous \(missing segment 0\)`})
+}
+
+func (s *validateSuite) TestSegmentMisaligned(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Segments[0].Offset += 100 },
+		err:    "segment 0 offset is not aligned to 512 bytes"})
+}
+
+func (s *validateSuite) TestSegmentInvalidSectorSize(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Segments[0].SectorSize = 8192 },
+		err:    "segment 0 has invalid sector size 8192"})
+}
+
+func (s *validateSuite) TestSegmentBeyondDevice(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		deviceSize: 8 * 1024 * 1024,
+		modify:     func(*Metadata) {},
+		err:        "segment 0 starts beyond the end of the device"})
+}
+
+func (s *validateSuite) TestFixedSizeSegmentBeyondDevice(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		deviceSize: 32 * 1024 * 1024,
+		modify: func(metadata *Metadata) {
+			metadata.Segments[0].DynamicSize = false
+			metadata.Segments[0].Size = 32 * 1024 * 1024
+		},
+		err: "segment 0 extends beyond the end of the device"})
+}
+
+func (s *validateSuite) TestSegmentOverlapsKeyslotsArea(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) { metadata.Segments[0].Offset = 8 * 1024 * 1024 },
+		err:    `segments overlap with the header and keyslots area \(data offset 8388608, keyslots area ends at 16777216\)`})
+}
+
+func (s *validateSuite) TestValidDetachedHeader(c *C) {
+	metadata := s.decode(c, validMetadata)
+	metadata.Segments[0].Offset = 0
+	c.Check(metadata.Validate(0), IsNil)
+}
+
+func (s *validateSuite) TestSegmentsOverlap(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) {
+			metadata.Segments[0].DynamicSize = false
+			metadata.Segments[0].Size = 1024 * 1024
+			segment := *metadata.Segments[0]
+			segment.Offset += 512 * 1024
+			metadata.Segments[1] = &segment
+			metadata.Digests[0].Segments = []int{0, 1}
+		},
+		err: "segment 0 overlaps with segment 1"})
+}
+
+func (s *validateSuite) TestDynamicSegmentNotLast(c *C) {
+	s.testValidateInvalid(c, &testValidateInvalidData{
+		modify: func(metadata *Metadata) {
+			segment := *metadata.Segments[0]
+			segment.DynamicSize = false
+			segment.Offset += 1024 * 1024
+			segment.Size = 1024 * 1024
+			metadata.Segments[1] = &segment
+			metadata.Digests[0].Segments = []int{0, 1}
+		},
+		err: "segment 0 with dynamic size is not the last segment"})
+}
+
+func (s *metadataSuite) TestReadHeaderWithOptionsValidate(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	expected, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	info, err := ReadHeaderWithOptions(path, LockModeBlocking, &ReadHeaderOptions{Validate: true})
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, expected)
+}
+
+func (s *metadataSuite) TestReadHeaderWithOptionsValidateFallsBackToValidCopy(c *C) {
+	stderr := new(bytes.Buffer)
+	s.AddCleanup(MockStderr(stderr))
+
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	orig, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	// Write a newer header with a token that references a missing keyslot, and
+	// then restore the original secondary header. The checksums of both copies
+	// are valid.
+	c.Assert(UpdateHeader(path, LockModeBlocking, func(metadata *Metadata) error {
+		metadata.Tokens[0].Keyslots = []int{5}
+		return nil
+	}), IsNil)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteAt(orig[16384:32768], 16384)
+	c.Assert(err, IsNil)
+
+	info, err := ReadHeader(path, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Tokens[0].Keyslots, DeepEquals, []int{5})
+
+	stderr.Reset()
+	info, err = ReadHeaderWithOptions(path, LockModeBlocking, &ReadHeaderOptions{Validate: true})
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Tokens[0].Keyslots, DeepEquals, []int{0})
+	c.Check(stderr.String(), Matches, "luks2.ReadHeader: primary header for .* is invalid: invalid metadata: token 0 references missing keyslot 5\n")
+}
+
+func (s *metadataSuite) TestReadHeaderWithOptionsValidateNoValidCopy(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	c.Assert(UpdateHeader(path, LockModeBlocking, func(metadata *Metadata) error {
+		metadata.Digests[0].Keyslots = []int{0, 1, 2}
+		return nil
+	}), IsNil)
+
+	_, err := ReadHeaderWithOptions(path, LockModeBlocking, &ReadHeaderOptions{Validate: true})
+	c.Check(err, ErrorMatches, "no valid header found, error from decoding primary header: invalid metadata: digest 0 references missing keyslot 2")
+}
+
+func (s *metadataSuite) TestReadHeaderWithOptionsValidateDeviceSize(c *C) {
+	path := s.decompress(c, "testdata/luks2-valid-hdr.img")
+
+	c.Assert(UpdateHeader(path, LockModeBlocking, func(metadata *Metadata) error {
+		metadata.Segments[0].Offset = 16 * 1024 * 1024
+		return nil
+	}), IsNil)
+
+	_, err := ReadHeaderWithOptions(path, LockModeBlocking, &ReadHeaderOptions{Validate: true, DeviceSize: 16 * 1024 * 1024})
+	c.Check(err, IsNil)
+	_, err = ReadHeaderWithOptions(path, LockModeBlocking, &ReadHeaderOptions{Validate: true, DeviceSize: 8 * 1024 * 1024})
+	c.Check(err, ErrorMatches, "no valid header found, error from decoding primary header: invalid metadata: segment 0 starts beyond the end of the device")
+}
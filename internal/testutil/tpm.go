@@ -58,8 +58,9 @@ var (
 	useTpm         bool
 	tpmPathForTest string
 
-	UseMssim  bool // Whether use of the TPM simulator is requested
-	MssimPort uint // The port number of the TPM interface TCP port
+	UseMssim        bool // Whether use of the TPM simulator is requested
+	MssimPort       uint // The port number of the TPM interface TCP port
+	SecondMssimPort uint // The port number of the TPM interface TCP port of a second simulator, for tests that need 2 TPMs
 
 	// EncodedTPMSimulatorEKCertChain is the data that will be passed to secboot.SecureConnectToDefaultTPM
 	// when OpenTPMSimulatorForTesting is called.
@@ -72,6 +73,7 @@ func init() {
 
 	flag.BoolVar(&UseMssim, "use-mssim", false, "")
 	flag.UintVar(&MssimPort, "mssim-port", 2321, "")
+	flag.UintVar(&SecondMssimPort, "mssim-second-port", 2331, "")
 }
 
 // TPMSimulatorOptions provide the options to LaunchTPMSimulator
@@ -79,6 +81,7 @@ type TPMSimulatorOptions struct {
 	SourceDir      string // Source directory for the persistent data file
 	Manufacture    bool   // Indicates that the simulator should be executed in re-manufacture mode
 	SavePersistent bool   // Saves the persistent data file back to SourceDir on exit
+	Port           uint   // The port number of the TPM interface TCP port. MssimPort is used if this is zero
 }
 
 // LaunchTPMSimulator launches a TPM simulator. A new temporary directory will be created in which the
@@ -101,6 +104,10 @@ func LaunchTPMSimulator(opts *TPMSimulatorOptions) (func(), error) {
 		}
 		opts.SourceDir = wd
 	}
+	port := opts.Port
+	if port == 0 {
+		port = MssimPort
+	}
 
 	// Search for a TPM simulator binary
 	mssimPath := ""
@@ -216,7 +223,7 @@ func LaunchTPMSimulator(opts *TPMSimulatorOptions) (func(), error) {
 				}
 			}()
 
-			tcti, err := mssim.OpenConnection("", MssimPort)
+			tcti, err := mssim.OpenConnection("", port)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Cannot open TPM simulator connection for shutdown: %v\n", err)
 				return
@@ -270,7 +277,7 @@ func LaunchTPMSimulator(opts *TPMSimulatorOptions) (func(), error) {
 	if opts.Manufacture {
 		args = append(args, "-m")
 	}
-	args = append(args, strconv.FormatUint(uint64(MssimPort), 10))
+	args = append(args, strconv.FormatUint(uint64(port), 10))
 
 	cmd = exec.Command(mssimPath, args...)
 	cmd.Dir = mssimTmpDir // Run from the temporary directory we created
@@ -288,7 +295,7 @@ func LaunchTPMSimulator(opts *TPMSimulatorOptions) (func(), error) {
 Loop:
 	for i := 0; ; i++ {
 		var err error
-		tcti, err = mssim.OpenConnection("", MssimPort)
+		tcti, err = mssim.OpenConnection("", port)
 		switch {
 		case err != nil && i == 4:
 			return nil, xerrors.Errorf("cannot open simulator connection: %w", err)
@@ -490,6 +497,30 @@ func OpenTPMSimulatorForTesting() (*secboot_tpm2.Connection, *mssim.Tcti, error)
 	return tpm, tcti, nil
 }
 
+// OpenSecondTPMSimulatorForTesting opens a connection to a second TPM simulator listening on SecondMssimPort, for
+// tests that require 2 TPMs. The connection is not verified with an EK certificate.
+func OpenSecondTPMSimulatorForTesting() (*secboot_tpm2.Connection, *mssim.Tcti, error) {
+	if !UseMssim {
+		return nil, nil, nil
+	}
+
+	var tcti *mssim.Tcti
+
+	restore := MockOpenDefaultTctiFn(func() (tpm2.TCTI, error) {
+		var err error
+		tcti, err = mssim.OpenConnection("", SecondMssimPort)
+		return tcti, err
+	})
+	defer restore()
+
+	tpm, err := secboot_tpm2.ConnectToDefaultTPM()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ConnectToDefaultTPM failed: %v", err)
+	}
+
+	return tpm, tcti, nil
+}
+
 func OpenTPMForTesting() (*secboot_tpm2.Connection, error) {
 	if !useTpm {
 		tpm, _, err := OpenTPMSimulatorForTesting()
@@ -0,0 +1,299 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"sort"
+
+	"github.com/snapcore/secboot/internal/luks2"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	luks2ReadHeader = luks2.ReadHeader
+)
+
+// LUKS2KeyslotUsage describes what a keyslot in a LUKS2 container is used for.
+type LUKS2KeyslotUsage int
+
+const (
+	// LUKS2KeyslotUsageUnknown indicates that the purpose of a keyslot
+	// could not be determined.
+	LUKS2KeyslotUsageUnknown LUKS2KeyslotUsage = iota
+
+	// LUKS2KeyslotUsagePlatformKey indicates that a keyslot contains a
+	// key that is protected by the platform's secure device, such as the
+	// key created by InitializeLUKS2Container.
+	LUKS2KeyslotUsagePlatformKey
+
+	// LUKS2KeyslotUsageRecoveryKey indicates that a keyslot contains a
+	// fallback recovery key, such as one added by
+	// AddRecoveryKeyToLUKS2Container.
+	LUKS2KeyslotUsageRecoveryKey
+
+	// LUKS2KeyslotUsagePassphrase indicates that a keyslot contains a
+	// user passphrase that was not added by this package.
+	LUKS2KeyslotUsagePassphrase
+)
+
+func (u LUKS2KeyslotUsage) String() string {
+	switch u {
+	case LUKS2KeyslotUsagePlatformKey:
+		return "platform-key"
+	case LUKS2KeyslotUsageRecoveryKey:
+		return "recovery-key"
+	case LUKS2KeyslotUsagePassphrase:
+		return "passphrase"
+	default:
+		return "unknown"
+	}
+}
+
+// LUKS2TokenInfo describes a token in the metadata of a LUKS2 container.
+type LUKS2TokenInfo struct {
+	ID       int    // The token ID
+	Type     string // The token type
+	Keyslots []int  // The keyslots that this token refers to
+}
+
+// LUKS2KeyslotInfo describes a keyslot in the metadata of a LUKS2 container.
+type LUKS2KeyslotInfo struct {
+	Slot     int               // The keyslot ID
+	Usage    LUKS2KeyslotUsage // What this keyslot is used for
+	Priority string            // The keyslot priority ("ignore", "normal" or "prefer")
+	KeySize  int               // The size of the key protected by this keyslot, in bytes
+
+	KDFType       string // The KDF type ("pbkdf2", "argon2i" or "argon2id")
+	KDFTime       int    // The number of iterations (argon2 only)
+	KDFMemoryKiB  int    // The memory cost in KiB (argon2 only)
+	KDFCPUs       int    // The number of threads (argon2 only)
+	KDFIterations int    // The number of iterations (pbkdf2 only)
+
+	Digests  []int            // The digests that this keyslot is assigned to
+	Segments []int            // The segments that can be unlocked with this keyslot
+	Tokens   []LUKS2TokenInfo // The tokens that refer to this keyslot
+}
+
+// LUKS2ContainerInventory describes the keyslots and tokens of a LUKS2 container.
+type LUKS2ContainerInventory struct {
+	Label    string             // The container label
+	Keyslots []LUKS2KeyslotInfo // All keyslots, ordered by keyslot ID
+	Tokens   []LUKS2TokenInfo   // All tokens, ordered by token ID
+}
+
+// Keyslot returns information about the keyslot with the specified ID, or nil if it
+// doesn't exist.
+func (i *LUKS2ContainerInventory) Keyslot(slot int) *LUKS2KeyslotInfo {
+	for j := range i.Keyslots {
+		if i.Keyslots[j].Slot == slot {
+			return &i.Keyslots[j]
+		}
+	}
+	return nil
+}
+
+// KeyslotsWithUsage returns information about all of the keyslots with the specified usage.
+func (i *LUKS2ContainerInventory) KeyslotsWithUsage(usage LUKS2KeyslotUsage) (out []LUKS2KeyslotInfo) {
+	for _, k := range i.Keyslots {
+		if k.Usage == usage {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// classifyLUKS2KeyslotFromTokens determines what the keyslot with the supplied ID is used
+// for from the tokens that are assigned to it. Secboot tokens record whether a keyslot
+// contains a platform protected key or a recovery key. Tokens created by
+// systemd-cryptenroll are also recognized. This returns false if none of the tokens
+// indicate what the keyslot is used for, which will be the case for keyslots created by
+// older versions of this package.
+func classifyLUKS2KeyslotFromTokens(slot int, tokens []*luks2.Token) (LUKS2KeyslotUsage, bool) {
+	for _, token := range tokens {
+		switch token.Type {
+		case luks2.SecbootTokenType:
+			decoded, err := token.Decode()
+			if err != nil {
+				return LUKS2KeyslotUsageUnknown, true
+			}
+			t, ok := decoded.(*luks2.SecbootToken)
+			if !ok || t.Keyslot != slot {
+				return LUKS2KeyslotUsageUnknown, true
+			}
+			if t.Recovery {
+				return LUKS2KeyslotUsageRecoveryKey, true
+			}
+			return LUKS2KeyslotUsagePlatformKey, true
+		case "systemd-recovery":
+			return LUKS2KeyslotUsageRecoveryKey, true
+		case "systemd-tpm2":
+			return LUKS2KeyslotUsagePlatformKey, true
+		case "systemd-fido2", "systemd-pkcs11":
+			return LUKS2KeyslotUsageUnknown, true
+		}
+	}
+	return LUKS2KeyslotUsageUnknown, false
+}
+
+// classifyLUKS2Keyslot determines what the supplied keyslot is used for, using the
+// supplied tokens that are assigned to it if they are recognized.
+//
+// Keyslots without a recognized token are classified based on the conventions used
+// by this package: InitializeLUKS2Container and ChangeLUKS2KeyUsingRecoveryKey store
+// the platform key in keyslot 0 with a priority of "prefer", and all keyslots created
+// by this package use the argon2i KDF. Any other keyslots created with argon2i are
+// assumed to be recovery keys. Keyslots created with another KDF were not created by
+// this package and are assumed to be user passphrases.
+//
+// Note that versions of cryptsetup prior to 2.4 also use argon2i by default, so
+// passphrases added with these versions and without a token will be reported as
+// recovery keys.
+func classifyLUKS2Keyslot(slot int, keyslot *luks2.Keyslot, tokens []*luks2.Token) LUKS2KeyslotUsage {
+	if keyslot.Type != luks2.KeyslotTypeLUKS2 || keyslot.KDF == nil {
+		return LUKS2KeyslotUsageUnknown
+	}
+	if usage, ok := classifyLUKS2KeyslotFromTokens(slot, tokens); ok {
+		return usage
+	}
+	if keyslot.Priority == luks2.SlotPriorityIgnore {
+		// Keyslots with this priority are only used when
+		// explicitly requested.
+		return LUKS2KeyslotUsageUnknown
+	}
+
+	switch keyslot.KDF.Type {
+	case luks2.KDFTypeArgon2i:
+		if slot == 0 && keyslot.Priority == luks2.SlotPriorityHigh {
+			return LUKS2KeyslotUsagePlatformKey
+		}
+		return LUKS2KeyslotUsageRecoveryKey
+	case luks2.KDFTypeArgon2id, luks2.KDFTypePBKDF2:
+		return LUKS2KeyslotUsagePassphrase
+	default:
+		return LUKS2KeyslotUsageUnknown
+	}
+}
+
+func sortedIDs(ids []int) []int {
+	out := make([]int, len(ids))
+	copy(out, ids)
+	sort.Ints(out)
+	return out
+}
+
+// GetLUKS2ContainerInventory returns information about the keyslots and tokens in the
+// LUKS2 container at the specified path, which can either be the path of a container
+// with an integral header or the path of a detached header. Each keyslot is joined with
+// the digests and tokens that refer to it, and classified according to what it is used
+// for. Keyslots are classified using the tokens assigned to them where possible, and
+// otherwise using heuristics based on the conventions used by this package, in which
+// case the Usage field should be treated as advisory.
+func GetLUKS2ContainerInventory(devicePath string) (*LUKS2ContainerInventory, error) {
+	info, err := luks2ReadHeader(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read header: %w", err)
+	}
+
+	inventory := &LUKS2ContainerInventory{Label: info.Label}
+
+	var tokenIds []int
+	for id := range info.Metadata.Tokens {
+		tokenIds = append(tokenIds, id)
+	}
+	sort.Ints(tokenIds)
+	for _, id := range tokenIds {
+		token := info.Metadata.Tokens[id]
+		inventory.Tokens = append(inventory.Tokens, LUKS2TokenInfo{
+			ID:       id,
+			Type:     token.Type,
+			Keyslots: sortedIDs(token.Keyslots)})
+	}
+
+	var digestIds []int
+	for id := range info.Metadata.Digests {
+		digestIds = append(digestIds, id)
+	}
+	sort.Ints(digestIds)
+
+	var slots []int
+	for slot := range info.Metadata.Keyslots {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+
+	for _, slot := range slots {
+		keyslot := info.Metadata.Keyslots[slot]
+
+		var tokens []*luks2.Token
+		for _, id := range tokenIds {
+			token := info.Metadata.Tokens[id]
+			for _, s := range token.Keyslots {
+				if s != slot {
+					continue
+				}
+				tokens = append(tokens, token)
+				break
+			}
+		}
+
+		k := LUKS2KeyslotInfo{
+			Slot:     slot,
+			Usage:    classifyLUKS2Keyslot(slot, keyslot, tokens),
+			Priority: keyslot.Priority.String(),
+			KeySize:  keyslot.KeySize}
+		if keyslot.KDF != nil {
+			k.KDFType = string(keyslot.KDF.Type)
+			k.KDFTime = keyslot.KDF.Time
+			k.KDFMemoryKiB = keyslot.KDF.Memory
+			k.KDFCPUs = keyslot.KDF.CPUs
+			k.KDFIterations = keyslot.KDF.Iterations
+		}
+
+		for _, id := range digestIds {
+			digest := info.Metadata.Digests[id]
+			for _, s := range digest.Keyslots {
+				if s != slot {
+					continue
+				}
+				k.Digests = append(k.Digests, id)
+				k.Segments = append(k.Segments, digest.Segments...)
+				break
+			}
+		}
+		if k.Segments != nil {
+			k.Segments = sortedIDs(k.Segments)
+		}
+
+		for _, token := range inventory.Tokens {
+			for _, s := range token.Keyslots {
+				if s != slot {
+					continue
+				}
+				k.Tokens = append(k.Tokens, token)
+				break
+			}
+		}
+
+		inventory.Keyslots = append(inventory.Keyslots, k)
+	}
+
+	return inventory, nil
+}
@@ -0,0 +1,244 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+type inventorySuite struct {
+	snapd_testutil.BaseTest
+
+	header *luks2.HeaderInfo
+}
+
+var _ = Suite(&inventorySuite{})
+
+func (s *inventorySuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.header = nil
+	s.AddCleanup(MockLUKS2ReadHeader(func(path string, lockMode luks2.LockMode) (*luks2.HeaderInfo, error) {
+		c.Check(lockMode, Equals, luks2.LockModeBlocking)
+		if path != "/dev/sda1" {
+			return nil, errors.New("no valid header found")
+		}
+		return s.header, nil
+	}))
+}
+
+func (s *inventorySuite) newKeyslot(kdfType luks2.KDFType, priority luks2.SlotPriority) *luks2.Keyslot {
+	kdf := &luks2.KDF{Type: kdfType}
+	switch kdfType {
+	case luks2.KDFTypePBKDF2:
+		kdf.Hash = luks2.HashSHA256
+		kdf.Iterations = 1000
+	default:
+		kdf.Time = 4
+		kdf.Memory = 32768
+		kdf.CPUs = 4
+	}
+	return &luks2.Keyslot{
+		Type:     luks2.KeyslotTypeLUKS2,
+		KeySize:  64,
+		KDF:      kdf,
+		Priority: priority}
+}
+
+func (s *inventorySuite) TestGetLUKS2ContainerInventory(c *C) {
+	s.header = &luks2.HeaderInfo{
+		Label: "data",
+		Metadata: luks2.Metadata{
+			Keyslots: map[int]*luks2.Keyslot{
+				0: s.newKeyslot(luks2.KDFTypeArgon2i, luks2.SlotPriorityHigh),
+				1: s.newKeyslot(luks2.KDFTypeArgon2i, luks2.SlotPriorityNormal),
+				2: s.newKeyslot(luks2.KDFTypeArgon2id, luks2.SlotPriorityNormal),
+				3: s.newKeyslot(luks2.KDFTypePBKDF2, luks2.SlotPriorityIgnore)},
+			Segments: map[int]*luks2.Segment{
+				0: &luks2.Segment{Type: "crypt", DynamicSize: true, Encryption: "aes-xts-plain64", SectorSize: 512}},
+			Digests: map[int]*luks2.Digest{
+				0: &luks2.Digest{Type: luks2.KDFTypePBKDF2, Keyslots: []int{2, 0, 1, 3}, Segments: []int{0}}},
+			Tokens: map[int]*luks2.Token{
+				1: &luks2.Token{Type: "secboot-test", Keyslots: []int{1}},
+				0: &luks2.Token{Type: "luks2-keyring", Keyslots: []int{0, 2}},
+				2: &luks2.Token{Type: "secboot-orphan"}}}}
+
+	inventory, err := GetLUKS2ContainerInventory("/dev/sda1")
+	c.Assert(err, IsNil)
+
+	token0 := LUKS2TokenInfo{ID: 0, Type: "luks2-keyring", Keyslots: []int{0, 2}}
+	token1 := LUKS2TokenInfo{ID: 1, Type: "secboot-test", Keyslots: []int{1}}
+	token2 := LUKS2TokenInfo{ID: 2, Type: "secboot-orphan", Keyslots: []int{}}
+
+	c.Check(inventory, DeepEquals, &LUKS2ContainerInventory{
+		Label: "data",
+		Keyslots: []LUKS2KeyslotInfo{
+			{
+				Slot:         0,
+				Usage:        LUKS2KeyslotUsagePlatformKey,
+				Priority:     "prefer",
+				KeySize:      64,
+				KDFType:      "argon2i",
+				KDFTime:      4,
+				KDFMemoryKiB: 32768,
+				KDFCPUs:      4,
+				Digests:      []int{0},
+				Segments:     []int{0},
+				Tokens:       []LUKS2TokenInfo{token0},
+			},
+			{
+				Slot:         1,
+				Usage:        LUKS2KeyslotUsageRecoveryKey,
+				Priority:     "normal",
+				KeySize:      64,
+				KDFType:      "argon2i",
+				KDFTime:      4,
+				KDFMemoryKiB: 32768,
+				KDFCPUs:      4,
+				Digests:      []int{0},
+				Segments:     []int{0},
+				Tokens:       []LUKS2TokenInfo{token1},
+			},
+			{
+				Slot:         2,
+				Usage:        LUKS2KeyslotUsagePassphrase,
+				Priority:     "normal",
+				KeySize:      64,
+				KDFType:      "argon2id",
+				KDFTime:      4,
+				KDFMemoryKiB: 32768,
+				KDFCPUs:      4,
+				Digests:      []int{0},
+				Segments:     []int{0},
+				Tokens:       []LUKS2TokenInfo{token0},
+			},
+			{
+				Slot:          3,
+				Usage:         LUKS2KeyslotUsageUnknown,
+				Priority:      "ignore",
+				KeySize:       64,
+				KDFType:       "pbkdf2",
+				KDFIterations: 1000,
+				Digests:       []int{0},
+				Segments:      []int{0},
+			},
+		},
+		Tokens: []LUKS2TokenInfo{token0, token1, token2}})
+
+	c.Check(inventory.Keyslot(2), DeepEquals, &inventory.Keyslots[2])
+	c.Check(inventory.Keyslot(5), IsNil)
+
+	recoveryKeys := inventory.KeyslotsWithUsage(LUKS2KeyslotUsageRecoveryKey)
+	c.Assert(recoveryKeys, HasLen, 1)
+	c.Check(recoveryKeys[0].Slot, Equals, 1)
+}
+
+func (s *inventorySuite) TestGetLUKS2ContainerInventoryClassifiedByTokens(c *C) {
+	// Keyslots with a recognized token are classified from the token rather
+	// than from their KDF and priority.
+	platformToken, err := luks2.NewToken(&luks2.SecbootToken{Version: luks2.SecbootTokenVersion, Keyslot: 1, KeyData: []byte("foo")})
+	c.Assert(err, IsNil)
+	recoveryToken, err := luks2.NewToken(&luks2.SecbootToken{Version: luks2.SecbootTokenVersion, Keyslot: 0, Recovery: true})
+	c.Assert(err, IsNil)
+
+	s.header = &luks2.HeaderInfo{
+		Label: "data",
+		Metadata: luks2.Metadata{
+			Keyslots: map[int]*luks2.Keyslot{
+				0: s.newKeyslot(luks2.KDFTypeArgon2i, luks2.SlotPriorityHigh),
+				1: s.newKeyslot(luks2.KDFTypeArgon2id, luks2.SlotPriorityNormal),
+				2: s.newKeyslot(luks2.KDFTypePBKDF2, luks2.SlotPriorityNormal),
+				3: s.newKeyslot(luks2.KDFTypeArgon2i, luks2.SlotPriorityNormal),
+				4: s.newKeyslot(luks2.KDFTypeArgon2i, luks2.SlotPriorityNormal),
+				5: s.newKeyslot(luks2.KDFTypeArgon2id, luks2.SlotPriorityNormal)},
+			Tokens: map[int]*luks2.Token{
+				0: recoveryToken,
+				1: platformToken,
+				2: &luks2.Token{Type: "systemd-recovery", Keyslots: []int{2}},
+				3: &luks2.Token{Type: "systemd-fido2", Keyslots: []int{3}},
+				4: &luks2.Token{Type: luks2.SecbootTokenType, Keyslots: []int{4}},
+				5: &luks2.Token{Type: "luks2-keyring", Keyslots: []int{5}}}}}
+
+	inventory, err := GetLUKS2ContainerInventory("/dev/sda1")
+	c.Assert(err, IsNil)
+
+	var usages []LUKS2KeyslotUsage
+	for _, k := range inventory.Keyslots {
+		usages = append(usages, k.Usage)
+	}
+	c.Check(usages, DeepEquals, []LUKS2KeyslotUsage{
+		LUKS2KeyslotUsageRecoveryKey,
+		LUKS2KeyslotUsagePlatformKey,
+		LUKS2KeyslotUsageRecoveryKey,
+		LUKS2KeyslotUsageUnknown,
+		LUKS2KeyslotUsageUnknown,    // invalid secboot token
+		LUKS2KeyslotUsagePassphrase, // unrecognized token
+	})
+}
+
+func (s *inventorySuite) TestGetLUKS2ContainerInventoryPlatformKeyNotPreferred(c *C) {
+	// A keyslot 0 without the "prefer" priority wasn't set up by
+	// InitializeLUKS2Container.
+	s.header = &luks2.HeaderInfo{
+		Label: "data",
+		Metadata: luks2.Metadata{
+			Keyslots: map[int]*luks2.Keyslot{
+				0: s.newKeyslot(luks2.KDFTypeArgon2i, luks2.SlotPriorityNormal)}}}
+
+	inventory, err := GetLUKS2ContainerInventory("/dev/sda1")
+	c.Assert(err, IsNil)
+	c.Assert(inventory.Keyslots, HasLen, 1)
+	c.Check(inventory.Keyslots[0].Usage, Equals, LUKS2KeyslotUsageRecoveryKey)
+	c.Check(inventory.Keyslots[0].Digests, IsNil)
+	c.Check(inventory.Tokens, IsNil)
+}
+
+func (s *inventorySuite) TestGetLUKS2ContainerInventoryUnknownKeyslotType(c *C) {
+	s.header = &luks2.HeaderInfo{
+		Label: "data",
+		Metadata: luks2.Metadata{
+			Keyslots: map[int]*luks2.Keyslot{
+				0: &luks2.Keyslot{Type: "reencrypt", Priority: luks2.SlotPriorityNormal}}}}
+
+	inventory, err := GetLUKS2ContainerInventory("/dev/sda1")
+	c.Assert(err, IsNil)
+	c.Assert(inventory.Keyslots, HasLen, 1)
+	c.Check(inventory.Keyslots[0].Usage, Equals, LUKS2KeyslotUsageUnknown)
+	c.Check(inventory.Keyslots[0].KDFType, Equals, "")
+}
+
+func (s *inventorySuite) TestGetLUKS2ContainerInventoryError(c *C) {
+	_, err := GetLUKS2ContainerInventory("/dev/sdb1")
+	c.Check(err, ErrorMatches, "cannot read header: no valid header found")
+}
+
+func (s *inventorySuite) TestLUKS2KeyslotUsageString(c *C) {
+	c.Check(LUKS2KeyslotUsageUnknown.String(), Equals, "unknown")
+	c.Check(LUKS2KeyslotUsagePlatformKey.String(), Equals, "platform-key")
+	c.Check(LUKS2KeyslotUsageRecoveryKey.String(), Equals, "recovery-key")
+	c.Check(LUKS2KeyslotUsagePassphrase.String(), Equals, "passphrase")
+}
@@ -0,0 +1,194 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/snapcore/secboot/internal/luks2"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	luks2ConvertKey = luks2.ConvertKey
+)
+
+// LUKS2KDFPolicy describes the minimum acceptable KDF parameters for the keyslots
+// of a LUKS2 container.
+type LUKS2KDFPolicy struct {
+	// Type is the required KDF type ("pbkdf2", "argon2i" or "argon2id").
+	// If this is empty, any KDF type is acceptable.
+	Type string
+
+	// MinMemoryKiB is the minimum memory cost in KiB. Keyslots that use
+	// pbkdf2 never satisfy a non-zero minimum memory cost.
+	MinMemoryKiB int
+
+	// MinTime is the minimum number of iterations for argon2 keyslots.
+	MinTime int
+}
+
+// DefaultLUKS2KDFPolicy is the policy used by CheckLUKS2KeyslotKDFs if no policy
+// is supplied.
+//
+// It deliberately doesn't require a KDF type. Keyslots created by this package use
+// argon2i, and GetLUKS2ContainerInventory relies on this to identify them, so
+// requiring argon2id would report every keyslot created by this package as weak,
+// and converting them with ChangeLUKS2KeyslotKDF would stop them from being
+// identified. Both argon2 variants are memory-hard, so the minimum memory cost is
+// what distinguishes a weak keyslot. Keyslots that use pbkdf2 never satisfy it.
+// Callers that want to require argon2id can supply their own policy.
+var DefaultLUKS2KDFPolicy = LUKS2KDFPolicy{
+	MinMemoryKiB: 32 * 1024,
+	MinTime:      4}
+
+// LUKS2WeakKeyslot describes a keyslot with KDF parameters that don't satisfy
+// a LUKS2KDFPolicy.
+type LUKS2WeakKeyslot struct {
+	LUKS2KeyslotInfo
+
+	Reasons []string // The reasons why this keyslot doesn't satisfy the policy
+}
+
+func (p *LUKS2KDFPolicy) check(keyslot *LUKS2KeyslotInfo) (reasons []string) {
+	if p.Type != "" && keyslot.KDFType != p.Type {
+		reasons = append(reasons, fmt.Sprintf("KDF type is %s (required %s)", keyslot.KDFType, p.Type))
+	}
+	if p.MinMemoryKiB > 0 && keyslot.KDFMemoryKiB < p.MinMemoryKiB {
+		reasons = append(reasons, fmt.Sprintf("memory cost is %d KiB (minimum %d KiB)", keyslot.KDFMemoryKiB, p.MinMemoryKiB))
+	}
+	if p.MinTime > 0 && keyslot.KDFType != string(luks2.KDFTypePBKDF2) && keyslot.KDFTime < p.MinTime {
+		reasons = append(reasons, fmt.Sprintf("time cost is %d (minimum %d)", keyslot.KDFTime, p.MinTime))
+	}
+	return reasons
+}
+
+// CheckLUKS2KeyslotKDFs checks the KDF parameters of every keyslot in the LUKS2 container
+// at the specified path against the supplied policy, and returns information about the
+// keyslots that don't satisfy it. If policy is nil, DefaultLUKS2KDFPolicy is used. Keyslots
+// without a KDF, such as those used during reencryption, are ignored.
+//
+// For a LUKS2 container with a detached header, devicePath should be the path of the header.
+//
+// Keyslots that are reported can be upgraded with ChangeLUKS2KeyslotKDF.
+func CheckLUKS2KeyslotKDFs(devicePath string, policy *LUKS2KDFPolicy) ([]LUKS2WeakKeyslot, error) {
+	if policy == nil {
+		policy = &DefaultLUKS2KDFPolicy
+	}
+
+	inventory, err := GetLUKS2ContainerInventory(devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []LUKS2WeakKeyslot
+	for _, keyslot := range inventory.Keyslots {
+		if keyslot.KDFType == "" {
+			continue
+		}
+		if reasons := policy.check(&keyslot); len(reasons) > 0 {
+			out = append(out, LUKS2WeakKeyslot{LUKS2KeyslotInfo: keyslot, Reasons: reasons})
+		}
+	}
+	return out, nil
+}
+
+// ChangeLUKS2KeyslotKDFOptions provides the KDF parameters for ChangeLUKS2KeyslotKDF.
+type ChangeLUKS2KeyslotKDFOptions struct {
+	// Type is the new KDF type, which must be "argon2i" or "argon2id". If
+	// this is empty, the keyslot's existing argon2 variant is retained,
+	// and keyslots that use pbkdf2 are converted to argon2id.
+	Type string
+
+	// TargetDuration is the target time for benchmarking the cost parameters.
+	// If it is zero then the cryptsetup default is used. This is ignored if
+	// Time is not zero.
+	TargetDuration time.Duration
+
+	// MemoryKiB is the maximum memory cost in KiB when benchmarking, or
+	// the actual memory cost if Time is not zero. If it is zero then the
+	// cryptsetup default is used.
+	MemoryKiB int
+
+	// Time forces the time cost, disabling benchmarking.
+	Time int
+}
+
+// ChangeLUKS2KeyslotKDF re-wraps the key in the specified keyslot of the LUKS2 container at
+// devicePath with new KDF parameters. The key for the keyslot must be supplied. The keyslot
+// retains its number and priority. If options is nil, the keyslot retains its argon2 variant
+// (or is converted to argon2id if it uses pbkdf2) with the cryptsetup default benchmark time.
+//
+// Note that GetLUKS2ContainerInventory identifies keyslots created by this package that don't
+// have a token by their use of argon2i, so converting such a keyslot to argon2id by setting the
+// Type field of options means that it will no longer be classified as a platform or recovery key.
+//
+// For a LUKS2 container with a detached header, devicePath should be the path of the header.
+//
+// On failure, this will return an error containing the output of the cryptsetup command.
+func ChangeLUKS2KeyslotKDF(devicePath string, slot int, key []byte, options *ChangeLUKS2KeyslotKDFOptions) error {
+	if options == nil {
+		options = &ChangeLUKS2KeyslotKDFOptions{}
+	}
+
+	kdfType := luks2.KDFType(options.Type)
+	switch kdfType {
+	case "", luks2.KDFTypeArgon2i, luks2.KDFTypeArgon2id:
+	default:
+		return fmt.Errorf("unsupported KDF type %q", options.Type)
+	}
+
+	info, err := luks2ReadHeader(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot read header: %w", err)
+	}
+	keyslot, ok := info.Metadata.Keyslots[slot]
+	if !ok || keyslot.Type != luks2.KeyslotTypeLUKS2 {
+		return fmt.Errorf("keyslot %d is not in use", slot)
+	}
+
+	if kdfType == "" {
+		// Retain the existing argon2 variant.
+		kdfType = luks2.KDFTypeArgon2id
+		if keyslot.KDF != nil && keyslot.KDF.Type == luks2.KDFTypeArgon2i {
+			kdfType = luks2.KDFTypeArgon2i
+		}
+	}
+
+	kdfOptions := luks2.KDFOptions{
+		Type:            kdfType,
+		TargetDuration:  options.TargetDuration,
+		MemoryKiB:       options.MemoryKiB,
+		ForceIterations: options.Time}
+	if err := luks2ConvertKey(devicePath, slot, key, &kdfOptions); err != nil {
+		return xerrors.Errorf("cannot convert keyslot: %w", err)
+	}
+
+	// Make sure that the keyslot priority is retained.
+	if keyslot.Priority != luks2.SlotPriorityNormal {
+		if err := luks2SetSlotPriority(devicePath, slot, keyslot.Priority); err != nil {
+			return xerrors.Errorf("cannot restore keyslot priority: %w", err)
+		}
+	}
+
+	return nil
+}
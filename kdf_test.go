@@ -0,0 +1,235 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+	"time"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+type kdfSuite struct {
+	snapd_testutil.BaseTest
+
+	header *luks2.HeaderInfo
+}
+
+var _ = Suite(&kdfSuite{})
+
+func (s *kdfSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.header = &luks2.HeaderInfo{
+		Metadata: luks2.Metadata{
+			Keyslots: map[int]*luks2.Keyslot{
+				0: s.newKeyslot(luks2.KDFTypeArgon2id, 4, 1024*1024, luks2.SlotPriorityHigh),
+				1: s.newKeyslot(luks2.KDFTypeArgon2i, 4, 1024*1024, luks2.SlotPriorityNormal),
+				2: s.newKeyslot(luks2.KDFTypeArgon2id, 4, 16*1024, luks2.SlotPriorityNormal),
+				3: s.newKeyslot(luks2.KDFTypePBKDF2, 0, 0, luks2.SlotPriorityNormal),
+				4: &luks2.Keyslot{Type: luks2.KeyslotTypeReencrypt}}}}
+	s.AddCleanup(MockLUKS2ReadHeader(func(path string, lockMode luks2.LockMode) (*luks2.HeaderInfo, error) {
+		c.Check(lockMode, Equals, luks2.LockModeBlocking)
+		if path != "/dev/sda1" {
+			return nil, errors.New("no valid header found")
+		}
+		return s.header, nil
+	}))
+}
+
+func (s *kdfSuite) newKeyslot(kdfType luks2.KDFType, timeCost, memory int, priority luks2.SlotPriority) *luks2.Keyslot {
+	kdf := &luks2.KDF{Type: kdfType}
+	switch kdfType {
+	case luks2.KDFTypePBKDF2:
+		kdf.Hash = luks2.HashSHA256
+		kdf.Iterations = 1000
+	default:
+		kdf.Time = timeCost
+		kdf.Memory = memory
+		kdf.CPUs = 4
+	}
+	return &luks2.Keyslot{
+		Type:     luks2.KeyslotTypeLUKS2,
+		KeySize:  64,
+		KDF:      kdf,
+		Priority: priority}
+}
+
+func (s *kdfSuite) weakSlots(keyslots []LUKS2WeakKeyslot) map[int][]string {
+	out := make(map[int][]string)
+	for _, k := range keyslots {
+		out[k.Slot] = k.Reasons
+	}
+	return out
+}
+
+func (s *kdfSuite) TestDefaultLUKS2KDFPolicy(c *C) {
+	// The default policy doesn't require a KDF type so that keyslots
+	// created by this package with argon2i are accepted, but pbkdf2 is
+	// rejected by the minimum memory cost.
+	c.Check(DefaultLUKS2KDFPolicy, DeepEquals, LUKS2KDFPolicy{MinMemoryKiB: 32 * 1024, MinTime: 4})
+}
+
+func (s *kdfSuite) TestCheckLUKS2KeyslotKDFsDefaultPolicy(c *C) {
+	weak, err := CheckLUKS2KeyslotKDFs("/dev/sda1", nil)
+	c.Assert(err, IsNil)
+	c.Check(weak, HasLen, 2)
+	c.Check(weak[0].KDFType, Equals, "argon2id")
+	c.Check(s.weakSlots(weak), DeepEquals, map[int][]string{
+		2: {"memory cost is 16384 KiB (minimum 32768 KiB)"},
+		3: {"memory cost is 0 KiB (minimum 32768 KiB)"}})
+}
+
+func (s *kdfSuite) TestCheckLUKS2KeyslotKDFsDefaultPolicyAcceptsArgon2i(c *C) {
+	// Keyslots created by this package use argon2i.
+	s.header.Metadata.Keyslots = map[int]*luks2.Keyslot{
+		0: s.newKeyslot(luks2.KDFTypeArgon2i, 4, 32*1024, luks2.SlotPriorityHigh),
+		1: s.newKeyslot(luks2.KDFTypeArgon2i, 4, 1024*1024, luks2.SlotPriorityNormal)}
+
+	weak, err := CheckLUKS2KeyslotKDFs("/dev/sda1", nil)
+	c.Check(err, IsNil)
+	c.Check(weak, HasLen, 0)
+}
+
+func (s *kdfSuite) TestCheckLUKS2KeyslotKDFsTypePolicy(c *C) {
+	weak, err := CheckLUKS2KeyslotKDFs("/dev/sda1", &LUKS2KDFPolicy{Type: "argon2id"})
+	c.Assert(err, IsNil)
+	c.Check(s.weakSlots(weak), DeepEquals, map[int][]string{
+		1: {"KDF type is argon2i (required argon2id)"},
+		3: {"KDF type is pbkdf2 (required argon2id)"}})
+}
+
+func (s *kdfSuite) TestCheckLUKS2KeyslotKDFsCustomPolicy(c *C) {
+	weak, err := CheckLUKS2KeyslotKDFs("/dev/sda1", &LUKS2KDFPolicy{MinMemoryKiB: 512 * 1024, MinTime: 5})
+	c.Assert(err, IsNil)
+	c.Check(s.weakSlots(weak), DeepEquals, map[int][]string{
+		0: {"time cost is 4 (minimum 5)"},
+		1: {"time cost is 4 (minimum 5)"},
+		2: {"memory cost is 16384 KiB (minimum 524288 KiB)", "time cost is 4 (minimum 5)"},
+		3: {"memory cost is 0 KiB (minimum 524288 KiB)"}})
+}
+
+func (s *kdfSuite) TestCheckLUKS2KeyslotKDFsNoWeakKeyslots(c *C) {
+	weak, err := CheckLUKS2KeyslotKDFs("/dev/sda1", &LUKS2KDFPolicy{})
+	c.Check(err, IsNil)
+	c.Check(weak, HasLen, 0)
+}
+
+func (s *kdfSuite) TestCheckLUKS2KeyslotKDFsError(c *C) {
+	_, err := CheckLUKS2KeyslotKDFs("/dev/sdb1", nil)
+	c.Check(err, ErrorMatches, "cannot read header: no valid header found")
+}
+
+type testChangeLUKS2KeyslotKDFData struct {
+	slot     int
+	options  *ChangeLUKS2KeyslotKDFOptions
+	expected luks2.KDFOptions
+
+	expectedPriority luks2.SlotPriority
+}
+
+func (s *kdfSuite) testChangeLUKS2KeyslotKDF(c *C, data *testChangeLUKS2KeyslotKDFData) {
+	key := []byte("foo")
+
+	convertCalled := false
+	s.AddCleanup(MockLUKS2ConvertKey(func(devicePath string, slot int, k []byte, options *luks2.KDFOptions) error {
+		convertCalled = true
+		c.Check(devicePath, Equals, "/dev/sda1")
+		c.Check(slot, Equals, data.slot)
+		c.Check(k, DeepEquals, key)
+		c.Check(*options, Equals, data.expected)
+		return nil
+	}))
+
+	var priority luks2.SlotPriority
+	s.AddCleanup(MockLUKS2SetSlotPriority(func(devicePath string, slot int, p luks2.SlotPriority) error {
+		c.Check(convertCalled, Equals, true)
+		c.Check(devicePath, Equals, "/dev/sda1")
+		c.Check(slot, Equals, data.slot)
+		priority = p
+		return nil
+	}))
+
+	c.Check(ChangeLUKS2KeyslotKDF("/dev/sda1", data.slot, key, data.options), IsNil)
+	c.Check(convertCalled, Equals, true)
+	c.Check(priority, Equals, data.expectedPriority)
+}
+
+func (s *kdfSuite) TestChangeLUKS2KeyslotKDFDefaults(c *C) {
+	s.testChangeLUKS2KeyslotKDF(c, &testChangeLUKS2KeyslotKDFData{
+		slot:     1,
+		expected: luks2.KDFOptions{Type: luks2.KDFTypeArgon2i}})
+}
+
+func (s *kdfSuite) TestChangeLUKS2KeyslotKDFDefaultsArgon2id(c *C) {
+	s.testChangeLUKS2KeyslotKDF(c, &testChangeLUKS2KeyslotKDFData{
+		slot:     2,
+		expected: luks2.KDFOptions{Type: luks2.KDFTypeArgon2id}})
+}
+
+func (s *kdfSuite) TestChangeLUKS2KeyslotKDFDefaultsPBKDF2(c *C) {
+	s.testChangeLUKS2KeyslotKDF(c, &testChangeLUKS2KeyslotKDFData{
+		slot:     3,
+		options:  &ChangeLUKS2KeyslotKDFOptions{MemoryKiB: 64 * 1024},
+		expected: luks2.KDFOptions{Type: luks2.KDFTypeArgon2id, MemoryKiB: 64 * 1024}})
+}
+
+func (s *kdfSuite) TestChangeLUKS2KeyslotKDFRetainsPriority(c *C) {
+	s.testChangeLUKS2KeyslotKDF(c, &testChangeLUKS2KeyslotKDFData{
+		slot:             0,
+		options:          &ChangeLUKS2KeyslotKDFOptions{TargetDuration: 100 * time.Millisecond},
+		expected:         luks2.KDFOptions{Type: luks2.KDFTypeArgon2id, TargetDuration: 100 * time.Millisecond},
+		expectedPriority: luks2.SlotPriorityHigh})
+}
+
+func (s *kdfSuite) TestChangeLUKS2KeyslotKDFCustom(c *C) {
+	s.testChangeLUKS2KeyslotKDF(c, &testChangeLUKS2KeyslotKDFData{
+		slot:     3,
+		options:  &ChangeLUKS2KeyslotKDFOptions{Type: "argon2i", MemoryKiB: 64 * 1024, Time: 4},
+		expected: luks2.KDFOptions{Type: luks2.KDFTypeArgon2i, MemoryKiB: 64 * 1024, ForceIterations: 4}})
+}
+
+func (s *kdfSuite) TestChangeLUKS2KeyslotKDFUnsupportedType(c *C) {
+	c.Check(ChangeLUKS2KeyslotKDF("/dev/sda1", 1, nil, &ChangeLUKS2KeyslotKDFOptions{Type: "pbkdf2"}),
+		ErrorMatches, "unsupported KDF type \"pbkdf2\"")
+}
+
+func (s *kdfSuite) TestChangeLUKS2KeyslotKDFMissingKeyslot(c *C) {
+	c.Check(ChangeLUKS2KeyslotKDF("/dev/sda1", 4, nil, nil), ErrorMatches, "keyslot 4 is not in use")
+	c.Check(ChangeLUKS2KeyslotKDF("/dev/sda1", 8, nil, nil), ErrorMatches, "keyslot 8 is not in use")
+}
+
+func (s *kdfSuite) TestChangeLUKS2KeyslotKDFError(c *C) {
+	s.AddCleanup(MockLUKS2ConvertKey(func(string, int, []byte, *luks2.KDFOptions) error {
+		return errors.New("cryptsetup failed with: No key available with this passphrase.")
+	}))
+	s.AddCleanup(MockLUKS2SetSlotPriority(func(string, int, luks2.SlotPriority) error {
+		c.Error("unexpected call")
+		return nil
+	}))
+
+	c.Check(ChangeLUKS2KeyslotKDF("/dev/sda1", 0, nil, nil), ErrorMatches,
+		"cannot convert keyslot: cryptsetup failed with: No key available with this passphrase.")
+}
@@ -23,9 +23,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/luks2"
 
 	"golang.org/x/xerrors"
 )
@@ -44,32 +49,205 @@ func keyringPrefixOrDefault(prefix string) string {
 	return prefix
 }
 
+// KeyringType specifies the kernel keyring in which keys are stored.
+type KeyringType int
+
+const (
+	// KeyringTypeUser is the user keyring.
+	KeyringTypeUser KeyringType = iota
+
+	// KeyringTypeSession is the session keyring of the calling process.
+	KeyringTypeSession
+
+	// KeyringTypePersistent is the persistent keyring of the calling
+	// user, which survives beyond the lifetime of the user keyring.
+	KeyringTypePersistent
+)
+
+// KeyringOptions customizes how keys are stored in the kernel keyring
+// after volumes are activated. The same options must be supplied when
+// retrieving keys.
+type KeyringOptions struct {
+	// Logon indicates that the disk unlock key should be stored as a
+	// "logon" key, which can be used by kernel consumers but which can't
+	// be read from userspace. The auxiliary key is always stored as a
+	// readable key. GetDiskUnlockKeyFromKernelWithOptions will return an
+	// error when this is set, but can still be used to remove the key.
+	Logon bool
+
+	// Timeout specifies the time after which keys expire and are removed
+	// from the keyring by the kernel. Zero means that keys don't expire.
+	Timeout time.Duration
+
+	// Keyring specifies the keyring in which keys are stored. The
+	// default is the user keyring.
+	Keyring KeyringType
+
+	// KeyringName is the name of a keyring inside Keyring in which keys
+	// are stored. If it doesn't exist, it is created with permissions that
+	// only grant access to processes that possess it. If this is empty,
+	// keys are stored in Keyring directly.
+	KeyringName string
+
+	// DetachedHeaderPath is the path of the file or block device
+	// containing the detached LUKS2 header of the volume. Keys are
+	// associated with the UUID of the LUKS2 container, which can't be
+	// read from a volume that has a detached header. When adding keys
+	// during activation, ActivateVolumeOptions.DetachedHeaderPath is used
+	// if this is empty, so this only needs to be set during activation
+	// if it differs. It must be set when retrieving keys for a volume
+	// that has a detached header.
+	DetachedHeaderPath string
+}
+
+// headerPath returns the path of the LUKS2 header of the volume at the
+// specified path, taking into account DetachedHeaderPath. If that is not
+// set, the supplied detachedHeaderPath is used instead if it isn't empty.
+func (o *KeyringOptions) headerPath(devicePath, detachedHeaderPath string) string {
+	if o != nil && o.DetachedHeaderPath != "" {
+		return o.DetachedHeaderPath
+	}
+	if detachedHeaderPath != "" {
+		return detachedHeaderPath
+	}
+	return devicePath
+}
+
+func (o *KeyringOptions) keyringOptions(purpose string) *keyring.Options {
+	if o == nil {
+		return nil
+	}
+
+	opts := &keyring.Options{
+		Logon:       o.Logon && purpose == keyringPurposeDiskUnlock,
+		Timeout:     o.Timeout,
+		KeyringName: o.KeyringName}
+	switch o.Keyring {
+	case KeyringTypeSession:
+		opts.Keyring = keyring.SessionKeyring
+	case KeyringTypePersistent:
+		opts.Keyring = keyring.PersistentKeyring
+	default:
+		opts.Keyring = keyring.UserKeyring
+	}
+	return opts
+}
+
+// luks2UUIDs caches the UUIDs of LUKS2 containers, keyed by the path of
+// the header, so that retrieving keys from the kernel keyring doesn't
+// require reading the header each time.
+var luks2UUIDs = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// readLUKS2UUID returns the UUID of the LUKS2 container with the header at
+// the specified path, or an empty string if the header can't be read. The
+// result is cached for subsequent calls to cachedLUKS2UUID.
+func readLUKS2UUID(headerPath string) string {
+	info, err := luks2ReadHeader(headerPath, luks2.LockModeBlocking)
+	if err != nil {
+		return ""
+	}
+
+	luks2UUIDs.Lock()
+	defer luks2UUIDs.Unlock()
+	luks2UUIDs.m[headerPath] = info.UUID
+	return info.UUID
+}
+
+// cachedLUKS2UUID is like readLUKS2UUID, but only reads the header if the
+// UUID for the specified path isn't already known.
+func cachedLUKS2UUID(headerPath string) string {
+	luks2UUIDs.Lock()
+	uuid, ok := luks2UUIDs.m[headerPath]
+	luks2UUIDs.Unlock()
+	if ok {
+		return uuid
+	}
+	return readLUKS2UUID(headerPath)
+}
+
+// volumeKeyringName returns the name used to identify the volume at the
+// specified path in the descriptions of keys added to the kernel keyring.
+// This is the UUID of the LUKS2 container so that keys can be found from any
+// path that refers to the volume. If the header at headerPath can't be read,
+// the supplied device path is used instead.
+func volumeKeyringName(devicePath, headerPath string) string {
+	if uuid := readLUKS2UUID(headerPath); uuid != "" {
+		return uuid
+	}
+	return devicePath
+}
+
+func addKeyToKernel(key []byte, volumeName, purpose, prefix string, options *KeyringOptions) error {
+	return keyring.AddKey(key, volumeName, purpose, prefix, options.keyringOptions(purpose))
+}
+
+func getKeyFromKernel(prefix, devicePath, purpose string, remove bool, options *KeyringOptions) ([]byte, error) {
+	// Look for a key described with the container UUID first, and then
+	// fall back to a key described with the supplied path, which is how
+	// keys were described by older versions.
+	names := []string{devicePath}
+	if uuid := cachedLUKS2UUID(options.headerPath(devicePath, "")); uuid != "" {
+		names = []string{uuid, devicePath}
+	}
+
+	for _, name := range names {
+		key, err := keyring.GetKey(name, purpose, keyringPrefixOrDefault(prefix), options.keyringOptions(purpose))
+		var e syscall.Errno
+		switch {
+		case xerrors.As(err, &e) && e == syscall.ENOKEY:
+			continue
+		case err != nil && !remove:
+			return nil, err
+		}
+
+		// Remove the key even if it couldn't be read, which is the case
+		// for logon keys.
+		if remove {
+			if err := keyring.RemoveKey(name, purpose, keyringPrefixOrDefault(prefix), options.keyringOptions(purpose)); err != nil {
+				fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
+			}
+		}
+
+		return key, err
+	}
+
+	return nil, ErrKernelKeyNotFound
+}
+
 // GetDiskUnlockKeyFromKernel retrieves the key that was used to unlock the
 // encrypted container at the specified path. The value of prefix must match
 // the prefix that was supplied via ActivateVolumeOptions during unlocking.
 //
+// Keys are associated with the UUID of the container where possible, so the
+// path can be any path that refers to the container, and it doesn't have to
+// match the path used during unlocking. For containers with a detached header,
+// the UUID can only be obtained from the header, so the path of the header must
+// be supplied via the DetachedHeaderPath field of KeyringOptions to
+// GetDiskUnlockKeyFromKernelWithOptions.
+//
 // If remove is true, the key will be removed from the kernel keyring prior
 // to returning.
 //
 // If no key is found, a ErrKernelKeyNotFound error will be returned.
+//
+// Use GetDiskUnlockKeyFromKernelWithOptions to retrieve keys that were stored
+// with non-default KeyringOptions.
 func GetDiskUnlockKeyFromKernel(prefix, devicePath string, remove bool) (DiskUnlockKey, error) {
-	key, err := keyring.GetKeyFromUserKeyring(devicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(prefix))
-	if err != nil {
-		var e syscall.Errno
-		if xerrors.As(err, &e) && e == syscall.ENOKEY {
-			return nil, ErrKernelKeyNotFound
-		}
-		return nil, err
-
-	}
-
-	if remove {
-		if err := keyring.RemoveKeyFromUserKeyring(devicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(prefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
-		}
-	}
+	return GetDiskUnlockKeyFromKernelWithOptions(prefix, devicePath, remove, nil)
+}
 
-	return key, nil
+// GetDiskUnlockKeyFromKernelWithOptions is like GetDiskUnlockKeyFromKernel,
+// but the supplied options must match the KeyringOptions that were supplied
+// via ActivateVolumeOptions during unlocking.
+//
+// If the key was stored as a logon key, it can't be read and an error will be
+// returned. If remove is true, the key will still be removed from the kernel
+// keyring in this case.
+func GetDiskUnlockKeyFromKernelWithOptions(prefix, devicePath string, remove bool, options *KeyringOptions) (DiskUnlockKey, error) {
+	return getKeyFromKernel(prefix, devicePath, keyringPurposeDiskUnlock, remove, options)
 }
 
 // GetAuxiliaryKeyFromKernel retrieves the auxiliary key associated with the
@@ -77,26 +255,105 @@ func GetDiskUnlockKeyFromKernel(prefix, devicePath string, remove bool) (DiskUnl
 // The value of prefix must match the prefix that was supplied via
 // ActivateVolumeOptions during unlocking.
 //
+// As with GetDiskUnlockKeyFromKernel, the path can be any path that refers to
+// the container. For containers with a detached header, the path of the header
+// must be supplied via the DetachedHeaderPath field of KeyringOptions to
+// GetAuxiliaryKeyFromKernelWithOptions.
+//
 // If remove is true, the key will be removed from the kernel keyring prior
 // to returning.
 //
 // If no key is found, a ErrKernelKeyNotFound error will be returned.
+//
+// Use GetAuxiliaryKeyFromKernelWithOptions to retrieve keys that were stored
+// with non-default KeyringOptions.
 func GetAuxiliaryKeyFromKernel(prefix, devicePath string, remove bool) (AuxiliaryKey, error) {
-	key, err := keyring.GetKeyFromUserKeyring(devicePath, keyringPurposeAuxiliary, keyringPrefixOrDefault(prefix))
-	if err != nil {
-		var e syscall.Errno
-		if xerrors.As(err, &e) && e == syscall.ENOKEY {
-			return nil, ErrKernelKeyNotFound
-		}
-		return nil, err
+	return GetAuxiliaryKeyFromKernelWithOptions(prefix, devicePath, remove, nil)
+}
+
+// GetAuxiliaryKeyFromKernelWithOptions is like GetAuxiliaryKeyFromKernel,
+// but the supplied options must match the KeyringOptions that were supplied
+// via ActivateVolumeOptions during unlocking.
+func GetAuxiliaryKeyFromKernelWithOptions(prefix, devicePath string, remove bool, options *KeyringOptions) (AuxiliaryKey, error) {
+	return getKeyFromKernel(prefix, devicePath, keyringPurposeAuxiliary, remove, options)
+}
+
+// KernelKeyPurpose describes the purpose of a key stored in the kernel keyring.
+type KernelKeyPurpose string
+
+const (
+	// KernelKeyPurposeDiskUnlock indicates a key that was used to unlock a
+	// volume, as returned by GetDiskUnlockKeyFromKernel.
+	KernelKeyPurposeDiskUnlock KernelKeyPurpose = keyringPurposeDiskUnlock
+
+	// KernelKeyPurposeAuxiliary indicates an auxiliary key, as returned by
+	// GetAuxiliaryKeyFromKernel.
+	KernelKeyPurposeAuxiliary KernelKeyPurpose = keyringPurposeAuxiliary
+)
+
+// KernelKeyInfo describes a key stored in the kernel keyring by this package.
+// Keys are associated with either the UUID of a LUKS2 container or the path of
+// a volume, depending on whether the container header could be read when the
+// key was added.
+type KernelKeyInfo struct {
+	UUID       string           // The UUID of the LUKS2 container that the key is associated with
+	DevicePath string           // The path of the volume that the key is associated with
+	Purpose    KernelKeyPurpose // The purpose of the key
+	Logon      bool             // Whether the key is a logon key that can't be read from userspace
+}
 
+// uuidRE matches the canonical textual form of a LUKS2 container UUID.
+var uuidRE = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ListKernelKeys returns information about all of the keys stored in the kernel
+// keyring with the specified prefix, which must match the prefix that was
+// supplied via ActivateVolumeOptions during unlocking. The supplied options
+// must match the KeyringOptions that were supplied during unlocking, although
+// the Logon and Timeout fields are ignored.
+func ListKernelKeys(prefix string, options *KeyringOptions) ([]*KernelKeyInfo, error) {
+	keys, err := keyring.ListKeys(keyringPrefixOrDefault(prefix), options.keyringOptions(""))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot list keys: %w", err)
 	}
 
-	if remove {
-		if err := keyring.RemoveKeyFromUserKeyring(devicePath, keyringPurposeAuxiliary, keyringPrefixOrDefault(prefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
+	var out []*KernelKeyInfo
+	for _, k := range keys {
+		switch KernelKeyPurpose(k.Purpose) {
+		case KernelKeyPurposeDiskUnlock, KernelKeyPurposeAuxiliary:
+		default:
+			// Not a key added by this package.
+			continue
 		}
+
+		info := &KernelKeyInfo{
+			Purpose: KernelKeyPurpose(k.Purpose),
+			Logon:   k.Logon}
+		switch {
+		case uuidRE.MatchString(k.DevicePath):
+			info.UUID = k.DevicePath
+		case filepath.IsAbs(k.DevicePath):
+			info.DevicePath = k.DevicePath
+		default:
+			// Not a key added by this package.
+			continue
+		}
+		out = append(out, info)
 	}
+	return out, nil
+}
 
-	return key, nil
+// PurgeKernelKeys removes all of the keys stored in the kernel keyring with the
+// specified prefix, which must match the prefix that was supplied via
+// ActivateVolumeOptions during unlocking. The supplied options must match the
+// KeyringOptions that were supplied during unlocking, although the Logon and
+// Timeout fields are ignored. If the keys were stored in a named keyring and
+// it is empty afterwards, it is also removed.
+//
+// This attempts to remove every key even if an error occurs, in which case
+// the first error is returned.
+func PurgeKernelKeys(prefix string, options *KeyringOptions) error {
+	if err := keyring.PurgeKeys(keyringPrefixOrDefault(prefix), options.keyringOptions("")); err != nil {
+		return xerrors.Errorf("cannot purge keys: %w", err)
+	}
+	return nil
 }
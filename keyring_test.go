@@ -20,21 +20,41 @@
 package secboot_test
 
 import (
+	"errors"
 	"math/rand"
 
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/testutil"
 
 	. "gopkg.in/check.v1"
 )
 
+// mockLUKS2Headers mocks reading LUKS2 headers so that the headers at the
+// paths in the supplied map have the corresponding UUID, and reading any
+// other header fails.
+func mockLUKS2Headers(uuids map[string]string) (restore func()) {
+	return MockLUKS2ReadHeader(func(path string, lockMode luks2.LockMode) (*luks2.HeaderInfo, error) {
+		uuid, ok := uuids[path]
+		if !ok {
+			return nil, errors.New("no valid header found")
+		}
+		return &luks2.HeaderInfo{UUID: uuid}, nil
+	})
+}
+
 type keyringSuite struct {
 	testutil.KeyringTestBase
 }
 
 var _ = Suite(&keyringSuite{})
 
+func (s *keyringSuite) SetUpTest(c *C) {
+	s.KeyringTestBase.SetUpTest(c)
+	s.AddCleanup(mockLUKS2Headers(nil))
+}
+
 func (s *keyringSuite) SetUpSuite(c *C) {
 	s.KeyringTestBase.SetUpSuite(c)
 
@@ -169,3 +189,181 @@ func (s *keyringSuite) TestGetAuxiliaryKeyFromKernelAndRemove(c *C) {
 	_, err = keyring.GetKeyFromUserKeyring("/dev/sda1", "aux", "ubuntu-fde")
 	c.Check(err, ErrorMatches, "cannot find key: required key not available")
 }
+
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelWithOptionsNamedKeyring(c *C) {
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKey(key, "/dev/sda1", "unlock", "ubuntu-fde", &keyring.Options{KeyringName: "secboot-test"}), IsNil)
+
+	options := &KeyringOptions{KeyringName: "secboot-test"}
+	key2, err := GetDiskUnlockKeyFromKernelWithOptions("", "/dev/sda1", true, options)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	_, err = GetDiskUnlockKeyFromKernelWithOptions("", "/dev/sda1", false, options)
+	c.Check(err, ErrorMatches, "cannot find key in kernel keyring")
+}
+
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelWithOptionsLogon(c *C) {
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKey(key, "/dev/sda1", "unlock", "ubuntu-fde", &keyring.Options{Logon: true}), IsNil)
+
+	options := &KeyringOptions{Logon: true}
+	_, err := GetDiskUnlockKeyFromKernelWithOptions("", "/dev/sda1", false, options)
+	c.Check(err, ErrorMatches, "cannot determine size of key payload: operation not supported")
+
+	// The key should be removed even though it can't be read.
+	_, err = GetDiskUnlockKeyFromKernelWithOptions("", "/dev/sda1", true, options)
+	c.Check(err, ErrorMatches, "cannot determine size of key payload: operation not supported")
+
+	_, err = GetDiskUnlockKeyFromKernelWithOptions("", "/dev/sda1", false, options)
+	c.Check(err, ErrorMatches, "cannot find key in kernel keyring")
+}
+
+func (s *keyringSuite) TestGetAuxiliaryKeyFromKernelWithOptionsLogon(c *C) {
+	// The auxiliary key is never stored as a logon key.
+	key := make(AuxiliaryKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKey(key, "/dev/sda1", "aux", "foo", &keyring.Options{KeyringName: "secboot-test"}), IsNil)
+
+	key2, err := GetAuxiliaryKeyFromKernelWithOptions("foo", "/dev/sda1", false, &KeyringOptions{Logon: true, KeyringName: "secboot-test"})
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+}
+
+func (s *keyringSuite) TestListKernelKeys(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "aux", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKey(key, "/dev/sda2", "unlock", "ubuntu-fde", &keyring.Options{Logon: true}), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda3", "unlock", "foo"), IsNil)
+
+	keys, err := ListKernelKeys("", nil)
+	c.Check(err, IsNil)
+	c.Check(keys, DeepEquals, []*KernelKeyInfo{
+		{DevicePath: "/dev/sda1", Purpose: KernelKeyPurposeAuxiliary},
+		{DevicePath: "/dev/sda1", Purpose: KernelKeyPurposeDiskUnlock},
+		{DevicePath: "/dev/sda2", Purpose: KernelKeyPurposeDiskUnlock, Logon: true},
+	})
+
+	keys, err = ListKernelKeys("foo", nil)
+	c.Check(err, IsNil)
+	c.Check(keys, DeepEquals, []*KernelKeyInfo{{DevicePath: "/dev/sda3", Purpose: KernelKeyPurposeDiskUnlock}})
+}
+
+func (s *keyringSuite) TestPurgeKernelKeys(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	options := &KeyringOptions{KeyringName: "secboot-test"}
+	kOptions := &keyring.Options{KeyringName: "secboot-test"}
+	c.Check(keyring.AddKey(key, "/dev/sda1", "unlock", "ubuntu-fde", kOptions), IsNil)
+	c.Check(keyring.AddKey(key, "/dev/sda1", "aux", "ubuntu-fde", kOptions), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda2", "unlock", "ubuntu-fde"), IsNil)
+
+	c.Check(PurgeKernelKeys("", options), IsNil)
+
+	keys, err := ListKernelKeys("", options)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 0)
+
+	// Keys outside of the named keyring should be left alone.
+	keys, err = ListKernelKeys("", nil)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 1)
+}
+
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelByUUID(c *C) {
+	s.AddCleanup(mockLUKS2Headers(map[string]string{
+		"/dev/nvme0n1p3":                 "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4",
+		"/dev/disk/by-partuuid/c7f2e1a8": "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4"}))
+
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4", "unlock", "ubuntu-fde"), IsNil)
+
+	key2, err := GetDiskUnlockKeyFromKernel("", "/dev/nvme0n1p3", false)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	key2, err = GetDiskUnlockKeyFromKernel("", "/dev/disk/by-partuuid/c7f2e1a8", true)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	_, err = GetDiskUnlockKeyFromKernel("", "/dev/nvme0n1p3", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *keyringSuite) TestGetAuxiliaryKeyFromKernelByUUIDFallback(c *C) {
+	// Test that keys described with the device path are still found
+	// if the container header can be read.
+	s.AddCleanup(mockLUKS2Headers(map[string]string{"/dev/sda1": "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4"}))
+
+	key := make(AuxiliaryKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "aux", "ubuntu-fde"), IsNil)
+
+	key2, err := GetAuxiliaryKeyFromKernel("", "/dev/sda1", true)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	_, err = keyring.GetKeyFromUserKeyring("/dev/sda1", "aux", "ubuntu-fde")
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *keyringSuite) TestListKernelKeysByUUID(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4", "unlock", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "ubuntu-fde"), IsNil)
+
+	keys, err := ListKernelKeys("", nil)
+	c.Check(err, IsNil)
+	c.Check(keys, DeepEquals, []*KernelKeyInfo{
+		{DevicePath: "/dev/sda1", Purpose: KernelKeyPurposeDiskUnlock},
+		{UUID: "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4", Purpose: KernelKeyPurposeDiskUnlock},
+	})
+}
+
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelCachesUUID(c *C) {
+	var paths []string
+	s.AddCleanup(MockLUKS2ReadHeader(func(path string, lockMode luks2.LockMode) (*luks2.HeaderInfo, error) {
+		paths = append(paths, path)
+		return &luks2.HeaderInfo{UUID: "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4"}, nil
+	}))
+
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "b6b3c1d6-3b4b-4d1c-a8b6-1d1a6d0ef3a4", "unlock", "ubuntu-fde"), IsNil)
+
+	for i := 0; i < 2; i++ {
+		key2, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+		c.Check(err, IsNil)
+		c.Check(key2, DeepEquals, key)
+	}
+	c.Check(paths, DeepEquals, []string{"/dev/sda1"})
+}
+
+func (s *keyringSuite) TestListKernelKeysIgnoresUnknownDescriptions(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "sda2", "unlock", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "b6b3c1d6-3b4b-4d1c-a8b6", "aux", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda3", "foo", "ubuntu-fde"), IsNil)
+
+	keys, err := ListKernelKeys("", nil)
+	c.Check(err, IsNil)
+	c.Check(keys, DeepEquals, []*KernelKeyInfo{{DevicePath: "/dev/sda1", Purpose: KernelKeyPurposeDiskUnlock}})
+}
@@ -0,0 +1,347 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+)
+
+// BootAttemptLimit describes a limit on the number of consecutive attempts to unseal a sealed key object without a
+// successful boot. Every call to SealedKeyObject.UnsealFromTPM increments a NV counter before the authorization policy
+// is executed, and the sealed key object can no longer be unsealed once the maximum number of attempts have been made
+// since the counter was last reset. The OS is expected to reset the counter with SealedKeyObject.ResetBootAttemptCounter
+// after a successful boot.
+//
+// As the counter is incremented by the code that performs the unseal, this relies on the PCR policy to ensure that this
+// code is trusted.
+type BootAttemptLimit struct {
+	// CounterHandle is the handle at which to create a NV counter for counting unseal attempts. It must be a valid NV
+	// index handle (MSO == 0x01), and the choice of handle should take in to consideration the reserved indices from the
+	// "Registry of reserved TPM 2.0 handles and localities" specification. It is recommended that the handle is in the
+	// block reserved for owner objects (0x01800000 - 0x01bfffff).
+	CounterHandle tpm2.Handle
+
+	// MaxAttempts is the number of unseal attempts that are permitted without the counter being reset. It must not be
+	// zero.
+	MaxAttempts uint32
+}
+
+// bootAttemptCounterData corresponds to the boot attempt limit of a PCR policy, and is part of dynamicPolicyData.
+type bootAttemptCounterData struct {
+	CounterHandle tpm2.Handle
+	MaxAttempts   uint32
+	Baseline      uint64 // The value of the counter when it was last reset
+}
+
+// makeBootAttemptCounterData converts the supplied BootAttemptLimit in to a bootAttemptCounterData without a baseline.
+// This returns nil if l is nil.
+func makeBootAttemptCounterData(l *BootAttemptLimit) (*bootAttemptCounterData, error) {
+	if l == nil {
+		return nil, nil
+	}
+	if l.CounterHandle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, errors.New("invalid counter handle")
+	}
+	if l.MaxAttempts == 0 {
+		return nil, errors.New("invalid maximum number of attempts")
+	}
+	return &bootAttemptCounterData{CounterHandle: l.CounterHandle, MaxAttempts: l.MaxAttempts}, nil
+}
+
+// isEmpty indicates whether this doesn't define a boot attempt limit.
+func (d *bootAttemptCounterData) isEmpty() bool {
+	return d.MaxAttempts == 0
+}
+
+// bootAttemptCounterAttrs are the attributes of a boot attempt counter, excluding tpm2.AttrNVWritten.
+var bootAttemptCounterAttrs = tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA)
+
+// createBootAttemptCounter creates and initializes a NV counter for counting unseal attempts. The counter can be read
+// and incremented by anyone - the only thing that can be achieved by incrementing it is a denial of service, which is
+// possible anyway by anybody with access to the TPM.
+func createBootAttemptCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	public := &tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   bootAttemptCounterAttrs,
+		Size:    8}
+
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot define NV space: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+	}()
+
+	// Initialize the index.
+	if err := tpm.NVIncrement(index, index, session); err != nil {
+		return nil, xerrors.Errorf("cannot initialize NV index: %w", err)
+	}
+
+	// The name has changed now that the index has been written to.
+	public.Attrs |= tpm2.AttrNVWritten
+
+	succeeded = true
+	return public, nil
+}
+
+// readBootAttemptCounter returns a context for the boot attempt counter at the specified handle, along with its
+// current value.
+func readBootAttemptCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, session tpm2.SessionContext) (tpm2.ResourceContext, uint64, error) {
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil, 0, dynamicPolicyDataError{errors.New("no boot attempt counter found")}
+	case err != nil:
+		return nil, 0, xerrors.Errorf("cannot obtain context for boot attempt counter: %w", err)
+	}
+
+	count, err := tpm.NVReadCounter(index, index, session)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("cannot read boot attempt counter: %w", err)
+	}
+
+	return index, count, nil
+}
+
+// reset returns a copy of this boot attempt limit with the baseline set to the current value of the counter, along with
+// the name of the counter.
+func (d *bootAttemptCounterData) reset(tpm *tpm2.TPMContext, session tpm2.SessionContext) (*bootAttemptCounterData, tpm2.Name, error) {
+	index, count, err := readBootAttemptCounter(tpm, d.CounterHandle, session)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := *d
+	out.Baseline = count
+	return &out, index.Name(), nil
+}
+
+// attempts returns the number of unseal attempts since the counter was last reset.
+func (d *bootAttemptCounterData) attempts(tpm *tpm2.TPMContext, session tpm2.SessionContext) (uint64, error) {
+	_, count, err := readBootAttemptCounter(tpm, d.CounterHandle, session)
+	if err != nil {
+		return 0, err
+	}
+	if count < d.Baseline {
+		return 0, dynamicPolicyDataError{errors.New("invalid boot attempt counter baseline")}
+	}
+	return count - d.Baseline, nil
+}
+
+// recordAttempt increments the counter in order to record an unseal attempt.
+func (d *bootAttemptCounterData) recordAttempt(tpm *tpm2.TPMContext, session tpm2.SessionContext) error {
+	index, err := tpm.CreateResourceContextFromTPM(d.CounterHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, d.CounterHandle):
+		return dynamicPolicyDataError{errors.New("no boot attempt counter found")}
+	case err != nil:
+		return xerrors.Errorf("cannot obtain context for boot attempt counter: %w", err)
+	}
+
+	if err := tpm.NVIncrement(index, index, session); err != nil {
+		return xerrors.Errorf("cannot increment boot attempt counter: %w", err)
+	}
+	return nil
+}
+
+// limit returns the operand for the TPM2_PolicyNV assertion that enforces this boot attempt limit.
+func (d *bootAttemptCounterData) limit() (tpm2.Operand, error) {
+	if d.Baseline > math.MaxUint64-uint64(d.MaxAttempts) {
+		return nil, errors.New("maximum number of attempts is too large")
+	}
+	operandB := make(tpm2.Operand, 8)
+	binary.BigEndian.PutUint64(operandB, d.Baseline+uint64(d.MaxAttempts))
+	return operandB, nil
+}
+
+// trialPolicyAssertion adds the assertion that enforces this boot attempt limit to the supplied trial policy.
+func (d *bootAttemptCounterData) trialPolicyAssertion(trial *util.TrialAuthPolicy, counterName tpm2.Name) error {
+	operandB, err := d.limit()
+	if err != nil {
+		return err
+	}
+	trial.PolicyNV(counterName, operandB, 0, tpm2.OpUnsignedLE)
+	return nil
+}
+
+// executeAssertion executes the assertion that enforces this boot attempt limit in the supplied policy session.
+func (d *bootAttemptCounterData) executeAssertion(tpm *tpm2.TPMContext, policySession tpm2.SessionContext) error {
+	operandB, err := d.limit()
+	if err != nil {
+		return dynamicPolicyDataError{err}
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(d.CounterHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, d.CounterHandle):
+		return dynamicPolicyDataError{errors.New("no boot attempt counter found")}
+	case err != nil:
+		return xerrors.Errorf("cannot obtain context for boot attempt counter: %w", err)
+	}
+
+	if err := tpm.PolicyNV(index, index, policySession, operandB, 0, tpm2.OpUnsignedLE, nil); err != nil {
+		if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV) {
+			return ErrBootAttemptLimitReached
+		}
+		return xerrors.Errorf("boot attempt limit check failed: %w", err)
+	}
+	return nil
+}
+
+func resetBootAttemptCounterCommon(tpm *tpm2.TPMContext, keys []*SealedKeyObject, authKey crypto.PrivateKey, session tpm2.SessionContext) error {
+	primaryData := keys[0].data
+
+	pcrPolicyCounterPub, err := validateRelatedKeys(tpm, keys, authKey, session)
+	if err != nil {
+		return err
+	}
+
+	current := primaryData.dynamicPolicyData
+	if current.bootAttempts == nil {
+		return errors.New("sealed key object has no boot attempt limit")
+	}
+
+	var policyCounterName tpm2.Name
+	if pcrPolicyCounterPub != nil {
+		policyCounterName, err = pcrPolicyCounterPub.Name()
+		if err != nil {
+			return xerrors.Errorf("cannot compute name of policy counter: %w", err)
+		}
+	}
+
+	bootAttempts, bootAttemptCounterName, err := current.bootAttempts.reset(tpm, session)
+	switch {
+	case isDynamicPolicyDataError(err):
+		return InvalidKeyFileError{err.Error()}
+	case err != nil:
+		return xerrors.Errorf("cannot compute new boot attempt counter baseline: %w", err)
+	}
+
+	// The new PCR policy reuses the PCR conditions from the existing one, so make sure that these were authorized.
+	if err := verifyDynamicPolicy(primaryData.version, primaryData.keyPublic.NameAlg, primaryData.staticPolicyData, current,
+		policyCounterName, bootAttemptCounterName); err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot verify existing PCR policy: %v", err)}
+	}
+
+	// Compute a new PCR policy with an updated baseline. There's no need to revoke the existing PCR policy as it is
+	// always more restrictive than the new one, because the counter can't be decremented.
+	authPublicKey := primaryData.staticPolicyData.authPublicKey
+	policyData, err := computeDynamicPolicy(primaryData.version, primaryData.keyPublic.NameAlg, &dynamicPolicyComputeParams{
+		key:                    authKey,
+		signAlg:                authPublicKey.NameAlg,
+		pcrs:                   current.pcrSelection,
+		pcrOrData:              current.pcrOrData,
+		policyCounterName:      policyCounterName,
+		policyCount:            current.policyCount,
+		validity:               current.validity,
+		bootAttemptCounterName: bootAttemptCounterName,
+		bootAttempts:           bootAttempts})
+	if err != nil {
+		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+
+	// Atomically update the key data files
+	for _, k := range keys {
+		k.data.dynamicPolicyData = policyData
+
+		if err := k.persist(); err != nil {
+			return xerrors.Errorf("cannot write key data file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// ResetBootAttemptCounter resets the boot attempt counter for this sealed key object, which must have been created with
+// a boot attempt limit. This is expected to be called by the OS after a successful boot. In order to do this, the caller
+// must also specify the private part of the authorization key that was either returned by SealKeyToTPM or
+// SealedKeyObject.UnsealFromTPM.
+//
+// The counter can't be decremented, so this works by recording its current value in a new PCR policy, which has the same
+// PCR conditions as the existing one.
+//
+// If validation of the sealed key data fails, a InvalidKeyFileError error will be returned.
+//
+// On success, the sealed key data file is updated atomically.
+func (k *SealedKeyObject) ResetBootAttemptCounter(tpm *Connection, authKey PolicyAuthKey) error {
+	ecdsaAuthKey, err := createECDSAPrivateKeyFromTPM(k.data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authKey))
+	if err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot create auth key: %v", err)}
+	}
+	return resetBootAttemptCounterCommon(tpm.TPMContext, []*SealedKeyObject{k}, ecdsaAuthKey, tpm.HmacSession())
+}
+
+// ResetKeyBootAttemptCounterMultiple resets the boot attempt counter shared by the supplied sealed key objects, which
+// must have been created with a boot attempt limit. The keys must all be related (ie, they were created using
+// SealKeyToTPMMultiple). If any key in the supplied set is not related, an error will be returned.
+//
+// If validation of any sealed key object fails, a InvalidKeyFileError error will be returned.
+//
+// On success, each sealed key data file is updated atomically.
+func ResetKeyBootAttemptCounterMultiple(tpm *Connection, keys []*SealedKeyObject, authKey PolicyAuthKey) error {
+	if len(keys) == 0 {
+		return errors.New("no sealed keys supplied")
+	}
+
+	ecdsaAuthKey, err := createECDSAPrivateKeyFromTPM(keys[0].data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authKey))
+	if err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot create auth key: %v", err)}
+	}
+
+	return resetBootAttemptCounterCommon(tpm.TPMContext, keys, ecdsaAuthKey, tpm.HmacSession())
+}
+
+// BootAttempts returns the number of unseal attempts that have been made since the boot attempt counter for this sealed
+// key object was last reset, and the maximum number of attempts that are permitted. If the sealed key object doesn't
+// have a boot attempt limit, an error will be returned.
+//
+// Note that this includes the attempt made during the current boot.
+func (k *SealedKeyObject) BootAttempts(tpm *Connection) (attempts uint64, maxAttempts uint32, err error) {
+	bootAttempts := k.data.dynamicPolicyData.bootAttempts
+	if bootAttempts == nil {
+		return 0, 0, errors.New("sealed key object has no boot attempt limit")
+	}
+
+	attempts, err = bootAttempts.attempts(tpm.TPMContext, tpm.HmacSession())
+	switch {
+	case isDynamicPolicyDataError(err):
+		return 0, 0, InvalidKeyFileError{err.Error()}
+	case err != nil:
+		return 0, 0, err
+	}
+
+	return attempts, bootAttempts.MaxAttempts, nil
+}
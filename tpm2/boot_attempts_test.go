@@ -0,0 +1,313 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestMakeBootAttemptCounterData(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		limit    *BootAttemptLimit
+		expected *BootAttemptCounterData
+		err      string
+	}{
+		{
+			desc: "Nil",
+		},
+		{
+			desc:     "Valid",
+			limit:    &BootAttemptLimit{CounterHandle: 0x01810001, MaxAttempts: 3},
+			expected: &BootAttemptCounterData{CounterHandle: 0x01810001, MaxAttempts: 3},
+		},
+		{
+			desc:  "InvalidHandle",
+			limit: &BootAttemptLimit{CounterHandle: 0x81000001, MaxAttempts: 3},
+			err:   "invalid counter handle",
+		},
+		{
+			desc:  "NoAttempts",
+			limit: &BootAttemptLimit{CounterHandle: 0x01810001},
+			err:   "invalid maximum number of attempts",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			bootAttempts, err := MakeBootAttemptCounterData(data.limit)
+			if data.err != "" {
+				if err == nil || err.Error() != data.err {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MakeBootAttemptCounterData failed: %v", err)
+			}
+			if !reflect.DeepEqual(bootAttempts, data.expected) {
+				t.Errorf("Unexpected boot attempt data: %#v", bootAttempts)
+			}
+		})
+	}
+}
+
+func TestComputeDynamicPolicyWithBootAttempts(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	pcrDigest, _ := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{
+		tpm2.HashAlgorithmSHA256: {7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")}})
+
+	base, err := ComputeDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256,
+		NewDynamicPolicyComputeParams(key, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{pcrDigest}, nil, 0))
+	if err != nil {
+		t.Fatalf("ComputeDynamicPolicy failed: %v", err)
+	}
+
+	counterName := append(tpm2.Name{0x00, 0x0b}, make([]byte, 32)...)
+	bootAttempts := &BootAttemptCounterData{CounterHandle: 0x01810001, MaxAttempts: 3, Baseline: 100}
+	data, err := ComputeDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256,
+		NewDynamicPolicyComputeParamsWithBootAttempts(key, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{pcrDigest}, nil, 0,
+			counterName, bootAttempts))
+	if err != nil {
+		t.Fatalf("ComputeDynamicPolicy failed: %v", err)
+	}
+	if data.BootAttempts() != bootAttempts {
+		t.Errorf("Unexpected boot attempt data")
+	}
+
+	// The boot attempt limit should be enforced by a TPM2_PolicyNV assertion after the rest of the PCR policy.
+	h := tpm2.HashAlgorithmSHA256.NewHash()
+	h.Write([]byte{0, 0, 0, 0, 0, 0, 0, 103})
+	binary.Write(h, binary.BigEndian, uint16(0))
+	binary.Write(h, binary.BigEndian, tpm2.OpUnsignedLE)
+	args := h.Sum(nil)
+
+	h = tpm2.HashAlgorithmSHA256.NewHash()
+	h.Write(base.AuthorizedPolicy())
+	binary.Write(h, binary.BigEndian, tpm2.CommandPolicyNV)
+	h.Write(args)
+	h.Write(counterName)
+	expected := h.Sum(nil)
+	if !bytes.Equal(data.AuthorizedPolicy(), expected) {
+		t.Errorf("Unexpected policy digest (got %x, expected %x)", data.AuthorizedPolicy(), expected)
+	}
+
+	_, err = ComputeDynamicPolicy(0, tpm2.HashAlgorithmSHA256,
+		NewDynamicPolicyComputeParamsWithBootAttempts(nil, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{pcrDigest}, nil, 0,
+			counterName, bootAttempts))
+	if err == nil || err.Error() != "boot attempt limits are not supported" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	_, err = ComputeDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256,
+		NewDynamicPolicyComputeParamsWithBootAttempts(nil, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{pcrDigest}, nil, 0,
+			counterName, &BootAttemptCounterData{CounterHandle: 0x01810001, MaxAttempts: 3, Baseline: math.MaxUint64}))
+	if err == nil || err.Error() != "cannot compute boot attempt limit assertion: maximum number of attempts is too large" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestVerifyDynamicPolicy(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	staticData, _, err := ComputeStaticPolicy(tpm2.HashAlgorithmSHA256, NewStaticPolicyComputeParams(CreateTPMPublicAreaForECDSAKey(&key.PublicKey), nil))
+	if err != nil {
+		t.Fatalf("ComputeStaticPolicy failed: %v", err)
+	}
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	counterName := append(tpm2.Name{0x00, 0x0b}, make([]byte, 32)...)
+	bootAttempts := &BootAttemptCounterData{CounterHandle: 0x01810001, MaxAttempts: 3, Baseline: 100}
+
+	for _, n := range []int{1, 8, 20} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			var pcrDigests tpm2.DigestList
+			for i := 0; i < n; i++ {
+				d, _ := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{
+					tpm2.HashAlgorithmSHA256: {7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, strconv.Itoa(i))}})
+				pcrDigests = append(pcrDigests, d)
+			}
+
+			data, err := ComputeDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256,
+				NewDynamicPolicyComputeParamsWithBootAttempts(key, tpm2.HashAlgorithmSHA256, pcrs, pcrDigests, nil, 0, counterName,
+					bootAttempts))
+			if err != nil {
+				t.Fatalf("ComputeDynamicPolicy failed: %v", err)
+			}
+			if err := VerifyDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256, staticData, data, nil, counterName); err != nil {
+				t.Errorf("VerifyDynamicPolicy failed: %v", err)
+			}
+
+			// The policy is bound to the boot attempt counter.
+			err = VerifyDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256, staticData, data, nil,
+				append(tpm2.Name{0x00, 0x0b}, make([]byte, 31)...))
+			if err == nil || err.Error() != "PCR policy digest is inconsistent with metadata" {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			// The PCR conditions are bound to the policy digest.
+			tampered := *data
+			tampered.PCROrData()[len(tampered.PCROrData())-1].Digests[0][0] ^= 0xff
+			err = VerifyDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256, staticData, &tampered, nil, counterName)
+			if err == nil || err.Error() != "PCR policy digest is inconsistent with metadata" {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+
+	data, err := ComputeDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256,
+		NewDynamicPolicyComputeParamsWithBootAttempts(otherKey, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{make(tpm2.Digest, 32)},
+			nil, 0, counterName, bootAttempts))
+	if err != nil {
+		t.Fatalf("ComputeDynamicPolicy failed: %v", err)
+	}
+	err = VerifyDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256, staticData, data, nil, counterName)
+	if err == nil || err.Error() != "cannot verify PCR policy signature: invalid signature" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSealKeyToTPMWithBootAttemptLimit(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithBootAttemptLimit_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x01810000,
+		BootAttemptLimit:       &BootAttemptLimit{CounterHandle: 0x01810001, MaxAttempts: 2}})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+	defer func() {
+		rc, err := tpm.CreateResourceContextFromTPM(0x01810001)
+		if err != nil {
+			t.Errorf("CreateResourceContextFromTPM failed: %v", err)
+			return
+		}
+		undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+	}()
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	checkAttempts := func(expected uint64) {
+		attempts, maxAttempts, err := k.BootAttempts(tpm)
+		if err != nil {
+			t.Fatalf("BootAttempts failed: %v", err)
+		}
+		if attempts != expected {
+			t.Errorf("Unexpected number of attempts %d", attempts)
+		}
+		if maxAttempts != 2 {
+			t.Errorf("Unexpected maximum number of attempts %d", maxAttempts)
+		}
+	}
+
+	checkAttempts(0)
+
+	for i := 0; i < 2; i++ {
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+	}
+	checkAttempts(2)
+
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != ErrBootAttemptLimitReached {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	checkAttempts(3)
+
+	if err := k.ResetBootAttemptCounter(tpm, authKey); err != nil {
+		t.Fatalf("ResetBootAttemptCounter failed: %v", err)
+	}
+	checkAttempts(0)
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+	checkAttempts(1)
+
+	// Updating the PCR policy must not reset the counter.
+	if err := k.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+	checkAttempts(1)
+}
+
+func TestSealKeyToExternalTPMStorageKeyWithBootAttemptLimit(t *testing.T) {
+	_, err := SealKeyToExternalTPMStorageKey(nil, nil, "", &KeyCreationParams{
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		BootAttemptLimit:       &BootAttemptLimit{CounterHandle: 0x01810001, MaxAttempts: 3}})
+	if err == nil || err.Error() != "BootAttemptLimit must be nil when creating an importable sealed key" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -93,13 +93,32 @@ func unsealKeyFromTPM(tpm *Connection, k *SealedKeyObject, pin string) ([]byte,
 	return sealedKey, err
 }
 
-func unsealKeyFromTPMAndActivate(tpm *Connection, volumeName, sourceDevicePath, keyringPrefix string, k *SealedKeyObject, pin string) error {
+// luks2ActivateOptions converts the supplied options in to the options used for
+// activating LUKS2 volumes, in the same way as the secboot package does, and returns
+// nil if options is nil.
+func luks2ActivateOptions(options *secboot.ActivateVolumeOptions) *luks2.ActivateOptions {
+	if options == nil {
+		return nil
+	}
+	opts := &luks2.ActivateOptions{DetachedHeaderPath: options.DetachedHeaderPath}
+	switch options.Backend {
+	case secboot.LUKS2ActivationBackendSystemd:
+		opts.Backend = luks2.ActivateBackendSystemd
+	case secboot.LUKS2ActivationBackendNative:
+		opts.Backend = luks2.ActivateBackendNative
+	default:
+		opts.Backend = luks2.ActivateBackendAuto
+	}
+	return opts
+}
+
+func unsealKeyFromTPMAndActivate(tpm *Connection, volumeName, sourceDevicePath, keyringPrefix string, activateOptions *luks2.ActivateOptions, k *SealedKeyObject, pin string) error {
 	sealedKey, err := unsealKeyFromTPM(tpm, k, pin)
 	if err != nil {
 		return xerrors.Errorf("cannot unseal key: %w", err)
 	}
 
-	if err := luks2Activate(volumeName, sourceDevicePath, sealedKey); err != nil {
+	if err := luks2Activate(volumeName, sourceDevicePath, sealedKey, activateOptions); err != nil {
 		return xerrors.Errorf("cannot activate volume: %w", err)
 	}
 
@@ -134,7 +153,7 @@ func (c *activateTPMKeyContext) Err() *activateWithTPMKeyError {
 	return &activateWithTPMKeyError{path: c.path, err: c.err}
 }
 
-func activateWithTPMKeys(tpm *Connection, volumeName, sourceDevicePath string, keyPaths []string, passphraseReader io.Reader, passphraseTries int, keyringPrefix string) (succeeded bool, errs []*activateWithTPMKeyError) {
+func activateWithTPMKeys(tpm *Connection, volumeName, sourceDevicePath string, keyPaths []string, passphraseReader io.Reader, passphraseTries int, keyringPrefix string, activateOptions *luks2.ActivateOptions) (succeeded bool, errs []*activateWithTPMKeyError) {
 	var contexts []*activateTPMKeyContext
 	// Read key files
 	for _, path := range keyPaths {
@@ -154,7 +173,7 @@ func activateWithTPMKeys(tpm *Connection, volumeName, sourceDevicePath string, k
 			continue
 		}
 
-		if err := unsealKeyFromTPMAndActivate(tpm, volumeName, sourceDevicePath, keyringPrefix, c.k, ""); err != nil {
+		if err := unsealKeyFromTPMAndActivate(tpm, volumeName, sourceDevicePath, keyringPrefix, activateOptions, c.k, ""); err != nil {
 			c.err = err
 			continue
 		}
@@ -191,7 +210,7 @@ func activateWithTPMKeys(tpm *Connection, volumeName, sourceDevicePath string, k
 			continue
 		}
 
-		if err := unsealKeyFromTPMAndActivate(tpm, volumeName, sourceDevicePath, keyringPrefix, c.k, pin); err != nil {
+		if err := unsealKeyFromTPMAndActivate(tpm, volumeName, sourceDevicePath, keyringPrefix, activateOptions, c.k, pin); err != nil {
 			c.err = err
 			continue
 		}
@@ -245,7 +264,7 @@ func ActivateVolumeWithMultipleSealedKeys(tpm *Connection, volumeName, sourceDev
 		return false, errors.New("invalid RecoveryKeyTries")
 	}
 
-	if success, errs := activateWithTPMKeys(tpm, volumeName, sourceDevicePath, keyPaths, passphraseReader, options.PassphraseTries, options.KeyringPrefix); !success {
+	if success, errs := activateWithTPMKeys(tpm, volumeName, sourceDevicePath, keyPaths, passphraseReader, options.PassphraseTries, options.KeyringPrefix, luks2ActivateOptions(options)); !success {
 		var tpmErrs []error
 		for _, e := range errs {
 			tpmErrs = append(tpmErrs, e)
@@ -39,6 +39,7 @@ import (
 	. "gopkg.in/check.v1"
 
 	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/tcg"
 	"github.com/snapcore/secboot/internal/testutil"
 	. "github.com/snapcore/secboot/tpm2"
@@ -54,6 +55,7 @@ type cryptTPMSimulatorSuite struct {
 	mockLUKS2ActivateCalls []struct {
 		volumeName       string
 		sourceDevicePath string
+		backend          luks2.ActivateBackend
 	}
 
 	mockActivateVolumeWithRecoveryKeyCalls []string
@@ -77,11 +79,16 @@ func (s *cryptTPMSimulatorSuite) SetUpTest(c *C) {
 	s.mockKeyslotsCount = 0
 	s.mockKeyslotsDir = c.MkDir()
 
-	activateFn := func(volumeName, sourceDevicePath string, key []byte) error {
+	activateFn := func(volumeName, sourceDevicePath string, key []byte, options *luks2.ActivateOptions) error {
+		var backend luks2.ActivateBackend
+		if options != nil {
+			backend = options.Backend
+		}
 		s.mockLUKS2ActivateCalls = append(s.mockLUKS2ActivateCalls, struct {
 			volumeName       string
 			sourceDevicePath string
-		}{volumeName, sourceDevicePath})
+			backend          luks2.ActivateBackend
+		}{volumeName, sourceDevicePath, backend})
 
 		f, err := os.Open(s.mockKeyslotsDir)
 		if err != nil {
@@ -143,7 +150,7 @@ func (s *cryptTPMSimulatorSuite) SetUpTest(c *C) {
 				continue
 			}
 
-			if err := activateFn(volumeName, sourceDevicePath, key[:]); err != nil {
+			if err := activateFn(volumeName, sourceDevicePath, key[:], nil); err != nil {
 				lastErr = xerrors.Errorf("cannot activate volume: %w", err)
 				continue
 			}
@@ -225,6 +232,8 @@ type testActivateVolumeWithMultipleSealedKeysData struct {
 	pinTries         int
 	recoveryKeyTries int
 	keyringPrefix    string
+	backend          secboot.LUKS2ActivationBackend
+	expectedBackend  luks2.ActivateBackend
 	activateTries    int
 	pins             []string
 	authPrivateKey   PolicyAuthKey
@@ -236,7 +245,8 @@ func (s *cryptTPMSimulatorSuite) testActivateVolumeWithMultipleSealedKeys(c *C,
 	options := secboot.ActivateVolumeOptions{
 		PassphraseTries:  data.pinTries,
 		RecoveryKeyTries: data.recoveryKeyTries,
-		KeyringPrefix:    data.keyringPrefix}
+		KeyringPrefix:    data.keyringPrefix,
+		Backend:          data.backend}
 	success, err := ActivateVolumeWithMultipleSealedKeys(s.TPM, data.volumeName, data.sourceDevicePath, data.keyFiles, nil, &options)
 	c.Check(success, Equals, true)
 	c.Check(err, IsNil)
@@ -251,6 +261,7 @@ func (s *cryptTPMSimulatorSuite) testActivateVolumeWithMultipleSealedKeys(c *C,
 	for _, call := range s.mockLUKS2ActivateCalls {
 		c.Check(call.volumeName, Equals, data.volumeName)
 		c.Check(call.sourceDevicePath, Equals, data.sourceDevicePath)
+		c.Check(call.backend, Equals, data.expectedBackend)
 	}
 }
 
@@ -272,6 +283,26 @@ func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithMultipleSealedKeys1(c *C)
 		authPrivateKey:   s.authPrivateKey})
 }
 
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithMultipleSealedKeysNativeBackend(c *C) {
+	key := make([]byte, 64)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	keyFile := filepath.Join(c.MkDir(), "keydata2")
+
+	_, err := SealKeyToTPM(s.TPM, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	s.testActivateVolumeWithMultipleSealedKeys(c, &testActivateVolumeWithMultipleSealedKeysData{
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		keyFiles:         []string{s.keyFile, keyFile},
+		backend:          secboot.LUKS2ActivationBackendNative,
+		expectedBackend:  luks2.ActivateBackendNative,
+		activateTries:    1,
+		authPrivateKey:   s.authPrivateKey})
+}
+
 func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithMultipleSealedKeys2(c *C) {
 	// Test with a different volumeName / sourceDevicePath
 	key := make([]byte, 64)
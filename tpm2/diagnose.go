@@ -0,0 +1,328 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// PCRMismatch describes a PCR with a current value that differs from its value in the nearest authorized branch of a
+// PCR policy.
+type PCRMismatch struct {
+	Alg      tpm2.HashAlgorithmId
+	PCR      int
+	Expected tpm2.Digest // The value of the PCR in the nearest authorized branch
+	Current  tpm2.Digest // The current value of the PCR
+
+	// LogConsistent indicates that replaying the events from the TCG event log that were measured to this PCR
+	// produces the current value. If this is false, the events can't be relied on to explain the difference.
+	LogConsistent bool
+
+	// Events are the events from the TCG event log that were measured to this PCR and which diverge from the digests
+	// that the nearest authorized branch extends it with, such as unexpected or modified events. Events that match the
+	// nearest authorized branch are omitted. If the nearest authorized branch sets the PCR to a value that doesn't
+	// correspond to any point in the log, the log can't be compared with it and every event measured to the PCR is
+	// included.
+	Events []*tcglog.Event
+
+	// MissingDigests are the digests that the nearest authorized branch extends this PCR with, but which don't
+	// correspond to any event in the TCG event log.
+	MissingDigests []tpm2.Digest
+}
+
+// PCRMismatchDiagnosis is returned from SealedKeyObject.DiagnosePCRMismatch.
+type PCRMismatchDiagnosis struct {
+	// CurrentValuesAuthorized indicates that the current PCR values satisfy the PCR policy.
+	CurrentValuesAuthorized bool
+
+	// NearestBranch is the index of the branch of the supplied PCRProtectionProfile that is authorized by the PCR policy
+	// and has the fewest PCRs with values that differ from the current values, or -1 if no branch is authorized.
+	NearestBranch int
+
+	// UnauthorizedBranches contains the indices of the branches of the supplied PCRProtectionProfile that are not
+	// authorized by the PCR policy. If this isn't empty, the profile doesn't correspond to the PCR policy.
+	UnauthorizedBranches []int
+
+	// Mismatches describes each PCR with a current value that differs from its value in the nearest authorized branch.
+	Mismatches []*PCRMismatch
+}
+
+// String returns a human readable report of this diagnosis, suitable for including in a support ticket.
+func (d *PCRMismatchDiagnosis) String() string {
+	var b bytes.Buffer
+	if d.CurrentValuesAuthorized {
+		fmt.Fprintf(&b, "the current PCR values satisfy the PCR policy\n")
+	} else {
+		fmt.Fprintf(&b, "the current PCR values do not satisfy the PCR policy\n")
+	}
+	if len(d.UnauthorizedBranches) > 0 {
+		fmt.Fprintf(&b, "the PCR profile contains branches that are not authorized by the PCR policy: %v\n", d.UnauthorizedBranches)
+	}
+	if d.NearestBranch < 0 {
+		fmt.Fprintf(&b, "no branch of the PCR profile is authorized by the PCR policy\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "nearest authorized branch of the PCR profile: %d\n", d.NearestBranch)
+	for _, m := range d.Mismatches {
+		fmt.Fprintf(&b, "PCR %d, bank %v: expected %x, current %x\n", m.PCR, m.Alg, m.Expected, m.Current)
+		if !m.LogConsistent {
+			fmt.Fprintf(&b, "  the TCG event log is not consistent with the current value\n")
+		}
+		for _, e := range m.Events {
+			fmt.Fprintf(&b, "  %v: %x %v\n", e.EventType, e.Digests[m.Alg], e.Data)
+		}
+		for _, d := range m.MissingDigests {
+			fmt.Fprintf(&b, "  missing: %x\n", d)
+		}
+	}
+	return b.String()
+}
+
+// initialPCRValueFromLog returns the value of the specified PCR before any of the events from the supplied log were
+// measured to it.
+func initialPCRValueFromLog(log *tcglog.Log, alg tpm2.HashAlgorithmId, pcr int) tpm2.Digest {
+	value := make(tpm2.Digest, alg.Size())
+	if pcr != 0 {
+		return value
+	}
+	for _, e := range log.Events {
+		// EV_NO_ACTION events aren't measured, although the StartupLocality event indicates the initial value of PCR 0.
+		if l, isLocality := e.Data.(*tcglog.StartupLocalityEventData); isLocality && e.PCRIndex == 0 && e.EventType == tcglog.EventTypeNoAction {
+			value[len(value)-1] = l.StartupLocality
+			break
+		}
+	}
+	return value
+}
+
+// replayLogForPCR computes the value of the specified PCR by replaying the events from the supplied log that were
+// measured to it, and returns these events. If any event doesn't have a digest for the specified algorithm, this
+// returns false.
+func replayLogForPCR(log *tcglog.Log, alg tpm2.HashAlgorithmId, pcr int) (tpm2.Digest, []*tcglog.Event, bool) {
+	value := initialPCRValueFromLog(log, alg, pcr)
+	var events []*tcglog.Event
+	ok := true
+
+	for _, e := range log.Events {
+		if int(e.PCRIndex) != pcr || e.EventType == tcglog.EventTypeNoAction {
+			continue
+		}
+
+		events = append(events, e)
+
+		digest, hasDigest := e.Digests[alg]
+		if !hasDigest {
+			ok = false
+			continue
+		}
+		h := alg.NewHash()
+		h.Write(value)
+		h.Write(digest)
+		value = h.Sum(nil)
+	}
+
+	return value, events, ok
+}
+
+// divergentLogEvents compares the supplied events that were measured to a PCR with the supplied components of its
+// expected value, and returns the events that don't correspond to the expected digests as well as the expected digests
+// that don't correspond to any event. The initial argument is the value of the PCR before any of the events were
+// measured.
+//
+// If the expected components begin with a value that the PCR doesn't have at any point during the replay of the
+// events, they can't be compared and all of the events are returned.
+func divergentLogEvents(alg tpm2.HashAlgorithmId, initial tpm2.Digest, events []*tcglog.Event, expected *pcrProfileComponents) (divergent []*tcglog.Event, missing []tpm2.Digest) {
+	// Find the point in the log that corresponds to the initial value of the expected components.
+	start := -1
+	value := initial
+	if bytes.Equal(value, expected.initial) {
+		start = 0
+	}
+	for i := 0; start < 0 && i < len(events); i++ {
+		digest, ok := events[i].Digests[alg]
+		if !ok {
+			break
+		}
+		h := alg.NewHash()
+		h.Write(value)
+		h.Write(digest)
+		value = h.Sum(nil)
+		if bytes.Equal(value, expected.initial) {
+			start = i + 1
+		}
+	}
+	if start < 0 {
+		return events, nil
+	}
+	events = events[start:]
+
+	matches := func(i, j int) bool {
+		digest, ok := events[i].Digests[alg]
+		return ok && bytes.Equal(digest, expected.digests[j])
+	}
+
+	// Compute the longest common subsequence of the event digests and the expected digests. lcs[i][j] is the
+	// length of the longest common subsequence of events[i:] and expected.digests[j:].
+	n := len(events)
+	m := len(expected.digests)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case matches(i, j):
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Anything that isn't part of the longest common subsequence diverges.
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case matches(i, j) && lcs[i][j] == lcs[i+1][j+1]+1:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			divergent = append(divergent, events[i])
+			i++
+		default:
+			missing = append(missing, expected.digests[j])
+			j++
+		}
+	}
+	divergent = append(divergent, events[i:]...)
+	missing = append(missing, expected.digests[j:]...)
+
+	return divergent, missing
+}
+
+// diagnosePCRMismatch compares the supplied current PCR values against each of the supplied branches, which are
+// expected to correspond to the PCR conditions of the supplied PCR policy. The nearest branch that is authorized
+// by the PCR policy is the one with the fewest PCRs that differ from the current values. The supplied log is
+// optional.
+func diagnosePCRMismatch(alg tpm2.HashAlgorithmId, data *dynamicPolicyData, current tpm2.PCRValues, branches pcrProfileBranchList,
+	log *tcglog.Log) (*PCRMismatchDiagnosis, error) {
+	isAuthorized := func(values tpm2.PCRValues) (bool, error) {
+		pcrDigest, err := util.ComputePCRDigest(alg, data.pcrSelection, values)
+		if err != nil {
+			return false, err
+		}
+		trial := util.ComputeAuthPolicy(alg)
+		trial.PolicyPCR(pcrDigest, data.pcrSelection)
+		return trialPolicyORAssertions(alg, data.pcrOrData, trial.GetDigest()), nil
+	}
+
+	currentAuthorized, err := isAuthorized(current)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR digest from current values: %w", err)
+	}
+
+	diagnosis := &PCRMismatchDiagnosis{CurrentValuesAuthorized: currentAuthorized, NearestBranch: -1}
+
+	var nearest []*PCRMismatch
+	for i, branch := range branches.values() {
+		authorized, err := isAuthorized(branch)
+		if err != nil || !authorized {
+			diagnosis.UnauthorizedBranches = append(diagnosis.UnauthorizedBranches, i)
+			continue
+		}
+
+		var mismatches []*PCRMismatch
+		for _, s := range data.pcrSelection {
+			for _, pcr := range s.Select {
+				if bytes.Equal(branch[s.Hash][pcr], current[s.Hash][pcr]) {
+					continue
+				}
+				mismatches = append(mismatches, &PCRMismatch{
+					Alg:      s.Hash,
+					PCR:      pcr,
+					Expected: branch[s.Hash][pcr],
+					Current:  current[s.Hash][pcr]})
+			}
+		}
+
+		if diagnosis.NearestBranch < 0 || len(mismatches) < len(nearest) {
+			diagnosis.NearestBranch = i
+			nearest = mismatches
+		}
+	}
+
+	if log != nil {
+		for _, m := range nearest {
+			value, events, ok := replayLogForPCR(log, m.Alg, m.PCR)
+			m.LogConsistent = ok && bytes.Equal(value, m.Current)
+			m.Events, m.MissingDigests = divergentLogEvents(m.Alg, initialPCRValueFromLog(log, m.Alg, m.PCR), events,
+				branches[diagnosis.NearestBranch][m.Alg][m.PCR])
+		}
+	}
+	diagnosis.Mismatches = nearest
+
+	return diagnosis, nil
+}
+
+// DiagnosePCRMismatch helps to diagnose why the PCR policy for this sealed key object is not satisfied by the current
+// PCR values. As the sealed key object only contains digests of the PCR values that it is authorized for, the profile
+// argument must correspond to the PCRProtectionProfile that was used to compute the current PCR policy. Each branch of
+// the profile is compared against the current PCR values, and the PCRs that differ from the nearest branch that is
+// authorized by the PCR policy are reported.
+//
+// If the log argument is supplied, the events from the TCG event log that were measured to each of the PCRs that differ
+// are compared with the digests that the nearest authorized branch of the profile extends them with, and the events
+// that diverge are reported along with the expected digests that are missing from the log. These can be used to
+// determine the reason for the difference, eg, a modified EFI signature database or an unexpected bootloader.
+//
+// If validation of the sealed key data fails, a InvalidKeyFileError error will be returned.
+func (k *SealedKeyObject) DiagnosePCRMismatch(tpm *Connection, profile *PCRProtectionProfile, log *tcglog.Log) (*PCRMismatchDiagnosis, error) {
+	session := tpm.HmacSession()
+	data := k.data.dynamicPolicyData
+
+	if _, err := k.data.validate(tpm.TPMContext, nil, session); err != nil {
+		if isKeyFileError(err) {
+			return nil, InvalidKeyFileError{err.Error()}
+		}
+		return nil, xerrors.Errorf("cannot validate key data: %w", err)
+	}
+
+	_, current, err := tpm.PCRRead(data.pcrSelection, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read PCR values: %w", err)
+	}
+
+	branches, err := profile.computeBranches(tpm.TPMContext)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values from profile: %w", err)
+	}
+
+	return diagnosePCRMismatch(k.data.keyPublic.NameAlg, data, current, branches, log)
+}
@@ -0,0 +1,364 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+	"github.com/canonical/tcglog-parser"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func makeTestEvent(pcr int, eventType tcglog.EventType, data string) *tcglog.Event {
+	return &tcglog.Event{
+		PCRIndex:  tcglog.PCRIndex(pcr),
+		EventType: eventType,
+		Digests: tcglog.DigestMap{
+			tpm2.HashAlgorithmSHA256: tcglog.Digest(testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, data))}}
+}
+
+func makeTestLog(events ...*tcglog.Event) *tcglog.Log {
+	return &tcglog.Log{Algorithms: tcglog.AlgorithmIdList{tpm2.HashAlgorithmSHA256}, Events: events}
+}
+
+func extendTestPCR(value tpm2.Digest, digests ...tcglog.Digest) tpm2.Digest {
+	for _, d := range digests {
+		h := tpm2.HashAlgorithmSHA256.NewHash()
+		h.Write(value)
+		h.Write(d)
+		value = h.Sum(nil)
+	}
+	return value
+}
+
+func TestReplayLogForPCR(t *testing.T) {
+	log := makeTestLog(
+		&tcglog.Event{PCRIndex: 0, EventType: tcglog.EventTypeNoAction, Data: &tcglog.StartupLocalityEventData{StartupLocality: 3},
+			Digests: tcglog.DigestMap{tpm2.HashAlgorithmSHA256: make(tcglog.Digest, 32)}},
+		makeTestEvent(0, tcglog.EventTypeSCRTMVersion, "version"),
+		makeTestEvent(7, tcglog.EventTypeEFIVariableDriverConfig, "db"),
+		makeTestEvent(4, tcglog.EventTypeEFIBootServicesApplication, "shim"),
+		makeTestEvent(7, tcglog.EventTypeSeparator, "separator"))
+
+	initial := make(tpm2.Digest, 32)
+	initial[31] = 3
+	value, events, ok := ReplayLogForPCR(log, tpm2.HashAlgorithmSHA256, 0)
+	if !ok {
+		t.Errorf("Unexpected result")
+	}
+	if !bytes.Equal(value, extendTestPCR(initial, log.Events[1].Digests[tpm2.HashAlgorithmSHA256])) {
+		t.Errorf("Unexpected value for PCR 0: %x", value)
+	}
+	if !reflect.DeepEqual(events, []*tcglog.Event{log.Events[1]}) {
+		t.Errorf("Unexpected events for PCR 0")
+	}
+
+	value, events, ok = ReplayLogForPCR(log, tpm2.HashAlgorithmSHA256, 7)
+	if !ok {
+		t.Errorf("Unexpected result")
+	}
+	if !bytes.Equal(value, extendTestPCR(make(tpm2.Digest, 32), log.Events[2].Digests[tpm2.HashAlgorithmSHA256],
+		log.Events[4].Digests[tpm2.HashAlgorithmSHA256])) {
+		t.Errorf("Unexpected value for PCR 7: %x", value)
+	}
+	if !reflect.DeepEqual(events, []*tcglog.Event{log.Events[2], log.Events[4]}) {
+		t.Errorf("Unexpected events for PCR 7")
+	}
+
+	if _, _, ok := ReplayLogForPCR(log, tpm2.HashAlgorithmSHA1, 7); ok {
+		t.Errorf("Replay should fail for a bank without digests")
+	}
+}
+
+func TestDivergentLogEvents(t *testing.T) {
+	digest := func(s string) tpm2.Digest {
+		return testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, s)
+	}
+
+	log := makeTestLog(
+		makeTestEvent(7, tcglog.EventTypeEFIVariableDriverConfig, "pk"),
+		makeTestEvent(7, tcglog.EventTypeEFIVariableDriverConfig, "db"),
+		makeTestEvent(7, tcglog.EventTypeSeparator, "separator"),
+		makeTestEvent(7, tcglog.EventTypeEFIVariableAuthority, "authority"))
+	_, events, _ := ReplayLogForPCR(log, tpm2.HashAlgorithmSHA256, 7)
+
+	for _, data := range []struct {
+		desc      string
+		profile   *PCRProtectionProfile
+		divergent []*tcglog.Event
+		missing   []tpm2.Digest
+	}{
+		{
+			desc: "Match",
+			profile: NewPCRProtectionProfile().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("pk")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("db")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("separator")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("authority")),
+		},
+		{
+			desc: "Modified",
+			profile: NewPCRProtectionProfile().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("pk")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("db2")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("separator")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("authority")),
+			divergent: []*tcglog.Event{log.Events[1]},
+			missing:   []tpm2.Digest{digest("db2")},
+		},
+		{
+			desc: "Unexpected",
+			profile: NewPCRProtectionProfile().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("pk")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("separator")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("authority")),
+			divergent: []*tcglog.Event{log.Events[1]},
+		},
+		{
+			desc: "Missing",
+			profile: NewPCRProtectionProfile().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("pk")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("db")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("separator")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("authority")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("authority2")),
+			missing: []tpm2.Digest{digest("authority2")},
+		},
+		{
+			desc: "InitialValue",
+			profile: NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "pk", "db")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("separator")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("authority2")),
+			divergent: []*tcglog.Event{log.Events[3]},
+			missing:   []tpm2.Digest{digest("authority2")},
+		},
+		{
+			desc: "UnknownInitialValue",
+			profile: NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("separator")),
+			divergent: events,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			branches, err := data.profile.ComputeBranches(nil)
+			if err != nil {
+				t.Fatalf("ComputeBranches failed: %v", err)
+			}
+			divergent, missing := DivergentLogEvents(tpm2.HashAlgorithmSHA256, InitialPCRValueFromLog(log, tpm2.HashAlgorithmSHA256, 7),
+				events, branches[0][tpm2.HashAlgorithmSHA256][7])
+			if !reflect.DeepEqual(divergent, data.divergent) {
+				t.Errorf("Unexpected divergent events: %v", divergent)
+			}
+			if !reflect.DeepEqual(missing, data.missing) {
+				t.Errorf("Unexpected missing digests: %x", missing)
+			}
+		})
+	}
+}
+
+func TestDiagnosePCRMismatch(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	log := makeTestLog(
+		makeTestEvent(4, tcglog.EventTypeEFIBootServicesApplication, "shim"),
+		makeTestEvent(7, tcglog.EventTypeEFIVariableDriverConfig, "db"),
+		makeTestEvent(7, tcglog.EventTypeSeparator, "separator"))
+
+	pcr4, _, _ := ReplayLogForPCR(log, tpm2.HashAlgorithmSHA256, 4)
+	pcr7, _, _ := ReplayLogForPCR(log, tpm2.HashAlgorithmSHA256, 7)
+	current := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: pcr4, 7: pcr7}}
+
+	digest := func(s string) tpm2.Digest {
+		return testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, s)
+	}
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}}
+	authorized := []*PCRProtectionProfile{
+		NewPCRProtectionProfile().
+			ExtendPCR(tpm2.HashAlgorithmSHA256, 4, digest("foo")).
+			ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("bar")),
+		NewPCRProtectionProfile().
+			ExtendPCR(tpm2.HashAlgorithmSHA256, 4, digest("shim")).
+			ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("db")).
+			ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("bar")),
+	}
+	unauthorized := NewPCRProtectionProfile().
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 4, digest("shim")).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("db")).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, digest("separator"))
+
+	authorizedBranches, err := NewPCRProtectionProfile().AddProfileOR(authorized...).ComputeBranches(nil)
+	if err != nil {
+		t.Fatalf("ComputeBranches failed: %v", err)
+	}
+	values, err := NewPCRProtectionProfile().AddProfileOR(authorized...).ComputePCRValues(nil)
+	if err != nil {
+		t.Fatalf("ComputePCRValues failed: %v", err)
+	}
+
+	var pcrDigests tpm2.DigestList
+	for _, v := range values {
+		d, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, v)
+		if err != nil {
+			t.Fatalf("ComputePCRDigest failed: %v", err)
+		}
+		pcrDigests = append(pcrDigests, d)
+	}
+	data, err := ComputeDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256,
+		NewDynamicPolicyComputeParams(key, tpm2.HashAlgorithmSHA256, pcrs, pcrDigests, nil, 0))
+	if err != nil {
+		t.Fatalf("ComputeDynamicPolicy failed: %v", err)
+	}
+
+	branches, err := NewPCRProtectionProfile().AddProfileOR(authorized[0], unauthorized, authorized[1]).ComputeBranches(nil)
+	if err != nil {
+		t.Fatalf("ComputeBranches failed: %v", err)
+	}
+
+	diagnosis, err := DiagnosePCRMismatch(tpm2.HashAlgorithmSHA256, data, current, branches, log)
+	if err != nil {
+		t.Fatalf("DiagnosePCRMismatch failed: %v", err)
+	}
+	if diagnosis.CurrentValuesAuthorized {
+		t.Errorf("Current values should not be authorized")
+	}
+	if diagnosis.NearestBranch != 2 {
+		t.Errorf("Unexpected nearest branch %d", diagnosis.NearestBranch)
+	}
+	if !reflect.DeepEqual(diagnosis.UnauthorizedBranches, []int{1}) {
+		t.Errorf("Unexpected unauthorized branches %v", diagnosis.UnauthorizedBranches)
+	}
+	// Only the event that diverges from the nearest branch is reported.
+	expected := []*PCRMismatch{
+		{
+			Alg:            tpm2.HashAlgorithmSHA256,
+			PCR:            7,
+			Expected:       values[1][tpm2.HashAlgorithmSHA256][7],
+			Current:        pcr7,
+			LogConsistent:  true,
+			Events:         []*tcglog.Event{log.Events[2]},
+			MissingDigests: []tpm2.Digest{digest("bar")},
+		},
+	}
+	if !reflect.DeepEqual(diagnosis.Mismatches, expected) {
+		t.Errorf("Unexpected mismatches")
+	}
+	if diagnosis.String() == "" {
+		t.Errorf("Empty report")
+	}
+
+	// Without a log, the mismatch is reported without any events.
+	diagnosis, err = DiagnosePCRMismatch(tpm2.HashAlgorithmSHA256, data, current, authorizedBranches, nil)
+	if err != nil {
+		t.Fatalf("DiagnosePCRMismatch failed: %v", err)
+	}
+	if diagnosis.NearestBranch != 1 || len(diagnosis.Mismatches) != 1 || diagnosis.Mismatches[0].Events != nil ||
+		diagnosis.Mismatches[0].MissingDigests != nil || diagnosis.Mismatches[0].LogConsistent {
+		t.Errorf("Unexpected diagnosis: %v", diagnosis)
+	}
+
+	// The log can't explain a PCR value that it's not consistent with.
+	current[tpm2.HashAlgorithmSHA256][7] = testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "baz")
+	diagnosis, err = DiagnosePCRMismatch(tpm2.HashAlgorithmSHA256, data, current, authorizedBranches, log)
+	if err != nil {
+		t.Fatalf("DiagnosePCRMismatch failed: %v", err)
+	}
+	if len(diagnosis.Mismatches) != 1 || diagnosis.Mismatches[0].LogConsistent {
+		t.Errorf("Unexpected diagnosis: %v", diagnosis)
+	}
+
+	// Nothing is reported when the current values are authorized.
+	diagnosis, err = DiagnosePCRMismatch(tpm2.HashAlgorithmSHA256, data, values[0], authorizedBranches, log)
+	if err != nil {
+		t.Fatalf("DiagnosePCRMismatch failed: %v", err)
+	}
+	if !diagnosis.CurrentValuesAuthorized || diagnosis.NearestBranch != 0 || len(diagnosis.Mismatches) != 0 {
+		t.Errorf("Unexpected diagnosis: %v", diagnosis)
+	}
+}
+
+func TestSealedKeyDiagnosePCRMismatch(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealedKeyDiagnosePCRMismatch_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	profile := NewPCRProtectionProfile().
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo"))
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: profile, PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	diagnosis, err := k.DiagnosePCRMismatch(tpm, profile, nil)
+	if err != nil {
+		t.Fatalf("DiagnosePCRMismatch failed: %v", err)
+	}
+	if diagnosis.CurrentValuesAuthorized || diagnosis.NearestBranch != 0 || len(diagnosis.Mismatches) != 1 ||
+		diagnosis.Mismatches[0].PCR != 7 {
+		t.Errorf("Unexpected diagnosis: %v", diagnosis)
+	}
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+
+	diagnosis, err = k.DiagnosePCRMismatch(tpm, profile, nil)
+	if err != nil {
+		t.Fatalf("DiagnosePCRMismatch failed: %v", err)
+	}
+	if !diagnosis.CurrentValuesAuthorized || len(diagnosis.Mismatches) != 0 {
+		t.Errorf("Unexpected diagnosis: %v", diagnosis)
+	}
+}
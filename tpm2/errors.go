@@ -52,6 +52,16 @@ var (
 	// ErrPINFail is returned from SealedKeyObject.UnsealFromTPM if the provided PIN is incorrect.
 	ErrPINFail = errors.New("the provided PIN is incorrect")
 
+	// ErrInvalidRecoveryResponse is returned from RecoverySession.Unseal if the supplied RecoveryResponse was not
+	// produced for the session's challenge by the key used for authorizing PCR policy updates, or if the challenge
+	// has expired.
+	ErrInvalidRecoveryResponse = errors.New("the recovery response is invalid or has expired")
+
+	// ErrBootAttemptLimitReached is returned from SealedKeyObject.UnsealFromTPM if the sealed key object has a boot
+	// attempt limit and the maximum number of unseal attempts have been made since the boot attempt counter was last
+	// reset with SealedKeyObject.ResetBootAttemptCounter.
+	ErrBootAttemptLimitReached = errors.New("the maximum number of unseal attempts has been reached")
+
 	// ErrNoTPM2Device is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if no TPM2 device is avaiable.
 	ErrNoTPM2Device = errors.New("no TPM2 device is available")
 )
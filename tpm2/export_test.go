@@ -26,6 +26,7 @@ import (
 	"github.com/canonical/go-tpm2"
 
 	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
 )
 
 // Export constants for testing
@@ -46,19 +47,41 @@ var (
 	ComputeSnapModelDigest                = computeSnapModelDigest
 	ComputeStaticPolicy                   = computeStaticPolicy
 	CreateTPMPublicAreaForECDSAKey        = createTPMPublicAreaForECDSAKey
+	DiagnosePCRMismatch                   = diagnosePCRMismatch
+	DivergentLogEvents                    = divergentLogEvents
 	ExecutePolicySession                  = executePolicySession
+	InitialPCRValueFromLog                = initialPCRValueFromLog
 	IncrementPcrPolicyCounter             = incrementPcrPolicyCounter
 	IsDynamicPolicyDataError              = isDynamicPolicyDataError
 	IsStaticPolicyDataError               = isStaticPolicyDataError
 	LockNVIndex1Attrs                     = lockNVIndex1Attrs
+	MakeBootAttemptCounterData            = makeBootAttemptCounterData
+	MakePCRPolicyValidityData             = makePCRPolicyValidityData
 	PerformPinChange                      = performPinChange
 	ReadPcrPolicyCounter                  = readPcrPolicyCounter
+	ReplayLogForPCR                       = replayLogForPCR
+	TrialPolicyORAssertions               = trialPolicyORAssertions
+	VerifyDynamicPolicy                   = verifyDynamicPolicy
 )
 
 // Alias some unexported types for testing. These are required in order to pass these between functions in tests, or to access
 // unexported members of some unexported types.
 type DynamicPolicyData = dynamicPolicyData
 
+type BootAttemptCounterData = bootAttemptCounterData
+
+type PCRProfileBranchList = pcrProfileBranchList
+
+type PCRPolicyValidityData = pcrPolicyValidityData
+
+func (d *PCRPolicyValidityData) ComputeLimits(clockInfo *tpm2.ClockInfo) (*PCRPolicyValidityData, error) {
+	return d.computeLimits(clockInfo)
+}
+
+func (d *PCRPolicyValidityData) HasExpired(clockInfo *tpm2.ClockInfo) bool {
+	return d.hasExpired(clockInfo)
+}
+
 func (d *DynamicPolicyData) PCRSelection() tpm2.PCRSelectionList {
 	return d.pcrSelection
 }
@@ -83,6 +106,71 @@ func (d *DynamicPolicyData) AuthorizedPolicySignature() *tpm2.Signature {
 	return d.authorizedPolicySignature
 }
 
+func (d *DynamicPolicyData) Validity() *PCRPolicyValidityData {
+	return d.validity
+}
+
+func (d *DynamicPolicyData) BootAttempts() *BootAttemptCounterData {
+	return d.bootAttempts
+}
+
+// NewPCRPolicyUpdate creates an unsigned PCRPolicyUpdate from the supplied parameters.
+func NewPCRPolicyUpdate(keyVersion uint32, policyAlg tpm2.HashAlgorithmId, authPublicKey *tpm2.Public, params *dynamicPolicyComputeParams) (*PCRPolicyUpdate, error) {
+	return newPCRPolicyUpdate(keyVersion, policyAlg, authPublicKey, params)
+}
+
+// SetPolicyCount modifies the policy count of this update without recomputing the PCR policy.
+func (u *PCRPolicyUpdate) SetPolicyCount(count uint64) {
+	u.policyData.policyCount = count
+}
+
+// SetAuthorizedPolicy modifies the PCR policy digest of this update.
+func (u *PCRPolicyUpdate) SetAuthorizedPolicy(digest tpm2.Digest) {
+	u.policyData.authorizedPolicy = digest
+}
+
+func (u *PCRPolicyUpdate) PolicyData() *DynamicPolicyData {
+	return u.policyData
+}
+
+// NewRecoveryChallenge creates a RecoveryChallenge for the supplied nonce.
+func NewRecoveryChallenge(authPublicKey *tpm2.Public, policyAlg tpm2.HashAlgorithmId, nonceTPM tpm2.Nonce, expiration int32, policyCounterName tpm2.Name, policyCount uint64) *RecoveryChallenge {
+	return &RecoveryChallenge{
+		authPublicKey:     authPublicKey,
+		policyAlg:         policyAlg,
+		nonceTPM:          nonceTPM,
+		expiration:        expiration,
+		policyCounterName: policyCounterName,
+		policyCount:       policyCount}
+}
+
+func (r *RecoveryResponse) Authorization() *tpm2.Signature {
+	return r.authorization
+}
+
+func (r *RecoveryResponse) Approval() *tpm2.Signature {
+	return r.approval
+}
+
+type KeyData = keyData
+
+// NewKeyData creates a KeyData with the supplied version, public area and policy data.
+func NewKeyData(version uint32, keyPublic *tpm2.Public, staticData *StaticPolicyData, dynamicData *DynamicPolicyData) *KeyData {
+	return &KeyData{
+		version:           version,
+		keyPublic:         keyPublic,
+		staticPolicyData:  staticData,
+		dynamicPolicyData: dynamicData}
+}
+
+func (d *KeyData) Version() uint32 {
+	return d.version
+}
+
+func (d *KeyData) DynamicPolicyData() *DynamicPolicyData {
+	return d.dynamicPolicyData
+}
+
 type GoSnapModelHasher = goSnapModelHasher
 type SnapModelHasher = snapModelHasher
 
@@ -113,7 +201,7 @@ func MockActivateVolumeWithRecoveryKey(fn func(string, string, io.Reader, *secbo
 	}
 }
 
-func MockLUKS2Activate(fn func(string, string, []byte) error) (restore func()) {
+func MockLUKS2Activate(fn func(string, string, []byte, *luks2.ActivateOptions) error) (restore func()) {
 	orig := luks2Activate
 	luks2Activate = fn
 	return func() {
@@ -173,6 +261,24 @@ func NewDynamicPolicyComputeParams(key *ecdsa.PrivateKey, signAlg tpm2.HashAlgor
 		policyCount:       policyCount}
 }
 
+// NewDynamicPolicyComputeParamsWithValidity creates dynamicPolicyComputeParams with a validity window.
+func NewDynamicPolicyComputeParamsWithValidity(key *ecdsa.PrivateKey, signAlg tpm2.HashAlgorithmId, pcrs tpm2.PCRSelectionList,
+	pcrDigests tpm2.DigestList, policyCounterName tpm2.Name, policyCount uint64, validity *PCRPolicyValidityData) *dynamicPolicyComputeParams {
+	params := NewDynamicPolicyComputeParams(key, signAlg, pcrs, pcrDigests, policyCounterName, policyCount)
+	params.validity = validity
+	return params
+}
+
+// NewDynamicPolicyComputeParamsWithBootAttempts creates dynamicPolicyComputeParams with a boot attempt limit.
+func NewDynamicPolicyComputeParamsWithBootAttempts(key *ecdsa.PrivateKey, signAlg tpm2.HashAlgorithmId, pcrs tpm2.PCRSelectionList,
+	pcrDigests tpm2.DigestList, policyCounterName tpm2.Name, policyCount uint64, bootAttemptCounterName tpm2.Name,
+	bootAttempts *BootAttemptCounterData) *dynamicPolicyComputeParams {
+	params := NewDynamicPolicyComputeParams(key, signAlg, pcrs, pcrDigests, policyCounterName, policyCount)
+	params.bootAttemptCounterName = bootAttemptCounterName
+	params.bootAttempts = bootAttempts
+	return params
+}
+
 func NewStaticPolicyComputeParams(key *tpm2.Public, pcrPolicyCounterPub *tpm2.NVPublic) *staticPolicyComputeParams {
 	return &staticPolicyComputeParams{key: key, pcrPolicyCounterPub: pcrPolicyCounterPub}
 }
@@ -191,3 +297,7 @@ func ValidateKeyDataFile(tpm *tpm2.TPMContext, keyFile string, authPrivateKey Po
 	_, err = k.data.validate(tpm, authKey, session)
 	return err
 }
+
+func (p *PCRProtectionProfile) ComputeBranches(tpm *tpm2.TPMContext) (PCRProfileBranchList, error) {
+	return p.computeBranches(tpm)
+}
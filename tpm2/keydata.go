@@ -47,7 +47,7 @@ import (
 )
 
 const (
-	currentMetadataVersion    uint32 = 2
+	currentMetadataVersion    uint32 = 3
 	keyDataHeader             uint32 = 0x55534b24
 	keyPolicyUpdateDataHeader uint32 = 0x55534b50
 )
@@ -260,6 +260,17 @@ type keyDataRaw_v2 struct {
 	DynamicPolicyData *dynamicPolicyDataRaw_v0
 }
 
+// keyDataRaw_v3 is version 3 of the on-disk format of keyDataRaw. It adds support for PCR policy validity windows and
+// boot attempt limits.
+type keyDataRaw_v3 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      authMode
+	ImportSymSeed     tpm2.EncryptedSecret
+	StaticPolicyData  *staticPolicyDataRaw_v1
+	DynamicPolicyData *dynamicPolicyDataRaw_v1
+}
+
 // for executing authorization policy assertions.
 // XXX: This is temporarily named keyData until this code is moved in to secboot/tpm
 type keyData struct {
@@ -273,10 +284,14 @@ type keyData struct {
 }
 
 func (d keyData) Marshal(w io.Writer) error {
-	// We can upgrade v1 to v2 automatically
+	// We can upgrade v1 to v2 automatically. Keys are only upgraded to v3 when they have a PCR policy validity window
+	// or a boot attempt limit, so that they can still be read by older versions of this package otherwise.
 	if d.version == 1 {
 		d.version = 2
 	}
+	if d.version == 2 && (d.dynamicPolicyData.validity != nil || d.dynamicPolicyData.bootAttempts != nil) {
+		d.version = 3
+	}
 	if _, err := mu.MarshalToWriter(w, d.version); err != nil {
 		return xerrors.Errorf("cannot marshal version number: %w", err)
 	}
@@ -311,6 +326,25 @@ func (d keyData) Marshal(w io.Writer) error {
 		if _, err := mu.MarshalToWriter(w, makeAfSplitDataRaw(splitData)); err != nil {
 			return xerrors.Errorf("cannot marshal split data: %w", err)
 		}
+	case 3:
+		var tmpW bytes.Buffer
+		raw := keyDataRaw_v3{
+			KeyPrivate:        d.keyPrivate,
+			KeyPublic:         d.keyPublic,
+			AuthModeHint:      d.authModeHint,
+			ImportSymSeed:     d.importSymSeed,
+			StaticPolicyData:  makeStaticPolicyDataRaw_v1(d.staticPolicyData),
+			DynamicPolicyData: makeDynamicPolicyDataRaw_v1(d.dynamicPolicyData)}
+		if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
+			return xerrors.Errorf("cannot marshal raw data: %w", err)
+		}
+		splitData, err := makeAfSplitData(tmpW.Bytes(), 128*1024, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			return xerrors.Errorf("cannot split data: %w", err)
+		}
+		if _, err := mu.MarshalToWriter(w, makeAfSplitDataRaw(splitData)); err != nil {
+			return xerrors.Errorf("cannot marshal split data: %w", err)
+		}
 	default:
 		return fmt.Errorf("unexpected version number (%d)", d.version)
 	}
@@ -381,6 +415,29 @@ func (d *keyData) Unmarshal(r mu.Reader) error {
 			importSymSeed:     raw.ImportSymSeed,
 			staticPolicyData:  raw.StaticPolicyData.data(),
 			dynamicPolicyData: raw.DynamicPolicyData.data()}
+	case 3:
+		var splitData afSplitDataRaw
+		if _, err := mu.UnmarshalFromReader(r, &splitData); err != nil {
+			return xerrors.Errorf("cannot unmarshal split data: %w", err)
+		}
+
+		merged, err := splitData.data().merge()
+		if err != nil {
+			return xerrors.Errorf("cannot merge data: %w", err)
+		}
+
+		var raw keyDataRaw_v3
+		if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+			return xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		*d = keyData{
+			version:           version,
+			keyPrivate:        raw.KeyPrivate,
+			keyPublic:         raw.KeyPublic,
+			authModeHint:      raw.AuthModeHint,
+			importSymSeed:     raw.ImportSymSeed,
+			staticPolicyData:  raw.StaticPolicyData.data(),
+			dynamicPolicyData: raw.DynamicPolicyData.data()}
 	default:
 		return fmt.Errorf("unexpected version number (%d)", version)
 	}
@@ -712,6 +769,39 @@ func (k *SealedKeyObject) PCRPolicyCounterHandle() tpm2.Handle {
 	return k.data.staticPolicyData.pcrPolicyCounterHandle
 }
 
+// persist atomically writes this sealed key object back to the file that it was read from. It does nothing if it
+// wasn't read from a file, in which case it is the responsibility of the caller to write it with SealedKeyObject.Write.
+func (k *SealedKeyObject) persist() error {
+	if k.path == "" {
+		return nil
+	}
+	return k.data.writeToFileAtomic(k.path)
+}
+
+// Write serializes this sealed key object to the supplied io.Writer. This is required to persist changes made to a sealed
+// key object that was read with ReadSealedKeyObjectFromReader, such as by SealedKeyObject.UpdatePCRProtectionPolicy or
+// SealedKeyObject.ChangePIN, as these functions only update sealed key objects that were read from a file in place.
+//
+// Note that updating the PCR policy of a sealed key object with a PCR policy counter revokes the previous PCR policy before
+// returning, so the updated sealed key object must be written successfully in order for it to remain usable.
+func (k *SealedKeyObject) Write(w io.Writer) error {
+	if err := k.data.write(w); err != nil {
+		return xerrors.Errorf("cannot write sealed key object: %w", err)
+	}
+	return nil
+}
+
+// ReadSealedKeyObjectFromReader loads a sealed key object that was serialized with SealedKeyObject.Write from the supplied
+// io.Reader. If the sealed key object cannot be deserialized successfully, a InvalidKeyFileError error will be returned.
+func ReadSealedKeyObjectFromReader(r io.Reader) (*SealedKeyObject, error) {
+	data, err := decodeKeyData(r)
+	if err != nil {
+		return nil, InvalidKeyFileError{err.Error()}
+	}
+
+	return &SealedKeyObject{data: data}, nil
+}
+
 // ReadSealedKeyObject loads a sealed key data file created by SealKeyToTPM from the specified path. If the file cannot be opened,
 // a wrapped *os.PathError error is returned. If the key data file cannot be deserialized successfully, a InvalidKeyFileError error
 // will be returned.
@@ -0,0 +1,134 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// ExportToExternalTPMStorageKey exports this sealed key object to another TPM, for example when migrating data to a
+// replacement device. The sealed key object is unsealed on the source TPM, which requires its authorization policy to be
+// satisfied and the correct PIN to be supplied if one is set, and the key is then wrapped in a duplication object that is
+// encrypted to the TPM storage key associated with the supplied public tpmKey, in the same way as
+// SealKeyToExternalTPMStorageKey. The exported sealed key object and associated metadata are written to a new file at the
+// path specified by keyPath, and must be imported on the target TPM with SealedKeyObject.ImportToTPM.
+//
+// Sealed key objects are created with the fixedTPM and fixedParent attributes, so they can't be duplicated with
+// TPM2_Duplicate. This means that the cleartext key is briefly present in the memory of this process, as it is when
+// unsealing.
+//
+// The tpmKey argument must correspond to the storage primary key on the target TPM, persisted at the standard handle.
+//
+// The exported sealed key object will be protected with a PCR policy computed from the PCRProtectionProfile supplied via
+// the pcrProfile argument, which must describe the PCR values of the target device. As with SealKeyToExternalTPMStorageKey,
+// the exported sealed key object does not have a PCR policy counter, a PCR policy validity window or a boot attempt limit.
+// In order to avoid silently dropping these protections, an error is returned without unsealing the key if this sealed
+// key object has a PCR policy validity window or a boot attempt limit. The PCR policy counter is not needed on the
+// target device, as none of the PCR policies created on the source device are valid there.
+//
+// The key used for authorizing PCR policy updates is retained, except for version 0 sealed key data files where a new key is
+// created.
+//
+// This function expects there to be no file at the specified path. If keyPath references a file that already exists, a wrapped
+// *os.PathError error will be returned with an underlying error of syscall.EEXIST.
+//
+// Any error that can be returned from SealedKeyObject.UnsealFromTPM can be returned from this function.
+//
+// On success, this function returns the private part of the key used for authorizing PCR policy updates, which is required
+// by SealedKeyObject.ImportToTPM.
+func (k *SealedKeyObject) ExportToExternalTPMStorageKey(tpm *Connection, pin string, tpmKey *tpm2.Public, keyPath string,
+	pcrProfile *PCRProtectionProfile) (PolicyAuthKey, error) {
+	if k.data.dynamicPolicyData.validity != nil || k.data.dynamicPolicyData.bootAttempts != nil {
+		return nil, errors.New("cannot export a sealed key object with a PCR policy validity window or boot attempt limit")
+	}
+
+	key, authKey, err := k.UnsealFromTPM(tpm, pin)
+	if err != nil {
+		return nil, err
+	}
+
+	var goAuthKey *ecdsa.PrivateKey
+	if k.data.version == 0 {
+		goAuthKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot generate key for signing dynamic authorization policies: %w", err)
+		}
+	} else {
+		goAuthKey, err = createECDSAPrivateKeyFromTPM(k.data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authKey))
+		if err != nil {
+			return nil, InvalidKeyFileError{fmt.Sprintf("cannot create auth key: %v", err)}
+		}
+	}
+
+	if err := sealKeyToExternalTPMStorageKey(tpmKey, key, keyPath, goAuthKey, pcrProfile); err != nil {
+		return nil, err
+	}
+
+	return goAuthKey.D.Bytes(), nil
+}
+
+// ImportToTPM imports this sealed key object, previously created by SealedKeyObject.ExportToExternalTPMStorageKey or
+// SealKeyToExternalTPMStorageKey, in to the storage hierarchy of the TPM and atomically updates the sealed key data file so
+// that it no longer needs to be imported each time it is used. In order to do this, the caller must supply the private part
+// of the key used for authorizing PCR policy updates that was returned when the sealed key object was exported or created,
+// which ensures that only the owner of the sealed key object can import it.
+//
+// If the sealed key object has already been imported, this function only performs the authorization check.
+//
+// If the sealed key object cannot be imported because it was exported for a different TPM or the TPM owner has changed, or
+// the supplied authorization key is incorrect, a InvalidKeyFileError error will be returned.
+func (k *SealedKeyObject) ImportToTPM(tpm *Connection, authKey PolicyAuthKey) error {
+	if len(authKey) == 0 {
+		return errors.New("no authorization key supplied")
+	}
+
+	ecdsaAuthKey, err := createECDSAPrivateKeyFromTPM(k.data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authKey))
+	if err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot create auth key: %v", err)}
+	}
+
+	needsImport := len(k.data.importSymSeed) > 0
+
+	// Validation loads the sealed key object, which imports it, and checks that the authorization key is correct.
+	if _, err := k.data.validate(tpm.TPMContext, ecdsaAuthKey, tpm.HmacSession()); err != nil {
+		if isKeyFileError(err) {
+			return InvalidKeyFileError{err.Error()}
+		}
+		return xerrors.Errorf("cannot validate key data: %w", err)
+	}
+
+	if !needsImport {
+		return nil
+	}
+
+	if err := k.persist(); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+// openSecondTPMSimulatorForTesting launches a second TPM simulator and opens a connection to it. The returned
+// function closes the connection and stops the simulator. This is only done by the tests that need it, rather than in
+// TestMain.
+func openSecondTPMSimulatorForTesting(t *testing.T) (*Connection, func()) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	simulatorCleanup, err := testutil.LaunchTPMSimulator(&testutil.TPMSimulatorOptions{
+		Manufacture: true,
+		Port:        testutil.SecondMssimPort})
+	if err != nil {
+		t.Fatalf("Cannot launch second TPM simulator: %v", err)
+	}
+
+	tpm, _, err := testutil.OpenSecondTPMSimulatorForTesting()
+	if err != nil {
+		simulatorCleanup()
+		t.Fatalf("%v", err)
+	}
+
+	return tpm, func() {
+		closeTPM(t, tpm)
+		simulatorCleanup()
+	}
+}
+
+func TestMigrateSealedKeyBetweenTPMs(t *testing.T) {
+	source, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, source)
+
+	target, closeTarget := openSecondTPMSimulatorForTesting(t)
+	defer closeTarget()
+
+	if err := source.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision source TPM for test: %v", err)
+	}
+	if err := target.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision target TPM for test: %v", err)
+	}
+
+	srk, err := target.CreateResourceContextFromTPM(tcg.SRKHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	srkPub, _, _, err := target.ReadPublic(srk)
+	if err != nil {
+		t.Fatalf("ReadPublic failed: %v", err)
+	}
+
+	// Compute a PCR profile for the target device.
+	_, targetValues, err := target.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}})
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+	targetProfile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, targetValues[tpm2.HashAlgorithmSHA256][7])
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestMigrateSealedKeyBetweenTPMs_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKey, err := SealKeyToTPM(source, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, source, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	exportedKeyFile := filepath.Join(tmpDir, "keydata.exported")
+	exportedAuthKey, err := k.ExportToExternalTPMStorageKey(source, "", srkPub, exportedKeyFile, targetProfile)
+	if err != nil {
+		t.Fatalf("ExportToExternalTPMStorageKey failed: %v", err)
+	}
+	if !bytes.Equal(exportedAuthKey, authKey) {
+		t.Errorf("Auth key was not retained")
+	}
+
+	exported, err := ReadSealedKeyObject(exportedKeyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	// The exported sealed key object can't be imported in to the source TPM.
+	if err := exported.ImportToTPM(source, exportedAuthKey); err == nil {
+		t.Errorf("ImportToTPM should fail on the source TPM")
+	} else if _, ok := err.(InvalidKeyFileError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Import requires the correct authorization key.
+	wrongAuthKey := make(PolicyAuthKey, len(exportedAuthKey))
+	copy(wrongAuthKey, exportedAuthKey)
+	wrongAuthKey[0] ^= 0xff
+	if err := exported.ImportToTPM(target, wrongAuthKey); err == nil {
+		t.Errorf("ImportToTPM should fail with the wrong auth key")
+	}
+
+	exported, err = ReadSealedKeyObject(exportedKeyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if err := exported.ImportToTPM(target, exportedAuthKey); err != nil {
+		t.Fatalf("ImportToTPM failed: %v", err)
+	}
+
+	imported, err := ReadSealedKeyObject(exportedKeyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	unsealedKey, unsealedAuthKey, err := imported.UnsealFromTPM(target, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(unsealedKey, key) {
+		t.Errorf("Unexpected key")
+	}
+	if !bytes.Equal(unsealedAuthKey, authKey) {
+		t.Errorf("Unexpected auth key")
+	}
+}
+
+func TestExportSealedKeyWithBootAttemptLimit(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	srkPub, _, _, err := tpm.ReadPublic(srk)
+	if err != nil {
+		t.Fatalf("ReadPublic failed: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestExportSealedKeyWithBootAttemptLimit_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x01810000,
+		BootAttemptLimit:       &BootAttemptLimit{CounterHandle: 0x01810001, MaxAttempts: 2}}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+	defer func() {
+		rc, err := tpm.CreateResourceContextFromTPM(0x01810001)
+		if err != nil {
+			t.Errorf("CreateResourceContextFromTPM failed: %v", err)
+			return
+		}
+		undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+	}()
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	// The boot attempt limit can't be preserved, so the key must not be exported.
+	if _, err := k.ExportToExternalTPMStorageKey(tpm, "", srkPub, filepath.Join(tmpDir, "keydata.exported"), getTestPCRProfile()); err == nil ||
+		err.Error() != "cannot export a sealed key object with a PCR policy validity window or boot attempt limit" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	attempts, _, err := k.BootAttempts(tpm)
+	if err != nil {
+		t.Fatalf("BootAttempts failed: %v", err)
+	}
+	if attempts != 0 {
+		t.Errorf("Unexpected number of attempts %d", attempts)
+	}
+}
@@ -0,0 +1,340 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	ownerNVIndexFirst tpm2.Handle = 0x01800000 // First handle in the block reserved for owner NV indices
+	ownerNVIndexLast  tpm2.Handle = 0x01bfffff // Last handle in the block reserved for owner NV indices
+)
+
+// NVIndexType describes the purpose of a NV index created by this package.
+type NVIndexType int
+
+const (
+	// NVIndexTypePCRPolicyCounter corresponds to a NV index used for revoking PCR policies, created by SealKeyToTPM.
+	// For version 0 sealed key data files, this is the PIN NV index.
+	NVIndexTypePCRPolicyCounter NVIndexType = iota + 1
+
+	// NVIndexTypeBootAttemptCounter corresponds to a NV counter used for limiting the number of unseal attempts.
+	NVIndexTypeBootAttemptCounter
+
+	// NVIndexTypeLegacyLock corresponds to the global lock NV index used by version 0 sealed key data files.
+	NVIndexTypeLegacyLock
+)
+
+func (t NVIndexType) String() string {
+	switch t {
+	case NVIndexTypePCRPolicyCounter:
+		return "PCR policy counter"
+	case NVIndexTypeBootAttemptCounter:
+		return "boot attempt counter"
+	case NVIndexTypeLegacyLock:
+		return "legacy lock"
+	default:
+		return fmt.Sprintf("NVIndexType(%d)", int(t))
+	}
+}
+
+// NVIndexInfo describes a NV index that appears to have been created by this package.
+type NVIndexInfo struct {
+	Handle tpm2.Handle
+	Type   NVIndexType
+
+	// Verified indicates that the authorization policy of the NV index was checked against one of the supplied sealed
+	// key objects, and so it is known to have been created by this package.
+	Verified bool
+
+	// Referenced indicates that the NV index is used by at least one of the supplied sealed key objects.
+	Referenced bool
+}
+
+// nvIndexReferences describes the NV indices used by a set of sealed key objects.
+type nvIndexReferences struct {
+	pcrPolicyCounters   map[tpm2.Handle][]*SealedKeyObject
+	bootAttemptCounters map[tpm2.Handle]bool
+	legacyLock          bool
+}
+
+func makeNVIndexReferences(keys []*SealedKeyObject) *nvIndexReferences {
+	refs := &nvIndexReferences{
+		pcrPolicyCounters:   make(map[tpm2.Handle][]*SealedKeyObject),
+		bootAttemptCounters: make(map[tpm2.Handle]bool)}
+	for _, k := range keys {
+		if k.data.version == 0 {
+			refs.legacyLock = true
+		}
+		if h := k.data.staticPolicyData.pcrPolicyCounterHandle; h != tpm2.HandleNull {
+			refs.pcrPolicyCounters[h] = append(refs.pcrPolicyCounters[h], k)
+		}
+		if b := k.data.dynamicPolicyData.bootAttempts; b != nil {
+			refs.bootAttemptCounters[b.CounterHandle] = true
+		}
+	}
+	return refs
+}
+
+// hasPcrPolicyCounterAuthPolicy indicates whether the NV index with the supplied public area has an authorization
+// policy that permits the supplied policy digests, as a PCR policy counter does.
+func hasPcrPolicyCounterAuthPolicy(pub *tpm2.NVPublic, authPolicies tpm2.DigestList) bool {
+	if len(authPolicies) < 2 {
+		return false
+	}
+
+	trial := util.ComputeAuthPolicy(pub.NameAlg)
+	trial.PolicyOR(authPolicies)
+	return bytes.Equal(pub.AuthPolicy, trial.GetDigest())
+}
+
+// isPcrPolicyCounterForKey indicates whether the NV index with the supplied public area is the PCR policy counter
+// for the supplied sealed key object, based on its authorization policy.
+func isPcrPolicyCounterForKey(pub *tpm2.NVPublic, k *SealedKeyObject) bool {
+	if !pub.NameAlg.Available() {
+		return false
+	}
+
+	if k.data.version == 0 {
+		return hasPcrPolicyCounterAuthPolicy(pub, k.data.staticPolicyData.v0PinIndexAuthPolicies)
+	}
+
+	keyName, err := k.data.staticPolicyData.authPublicKey.Name()
+	if err != nil {
+		return false
+	}
+	return isPcrPolicyCounterForAuthKey(pub, keyName)
+}
+
+// isPcrPolicyCounterForAuthKey indicates whether the NV index with the supplied public area is a PCR policy counter
+// associated with the key used for authorizing PCR policy updates with the supplied name, based on its authorization
+// policy.
+func isPcrPolicyCounterForAuthKey(pub *tpm2.NVPublic, keyName tpm2.Name) bool {
+	if !pub.NameAlg.Available() {
+		return false
+	}
+	return hasPcrPolicyCounterAuthPolicy(pub, computePcrPolicyCounterAuthPolicies(pub.NameAlg, keyName))
+}
+
+// classifyNVIndex determines whether the NV index with the supplied public area was created by this package, using the
+// references from the supplied sealed key objects. Unreferenced PCR policy counters are verified against the supplied
+// sealed key objects and the names of the supplied retired authorization keys. Unreferenced boot attempt counters are
+// identified by their attributes and can never be verified. It returns nil if the NV index isn't recognized.
+func classifyNVIndex(pub *tpm2.NVPublic, refs *nvIndexReferences, keys []*SealedKeyObject, retiredAuthKeyNames []tpm2.Name) *NVIndexInfo {
+	attrs := pub.Attrs &^ tpm2.AttrNVWritten
+
+	if ks, ok := refs.pcrPolicyCounters[pub.Index]; ok {
+		info := &NVIndexInfo{Handle: pub.Index, Type: NVIndexTypePCRPolicyCounter, Referenced: true}
+		for _, k := range ks {
+			if isPcrPolicyCounterForKey(pub, k) {
+				info.Verified = true
+				break
+			}
+		}
+		return info
+	}
+
+	if refs.bootAttemptCounters[pub.Index] {
+		return &NVIndexInfo{Handle: pub.Index, Type: NVIndexTypeBootAttemptCounter, Referenced: true}
+	}
+
+	switch {
+	case pub.Index == lockNVHandle && attrs&^tpm2.AttrNVReadLocked == lockNVIndex1Attrs:
+		return &NVIndexInfo{Handle: pub.Index, Type: NVIndexTypeLegacyLock, Referenced: refs.legacyLock}
+	case attrs == tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA) &&
+		pub.Size == 8 && len(pub.AuthPolicy) > 0:
+		// This looks like a PCR policy counter, but it isn't used by any of the supplied sealed key objects. Its
+		// authorization policy can only be verified if it is associated with one of their authorization keys, or
+		// with one of the supplied retired authorization keys.
+		info := &NVIndexInfo{Handle: pub.Index, Type: NVIndexTypePCRPolicyCounter}
+		for _, k := range keys {
+			if k.data.version > 0 && isPcrPolicyCounterForKey(pub, k) {
+				info.Verified = true
+				return info
+			}
+		}
+		for _, name := range retiredAuthKeyNames {
+			if isPcrPolicyCounterForAuthKey(pub, name) {
+				info.Verified = true
+				break
+			}
+		}
+		return info
+	case attrs == bootAttemptCounterAttrs && pub.Size == 8 && len(pub.AuthPolicy) == 0:
+		// This looks like a boot attempt counter, but it isn't used by any of the supplied sealed key objects. Boot
+		// attempt counters have no authorization policy, and so it can't be distinguished from a NV counter created
+		// by other software with the same attributes.
+		return &NVIndexInfo{Handle: pub.Index, Type: NVIndexTypeBootAttemptCounter}
+	default:
+		return nil
+	}
+}
+
+// ListNVIndices enumerates the NV indices in the block reserved for owner objects (0x01800000 - 0x01bfffff) and
+// returns those that appear to have been created by this package, such as PCR policy counters created by
+// SealKeyToTPM, boot attempt counters and the global lock NV index used by version 0 sealed key data files.
+//
+// The keys argument should contain the sealed key objects for every sealed key data file that is still in use on this
+// device. Each returned NV index is marked as referenced if it is used by any of the supplied sealed key objects. PCR
+// policy counters are identified by their attributes, and are marked as verified if their authorization policy is
+// associated with the authorization key of one of the supplied sealed key objects. Boot attempt counters are also
+// identified by their attributes, but they have no authorization policy and so an unreferenced boot attempt counter
+// is never marked as verified.
+func ListNVIndices(tpm *Connection, keys []*SealedKeyObject) ([]*NVIndexInfo, error) {
+	return listNVIndices(tpm, keys, nil)
+}
+
+func listNVIndices(tpm *Connection, keys []*SealedKeyObject, retiredAuthKeys []*ecdsa.PublicKey) ([]*NVIndexInfo, error) {
+	var retiredAuthKeyNames []tpm2.Name
+	for _, key := range retiredAuthKeys {
+		name, err := createTPMPublicAreaForECDSAKey(key).Name()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute name of retired authorization key: %w", err)
+		}
+		retiredAuthKeyNames = append(retiredAuthKeyNames, name)
+	}
+
+	session := tpm.HmacSession()
+
+	handles, err := tpm.GetCapabilityHandles(ownerNVIndexFirst, tpm2.CapabilityMaxProperties, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain NV index handles: %w", err)
+	}
+
+	refs := makeNVIndexReferences(keys)
+
+	var out []*NVIndexInfo
+	for _, h := range handles {
+		if h > ownerNVIndexLast {
+			break
+		}
+
+		index, err := tpm.CreateResourceContextFromTPM(h, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create context for NV index %v: %w", h, err)
+		}
+		pub, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read public area of NV index %v: %w", h, err)
+		}
+
+		if info := classifyNVIndex(pub, refs, keys, retiredAuthKeyNames); info != nil {
+			out = append(out, info)
+		}
+	}
+
+	return out, nil
+}
+
+// UndefineNVIndicesOptions provides options to UndefineUnreferencedNVIndices.
+type UndefineNVIndicesOptions struct {
+	// RetiredAuthKeys are the public parts of the keys used for authorizing PCR policy updates for sealed key data files
+	// that have been deleted. Unreferenced PCR policy counters that are associated with one of these keys are verified
+	// to have been created by this package, and are undefined.
+	RetiredAuthKeys []*ecdsa.PublicKey
+
+	// UndefineUnverified permits unreferenced PCR policy counters and boot attempt counters to be undefined even if they
+	// can't be verified to have been created by this package. These NV indices only have the same attributes as a NV
+	// index created by this package, and so they may belong to other software.
+	UndefineUnverified bool
+
+	// UndefineLegacyLock permits the global lock NV index used by version 0 sealed key data files to be undefined if
+	// none of the supplied sealed key objects are version 0. This should only be set once it is known that there are
+	// no version 0 sealed key data files left on this device.
+	UndefineLegacyLock bool
+}
+
+// UndefineUnreferencedNVIndices undefines the NV indices returned from ListNVIndices that are not referenced by any of
+// the supplied sealed key objects, in order to reclaim NV storage used by sealed key data files that have been deleted.
+// The keys argument must contain the sealed key objects for every sealed key data file that is still in use on this
+// device, as any sealed key object that uses a NV index that is undefined by this function will become permanently
+// unusable. NV indices that are referenced by any of the supplied sealed key objects are never undefined.
+//
+// By default, only PCR policy counters that are known to have been created by this package are undefined. These have
+// an authorization policy that is associated with the authorization key of one of the supplied sealed key objects or
+// one of the retired authorization keys supplied via the RetiredAuthKeys field of the options argument. Other NV
+// indices that have the attributes of a PCR policy counter or a boot attempt counter are only undefined if the
+// UndefineUnverified field of the options argument is set.
+//
+// The global lock NV index used by version 0 sealed key data files is only undefined if the UndefineLegacyLock field
+// of the options argument is set, as it is shared by every version 0 sealed key data file and there is no way to tell
+// whether any of these remain on this device.
+//
+// If no sealed key objects are supplied, an error will be returned.
+//
+// If the authorization value for the storage hierarchy is incorrect, a AuthFailError error will be returned. This may
+// happen after some NV indices have already been undefined.
+//
+// On success, the handles of the NV indices that were undefined are returned.
+func UndefineUnreferencedNVIndices(tpm *Connection, keys []*SealedKeyObject, options *UndefineNVIndicesOptions) ([]tpm2.Handle, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no sealed key objects supplied")
+	}
+	if options == nil {
+		options = &UndefineNVIndicesOptions{}
+	}
+
+	indices, err := listNVIndices(tpm, keys, options.RetiredAuthKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	session := tpm.HmacSession()
+
+	var undefined []tpm2.Handle
+	for _, info := range indices {
+		if info.Referenced {
+			continue
+		}
+		switch info.Type {
+		case NVIndexTypePCRPolicyCounter, NVIndexTypeBootAttemptCounter:
+			if !info.Verified && !options.UndefineUnverified {
+				continue
+			}
+		case NVIndexTypeLegacyLock:
+			if !options.UndefineLegacyLock {
+				continue
+			}
+		}
+
+		index, err := tpm.CreateResourceContextFromTPM(info.Handle, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return undefined, xerrors.Errorf("cannot create context for NV index %v: %w", info.Handle, err)
+		}
+		if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session); err != nil {
+			if isAuthFailError(err, tpm2.CommandNVUndefineSpace, 1) {
+				return undefined, AuthFailError{tpm2.HandleOwner}
+			}
+			return undefined, xerrors.Errorf("cannot undefine NV index %v: %w", info.Handle, err)
+		}
+		undefined = append(undefined, info.Handle)
+	}
+
+	return undefined, nil
+}
@@ -0,0 +1,178 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestUndefineUnreferencedNVIndices(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestUndefineUnreferencedNVIndices_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x01810000,
+		BootAttemptLimit:       &BootAttemptLimit{CounterHandle: 0x01810010, MaxAttempts: 3}}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	orphanKeyFile := filepath.Join(tmpDir, "keydata.orphan")
+	orphanAuthKey, err := SealKeyToTPM(tpm, key, orphanKeyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x01810001,
+		BootAttemptLimit:       &BootAttemptLimit{CounterHandle: 0x01810011, MaxAttempts: 3}})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	if err := os.Remove(orphanKeyFile); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	// Define a NV counter that isn't owned by secboot but has the same attributes as a boot attempt counter, which must
+	// not be undefined unless explicitly requested.
+	public := tpm2.NVPublic{
+		Index:   0x01810020,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8}
+	if _, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil); err != nil {
+		t.Fatalf("NVDefineSpace failed: %v", err)
+	}
+
+	// Define a NV counter that isn't owned by secboot but has the same attributes as a PCR policy counter, which must
+	// not be undefined unless explicitly requested.
+	foreignPublic := tpm2.NVPublic{
+		Index:      0x01810021,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		AuthPolicy: testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foreign policy"),
+		Size:       8}
+	if _, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &foreignPublic, nil); err != nil {
+		t.Fatalf("NVDefineSpace failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	indices, err := ListNVIndices(tpm, []*SealedKeyObject{k})
+	if err != nil {
+		t.Fatalf("ListNVIndices failed: %v", err)
+	}
+	expected := []*NVIndexInfo{
+		{Handle: 0x01810000, Type: NVIndexTypePCRPolicyCounter, Verified: true, Referenced: true},
+		{Handle: 0x01810001, Type: NVIndexTypePCRPolicyCounter},
+		{Handle: 0x01810010, Type: NVIndexTypeBootAttemptCounter, Referenced: true},
+		{Handle: 0x01810011, Type: NVIndexTypeBootAttemptCounter},
+		{Handle: 0x01810020, Type: NVIndexTypeBootAttemptCounter},
+		{Handle: 0x01810021, Type: NVIndexTypePCRPolicyCounter}}
+	if !reflect.DeepEqual(indices, expected) {
+		t.Errorf("Unexpected NV indices:")
+		for _, i := range indices {
+			t.Logf("  %v", *i)
+		}
+	}
+
+	if _, err := UndefineUnreferencedNVIndices(tpm, nil, nil); err == nil || err.Error() != "no sealed key objects supplied" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	checkHandles := func(exist []tpm2.Handle, undefined []tpm2.Handle) {
+		for _, h := range exist {
+			if !tpm.DoesHandleExist(h) {
+				t.Errorf("NV index %v should still exist", h)
+			}
+		}
+		for _, h := range undefined {
+			if tpm.DoesHandleExist(h) {
+				t.Errorf("NV index %v should have been undefined", h)
+			}
+		}
+	}
+
+	// By default, unverified PCR policy counters and boot attempt counters are not undefined.
+	undefined, err := UndefineUnreferencedNVIndices(tpm, []*SealedKeyObject{k}, nil)
+	if err != nil {
+		t.Fatalf("UndefineUnreferencedNVIndices failed: %v", err)
+	}
+	if len(undefined) != 0 {
+		t.Errorf("Unexpected undefined handles: %v", undefined)
+	}
+	checkHandles([]tpm2.Handle{0x01810000, 0x01810001, 0x01810010, 0x01810011, 0x01810020, 0x01810021}, nil)
+
+	// Supplying the authorization key of the deleted key file verifies its PCR policy counter.
+	retiredAuthKey := &ecdsa.PublicKey{Curve: elliptic.P256()}
+	retiredAuthKey.X, retiredAuthKey.Y = elliptic.P256().ScalarBaseMult(orphanAuthKey)
+
+	undefined, err = UndefineUnreferencedNVIndices(tpm, []*SealedKeyObject{k},
+		&UndefineNVIndicesOptions{RetiredAuthKeys: []*ecdsa.PublicKey{retiredAuthKey}})
+	if err != nil {
+		t.Fatalf("UndefineUnreferencedNVIndices failed: %v", err)
+	}
+	if !reflect.DeepEqual(undefined, []tpm2.Handle{0x01810001}) {
+		t.Errorf("Unexpected undefined handles: %v", undefined)
+	}
+	checkHandles([]tpm2.Handle{0x01810000, 0x01810010, 0x01810011, 0x01810020, 0x01810021}, []tpm2.Handle{0x01810001})
+
+	// Undefining unverified PCR policy counters and boot attempt counters requires an explicit opt-in.
+	undefined, err = UndefineUnreferencedNVIndices(tpm, []*SealedKeyObject{k}, &UndefineNVIndicesOptions{UndefineUnverified: true})
+	if err != nil {
+		t.Fatalf("UndefineUnreferencedNVIndices failed: %v", err)
+	}
+	if !reflect.DeepEqual(undefined, []tpm2.Handle{0x01810011, 0x01810020, 0x01810021}) {
+		t.Errorf("Unexpected undefined handles: %v", undefined)
+	}
+	checkHandles([]tpm2.Handle{0x01810000, 0x01810010}, []tpm2.Handle{0x01810011, 0x01810020, 0x01810021})
+
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+}
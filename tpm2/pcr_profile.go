@@ -30,42 +30,81 @@ import (
 	"golang.org/x/xerrors"
 )
 
-// pcrValuesList is a list of PCR value combinations computed from PCRProtectionProfile.
-type pcrValuesList []tpm2.PCRValues
+// pcrProfileComponents describes how the value of a single PCR is computed in a branch of a PCRProtectionProfile, as
+// an initial value followed by a sequence of digests that it is extended with.
+type pcrProfileComponents struct {
+	initial tpm2.Digest
+	digests []tpm2.Digest
+}
+
+// value computes the value of the PCR from these components.
+func (c *pcrProfileComponents) value(alg tpm2.HashAlgorithmId) tpm2.Digest {
+	value := c.initial
+	for _, d := range c.digests {
+		h := alg.NewHash()
+		h.Write(value)
+		h.Write(d)
+		value = h.Sum(nil)
+	}
+	return value
+}
+
+// pcrProfileBranch describes how the value of each PCR is computed in a single complete branch of a
+// PCRProtectionProfile.
+type pcrProfileBranch map[tpm2.HashAlgorithmId]map[int]*pcrProfileComponents
+
+// pcrProfileBranchList is a list of complete branches computed from a PCRProtectionProfile.
+type pcrProfileBranchList []pcrProfileBranch
 
 // setValue sets the specified PCR to the supplied value for all branches.
-func (l pcrValuesList) setValue(alg tpm2.HashAlgorithmId, pcr int, value tpm2.Digest) {
-	for _, v := range l {
-		v.SetValue(alg, pcr, value)
+func (l pcrProfileBranchList) setValue(alg tpm2.HashAlgorithmId, pcr int, value tpm2.Digest) {
+	for _, b := range l {
+		if _, ok := b[alg]; !ok {
+			b[alg] = make(map[int]*pcrProfileComponents)
+		}
+		b[alg][pcr] = &pcrProfileComponents{initial: value}
 	}
 }
 
 // extendValue extends the specified PCR with the supplied value for all branches.
-func (l pcrValuesList) extendValue(alg tpm2.HashAlgorithmId, pcr int, value tpm2.Digest) {
-	for _, v := range l {
-		if _, ok := v[alg]; !ok {
-			v[alg] = make(map[int]tpm2.Digest)
+func (l pcrProfileBranchList) extendValue(alg tpm2.HashAlgorithmId, pcr int, value tpm2.Digest) {
+	for _, b := range l {
+		if _, ok := b[alg]; !ok {
+			b[alg] = make(map[int]*pcrProfileComponents)
 		}
-		if _, ok := v[alg][pcr]; !ok {
-			v[alg][pcr] = make(tpm2.Digest, alg.Size())
+		c, ok := b[alg][pcr]
+		if !ok {
+			c = &pcrProfileComponents{initial: make(tpm2.Digest, alg.Size())}
+			b[alg][pcr] = c
 		}
-		h := alg.NewHash()
-		h.Write(v[alg][pcr])
-		h.Write(value)
-		v[alg][pcr] = h.Sum(nil)
+		c.digests = append(c.digests, value)
 	}
 }
 
-func (l pcrValuesList) copy() (out pcrValuesList) {
-	for _, v := range l {
-		ov := make(tpm2.PCRValues)
-		for alg := range v {
-			ov[alg] = make(map[int]tpm2.Digest)
-			for pcr := range v[alg] {
-				ov[alg][pcr] = v[alg][pcr]
+func (l pcrProfileBranchList) copy() (out pcrProfileBranchList) {
+	for _, b := range l {
+		ob := make(pcrProfileBranch)
+		for alg := range b {
+			ob[alg] = make(map[int]*pcrProfileComponents)
+			for pcr, c := range b[alg] {
+				ob[alg][pcr] = &pcrProfileComponents{initial: c.initial, digests: append([]tpm2.Digest(nil), c.digests...)}
 			}
 		}
-		out = append(out, ov)
+		out = append(out, ob)
+	}
+	return
+}
+
+// values computes the PCR values for each of the branches in this list.
+func (l pcrProfileBranchList) values() (out []tpm2.PCRValues) {
+	for _, b := range l {
+		v := make(tpm2.PCRValues)
+		for alg := range b {
+			for pcr, c := range b[alg] {
+				v.SetValue(alg, pcr, c.value(alg))
+			}
+		}
+		out = append(out, v)
 	}
 	return
 }
@@ -260,8 +299,8 @@ func (p *PCRProtectionProfile) String() string {
 
 // pcrProtectionProfileComputeContext records state used when computing PCR values for a PCRProtectionProfile
 type pcrProtectionProfileComputeContext struct {
-	parent *pcrProtectionProfileComputeContext
-	values pcrValuesList
+	parent   *pcrProtectionProfileComputeContext
+	branches pcrProfileBranchList
 }
 
 // handleBranches is called when encountering a branch in a profile, and returns a slice of new *pcrProtectionProfileComputeContext
@@ -270,17 +309,17 @@ type pcrProtectionProfileComputeContext struct {
 func (c *pcrProtectionProfileComputeContext) handleBranches(n int) (out []*pcrProtectionProfileComputeContext) {
 	out = make([]*pcrProtectionProfileComputeContext, 0, n)
 	for i := 0; i < n; i++ {
-		out = append(out, &pcrProtectionProfileComputeContext{parent: c, values: c.values.copy()})
+		out = append(out, &pcrProtectionProfileComputeContext{parent: c, branches: c.branches.copy()})
 	}
-	c.values = nil
+	c.branches = nil
 	return
 }
 
-// finishBranch is called when encountering the end of a branch. This propagates the computed PCR values to the
+// finishBranch is called when encountering the end of a branch. This propagates the computed branches to the
 // *pcrProtectionProfileComputeContext associated with the parent branch. Calling this will panic on a
 // *pcrProtectionProfileComputeContext associated with the root branch.
 func (c *pcrProtectionProfileComputeContext) finishBranch() {
-	c.parent.values = append(c.parent.values, c.values...)
+	c.parent.branches = append(c.parent.branches, c.branches...)
 }
 
 // isRoot returns true if this *pcrProtectionProfileComputeContext is associated with a root branch.
@@ -300,7 +339,7 @@ func (s pcrProtectionProfileComputeContextStack) handleBranches(n int) pcrProtec
 	return pcrProtectionProfileComputeContextStack(append(newContexts, s...))
 }
 
-// finishBranch is called when encountering the end of a branch. This propagates the computed PCR values from the
+// finishBranch is called when encountering the end of a branch. This propagates the computed branches from the
 // *pcrProtectionProfileComputeContext at the top of the stack to the *pcrProtectionProfileComputeContext associated with the parent
 // branch, and then pops the context from the top of the stack. The new top of the stack corresponds to either a sibling branch or
 // the parent branch, from which subsequent instructions will be processed from.
@@ -315,16 +354,16 @@ func (s pcrProtectionProfileComputeContextStack) top() *pcrProtectionProfileComp
 	return s[0]
 }
 
-// ComputePCRValues computes PCR values for this PCRProtectionProfile, returning one set of PCR values
-// for each complete branch. The returned list of PCR values is not de-duplicated.
-func (p *PCRProtectionProfile) ComputePCRValues(tpm *tpm2.TPMContext) ([]tpm2.PCRValues, error) {
-	contexts := pcrProtectionProfileComputeContextStack{{values: pcrValuesList{make(tpm2.PCRValues)}}}
+// computeBranches computes the components of the PCR values for each complete branch of this PCRProtectionProfile.
+// Unlike ComputePCRValues, this retains the individual digests that each PCR is extended with.
+func (p *PCRProtectionProfile) computeBranches(tpm *tpm2.TPMContext) (pcrProfileBranchList, error) {
+	contexts := pcrProtectionProfileComputeContextStack{{branches: pcrProfileBranchList{make(pcrProfileBranch)}}}
 
 	iter := p.traverseInstructions()
 	for {
 		switch i := iter.next().(type) {
 		case *pcrProtectionProfileAddPCRValueInstr:
-			contexts.top().values.setValue(i.alg, i.pcr, i.value)
+			contexts.top().branches.setValue(i.alg, i.pcr, i.value)
 		case *pcrProtectionProfileAddPCRValueFromTPMInstr:
 			if tpm == nil {
 				return nil, fmt.Errorf("cannot read current value of PCR %d from bank %v: no TPM context", i.pcr, i.alg)
@@ -333,9 +372,9 @@ func (p *PCRProtectionProfile) ComputePCRValues(tpm *tpm2.TPMContext) ([]tpm2.PC
 			if err != nil {
 				return nil, xerrors.Errorf("cannot read current value of PCR %d from bank %v: %w", i.pcr, i.alg, err)
 			}
-			contexts.top().values.setValue(i.alg, i.pcr, v[i.alg][i.pcr])
+			contexts.top().branches.setValue(i.alg, i.pcr, v[i.alg][i.pcr])
 		case *pcrProtectionProfileExtendPCRInstr:
-			contexts.top().values.extendValue(i.alg, i.pcr, i.value)
+			contexts.top().branches.extendValue(i.alg, i.pcr, i.value)
 		case *pcrProtectionProfileAddProfileORInstr:
 			// As this is a depth-first traversal, processing of this branch is parked when a AddProfileOR instruction is encountered.
 			// Subsequent instructions will be from each of the sub-branches in turn.
@@ -343,13 +382,23 @@ func (p *PCRProtectionProfile) ComputePCRValues(tpm *tpm2.TPMContext) ([]tpm2.PC
 		case *pcrProtectionProfileEndProfileInstr:
 			if contexts.top().isRoot() {
 				// This is the end of the profile
-				return []tpm2.PCRValues(contexts.top().values), nil
+				return contexts.top().branches, nil
 			}
 			contexts = contexts.finishBranch()
 		}
 	}
 }
 
+// ComputePCRValues computes PCR values for this PCRProtectionProfile, returning one set of PCR values
+// for each complete branch. The returned list of PCR values is not de-duplicated.
+func (p *PCRProtectionProfile) ComputePCRValues(tpm *tpm2.TPMContext) ([]tpm2.PCRValues, error) {
+	branches, err := p.computeBranches(tpm)
+	if err != nil {
+		return nil, err
+	}
+	return branches.values(), nil
+}
+
 // ComputePCRDigests computes a PCR selection and a list of composite PCR digests from this PCRProtectionProfile (one composite digest per
 // complete branch). The returned list of PCR digests is de-duplicated.
 func (p *PCRProtectionProfile) ComputePCRDigests(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (tpm2.PCRSelectionList, tpm2.DigestList, error) {
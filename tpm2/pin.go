@@ -186,7 +186,7 @@ func (k *SealedKeyObject) ChangePIN(tpm *Connection, oldPIN, newPIN string) erro
 		return nil
 	}
 
-	if err := k.data.writeToFileAtomic(k.path); err != nil {
+	if err := k.persist(); err != nil {
 		return xerrors.Errorf("cannot write key data file: %v", err)
 	}
 
@@ -20,6 +20,7 @@
 package tpm2
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
@@ -45,10 +46,17 @@ type dynamicPolicyComputeParams struct {
 	// signAlg is the digest algorithm for the signature used to authorize the generated dynamic authorization policy. It must
 	// match the name algorithm of the public part of key that will be loaded in to the TPM for verification.
 	signAlg           tpm2.HashAlgorithmId
-	pcrs              tpm2.PCRSelectionList // PCR selection
-	pcrDigests        tpm2.DigestList       // Approved PCR digests
-	policyCounterName tpm2.Name             // Name of the NV index used for revoking authorization policies
-	policyCount       uint64                // Count for this policy, used for revocation
+	pcrs              tpm2.PCRSelectionList  // PCR selection
+	pcrDigests        tpm2.DigestList        // Approved PCR digests
+	policyCounterName tpm2.Name              // Name of the NV index used for revoking authorization policies
+	policyCount       uint64                 // Count for this policy, used for revocation
+	validity          *pcrPolicyValidityData // Optional validity window for this policy, with limits computed
+
+	// pcrOrData can be set instead of pcrDigests in order to reuse the PCR conditions of an existing policy.
+	pcrOrData policyOrDataTree
+
+	bootAttemptCounterName tpm2.Name               // Name of the NV index used for counting unseal attempts
+	bootAttempts           *bootAttemptCounterData // Optional boot attempt limit for this policy, with the baseline read
 }
 
 // policyOrDataNode represents a collection of up to 8 digests used in a single TPM2_PolicyOR invocation, and forms part of a tree
@@ -67,6 +75,8 @@ type dynamicPolicyData struct {
 	policyCount               uint64
 	authorizedPolicy          tpm2.Digest
 	authorizedPolicySignature *tpm2.Signature
+	validity                  *pcrPolicyValidityData
+	bootAttempts              *bootAttemptCounterData
 }
 
 // dynamicPolicyDataRaw_v0 is version 0 of the on-disk format of dynamicPolicyData.
@@ -97,6 +107,56 @@ func makeDynamicPolicyDataRaw_v0(data *dynamicPolicyData) *dynamicPolicyDataRaw_
 		AuthorizedPolicySignature: data.authorizedPolicySignature}
 }
 
+// dynamicPolicyDataRaw_v1 is version 1 of the on-disk format of dynamicPolicyData. It adds support for a validity window and a
+// boot attempt limit.
+type dynamicPolicyDataRaw_v1 struct {
+	PCRSelection              tpm2.PCRSelectionList
+	PCROrData                 policyOrDataTree
+	PolicyCount               uint64
+	AuthorizedPolicy          tpm2.Digest
+	AuthorizedPolicySignature *tpm2.Signature
+	Validity                  pcrPolicyValidityData
+	BootAttempts              bootAttemptCounterData
+}
+
+func (d *dynamicPolicyDataRaw_v1) data() *dynamicPolicyData {
+	var validity *pcrPolicyValidityData
+	if !d.Validity.isEmpty() {
+		v := d.Validity
+		validity = &v
+	}
+	var bootAttempts *bootAttemptCounterData
+	if !d.BootAttempts.isEmpty() {
+		b := d.BootAttempts
+		bootAttempts = &b
+	}
+	return &dynamicPolicyData{
+		pcrSelection:              d.PCRSelection,
+		pcrOrData:                 d.PCROrData,
+		policyCount:               d.PolicyCount,
+		authorizedPolicy:          d.AuthorizedPolicy,
+		authorizedPolicySignature: d.AuthorizedPolicySignature,
+		validity:                  validity,
+		bootAttempts:              bootAttempts}
+}
+
+// makeDynamicPolicyDataRaw_v1 converts dynamicPolicyData to version 1 of the on-disk format.
+func makeDynamicPolicyDataRaw_v1(data *dynamicPolicyData) *dynamicPolicyDataRaw_v1 {
+	raw := &dynamicPolicyDataRaw_v1{
+		PCRSelection:              data.pcrSelection,
+		PCROrData:                 data.pcrOrData,
+		PolicyCount:               data.policyCount,
+		AuthorizedPolicy:          data.authorizedPolicy,
+		AuthorizedPolicySignature: data.authorizedPolicySignature}
+	if data.validity != nil {
+		raw.Validity = *data.validity
+	}
+	if data.bootAttempts != nil {
+		raw.BootAttempts = *data.bootAttempts
+	}
+	return raw
+}
+
 // staticPolicyComputeParams provides the parameters to computeStaticPolicy.
 type staticPolicyComputeParams struct {
 	key                 *tpm2.Public   // Public part of key used to authorize a dynamic authorization policy
@@ -240,6 +300,14 @@ func incrementPcrPolicyCounter(tpm *tpm2.TPMContext, version uint32, nvPublic *t
 		panic("invalid private key type")
 	}
 
+	return incrementPcrPolicyCounterWithSignature(tpm, version, index, nvPublic, nvAuthPolicies, keyPublic, policySession, &signature, hmacSession)
+}
+
+// incrementPcrPolicyCounterWithSignature will increment the NV counter index associated with nvPublic using the supplied policy
+// session, which must have been started with the name algorithm of the index. The signature argument must be a signature of the
+// session's nonceTPM and a zero expiration time by the key associated with keyPublic, as required by the PolicySigned assertion in
+// the authorization policy of the index.
+func incrementPcrPolicyCounterWithSignature(tpm *tpm2.TPMContext, version uint32, index tpm2.ResourceContext, nvPublic *tpm2.NVPublic, nvAuthPolicies tpm2.DigestList, keyPublic *tpm2.Public, policySession tpm2.SessionContext, signature *tpm2.Signature, hmacSession tpm2.SessionContext) error {
 	// Load the public part of the key in to the TPM. There's no integrity protection for this command as if it's altered in
 	// transit then either the signature verification fails or the policy digest will not match the one associated with the NV
 	// index.
@@ -265,7 +333,7 @@ func incrementPcrPolicyCounter(tpm *tpm2.TPMContext, version uint32, nvPublic *t
 		nvAuthPolicies = computePcrPolicyCounterAuthPolicies(nvPublic.NameAlg, keyLoaded.Name())
 	}
 
-	if _, _, err := tpm.PolicySigned(keyLoaded, policySession, true, nil, nil, 0, &signature); err != nil {
+	if _, _, err := tpm.PolicySigned(keyLoaded, policySession, true, nil, nil, 0, signature); err != nil {
 		return xerrors.Errorf("cannot execute assertion to increment counter: %w", err)
 	}
 	if err := tpm.PolicyOR(policySession, nvAuthPolicies); err != nil {
@@ -524,23 +592,37 @@ func computePolicyORData(alg tpm2.HashAlgorithmId, trial *util.TrialAuthPolicy,
 //   assertions (depending on how many sets of permitted PCR values there are).
 // - The PCR policy hasn't been revoked. This is done using a PolicyNV assertion to assert that the value of an optional NV counter
 //   is not greater than the expected value.
+// - The PCR policy hasn't expired, if it has a validity window. This is done using one or more PolicyCounterTimer assertions
+//   that compare the TPM's clock and reset count against the computed limits.
+// - The maximum number of unseal attempts since the boot attempt counter was last reset hasn't been reached, if the policy has
+//   a boot attempt limit. This is done using a PolicyNV assertion to assert that the value of the counter is not greater than
+//   the recorded baseline plus the maximum number of attempts.
 // The computed PCR policy digest is signed with the supplied asymmetric key, and the signature of this is validated before executing
-// the corresponding PolicyAuthorize assertion as part of the static policy.
+// the corresponding PolicyAuthorize assertion as part of the static policy. If no key is supplied, the returned policy is unsigned
+// and must be signed before it can be used.
 func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynamicPolicyComputeParams) (*dynamicPolicyData, error) {
-	if len(input.pcrDigests) == 0 {
-		return nil, errors.New("no PCR digests specified")
-	}
+	trial := util.ComputeAuthPolicy(alg)
 
-	// Compute the policy digest that would result from a TPM2_PolicyPCR assertion for each condition
-	var pcrOrDigests tpm2.DigestList
-	for _, d := range input.pcrDigests {
-		trial := util.ComputeAuthPolicy(alg)
-		trial.PolicyPCR(d, input.pcrs)
-		pcrOrDigests = append(pcrOrDigests, trial.GetDigest())
-	}
+	var pcrOrData policyOrDataTree
+	switch {
+	case len(input.pcrOrData) > 0:
+		// Reuse the PCR conditions from an existing policy. The root node is always the last one, and the final
+		// TPM2_PolicyOR assertion resets the session digest, so this is all that's needed to reproduce the digest.
+		pcrOrData = input.pcrOrData
+		trial.PolicyOR(ensureSufficientORDigests(pcrOrData[len(pcrOrData)-1].Digests))
+	case len(input.pcrDigests) > 0:
+		// Compute the policy digest that would result from a TPM2_PolicyPCR assertion for each condition
+		var pcrOrDigests tpm2.DigestList
+		for _, d := range input.pcrDigests {
+			trial := util.ComputeAuthPolicy(alg)
+			trial.PolicyPCR(d, input.pcrs)
+			pcrOrDigests = append(pcrOrDigests, trial.GetDigest())
+		}
 
-	trial := util.ComputeAuthPolicy(alg)
-	pcrOrData := computePolicyORData(alg, trial, pcrOrDigests)
+		pcrOrData = computePolicyORData(alg, trial, pcrOrDigests)
+	default:
+		return nil, errors.New("no PCR digests specified")
+	}
 
 	if len(input.policyCounterName) > 0 {
 		operandB := make([]byte, 8)
@@ -548,8 +630,34 @@ func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynam
 		trial.PolicyNV(input.policyCounterName, operandB, 0, tpm2.OpUnsignedLE)
 	}
 
+	if input.validity != nil {
+		if version == 0 {
+			return nil, errors.New("validity windows are not supported")
+		}
+		input.validity.trialPolicyAssertions(trial)
+	}
+
+	if input.bootAttempts != nil {
+		if version == 0 {
+			return nil, errors.New("boot attempt limits are not supported")
+		}
+		if err := input.bootAttempts.trialPolicyAssertion(trial, input.bootAttemptCounterName); err != nil {
+			return nil, xerrors.Errorf("cannot compute boot attempt limit assertion: %w", err)
+		}
+	}
+
 	authorizedPolicy := trial.GetDigest()
 
+	if input.key == nil {
+		return &dynamicPolicyData{
+			pcrSelection:     input.pcrs,
+			pcrOrData:        pcrOrData,
+			policyCount:      input.policyCount,
+			authorizedPolicy: authorizedPolicy,
+			validity:         input.validity,
+			bootAttempts:     input.bootAttempts}, nil
+	}
+
 	// Create a digest to sign
 	h := input.signAlg.NewHash()
 	h.Write(authorizedPolicy)
@@ -592,7 +700,58 @@ func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynam
 		pcrOrData:                 pcrOrData,
 		policyCount:               input.policyCount,
 		authorizedPolicy:          authorizedPolicy,
-		authorizedPolicySignature: &signature}, nil
+		authorizedPolicySignature: &signature,
+		validity:                  input.validity,
+		bootAttempts:              input.bootAttempts}, nil
+}
+
+// verifyDynamicPolicy checks that the supplied PCR policy is consistent with its policy digest, and that the policy digest was
+// signed by the key associated with the supplied static policy. This is used before signing a new PCR policy that reuses the PCR
+// conditions of an existing one, or when making predictions about an existing one.
+func verifyDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, staticData *staticPolicyData, data *dynamicPolicyData,
+	policyCounterName, bootAttemptCounterName tpm2.Name) error {
+	authPublicKey := staticData.authPublicKey
+
+	expected, err := computeDynamicPolicy(version, alg, &dynamicPolicyComputeParams{
+		signAlg:                authPublicKey.NameAlg,
+		pcrs:                   data.pcrSelection,
+		pcrOrData:              data.pcrOrData,
+		policyCounterName:      policyCounterName,
+		policyCount:            data.policyCount,
+		validity:               data.validity,
+		bootAttemptCounterName: bootAttemptCounterName,
+		bootAttempts:           data.bootAttempts})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expected.authorizedPolicy, data.authorizedPolicy) {
+		return errors.New("PCR policy digest is inconsistent with metadata")
+	}
+
+	h := authPublicKey.NameAlg.NewHash()
+	h.Write(data.authorizedPolicy)
+	if version > 0 {
+		h.Write(computePcrPolicyRefFromCounterName(policyCounterName))
+	}
+
+	if version == 0 {
+		key, ok := authPublicKey.Public().(*rsa.PublicKey)
+		sig := data.authorizedPolicySignature
+		if !ok || sig.SigAlg != tpm2.SigSchemeAlgRSAPSS || sig.Signature.RSAPSS.Hash != authPublicKey.NameAlg {
+			return errors.New("cannot verify PCR policy signature: unexpected signature scheme")
+		}
+		if err := rsa.VerifyPSS(key, authPublicKey.NameAlg.GetHash(), h.Sum(nil), sig.Signature.RSAPSS.Sig,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+			return errors.New("cannot verify PCR policy signature: invalid signature")
+		}
+		return nil
+	}
+
+	if err := verifyECDSASignature(authPublicKey, h.Sum(nil), data.authorizedPolicySignature); err != nil {
+		return xerrors.Errorf("cannot verify PCR policy signature: %w", err)
+	}
+
+	return nil
 }
 
 type staticPolicyDataError struct {
@@ -675,6 +834,49 @@ func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext
 	return nil
 }
 
+// trialPolicyORAssertions determines whether the TPM2_PolicyOR assertions in the supplied tree can be executed successfully from
+// the supplied session digest, without using the TPM. It traverses the tree in the same way as executePolicyORAssertions.
+func trialPolicyORAssertions(alg tpm2.HashAlgorithmId, data policyOrDataTree, digest tpm2.Digest) bool {
+	if len(data) == 0 {
+		return false
+	}
+
+	// Find the leaf node that contains the digest.
+	index := -1
+	end := data[0].Next
+	if end == 0 {
+		end = 1
+	}
+
+	for i := 0; i < len(data) && i < int(end); i++ {
+		if digestListContains(data[i].Digests, digest) {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return false
+	}
+
+	// Traverse up the tree to the root node, checking that the digest produced by each TPM2_PolicyOR assertion is in the
+	// parent node.
+	for lastIndex := -1; index > lastIndex && index < len(data); index += int(data[index].Next) {
+		lastIndex = index
+		if !digestListContains(data[index].Digests, digest) {
+			return false
+		}
+		if data[index].Next == 0 {
+			// This is the root node, so we're finished.
+			return true
+		}
+
+		trial := util.ComputeAuthPolicy(alg)
+		trial.PolicyOR(ensureSufficientORDigests(data[index].Digests))
+		digest = trial.GetDigest()
+	}
+	return false
+}
+
 // executePolicySession executes an authorization policy session using the supplied metadata. On success, the supplied policy
 // session can be used for authorization.
 func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContext, version uint32, staticInput *staticPolicyData,
@@ -758,6 +960,18 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 		}
 	}
 
+	if dynamicInput.validity != nil {
+		if err := dynamicInput.validity.executeAssertions(tpm, policySession); err != nil {
+			return err
+		}
+	}
+
+	if dynamicInput.bootAttempts != nil {
+		if err := dynamicInput.bootAttempts.executeAssertion(tpm, policySession); err != nil {
+			return err
+		}
+	}
+
 	authPublicKey := staticInput.authPublicKey
 	if !authPublicKey.NameAlg.Available() {
 		return staticPolicyDataError{errors.New("public area of dynamic authorization policy signing key has an unsupported name algorithm")}
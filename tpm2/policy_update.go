@@ -0,0 +1,726 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	pcrPolicyUpdateHeader              uint32 = 0x55534b55
+	pcrPolicyRevocationChallengeHeader uint32 = 0x55534b56
+	pcrPolicyRevocationResponseHeader  uint32 = 0x55534b57
+)
+
+// pcrPolicyUpdateRaw_v0 is version 0 of the serialized format of PCRPolicyUpdate. It contains the parameters that the PCR
+// policy was computed from rather than the computed policy, so that the policy can be recomputed when it is deserialized.
+type pcrPolicyUpdateRaw_v0 struct {
+	KeyVersion                uint32
+	PolicyAlg                 tpm2.HashAlgorithmId
+	AuthPublicKey             *tpm2.Public
+	PCRSelection              tpm2.PCRSelectionList
+	PCRDigests                tpm2.DigestList
+	PolicyCounterName         tpm2.Name
+	PolicyCount               uint64
+	Validity                  pcrPolicyValidityData
+	BootAttemptCounterName    tpm2.Name
+	BootAttempts              bootAttemptCounterData
+	AuthorizedPolicy          tpm2.Digest
+	AuthorizedPolicySignature *tpm2.Signature
+}
+
+// PCRPolicyUpdate corresponds to a PCR policy for a set of related sealed key objects that has been computed
+// by ComputePCRPolicyUpdate, but which has not been installed yet. It must be signed with the key used for
+// authorizing PCR policy updates for the sealed key objects before it can be installed with
+// InstallPCRPolicyUpdate.
+//
+// It can be serialized with Write and deserialized with ReadPCRPolicyUpdate, so that it can be signed on
+// another machine with a key that never leaves that machine, such as a key stored in a HSM. The conditions
+// of the PCR policy are available from PCRSelection, PCRDigests, PolicyCount, Validity and BootAttemptLimit,
+// so that the signer can inspect what it is approving before signing it.
+type PCRPolicyUpdate struct {
+	keyVersion             uint32
+	policyAlg              tpm2.HashAlgorithmId
+	authPublicKey          *tpm2.Public
+	pcrDigests             tpm2.DigestList
+	policyCounterName      tpm2.Name
+	bootAttemptCounterName tpm2.Name
+	policyData             *dynamicPolicyData
+}
+
+// newPCRPolicyUpdate creates a new unsigned PCRPolicyUpdate by computing a PCR policy from the supplied parameters.
+// The key field of params is ignored.
+func newPCRPolicyUpdate(keyVersion uint32, policyAlg tpm2.HashAlgorithmId, authPublicKey *tpm2.Public, params *dynamicPolicyComputeParams) (*PCRPolicyUpdate, error) {
+	p := *params
+	p.key = nil
+	p.pcrOrData = nil
+
+	policyData, err := computeDynamicPolicy(keyVersion, policyAlg, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PCRPolicyUpdate{
+		keyVersion:             keyVersion,
+		policyAlg:              policyAlg,
+		authPublicKey:          authPublicKey,
+		pcrDigests:             params.pcrDigests,
+		policyCounterName:      params.policyCounterName,
+		bootAttemptCounterName: params.bootAttemptCounterName,
+		policyData:             policyData}, nil
+}
+
+// isValidNVIndexName indicates whether the supplied name is empty or a valid name for a NV index.
+func isValidNVIndexName(name tpm2.Name) bool {
+	return len(name) == 0 || (name.Type() == tpm2.NameTypeDigest && name.Algorithm().Available())
+}
+
+// ReadPCRPolicyUpdate deserializes a PCRPolicyUpdate that was serialized with PCRPolicyUpdate.Write. The PCR policy
+// is recomputed from its conditions, and an error is returned if the result doesn't match the serialized policy digest.
+func ReadPCRPolicyUpdate(r io.Reader) (*PCRPolicyUpdate, error) {
+	var header uint32
+	if _, err := mu.UnmarshalFromReader(r, &header); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != pcrPolicyUpdateHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+
+	var version uint32
+	if _, err := mu.UnmarshalFromReader(r, &version); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal version number: %w", err)
+	}
+
+	var raw pcrPolicyUpdateRaw_v0
+	switch version {
+	case 0:
+		if _, err := mu.UnmarshalFromReader(r, &raw); err != nil {
+			return nil, xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected version number (%d)", version)
+	}
+
+	switch {
+	case raw.KeyVersion == 0 || raw.KeyVersion > currentMetadataVersion:
+		return nil, errors.New("unsupported sealed key object version")
+	case !raw.PolicyAlg.Available():
+		return nil, errors.New("unsupported policy digest algorithm")
+	case raw.AuthPublicKey.Type != tpm2.ObjectTypeECC:
+		return nil, errors.New("unexpected authorization key type")
+	case !raw.AuthPublicKey.NameAlg.Available():
+		return nil, errors.New("unsupported authorization key name algorithm")
+	case !isValidNVIndexName(raw.PolicyCounterName):
+		return nil, errors.New("invalid PCR policy counter name")
+	case !isValidNVIndexName(raw.BootAttemptCounterName):
+		return nil, errors.New("invalid boot attempt counter name")
+	case len(raw.AuthorizedPolicy) != raw.PolicyAlg.Size():
+		return nil, errors.New("invalid PCR policy digest size")
+	}
+	for _, d := range raw.PCRDigests {
+		if len(d) != raw.PolicyAlg.Size() {
+			return nil, errors.New("invalid PCR digest size")
+		}
+	}
+
+	params := &dynamicPolicyComputeParams{
+		pcrs:                   raw.PCRSelection,
+		pcrDigests:             raw.PCRDigests,
+		policyCounterName:      raw.PolicyCounterName,
+		policyCount:            raw.PolicyCount,
+		bootAttemptCounterName: raw.BootAttemptCounterName}
+	if !raw.Validity.isEmpty() {
+		params.validity = &raw.Validity
+	}
+	if !raw.BootAttempts.isEmpty() {
+		if len(raw.BootAttemptCounterName) == 0 {
+			return nil, errors.New("invalid boot attempt counter name")
+		}
+		params.bootAttempts = &raw.BootAttempts
+	}
+
+	update, err := newPCRPolicyUpdate(raw.KeyVersion, raw.PolicyAlg, raw.AuthPublicKey, params)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR policy: %w", err)
+	}
+	if !bytes.Equal(update.policyData.authorizedPolicy, raw.AuthorizedPolicy) {
+		return nil, errors.New("PCR policy digest is inconsistent with the PCR policy conditions")
+	}
+	if raw.AuthorizedPolicySignature.SigAlg != tpm2.SigSchemeAlgNull {
+		update.policyData.authorizedPolicySignature = raw.AuthorizedPolicySignature
+	}
+
+	return update, nil
+}
+
+// Write serializes this update to the supplied io.Writer.
+func (u *PCRPolicyUpdate) Write(w io.Writer) error {
+	raw := pcrPolicyUpdateRaw_v0{
+		KeyVersion:                u.keyVersion,
+		PolicyAlg:                 u.policyAlg,
+		AuthPublicKey:             u.authPublicKey,
+		PCRSelection:              u.policyData.pcrSelection,
+		PCRDigests:                u.pcrDigests,
+		PolicyCounterName:         u.policyCounterName,
+		PolicyCount:               u.policyData.policyCount,
+		BootAttemptCounterName:    u.bootAttemptCounterName,
+		AuthorizedPolicy:          u.policyData.authorizedPolicy,
+		AuthorizedPolicySignature: u.policyData.authorizedPolicySignature}
+	if u.policyData.validity != nil {
+		raw.Validity = *u.policyData.validity
+	}
+	if u.policyData.bootAttempts != nil {
+		raw.BootAttempts = *u.policyData.bootAttempts
+	}
+	if raw.AuthorizedPolicySignature == nil {
+		raw.AuthorizedPolicySignature = &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}
+	}
+
+	if _, err := mu.MarshalToWriter(w, pcrPolicyUpdateHeader, uint32(0), raw); err != nil {
+		return xerrors.Errorf("cannot marshal data: %w", err)
+	}
+	return nil
+}
+
+// PCRSelection returns the PCRs that the PCR policy in this update is bound to.
+func (u *PCRPolicyUpdate) PCRSelection() tpm2.PCRSelectionList {
+	return u.policyData.pcrSelection
+}
+
+// PCRDigests returns the permitted values of the PCRs returned from PCRSelection. Each digest corresponds to one
+// permitted combination of PCR values, and is computed by hashing the concatenation of those values in the order
+// described by the PCR selection with the algorithm returned from PCRDigestAlg.
+func (u *PCRPolicyUpdate) PCRDigests() tpm2.DigestList {
+	return u.pcrDigests
+}
+
+// PCRDigestAlg returns the algorithm used to compute the digests returned from PCRDigests.
+func (u *PCRPolicyUpdate) PCRDigestAlg() tpm2.HashAlgorithmId {
+	return u.policyAlg
+}
+
+// PolicyCount returns the value of the PCR policy counter for the PCR policy in this update. The PCR policy is
+// revoked once the counter is incremented beyond this value.
+func (u *PCRPolicyUpdate) PolicyCount() uint64 {
+	return u.policyData.policyCount
+}
+
+// Validity returns the validity window of the PCR policy in this update, along with the TPM clock value at
+// which it expires and the maximum TPM reset count for which it is valid. If the PCR policy doesn't have a
+// validity window, nil is returned.
+func (u *PCRPolicyUpdate) Validity() (validity *PCRPolicyValidity, clockLimit uint64, resetCountLimit uint32) {
+	v := u.policyData.validity
+	if v == nil {
+		return nil, 0, 0
+	}
+	return &PCRPolicyValidity{
+		Duration:    time.Duration(v.Duration) * time.Millisecond,
+		LimitResets: v.LimitResets,
+		MaxResets:   v.MaxResets}, v.ClockLimit, v.ResetCountLimit
+}
+
+// BootAttemptLimit returns the boot attempt limit of the PCR policy in this update, along with the value of the
+// boot attempt counter from which attempts are counted. If the PCR policy doesn't have a boot attempt limit, nil
+// is returned.
+func (u *PCRPolicyUpdate) BootAttemptLimit() (limit *BootAttemptLimit, baseline uint64) {
+	b := u.policyData.bootAttempts
+	if b == nil {
+		return nil, 0
+	}
+	return &BootAttemptLimit{CounterHandle: b.CounterHandle, MaxAttempts: b.MaxAttempts}, b.Baseline
+}
+
+// HashAlg returns the digest algorithm that must be used to sign this update.
+func (u *PCRPolicyUpdate) HashAlg() crypto.Hash {
+	return u.authPublicKey.NameAlg.GetHash()
+}
+
+// Digest returns the digest that must be signed in order to authorize this update.
+func (u *PCRPolicyUpdate) Digest() []byte {
+	h := u.authPublicKey.NameAlg.NewHash()
+	h.Write(u.policyData.authorizedPolicy)
+	h.Write(computePcrPolicyRefFromCounterName(u.policyCounterName))
+	return h.Sum(nil)
+}
+
+// IsSigned indicates whether this update has been signed.
+func (u *PCRPolicyUpdate) IsSigned() bool {
+	return u.policyData.authorizedPolicySignature != nil
+}
+
+// verifySignature checks that this update has a valid signature from the PCR policy authorization key.
+func (u *PCRPolicyUpdate) verifySignature() error {
+	sig := u.policyData.authorizedPolicySignature
+	if sig == nil {
+		return errors.New("update is not signed")
+	}
+	return verifyECDSASignature(u.authPublicKey, u.Digest(), sig)
+}
+
+// Sign signs this update with the supplied crypto.Signer, which must correspond to the key used for authorizing
+// PCR policy updates for the sealed key objects that this update was computed for. The signer can be backed by
+// any key store, as long as it produces ECDSA signatures in the ASN.1 format produced by *ecdsa.PrivateKey.
+//
+// An error will be returned if the public key of the signer doesn't match the authorization key for this update,
+// or if the signature cannot be verified.
+func (u *PCRPolicyUpdate) Sign(signer crypto.Signer) error {
+	sig, err := signDigestWithECDSASigner(signer, u.authPublicKey, u.Digest())
+	if err != nil {
+		return err
+	}
+
+	policyData := *u.policyData
+	policyData.authorizedPolicySignature = sig
+
+	signed := *u
+	signed.policyData = &policyData
+	if err := signed.verifySignature(); err != nil {
+		return xerrors.Errorf("cannot verify signature: %w", err)
+	}
+
+	*u = signed
+	return nil
+}
+
+// ComputePCRPolicyUpdate computes a new PCR policy for the supplied sealed key objects from the profile defined
+// by the pcrProfile argument, without requiring the key used for authorizing PCR policy updates. The keys must
+// all be related (ie, they were created using SealKeyToTPMMultiple). Version 0 sealed key objects are not supported.
+//
+// The returned update must be signed with PCRPolicyUpdate.Sign and then installed with InstallPCRPolicyUpdate, after
+// which the previous PCR policies must be revoked with BeginPCRPolicyRevocation.
+//
+// If validation of any sealed key object fails, a InvalidKeyFileError error will be returned.
+func ComputePCRPolicyUpdate(tpm *Connection, keys []*SealedKeyObject, pcrProfile *PCRProtectionProfile) (*PCRPolicyUpdate, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no sealed keys supplied")
+	}
+
+	primaryData := keys[0].data
+	if primaryData.version == 0 {
+		return nil, errors.New("unsupported sealed key object version")
+	}
+
+	session := tpm.HmacSession()
+
+	pcrPolicyCounterPub, err := validateRelatedKeys(tpm.TPMContext, keys, nil, session)
+	if err != nil {
+		return nil, err
+	}
+
+	authPublicKey := primaryData.staticPolicyData.authPublicKey
+
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+	params, err := computeSealedKeyDynamicAuthPolicyParams(tpm.TPMContext, primaryData.version, primaryData.keyPublic.NameAlg,
+		authPublicKey.NameAlg, nil, pcrPolicyCounterPub, nil, pcrProfile, primaryData.dynamicPolicyData.validity,
+		primaryData.dynamicPolicyData.bootAttempts, session)
+	if err != nil {
+		return nil, err
+	}
+
+	update, err := newPCRPolicyUpdate(primaryData.version, primaryData.keyPublic.NameAlg, authPublicKey, params)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+	return update, nil
+}
+
+// InstallPCRPolicyUpdate installs the supplied signed PCR policy update in to the supplied sealed key objects. The keys
+// must be the same set of related keys that the update was computed for with ComputePCRPolicyUpdate, and the update must
+// have been signed with PCRPolicyUpdate.Sign.
+//
+// If validation of any sealed key object fails, a InvalidKeyFileError error will be returned.
+//
+// On success, each sealed key data file is updated atomically with the new PCR policy. Note that the previous PCR policy
+// is not revoked by this function, as revoking it requires a signature that is bound to a TPM session. Once the update
+// has been installed, previous PCR policies must be revoked with BeginPCRPolicyRevocation. An error is returned if the
+// PCR policy counter has been incremented since the update was computed, because the update would already be revoked.
+func InstallPCRPolicyUpdate(tpm *Connection, keys []*SealedKeyObject, update *PCRPolicyUpdate) error {
+	if len(keys) == 0 {
+		return errors.New("no sealed keys supplied")
+	}
+
+	primaryData := keys[0].data
+	session := tpm.HmacSession()
+
+	pcrPolicyCounterPub, err := validateRelatedKeys(tpm.TPMContext, keys, nil, session)
+	if err != nil {
+		return err
+	}
+
+	// Make sure that this update was computed for these keys.
+	if update.keyVersion != primaryData.version {
+		return errors.New("update was computed for sealed key objects with a different version")
+	}
+	if update.policyAlg != primaryData.keyPublic.NameAlg {
+		return errors.New("update was computed for sealed key objects with a different policy digest algorithm")
+	}
+	expectedName, err := primaryData.staticPolicyData.authPublicKey.Name()
+	if err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot compute name of dynamic authorization policy key: %v", err)}
+	}
+	name, err := update.authPublicKey.Name()
+	if err != nil {
+		return xerrors.Errorf("cannot compute name of update authorization key: %w", err)
+	}
+	if !bytes.Equal(name, expectedName) {
+		return errors.New("update was computed for sealed key objects with a different authorization key")
+	}
+
+	var pcrPolicyCounterName tpm2.Name
+	if pcrPolicyCounterPub != nil {
+		pcrPolicyCounterName, err = pcrPolicyCounterPub.Name()
+		if err != nil {
+			return xerrors.Errorf("cannot compute name of PCR policy counter: %w", err)
+		}
+	}
+	if !bytes.Equal(update.policyCounterName, pcrPolicyCounterName) {
+		return errors.New("update was computed for sealed key objects with a different PCR policy counter")
+	}
+
+	if update.policyData.bootAttempts != nil {
+		index, _, err := readBootAttemptCounter(tpm.TPMContext, update.policyData.bootAttempts.CounterHandle, session)
+		switch {
+		case isDynamicPolicyDataError(err):
+			return errors.New("update has a boot attempt limit for a counter that doesn't exist")
+		case err != nil:
+			return err
+		}
+		if !bytes.Equal(update.bootAttemptCounterName, index.Name()) {
+			return errors.New("update was computed for a different boot attempt counter")
+		}
+	}
+
+	if err := update.verifySignature(); err != nil {
+		return xerrors.Errorf("cannot verify update signature: %w", err)
+	}
+
+	if pcrPolicyCounterPub != nil {
+		count, err := readPcrPolicyCounter(tpm.TPMContext, primaryData.version, pcrPolicyCounterPub, nil, session)
+		if err != nil {
+			return xerrors.Errorf("cannot read PCR policy counter: %w", err)
+		}
+		if count > update.policyData.policyCount {
+			return errors.New("update has already been revoked")
+		}
+	}
+
+	// Atomically update the key data files
+	for _, k := range keys {
+		k.data.dynamicPolicyData = update.policyData
+
+		if err := k.persist(); err != nil {
+			return xerrors.Errorf("cannot write key data file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// pcrPolicyRevocationChallengeRaw_v0 is version 0 of the serialized format of PCRPolicyRevocationChallenge.
+type pcrPolicyRevocationChallengeRaw_v0 struct {
+	AuthPublicKey *tpm2.Public
+	NonceTPM      tpm2.Nonce
+}
+
+// PCRPolicyRevocationChallenge is a challenge created by BeginPCRPolicyRevocation. It must be signed with the key used
+// for authorizing PCR policy updates for the sealed key objects in order to produce a PCRPolicyRevocationResponse,
+// which authorizes a single increment of their PCR policy counter.
+//
+// It can be serialized with Write and deserialized with ReadPCRPolicyRevocationChallenge, so that it can be signed on
+// another machine with a key that never leaves that machine.
+type PCRPolicyRevocationChallenge struct {
+	authPublicKey *tpm2.Public
+	nonceTPM      tpm2.Nonce
+}
+
+// ReadPCRPolicyRevocationChallenge deserializes a PCRPolicyRevocationChallenge that was serialized with
+// PCRPolicyRevocationChallenge.Write.
+func ReadPCRPolicyRevocationChallenge(r io.Reader) (*PCRPolicyRevocationChallenge, error) {
+	var header uint32
+	if _, err := mu.UnmarshalFromReader(r, &header); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != pcrPolicyRevocationChallengeHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+
+	var version uint32
+	if _, err := mu.UnmarshalFromReader(r, &version); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal version number: %w", err)
+	}
+
+	switch version {
+	case 0:
+		var raw pcrPolicyRevocationChallengeRaw_v0
+		if _, err := mu.UnmarshalFromReader(r, &raw); err != nil {
+			return nil, xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		if raw.AuthPublicKey.Type != tpm2.ObjectTypeECC {
+			return nil, errors.New("unexpected authorization key type")
+		}
+		if !raw.AuthPublicKey.NameAlg.Available() {
+			return nil, errors.New("unsupported authorization key name algorithm")
+		}
+		if len(raw.NonceTPM) == 0 {
+			return nil, errors.New("invalid nonce size")
+		}
+		return &PCRPolicyRevocationChallenge{authPublicKey: raw.AuthPublicKey, nonceTPM: raw.NonceTPM}, nil
+	default:
+		return nil, fmt.Errorf("unexpected version number (%d)", version)
+	}
+}
+
+// Write serializes this challenge to the supplied io.Writer.
+func (c *PCRPolicyRevocationChallenge) Write(w io.Writer) error {
+	raw := pcrPolicyRevocationChallengeRaw_v0{AuthPublicKey: c.authPublicKey, NonceTPM: c.nonceTPM}
+	if _, err := mu.MarshalToWriter(w, pcrPolicyRevocationChallengeHeader, uint32(0), raw); err != nil {
+		return xerrors.Errorf("cannot marshal data: %w", err)
+	}
+	return nil
+}
+
+// HashAlg returns the digest algorithm that must be used to sign this challenge.
+func (c *PCRPolicyRevocationChallenge) HashAlg() crypto.Hash {
+	return c.authPublicKey.NameAlg.GetHash()
+}
+
+// authorizationDigest computes the digest that is signed in order to satisfy the TPM2_PolicySigned assertion in the
+// authorization policy of the PCR policy counter. This has no expiration time or policy ref.
+func (c *PCRPolicyRevocationChallenge) authorizationDigest() []byte {
+	h := c.authPublicKey.NameAlg.NewHash()
+	h.Write(c.nonceTPM)
+	binary.Write(h, binary.BigEndian, int32(0))
+	return h.Sum(nil)
+}
+
+// Sign signs this challenge with the supplied crypto.Signer, which must correspond to the key used for authorizing
+// PCR policy updates for the sealed key objects that this challenge was created for. The signer can be backed by any
+// key store, as long as it produces ECDSA signatures in the ASN.1 format produced by *ecdsa.PrivateKey.
+//
+// The returned response permits the PCR policy counter to be incremented once with PCRPolicyRevocationSession.Revoke.
+func (c *PCRPolicyRevocationChallenge) Sign(signer crypto.Signer) (*PCRPolicyRevocationResponse, error) {
+	sig, err := signDigestWithECDSASigner(signer, c.authPublicKey, c.authorizationDigest())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign challenge: %w", err)
+	}
+
+	response := &PCRPolicyRevocationResponse{authorization: sig}
+	if err := c.verifyResponse(response); err != nil {
+		return nil, xerrors.Errorf("cannot verify response: %w", err)
+	}
+	return response, nil
+}
+
+// verifyResponse checks that the supplied response contains a valid signature for this challenge.
+func (c *PCRPolicyRevocationChallenge) verifyResponse(response *PCRPolicyRevocationResponse) error {
+	return verifyECDSASignature(c.authPublicKey, c.authorizationDigest(), response.authorization)
+}
+
+// pcrPolicyRevocationResponseRaw_v0 is version 0 of the serialized format of PCRPolicyRevocationResponse.
+type pcrPolicyRevocationResponseRaw_v0 struct {
+	Authorization *tpm2.Signature
+}
+
+// PCRPolicyRevocationResponse is a response to a PCRPolicyRevocationChallenge, created by
+// PCRPolicyRevocationChallenge.Sign. It can be serialized with Write and deserialized with
+// ReadPCRPolicyRevocationResponse.
+type PCRPolicyRevocationResponse struct {
+	authorization *tpm2.Signature // Signature for the TPM2_PolicySigned assertion
+}
+
+// ReadPCRPolicyRevocationResponse deserializes a PCRPolicyRevocationResponse that was serialized with
+// PCRPolicyRevocationResponse.Write.
+func ReadPCRPolicyRevocationResponse(r io.Reader) (*PCRPolicyRevocationResponse, error) {
+	var header uint32
+	if _, err := mu.UnmarshalFromReader(r, &header); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != pcrPolicyRevocationResponseHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+
+	var version uint32
+	if _, err := mu.UnmarshalFromReader(r, &version); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal version number: %w", err)
+	}
+
+	switch version {
+	case 0:
+		var raw pcrPolicyRevocationResponseRaw_v0
+		if _, err := mu.UnmarshalFromReader(r, &raw); err != nil {
+			return nil, xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		return &PCRPolicyRevocationResponse{authorization: raw.Authorization}, nil
+	default:
+		return nil, fmt.Errorf("unexpected version number (%d)", version)
+	}
+}
+
+// Write serializes this response to the supplied io.Writer.
+func (r *PCRPolicyRevocationResponse) Write(w io.Writer) error {
+	raw := pcrPolicyRevocationResponseRaw_v0{Authorization: r.authorization}
+	if _, err := mu.MarshalToWriter(w, pcrPolicyRevocationResponseHeader, uint32(0), raw); err != nil {
+		return xerrors.Errorf("cannot marshal data: %w", err)
+	}
+	return nil
+}
+
+// PCRPolicyRevocationSession corresponds to a TPM policy session that has been started in order to increment the PCR
+// policy counter for a set of related sealed key objects with a signed assertion. It is created by
+// BeginPCRPolicyRevocation.
+type PCRPolicyRevocationSession struct {
+	tpm         *Connection
+	policyCount uint64
+	counterPub  *tpm2.NVPublic
+	session     tpm2.SessionContext
+	challenge   *PCRPolicyRevocationChallenge
+}
+
+// checkPcrPolicyCounterForRevocation checks that incrementing the PCR policy counter associated with counterPub will
+// revoke the PCR policies that are older than the one with the supplied count, without revoking that one.
+func checkPcrPolicyCounterForRevocation(tpm *tpm2.TPMContext, counterPub *tpm2.NVPublic, policyCount uint64, session tpm2.SessionContext) error {
+	count, err := readPcrPolicyCounter(tpm, 1, counterPub, nil, session)
+	if err != nil {
+		return xerrors.Errorf("cannot read PCR policy counter: %w", err)
+	}
+	if count >= policyCount {
+		return errors.New("previous PCR policies have already been revoked")
+	}
+	return nil
+}
+
+// BeginPCRPolicyRevocation begins the process of revoking the PCR policies that were in use by the supplied sealed key
+// objects before the most recent update was installed with InstallPCRPolicyUpdate. The keys must all be related (ie,
+// they were created using SealKeyToTPMMultiple) and must already contain the new PCR policy. Version 0 sealed key
+// objects are not supported.
+//
+// This starts a policy session on the TPM and returns a PCRPolicyRevocationSession. The challenge obtained from
+// PCRPolicyRevocationSession.Challenge must be signed by the holder of the authorization key with
+// PCRPolicyRevocationChallenge.Sign, and the resulting response supplied to PCRPolicyRevocationSession.Revoke.
+//
+// If validation of any sealed key object fails, a InvalidKeyFileError error will be returned. An error will be returned
+// if the sealed key objects don't have a PCR policy counter, or if the previous PCR policies have already been
+// revoked.
+//
+// The session must be closed with PCRPolicyRevocationSession.Close if it isn't used to revoke the previous PCR policies.
+func BeginPCRPolicyRevocation(tpm *Connection, keys []*SealedKeyObject) (*PCRPolicyRevocationSession, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no sealed keys supplied")
+	}
+
+	primaryData := keys[0].data
+	if primaryData.version == 0 {
+		return nil, errors.New("unsupported sealed key object version")
+	}
+
+	session := tpm.HmacSession()
+
+	pcrPolicyCounterPub, err := validateRelatedKeys(tpm.TPMContext, keys, nil, session)
+	if err != nil {
+		return nil, err
+	}
+	if pcrPolicyCounterPub == nil {
+		return nil, errors.New("sealed key objects have no PCR policy counter")
+	}
+
+	policyCount := primaryData.dynamicPolicyData.policyCount
+	if err := checkPcrPolicyCounterForRevocation(tpm.TPMContext, pcrPolicyCounterPub, policyCount, session); err != nil {
+		return nil, err
+	}
+
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, pcrPolicyCounterPub.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+
+	return &PCRPolicyRevocationSession{
+		tpm:         tpm,
+		policyCount: policyCount,
+		counterPub:  pcrPolicyCounterPub,
+		session:     policySession,
+		challenge: &PCRPolicyRevocationChallenge{
+			authPublicKey: primaryData.staticPolicyData.authPublicKey,
+			nonceTPM:      policySession.NonceTPM()}}, nil
+}
+
+// Challenge returns the challenge for this session, which must be signed in order to revoke the previous PCR policies.
+func (s *PCRPolicyRevocationSession) Challenge() *PCRPolicyRevocationChallenge {
+	return s.challenge
+}
+
+// Close flushes the policy session associated with this revocation session from the TPM.
+func (s *PCRPolicyRevocationSession) Close() error {
+	if s.session == nil {
+		return nil
+	}
+	defer func() { s.session = nil }()
+	return s.tpm.FlushContext(s.session)
+}
+
+// Revoke increments the PCR policy counter using the supplied response to this session's challenge, so that every PCR
+// policy older than the one currently used by the sealed key objects that this session was started for can no longer
+// be used to unseal them. The session is closed by this function, and a new one must be started with
+// BeginPCRPolicyRevocation in order to try again.
+//
+// If the response wasn't produced for this session's challenge by the key used for authorizing PCR policy updates, an
+// error will be returned.
+func (s *PCRPolicyRevocationSession) Revoke(response *PCRPolicyRevocationResponse) error {
+	if s.session == nil {
+		return errors.New("session is closed")
+	}
+	defer s.Close()
+
+	if err := s.challenge.verifyResponse(response); err != nil {
+		return xerrors.Errorf("invalid response: %w", err)
+	}
+
+	hmacSession := s.tpm.HmacSession()
+
+	// Make sure that the counter hasn't been incremented since the session was started, else incrementing it
+	// again would revoke the current PCR policy.
+	if err := checkPcrPolicyCounterForRevocation(s.tpm.TPMContext, s.counterPub, s.policyCount, hmacSession); err != nil {
+		return err
+	}
+
+	index, err := tpm2.CreateNVIndexResourceContextFromPublic(s.counterPub)
+	if err != nil {
+		return xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+	}
+
+	if err := incrementPcrPolicyCounterWithSignature(s.tpm.TPMContext, 1, index, s.counterPub, nil,
+		s.challenge.authPublicKey, s.session, response.authorization, hmacSession); err != nil {
+		return xerrors.Errorf("cannot revoke previous PCR policies: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,517 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+// testSigner is a crypto.Signer that wraps another one, so that tests don't depend
+// on *ecdsa.PrivateKey being passed directly.
+type testSigner struct {
+	signer crypto.Signer
+	sig    []byte
+}
+
+func (s *testSigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s *testSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if s.sig != nil {
+		return s.sig, nil
+	}
+	return s.signer.Sign(rand, digest, opts)
+}
+
+func testPCRPolicyCounterName(t *testing.T) tpm2.Name {
+	pub := tpm2.NVPublic{
+		Index:   0x01810000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVWritten),
+		Size:    8}
+	name, err := pub.Name()
+	if err != nil {
+		t.Fatalf("Name failed: %v", err)
+	}
+	return name
+}
+
+func newTestPCRPolicyUpdate(t *testing.T, key *ecdsa.PrivateKey) *PCRPolicyUpdate {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	pcrDigest, _ := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{
+		tpm2.HashAlgorithmSHA256: {7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")}})
+
+	update, err := NewPCRPolicyUpdate(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256, CreateTPMPublicAreaForECDSAKey(&key.PublicKey),
+		NewDynamicPolicyComputeParams(nil, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{pcrDigest}, testPCRPolicyCounterName(t), 5))
+	if err != nil {
+		t.Fatalf("NewPCRPolicyUpdate failed: %v", err)
+	}
+	return update
+}
+
+func TestPCRPolicyUpdateSign(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	update := newTestPCRPolicyUpdate(t, key)
+	if update.IsSigned() {
+		t.Errorf("Unexpected signed update")
+	}
+	if update.HashAlg() != crypto.SHA256 {
+		t.Errorf("Unexpected digest algorithm")
+	}
+
+	h := crypto.SHA256.New()
+	h.Write(update.PolicyData().AuthorizedPolicy())
+	h.Write(ComputePcrPolicyRefFromCounterName(testPCRPolicyCounterName(t)))
+	if !bytes.Equal(update.Digest(), h.Sum(nil)) {
+		t.Errorf("Unexpected digest")
+	}
+
+	if err := update.Sign(&testSigner{signer: key}); err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if !update.IsSigned() {
+		t.Errorf("Expected signed update")
+	}
+
+	sig := update.PolicyData().AuthorizedPolicySignature()
+	if sig.SigAlg != tpm2.SigSchemeAlgECDSA {
+		t.Errorf("Unexpected signature algorithm")
+	}
+	if sig.Signature.ECDSA.Hash != tpm2.HashAlgorithmSHA256 {
+		t.Errorf("Unexpected signature digest algorithm")
+	}
+	if ok := ecdsa.Verify(&key.PublicKey, update.Digest(),
+		new(big.Int).SetBytes(sig.Signature.ECDSA.SignatureR),
+		new(big.Int).SetBytes(sig.Signature.ECDSA.SignatureS)); !ok {
+		t.Errorf("Invalid signature")
+	}
+}
+
+func TestPCRPolicyUpdateSignWithWrongKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	update := newTestPCRPolicyUpdate(t, key)
+	err = update.Sign(otherKey)
+	if err == nil || err.Error() != "signer doesn't correspond to the PCR policy authorization key" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if update.IsSigned() {
+		t.Errorf("Unexpected signed update")
+	}
+}
+
+func TestPCRPolicyUpdateSignWithBadSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	// Produce a valid signature for a different digest.
+	otherSig, err := key.Sign(testutil.RandReader, make([]byte, 32), crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	update := newTestPCRPolicyUpdate(t, key)
+	err = update.Sign(&testSigner{signer: key, sig: otherSig})
+	if err == nil || err.Error() != "cannot verify signature: invalid signature" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if update.IsSigned() {
+		t.Errorf("Unexpected signed update")
+	}
+
+	err = update.Sign(&testSigner{signer: key, sig: []byte("foo")})
+	if err == nil || !strings.HasPrefix(err.Error(), "cannot decode signature: asn1: ") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestPCRPolicyUpdateSerialization(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	update := newTestPCRPolicyUpdate(t, key)
+
+	run := func(t *testing.T, update *PCRPolicyUpdate) *PCRPolicyUpdate {
+		b := new(bytes.Buffer)
+		if err := update.Write(b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		update2, err := ReadPCRPolicyUpdate(b)
+		if err != nil {
+			t.Fatalf("ReadPCRPolicyUpdate failed: %v", err)
+		}
+		if update2.IsSigned() != update.IsSigned() {
+			t.Errorf("Unexpected signed state")
+		}
+		if !bytes.Equal(update2.Digest(), update.Digest()) {
+			t.Errorf("Unexpected digest")
+		}
+		if !reflect.DeepEqual(update2.PolicyData(), update.PolicyData()) {
+			t.Errorf("Unexpected policy data")
+		}
+		return update2
+	}
+
+	t.Run("Unsigned", func(t *testing.T) {
+		// Serialize the unsigned update, sign the copy and serialize it again.
+		update2 := run(t, update)
+		if err := update2.Sign(key); err != nil {
+			t.Fatalf("Sign failed: %v", err)
+		}
+		run(t, update2)
+	})
+
+	t.Run("Conditions", func(t *testing.T) {
+		update2 := run(t, update)
+		pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+		if !reflect.DeepEqual(update2.PCRSelection(), pcrs) {
+			t.Errorf("Unexpected PCR selection")
+		}
+		if !reflect.DeepEqual(update2.PCRDigests(), update.PCRDigests()) || len(update2.PCRDigests()) != 1 {
+			t.Errorf("Unexpected PCR digests")
+		}
+		if update2.PCRDigestAlg() != tpm2.HashAlgorithmSHA256 {
+			t.Errorf("Unexpected PCR digest algorithm")
+		}
+		if update2.PolicyCount() != 5 {
+			t.Errorf("Unexpected policy count")
+		}
+		if v, _, _ := update2.Validity(); v != nil {
+			t.Errorf("Unexpected validity window")
+		}
+		if l, _ := update2.BootAttemptLimit(); l != nil {
+			t.Errorf("Unexpected boot attempt limit")
+		}
+	})
+
+	t.Run("InconsistentPolicy", func(t *testing.T) {
+		// An update that has been modified so that its conditions don't match
+		// the policy digest must be rejected, so that a signer never approves
+		// a policy that is different to the one it inspected.
+		update2 := newTestPCRPolicyUpdate(t, key)
+		update2.SetPolicyCount(10)
+		b := new(bytes.Buffer)
+		if err := update2.Write(b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		_, err := ReadPCRPolicyUpdate(b)
+		if err == nil || err.Error() != "PCR policy digest is inconsistent with the PCR policy conditions" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("InvalidPolicyDigestSize", func(t *testing.T) {
+		update2 := newTestPCRPolicyUpdate(t, key)
+		update2.SetAuthorizedPolicy(make(tpm2.Digest, 64))
+		b := new(bytes.Buffer)
+		if err := update2.Write(b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		_, err := ReadPCRPolicyUpdate(b)
+		if err == nil || err.Error() != "invalid PCR policy digest size" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("InvalidHeader", func(t *testing.T) {
+		_, err := ReadPCRPolicyUpdate(bytes.NewReader([]byte{0x55, 0x53, 0x4b, 0x24, 0, 0, 0, 0}))
+		if err == nil || err.Error() != "unexpected header (1431522084)" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestComputeAndInstallPCRPolicyUpdate(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestComputeAndInstallPCRPolicyUpdate_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKeyBytes, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	authKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256()},
+		D:         new(big.Int).SetBytes(authKeyBytes)}
+	authKey.X, authKey.Y = elliptic.P256().ScalarBaseMult(authKeyBytes)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	profile := NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo"))
+	update, err := ComputePCRPolicyUpdate(tpm, []*SealedKeyObject{k}, profile)
+	if err != nil {
+		t.Fatalf("ComputePCRPolicyUpdate failed: %v", err)
+	}
+
+	// Serialize the update to emulate signing it elsewhere.
+	b := new(bytes.Buffer)
+	if err := update.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	update, err = ReadPCRPolicyUpdate(b)
+	if err != nil {
+		t.Fatalf("ReadPCRPolicyUpdate failed: %v", err)
+	}
+
+	if err := InstallPCRPolicyUpdate(tpm, []*SealedKeyObject{k}, update); err == nil ||
+		err.Error() != "cannot verify update signature: update is not signed" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := update.Sign(&testSigner{signer: authKey}); err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if err := InstallPCRPolicyUpdate(tpm, []*SealedKeyObject{k}, update); err != nil {
+		t.Fatalf("InstallPCRPolicyUpdate failed: %v", err)
+	}
+
+	// Modify the PCR state to match the new policy
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+		t.Errorf("PCREvent failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(unsealedKey, key) {
+		t.Errorf("Unexpected key")
+	}
+
+	// Revoking the policy with a regular update makes the computed update unusable.
+	if err := k.UpdatePCRProtectionPolicy(tpm, authKeyBytes, profile); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+	if err := k.UpdatePCRProtectionPolicy(tpm, authKeyBytes, profile); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+	if err := InstallPCRPolicyUpdate(tpm, []*SealedKeyObject{k}, update); err == nil ||
+		err.Error() != "update has already been revoked" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRevokePreviousPCRPolicies(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestRevokePreviousPCRPolicies_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKeyBytes, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	authKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256()},
+		D:         new(big.Int).SetBytes(authKeyBytes)}
+	authKey.X, authKey.Y = elliptic.P256().ScalarBaseMult(authKeyBytes)
+
+	// Keep a copy of the key data file with the original PCR policy.
+	oldKeyFile := filepath.Join(tmpDir, "keydata.old")
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if err := ioutil.WriteFile(oldKeyFile, b, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	if _, err := BeginPCRPolicyRevocation(tpm, []*SealedKeyObject{k}); err == nil ||
+		err.Error() != "previous PCR policies have already been revoked" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	update, err := ComputePCRPolicyUpdate(tpm, []*SealedKeyObject{k}, getTestPCRProfile())
+	if err != nil {
+		t.Fatalf("ComputePCRPolicyUpdate failed: %v", err)
+	}
+	if err := update.Sign(&testSigner{signer: authKey}); err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if err := InstallPCRPolicyUpdate(tpm, []*SealedKeyObject{k}, update); err != nil {
+		t.Fatalf("InstallPCRPolicyUpdate failed: %v", err)
+	}
+
+	unseal := func(path string) error {
+		k, err := ReadSealedKeyObject(path)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return nil
+	}
+
+	// The previous PCR policy isn't revoked until the revocation phase completes.
+	if err := unseal(oldKeyFile); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	// A response signed by a different key must be rejected.
+	session, err := BeginPCRPolicyRevocation(tpm, []*SealedKeyObject{k})
+	if err != nil {
+		t.Fatalf("BeginPCRPolicyRevocation failed: %v", err)
+	}
+	wrongKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	if _, err := session.Challenge().Sign(wrongKey); err == nil ||
+		err.Error() != "cannot sign challenge: signer doesn't correspond to the PCR policy authorization key" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := session.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	session, err = BeginPCRPolicyRevocation(tpm, []*SealedKeyObject{k})
+	if err != nil {
+		t.Fatalf("BeginPCRPolicyRevocation failed: %v", err)
+	}
+
+	// Serialize the challenge and response to emulate signing elsewhere.
+	b2 := new(bytes.Buffer)
+	if err := session.Challenge().Write(b2); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	challenge, err := ReadPCRPolicyRevocationChallenge(b2)
+	if err != nil {
+		t.Fatalf("ReadPCRPolicyRevocationChallenge failed: %v", err)
+	}
+	response, err := challenge.Sign(&testSigner{signer: authKey})
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	b2.Reset()
+	if err := response.Write(b2); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	response, err = ReadPCRPolicyRevocationResponse(b2)
+	if err != nil {
+		t.Fatalf("ReadPCRPolicyRevocationResponse failed: %v", err)
+	}
+
+	if err := session.Revoke(response); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if err := session.Revoke(response); err == nil || err.Error() != "session is closed" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := unseal(oldKeyFile); err == nil ||
+		err.Error() != "invalid key data file: cannot complete authorization policy assertions: the PCR policy has been revoked" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := unseal(keyFile); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+
+	// Revoking again would revoke the current PCR policy.
+	if _, err := BeginPCRPolicyRevocation(tpm, []*SealedKeyObject{k}); err == nil ||
+		err.Error() != "previous PCR policies have already been revoked" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
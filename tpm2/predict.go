@@ -0,0 +1,173 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+)
+
+// UnsealPrediction is returned from SealedKeyObject.PredictUnseal and describes whether a sealed key object is expected
+// to be unsealed successfully by SealedKeyObject.UnsealFromTPM.
+type UnsealPrediction struct {
+	// PCRPolicySatisfied indicates that the supplied PCR values satisfy the PCR policy.
+	PCRPolicySatisfied bool
+
+	// PCRPolicyRevoked indicates that the PCR policy has been revoked by a subsequent update.
+	PCRPolicyRevoked bool
+
+	// PCRPolicyExpired indicates that the validity window of the PCR policy has passed.
+	PCRPolicyExpired bool
+
+	// BootAttemptLimitReached indicates that the next unseal attempt will exceed the boot attempt limit.
+	BootAttemptLimitReached bool
+
+	// PINRequired indicates that a PIN must be supplied in order to unseal the key.
+	PINRequired bool
+
+	// TPMLockout indicates that the TPM is in dictionary-attack lockout mode.
+	TPMLockout bool
+}
+
+// Satisfiable indicates whether SealedKeyObject.UnsealFromTPM is expected to succeed, on the condition that the correct
+// PIN is supplied if one is required.
+func (p *UnsealPrediction) Satisfiable() bool {
+	return p.PCRPolicySatisfied && !p.PCRPolicyRevoked && !p.PCRPolicyExpired && !p.BootAttemptLimitReached && !p.TPMLockout
+}
+
+// PredictUnsealOptions provides options to SealedKeyObject.PredictUnseal.
+type PredictUnsealOptions struct {
+	// NextBoot indicates that the prediction is for an unseal attempt during the next boot rather than the current
+	// one. The validity window of the PCR policy is checked against the TPM reset count that the next boot will have.
+	// The PCR values for the next boot must be supplied when this is set.
+	NextBoot bool
+}
+
+// PredictUnseal determines whether this sealed key object is expected to be unsealed successfully by
+// SealedKeyObject.UnsealFromTPM with the supplied PCR values, without unsealing it. If pcrValues is nil, the current
+// PCR values are read from the TPM. In order to predict whether the sealed key object can be unsealed after the
+// next boot, the PCR values can be computed from a PCRProtectionProfile with PCRProtectionProfile.ComputePCRValues
+// and the NextBoot field of the options argument should be set.
+//
+// The PCR policy is checked by computing the TPM2_PolicyPCR and TPM2_PolicyOR assertions that would be executed with
+// the supplied PCR values in software. The PCR policy counter, validity window and boot attempt limit are checked
+// against the current state of the TPM. When predicting the next boot, the validity window is checked against a TPM
+// reset count one higher than the current one, as the TPM is reset when the device reboots.
+//
+// If validation of the sealed key data fails, or the PCR policy metadata is inconsistent with its signed policy
+// digest, a InvalidKeyFileError error will be returned.
+func (k *SealedKeyObject) PredictUnseal(tpm *Connection, pcrValues tpm2.PCRValues, options *PredictUnsealOptions) (*UnsealPrediction, error) {
+	if options == nil {
+		options = &PredictUnsealOptions{}
+	}
+	if options.NextBoot && pcrValues == nil {
+		return nil, errors.New("PCR values must be supplied when predicting the next boot")
+	}
+
+	session := tpm.HmacSession()
+	data := k.data.dynamicPolicyData
+
+	pcrPolicyCounterPub, err := k.data.validate(tpm.TPMContext, nil, session)
+	if err != nil {
+		if isKeyFileError(err) {
+			return nil, InvalidKeyFileError{err.Error()}
+		}
+		return nil, xerrors.Errorf("cannot validate key data: %w", err)
+	}
+
+	var prediction UnsealPrediction
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch properties from TPM: %w", err)
+	}
+	prediction.TPMLockout = tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0
+	prediction.PINRequired = k.data.authModeHint == authModePIN
+
+	var pcrPolicyCounterName tpm2.Name
+	if pcrPolicyCounterPub != nil {
+		pcrPolicyCounterName, err = pcrPolicyCounterPub.Name()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute name of PCR policy counter: %w", err)
+		}
+
+		count, err := readPcrPolicyCounter(tpm.TPMContext, k.data.version, pcrPolicyCounterPub,
+			k.data.staticPolicyData.v0PinIndexAuthPolicies, session)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read PCR policy counter: %w", err)
+		}
+		prediction.PCRPolicyRevoked = count > data.policyCount
+	}
+
+	var bootAttemptCounterName tpm2.Name
+	if data.bootAttempts != nil {
+		index, count, err := readBootAttemptCounter(tpm.TPMContext, data.bootAttempts.CounterHandle, session)
+		switch {
+		case isDynamicPolicyDataError(err):
+			return nil, InvalidKeyFileError{err.Error()}
+		case err != nil:
+			return nil, err
+		}
+		bootAttemptCounterName = index.Name()
+		prediction.BootAttemptLimitReached = count < data.bootAttempts.Baseline ||
+			count-data.bootAttempts.Baseline >= uint64(data.bootAttempts.MaxAttempts)
+	}
+
+	if err := verifyDynamicPolicy(k.data.version, k.data.keyPublic.NameAlg, k.data.staticPolicyData, data,
+		pcrPolicyCounterName, bootAttemptCounterName); err != nil {
+		return nil, InvalidKeyFileError{fmt.Sprintf("cannot verify PCR policy: %v", err)}
+	}
+
+	if data.validity != nil {
+		timeInfo, err := tpm.ReadClock(session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read clock: %w", err)
+		}
+		clockInfo := timeInfo.ClockInfo
+		if options.NextBoot {
+			// The TPM clock keeps running across a reset, but the reset count is incremented.
+			clockInfo.ResetCount++
+		}
+		prediction.PCRPolicyExpired = data.validity.hasExpired(&clockInfo)
+	}
+
+	if pcrValues == nil {
+		_, pcrValues, err = tpm.PCRRead(data.pcrSelection, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read PCR values: %w", err)
+		}
+	}
+
+	pcrDigest, err := util.ComputePCRDigest(k.data.keyPublic.NameAlg, data.pcrSelection, pcrValues)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR digest: %w", err)
+	}
+
+	trial := util.ComputeAuthPolicy(k.data.keyPublic.NameAlg)
+	trial.PolicyPCR(pcrDigest, data.pcrSelection)
+	prediction.PCRPolicySatisfied = trialPolicyORAssertions(k.data.keyPublic.NameAlg, data.pcrOrData, trial.GetDigest())
+
+	return &prediction, nil
+}
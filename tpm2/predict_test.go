@@ -0,0 +1,298 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestTrialPolicyORAssertions(t *testing.T) {
+	for _, n := range []int{1, 5, 8, 20, 100} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			var digests tpm2.DigestList
+			for i := 0; i < n; i++ {
+				d := make(tpm2.Digest, 32)
+				rand.Read(d)
+				digests = append(digests, d)
+			}
+
+			trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+			orData := ComputePolicyORData(tpm2.HashAlgorithmSHA256, trial, digests)
+
+			for i, d := range digests {
+				if !TrialPolicyORAssertions(tpm2.HashAlgorithmSHA256, orData, d) {
+					t.Errorf("Digest %d not accepted", i)
+				}
+			}
+
+			d := make(tpm2.Digest, 32)
+			rand.Read(d)
+			if TrialPolicyORAssertions(tpm2.HashAlgorithmSHA256, orData, d) {
+				t.Errorf("Unexpected digest accepted")
+			}
+		})
+	}
+
+	if TrialPolicyORAssertions(tpm2.HashAlgorithmSHA256, nil, make(tpm2.Digest, 32)) {
+		t.Errorf("Digest accepted with no policy data")
+	}
+}
+
+func TestPCRPolicyValidityHasExpired(t *testing.T) {
+	for _, data := range []struct {
+		desc      string
+		validity  *PCRPolicyValidityData
+		clockInfo *tpm2.ClockInfo
+		expired   bool
+	}{
+		{
+			desc:      "Valid",
+			validity:  &PCRPolicyValidityData{Duration: 60000, LimitResets: true, ClockLimit: 1060000, ResetCountLimit: 12},
+			clockInfo: &tpm2.ClockInfo{Clock: 1059999, ResetCount: 12},
+		},
+		{
+			desc:      "ClockLimit",
+			validity:  &PCRPolicyValidityData{Duration: 60000, LimitResets: true, ClockLimit: 1060000, ResetCountLimit: 12},
+			clockInfo: &tpm2.ClockInfo{Clock: 1060000, ResetCount: 12},
+			expired:   true,
+		},
+		{
+			desc:      "ResetCountLimit",
+			validity:  &PCRPolicyValidityData{Duration: 60000, LimitResets: true, ClockLimit: 1060000, ResetCountLimit: 12},
+			clockInfo: &tpm2.ClockInfo{Clock: 1000, ResetCount: 13},
+			expired:   true,
+		},
+		{
+			desc:      "NoDuration",
+			validity:  &PCRPolicyValidityData{LimitResets: true, ResetCountLimit: 12},
+			clockInfo: &tpm2.ClockInfo{Clock: 1060000, ResetCount: 2},
+		},
+		{
+			desc:      "NoResetLimit",
+			validity:  &PCRPolicyValidityData{Duration: 60000, ClockLimit: 1060000},
+			clockInfo: &tpm2.ClockInfo{Clock: 1000, ResetCount: 100},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			if data.validity.HasExpired(data.clockInfo) != data.expired {
+				t.Errorf("Unexpected result")
+			}
+		})
+	}
+}
+
+func TestUnsealPredictionSatisfiable(t *testing.T) {
+	for _, data := range []struct {
+		desc        string
+		prediction  UnsealPrediction
+		satisfiable bool
+	}{
+		{
+			desc:        "Good",
+			prediction:  UnsealPrediction{PCRPolicySatisfied: true},
+			satisfiable: true,
+		},
+		{
+			desc:        "PIN",
+			prediction:  UnsealPrediction{PCRPolicySatisfied: true, PINRequired: true},
+			satisfiable: true,
+		},
+		{
+			desc: "PCRPolicyNotSatisfied",
+		},
+		{
+			desc:       "Revoked",
+			prediction: UnsealPrediction{PCRPolicySatisfied: true, PCRPolicyRevoked: true},
+		},
+		{
+			desc:       "Expired",
+			prediction: UnsealPrediction{PCRPolicySatisfied: true, PCRPolicyExpired: true},
+		},
+		{
+			desc:       "BootAttemptLimitReached",
+			prediction: UnsealPrediction{PCRPolicySatisfied: true, BootAttemptLimitReached: true},
+		},
+		{
+			desc:       "Lockout",
+			prediction: UnsealPrediction{PCRPolicySatisfied: true, TPMLockout: true},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			if data.prediction.Satisfiable() != data.satisfiable {
+				t.Errorf("Unexpected result")
+			}
+		})
+	}
+}
+
+func TestPredictUnseal(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestPredictUnseal_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	prediction, err := k.PredictUnseal(tpm, nil, nil)
+	if err != nil {
+		t.Fatalf("PredictUnseal failed: %v", err)
+	}
+	if !prediction.Satisfiable() {
+		t.Errorf("Unexpected prediction: %#v", prediction)
+	}
+
+	// Predict with the values from a PCR profile that doesn't correspond to the current values.
+	values, err := NewPCRProtectionProfile().
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).
+		ComputePCRValues(tpm.TPMContext)
+	if err != nil {
+		t.Fatalf("ComputePCRValues failed: %v", err)
+	}
+	prediction, err = k.PredictUnseal(tpm, values[0], nil)
+	if err != nil {
+		t.Fatalf("PredictUnseal failed: %v", err)
+	}
+	if prediction.PCRPolicySatisfied {
+		t.Errorf("Unexpected prediction: %#v", prediction)
+	}
+
+	// Revoke the PCR policy with an update.
+	k2, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if err := k2.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+	prediction, err = k.PredictUnseal(tpm, nil, nil)
+	if err != nil {
+		t.Fatalf("PredictUnseal failed: %v", err)
+	}
+	if !prediction.PCRPolicySatisfied || !prediction.PCRPolicyRevoked {
+		t.Errorf("Unexpected prediction: %#v", prediction)
+	}
+}
+
+func TestPredictUnsealNextBoot(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	values, err := getTestPCRProfile().ComputePCRValues(tpm.TPMContext)
+	if err != nil {
+		t.Fatalf("ComputePCRValues failed: %v", err)
+	}
+
+	for _, data := range []struct {
+		desc      string
+		maxResets uint32
+		expired   bool
+	}{
+		{
+			desc:    "CurrentBootOnly",
+			expired: true,
+		},
+		{
+			desc:      "NextBoot",
+			maxResets: 1,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			key := make([]byte, 64)
+			rand.Read(key)
+
+			tmpDir, err := ioutil.TempDir("", "_TestPredictUnsealNextBoot_")
+			if err != nil {
+				t.Fatalf("Creating temporary directory failed: %v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			keyFile := filepath.Join(tmpDir, "keydata")
+			if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+				PCRProfile:             getTestPCRProfile(),
+				PCRPolicyCounterHandle: 0x01810000,
+				PCRPolicyValidity:      &PCRPolicyValidity{LimitResets: true, MaxResets: data.maxResets}}); err != nil {
+				t.Fatalf("SealKeyToTPM failed: %v", err)
+			}
+			defer undefineKeyNVSpace(t, tpm, keyFile)
+
+			k, err := ReadSealedKeyObject(keyFile)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+
+			prediction, err := k.PredictUnseal(tpm, values[0], nil)
+			if err != nil {
+				t.Fatalf("PredictUnseal failed: %v", err)
+			}
+			if !prediction.Satisfiable() {
+				t.Errorf("Unexpected prediction for the current boot: %#v", prediction)
+			}
+
+			prediction, err = k.PredictUnseal(tpm, values[0], &PredictUnsealOptions{NextBoot: true})
+			if err != nil {
+				t.Fatalf("PredictUnseal failed: %v", err)
+			}
+			if prediction.PCRPolicyExpired != data.expired || prediction.Satisfiable() == data.expired {
+				t.Errorf("Unexpected prediction for the next boot: %#v", prediction)
+			}
+
+			if _, err := k.PredictUnseal(tpm, nil, &PredictUnsealOptions{NextBoot: true}); err == nil ||
+				err.Error() != "PCR values must be supplied when predicting the next boot" {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,517 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	recoveryChallengeHeader uint32 = 0x55534b43
+	recoveryResponseHeader  uint32 = 0x55534b52
+)
+
+// computeRecoveryPolicyRef computes the reference used in the signed TPM2_PolicySigned assertion for recovering a
+// sealed key object from the supplied PCR policy ref. Like the PCR policy ref, this limits the scope of these
+// signatures and binds them to the PCR policy counter. It uses a label that is distinct from the one used for the
+// PCR policy ref so that a signature for one purpose can't be used for another.
+func computeRecoveryPolicyRef(pcrPolicyRef tpm2.Nonce) tpm2.Nonce {
+	h := tpm2.HashAlgorithmSHA256.NewHash()
+	h.Write([]byte("RECOVERY-AUTHORIZATION"))
+	h.Write(pcrPolicyRef)
+	return h.Sum(nil)
+}
+
+// computeRecoveryApprovalLabel computes a digest that is included as an unsatisfiable branch of the final
+// TPM2_PolicyOR assertion in the recovery policy. The TPM defines the format of the signed digest for a
+// TPM2_PolicyAuthorize assertion, so this is how the digest signed to approve a recovery policy is
+// distinguished from the digest signed to approve a PCR policy.
+func computeRecoveryApprovalLabel(alg tpm2.HashAlgorithmId) tpm2.Digest {
+	h := alg.NewHash()
+	h.Write([]byte("RECOVERY-APPROVAL"))
+	return h.Sum(nil)
+}
+
+// computeRecoveryPolicy computes the policy digest for the recovery branch of a sealed key object's authorization
+// policy. This is authorized by the key used for authorizing PCR policy updates in the same way as a PCR policy, and
+// asserts that the key has signed a fresh challenge from the TPM. If the sealed key object has a PCR policy counter,
+// it also asserts that the PCR policy that was current when the challenge was created hasn't been revoked, so that
+// revoking a PCR policy also revokes any outstanding recovery approvals.
+//
+// The final assertion is a TPM2_PolicyOR with a branch that can't be satisfied in order to label the policy - see
+// computeRecoveryApprovalLabel. The digests for this assertion are returned along with the policy digest.
+func computeRecoveryPolicy(alg tpm2.HashAlgorithmId, authPublicKey *tpm2.Public, recoveryPolicyRef tpm2.Nonce, policyCounterName tpm2.Name, policyCount uint64) (tpm2.Digest, tpm2.DigestList, error) {
+	keyName, err := authPublicKey.Name()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute name of signing key: %w", err)
+	}
+
+	trial := util.ComputeAuthPolicy(alg)
+	trial.PolicySigned(keyName, recoveryPolicyRef)
+
+	if len(policyCounterName) > 0 {
+		operandB := make([]byte, 8)
+		binary.BigEndian.PutUint64(operandB, policyCount)
+		trial.PolicyNV(policyCounterName, operandB, 0, tpm2.OpUnsignedLE)
+	}
+
+	orDigests := tpm2.DigestList{trial.GetDigest(), computeRecoveryApprovalLabel(alg)}
+	trial.PolicyOR(orDigests)
+	return trial.GetDigest(), orDigests, nil
+}
+
+// recoveryChallengeRaw_v0 is version 0 of the serialized format of RecoveryChallenge.
+type recoveryChallengeRaw_v0 struct {
+	AuthPublicKey     *tpm2.Public
+	PolicyAlg         tpm2.HashAlgorithmId
+	NonceTPM          tpm2.Nonce
+	Expiration        int32
+	PolicyCounterName tpm2.Name
+	PolicyCount       uint64
+}
+
+// RecoveryChallenge is a challenge created by SealedKeyObject.BeginRecovery. It must be signed with the key used for
+// authorizing PCR policy updates for the sealed key object in order to produce a RecoveryResponse, which can be used
+// to unseal the key regardless of the current PCR values.
+//
+// It can be serialized with Write and deserialized with ReadRecoveryChallenge, so that it can be signed on another
+// machine with a key that never leaves that machine. Only the nonce, expiry and the PCR policy counter name and
+// value that bind the signatures to the sealed key object are supplied by the device - the signed policy digest is
+// computed by Sign.
+type RecoveryChallenge struct {
+	authPublicKey     *tpm2.Public
+	policyAlg         tpm2.HashAlgorithmId // Digest algorithm of the sealed key object's authorization policy
+	nonceTPM          tpm2.Nonce
+	expiration        int32
+	policyCounterName tpm2.Name
+	policyCount       uint64
+}
+
+// ReadRecoveryChallenge deserializes a RecoveryChallenge that was serialized with RecoveryChallenge.Write.
+func ReadRecoveryChallenge(r io.Reader) (*RecoveryChallenge, error) {
+	var header uint32
+	if _, err := mu.UnmarshalFromReader(r, &header); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != recoveryChallengeHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+
+	var version uint32
+	if _, err := mu.UnmarshalFromReader(r, &version); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal version number: %w", err)
+	}
+
+	switch version {
+	case 0:
+		var raw recoveryChallengeRaw_v0
+		if _, err := mu.UnmarshalFromReader(r, &raw); err != nil {
+			return nil, xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		if raw.AuthPublicKey.Type != tpm2.ObjectTypeECC {
+			return nil, errors.New("unexpected authorization key type")
+		}
+		if !raw.AuthPublicKey.NameAlg.Available() {
+			return nil, errors.New("unsupported authorization key name algorithm")
+		}
+		if !raw.PolicyAlg.Available() {
+			return nil, errors.New("unsupported policy digest algorithm")
+		}
+		// The lengths of these are fixed so that a signature for one purpose can't be used for another.
+		if len(raw.NonceTPM) != raw.PolicyAlg.Size() {
+			return nil, errors.New("invalid nonce size")
+		}
+		if !isValidNVIndexName(raw.PolicyCounterName) {
+			return nil, errors.New("invalid PCR policy counter name")
+		}
+		return &RecoveryChallenge{
+			authPublicKey:     raw.AuthPublicKey,
+			policyAlg:         raw.PolicyAlg,
+			nonceTPM:          raw.NonceTPM,
+			expiration:        raw.Expiration,
+			policyCounterName: raw.PolicyCounterName,
+			policyCount:       raw.PolicyCount}, nil
+	default:
+		return nil, fmt.Errorf("unexpected version number (%d)", version)
+	}
+}
+
+// Write serializes this challenge to the supplied io.Writer.
+func (c *RecoveryChallenge) Write(w io.Writer) error {
+	raw := recoveryChallengeRaw_v0{
+		AuthPublicKey:     c.authPublicKey,
+		PolicyAlg:         c.policyAlg,
+		NonceTPM:          c.nonceTPM,
+		Expiration:        c.expiration,
+		PolicyCounterName: c.policyCounterName,
+		PolicyCount:       c.policyCount}
+	if _, err := mu.MarshalToWriter(w, recoveryChallengeHeader, uint32(0), raw); err != nil {
+		return xerrors.Errorf("cannot marshal data: %w", err)
+	}
+	return nil
+}
+
+// HashAlg returns the digest algorithm that must be used to sign this challenge.
+func (c *RecoveryChallenge) HashAlg() crypto.Hash {
+	return c.authPublicKey.NameAlg.GetHash()
+}
+
+// Expiry returns the time after the challenge was created that a response to it is valid for. If this is zero,
+// a response is valid until the session that created the challenge is closed.
+func (c *RecoveryChallenge) Expiry() time.Duration {
+	return time.Duration(c.expiration) * time.Second
+}
+
+// authorizationDigest computes the digest that is signed in order to satisfy the TPM2_PolicySigned assertion in
+// the recovery policy.
+func (c *RecoveryChallenge) authorizationDigest() []byte {
+	h := c.authPublicKey.NameAlg.NewHash()
+	h.Write(c.nonceTPM)
+	binary.Write(h, binary.BigEndian, c.expiration)
+	h.Write(c.recoveryPolicyRef())
+	return h.Sum(nil)
+}
+
+func (c *RecoveryChallenge) pcrPolicyRef() tpm2.Nonce {
+	return computePcrPolicyRefFromCounterName(c.policyCounterName)
+}
+
+func (c *RecoveryChallenge) recoveryPolicyRef() tpm2.Nonce {
+	return computeRecoveryPolicyRef(c.pcrPolicyRef())
+}
+
+func (c *RecoveryChallenge) recoveryPolicy() (tpm2.Digest, tpm2.DigestList, error) {
+	return computeRecoveryPolicy(c.policyAlg, c.authPublicKey, c.recoveryPolicyRef(), c.policyCounterName, c.policyCount)
+}
+
+// approvalDigest computes the digest that is signed in order for the recovery policy to satisfy the
+// TPM2_PolicyAuthorize assertion in the sealed key object's static authorization policy.
+func (c *RecoveryChallenge) approvalDigest() ([]byte, error) {
+	policy, _, err := c.recoveryPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	h := c.authPublicKey.NameAlg.NewHash()
+	h.Write(policy)
+	h.Write(c.pcrPolicyRef())
+	return h.Sum(nil), nil
+}
+
+// Sign signs this challenge with the supplied crypto.Signer, which must correspond to the key used for authorizing
+// PCR policy updates for the sealed key object that this challenge was created for. The signer can be backed by any
+// key store, as long as it produces ECDSA signatures in the ASN.1 format produced by *ecdsa.PrivateKey.
+//
+// The returned response permits the sealed key object to be unsealed once with RecoverySession.Unseal, regardless of
+// the current PCR values, so this should only be called once the owner of the device has been authenticated.
+func (c *RecoveryChallenge) Sign(signer crypto.Signer) (*RecoveryResponse, error) {
+	authorization, err := signDigestWithECDSASigner(signer, c.authPublicKey, c.authorizationDigest())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign challenge: %w", err)
+	}
+	approvalDigest, err := c.approvalDigest()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute recovery policy: %w", err)
+	}
+	approval, err := signDigestWithECDSASigner(signer, c.authPublicKey, approvalDigest)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign recovery policy: %w", err)
+	}
+
+	response := &RecoveryResponse{authorization: authorization, approval: approval}
+	if err := c.verifyResponse(response); err != nil {
+		return nil, xerrors.Errorf("cannot verify response: %w", err)
+	}
+	return response, nil
+}
+
+// verifyResponse checks that the supplied response contains valid signatures for this challenge.
+func (c *RecoveryChallenge) verifyResponse(response *RecoveryResponse) error {
+	if err := verifyECDSASignature(c.authPublicKey, c.authorizationDigest(), response.authorization); err != nil {
+		return xerrors.Errorf("invalid challenge signature: %w", err)
+	}
+	approvalDigest, err := c.approvalDigest()
+	if err != nil {
+		return xerrors.Errorf("cannot compute recovery policy: %w", err)
+	}
+	if err := verifyECDSASignature(c.authPublicKey, approvalDigest, response.approval); err != nil {
+		return xerrors.Errorf("invalid recovery policy signature: %w", err)
+	}
+	return nil
+}
+
+// recoveryResponseRaw_v0 is version 0 of the serialized format of RecoveryResponse.
+type recoveryResponseRaw_v0 struct {
+	Authorization *tpm2.Signature
+	Approval      *tpm2.Signature
+}
+
+// RecoveryResponse is a response to a RecoveryChallenge, created by RecoveryChallenge.Sign. It can be serialized with
+// Write and deserialized with ReadRecoveryResponse.
+type RecoveryResponse struct {
+	authorization *tpm2.Signature // Signature for the TPM2_PolicySigned assertion
+	approval      *tpm2.Signature // Signature for the TPM2_PolicyAuthorize assertion
+}
+
+// ReadRecoveryResponse deserializes a RecoveryResponse that was serialized with RecoveryResponse.Write.
+func ReadRecoveryResponse(r io.Reader) (*RecoveryResponse, error) {
+	var header uint32
+	if _, err := mu.UnmarshalFromReader(r, &header); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != recoveryResponseHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+
+	var version uint32
+	if _, err := mu.UnmarshalFromReader(r, &version); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal version number: %w", err)
+	}
+
+	switch version {
+	case 0:
+		var raw recoveryResponseRaw_v0
+		if _, err := mu.UnmarshalFromReader(r, &raw); err != nil {
+			return nil, xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		return &RecoveryResponse{authorization: raw.Authorization, approval: raw.Approval}, nil
+	default:
+		return nil, fmt.Errorf("unexpected version number (%d)", version)
+	}
+}
+
+// Write serializes this response to the supplied io.Writer.
+func (r *RecoveryResponse) Write(w io.Writer) error {
+	raw := recoveryResponseRaw_v0{Authorization: r.authorization, Approval: r.approval}
+	if _, err := mu.MarshalToWriter(w, recoveryResponseHeader, uint32(0), raw); err != nil {
+		return xerrors.Errorf("cannot marshal data: %w", err)
+	}
+	return nil
+}
+
+// RecoverySession corresponds to a TPM policy session that has been started in order to unseal a sealed key object
+// with a signed assertion. It is created by SealedKeyObject.BeginRecovery.
+type RecoverySession struct {
+	tpm              *Connection
+	k                *SealedKeyObject
+	pcrPolicyCounter tpm2.ResourceContext
+	session          tpm2.SessionContext
+	challenge        *RecoveryChallenge
+}
+
+// BeginRecovery begins the process of unsealing this sealed key object with a signed assertion from the key used for
+// authorizing PCR policy updates, regardless of the current PCR values. This is intended to permit remote-assisted
+// recovery of a device where the boot chain has changed unexpectedly.
+//
+// This starts a policy session on the TPM and returns a RecoverySession. The challenge obtained from
+// RecoverySession.Challenge must be signed by the holder of the authorization key with RecoveryChallenge.Sign, and
+// the resulting response supplied to RecoverySession.Unseal.
+//
+// If expiry is not zero, the response must be supplied to the TPM within the specified duration of this function
+// being called. It has a resolution of 1 second. A response can only be used with the session that created the
+// challenge.
+//
+// Version 0 sealed key objects are not supported.
+//
+// The session must be closed with RecoverySession.Close if it isn't used to unseal the key.
+func (k *SealedKeyObject) BeginRecovery(tpm *Connection, expiry time.Duration) (*RecoverySession, error) {
+	if k.data.version == 0 {
+		return nil, errors.New("unsupported sealed key object version")
+	}
+	if expiry < 0 || expiry/time.Second > math.MaxInt32 {
+		return nil, errors.New("invalid expiry")
+	}
+
+	var pcrPolicyCounter tpm2.ResourceContext
+	if handle := k.data.staticPolicyData.pcrPolicyCounterHandle; handle != tpm2.HandleNull {
+		var err error
+		pcrPolicyCounter, err = tpm.CreateResourceContextFromTPM(handle, tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+		switch {
+		case tpm2.IsResourceUnavailableError(err, handle):
+			return nil, InvalidKeyFileError{"PCR policy counter is unavailable"}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+		}
+	}
+
+	authPublicKey := k.data.staticPolicyData.authPublicKey
+	if !authPublicKey.NameAlg.Available() {
+		return nil, InvalidKeyFileError{"public area of dynamic authorization policy signing key has an unsupported name algorithm"}
+	}
+
+	challenge := &RecoveryChallenge{
+		authPublicKey: authPublicKey,
+		policyAlg:     k.data.keyPublic.NameAlg,
+		expiration:    int32(expiry / time.Second),
+		policyCount:   k.data.dynamicPolicyData.policyCount}
+	if pcrPolicyCounter != nil {
+		challenge.policyCounterName = pcrPolicyCounter.Name()
+	}
+	if _, _, err := challenge.recoveryPolicy(); err != nil {
+		return nil, InvalidKeyFileError{err.Error()}
+	}
+
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.keyPublic.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+
+	challenge.nonceTPM = session.NonceTPM()
+
+	return &RecoverySession{
+		tpm:              tpm,
+		k:                k,
+		pcrPolicyCounter: pcrPolicyCounter,
+		session:          session,
+		challenge:        challenge}, nil
+}
+
+// Challenge returns the challenge for this session, which must be signed in order to unseal the key.
+func (s *RecoverySession) Challenge() *RecoveryChallenge {
+	return s.challenge
+}
+
+// Close flushes the policy session associated with this recovery session from the TPM.
+func (s *RecoverySession) Close() error {
+	if s.session == nil {
+		return nil
+	}
+	defer func() { s.session = nil }()
+	return s.tpm.FlushContext(s.session)
+}
+
+// Unseal unseals the key using the supplied response to this session's challenge. If a PIN has been set, the correct
+// PIN must be provided via the pin argument. The session is closed by this function, and a new one must be started
+// with SealedKeyObject.BeginRecovery in order to try again.
+//
+// If the response wasn't produced for this session's challenge by the key used for authorizing PCR policy updates,
+// or the challenge has expired, a ErrInvalidRecoveryResponse error will be returned.
+//
+// If the PCR policy that was current when the challenge was created has been revoked, then a InvalidKeyFileError
+// error will be returned.
+//
+// If the provided PIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter
+// will be incremented.
+//
+// If the sealed key object has a boot attempt limit, this counts as an unseal attempt, but the limit itself isn't
+// enforced.
+//
+// The other errors that can be returned are the same as those returned from SealedKeyObject.UnsealFromTPM, apart
+// from those related to the PCR policy.
+//
+// On success, the unsealed cleartext key is returned as the first return value, and the private part of the key used
+// for authorizing PCR policy updates with UpdateKeyPCRProtectionPolicy is returned as the second return value.
+func (s *RecoverySession) Unseal(response *RecoveryResponse, pin string) (key []byte, authKey PolicyAuthKey, err error) {
+	if s.session == nil {
+		return nil, nil, errors.New("session is closed")
+	}
+	defer s.Close()
+
+	if err := s.challenge.verifyResponse(response); err != nil {
+		return nil, nil, ErrInvalidRecoveryResponse
+	}
+
+	keyObject, err := s.k.loadForUnseal(s.tpm)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.tpm.FlushContext(keyObject)
+
+	// Record this attempt before executing the policy session so that it counts even if unsealing fails.
+	if bootAttempts := s.k.data.dynamicPolicyData.bootAttempts; bootAttempts != nil {
+		if err := bootAttempts.recordAttempt(s.tpm.TPMContext, s.tpm.HmacSession()); err != nil {
+			if isDynamicPolicyDataError(err) {
+				return nil, nil, InvalidKeyFileError{err.Error()}
+			}
+			return nil, nil, xerrors.Errorf("cannot record unseal attempt: %w", err)
+		}
+	}
+
+	authorizeKey, err := s.tpm.LoadExternal(nil, s.challenge.authPublicKey, tpm2.HandleOwner)
+	if err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandLoadExternal, 2) {
+			return nil, nil, InvalidKeyFileError{"public area of dynamic authorization policy signing key is invalid"}
+		}
+		return nil, nil, xerrors.Errorf("cannot load public area for dynamic authorization policy signing key: %w", err)
+	}
+	defer s.tpm.FlushContext(authorizeKey)
+
+	if _, _, err := s.tpm.PolicySigned(authorizeKey, s.session, true, nil, s.challenge.recoveryPolicyRef(),
+		s.challenge.expiration, response.authorization); err != nil {
+		switch {
+		case tpm2.IsTPMParameterError(err, tpm2.ErrorExpired, tpm2.CommandPolicySigned, 4):
+			return nil, nil, ErrInvalidRecoveryResponse
+		case tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandPolicySigned, 5):
+			return nil, nil, ErrInvalidRecoveryResponse
+		}
+		return nil, nil, xerrors.Errorf("cannot execute PolicySigned assertion: %w", err)
+	}
+
+	if s.pcrPolicyCounter != nil {
+		operandB := make([]byte, 8)
+		binary.BigEndian.PutUint64(operandB, s.challenge.policyCount)
+		if err := s.tpm.PolicyNV(s.pcrPolicyCounter, s.pcrPolicyCounter, s.session, operandB, 0, tpm2.OpUnsignedLE, nil); err != nil {
+			if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV) {
+				return nil, nil, InvalidKeyFileError{"the PCR policy has been revoked"}
+			}
+			return nil, nil, xerrors.Errorf("PCR policy revocation check failed: %w", err)
+		}
+	}
+
+	recoveryPolicy, orDigests, _ := s.challenge.recoveryPolicy()
+	if err := s.tpm.PolicyOR(s.session, orDigests); err != nil {
+		return nil, nil, xerrors.Errorf("cannot execute PolicyOR assertion: %w", err)
+	}
+
+	approvalDigest, err := s.challenge.approvalDigest()
+	if err != nil {
+		return nil, nil, InvalidKeyFileError{err.Error()}
+	}
+	approvalTicket, err := s.tpm.VerifySignature(authorizeKey, approvalDigest, response.approval)
+	if err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandVerifySignature, 2) {
+			return nil, nil, ErrInvalidRecoveryResponse
+		}
+		return nil, nil, xerrors.Errorf("cannot verify recovery policy signature: %w", err)
+	}
+
+	if err := s.tpm.PolicyAuthorize(s.session, recoveryPolicy, s.challenge.pcrPolicyRef(), authorizeKey.Name(), approvalTicket); err != nil {
+		return nil, nil, xerrors.Errorf("recovery policy check failed: %w", err)
+	}
+
+	// The static policy requires knowledge of the sealed key object's authorization value.
+	if err := s.tpm.PolicyAuthValue(s.session); err != nil {
+		return nil, nil, xerrors.Errorf("cannot execute PolicyAuthValue assertion: %w", err)
+	}
+
+	return s.k.unsealWithPolicySession(s.tpm, keyObject, s.session, pin)
+}
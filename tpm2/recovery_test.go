@@ -0,0 +1,295 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func newTestRecoveryChallenge(t *testing.T, key *ecdsa.PrivateKey, nonce tpm2.Nonce) *RecoveryChallenge {
+	return NewRecoveryChallenge(CreateTPMPublicAreaForECDSAKey(&key.PublicKey), tpm2.HashAlgorithmSHA256, nonce, 60,
+		testPCRPolicyCounterName(t), 5)
+}
+
+func verifyTestSignature(t *testing.T, key *ecdsa.PrivateKey, digest []byte, sig *tpm2.Signature) {
+	if sig.SigAlg != tpm2.SigSchemeAlgECDSA || sig.Signature.ECDSA.Hash != tpm2.HashAlgorithmSHA256 {
+		t.Errorf("Unexpected signature scheme")
+		return
+	}
+	if ok := ecdsa.Verify(&key.PublicKey, digest,
+		new(big.Int).SetBytes(sig.Signature.ECDSA.SignatureR),
+		new(big.Int).SetBytes(sig.Signature.ECDSA.SignatureS)); !ok {
+		t.Errorf("Invalid signature")
+	}
+}
+
+func TestRecoveryChallengeSign(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	nonce := make(tpm2.Nonce, 32)
+	rand.Read(nonce)
+
+	challenge := newTestRecoveryChallenge(t, key, nonce)
+	if challenge.HashAlg() != crypto.SHA256 {
+		t.Errorf("Unexpected digest algorithm")
+	}
+	if challenge.Expiry() != time.Minute {
+		t.Errorf("Unexpected expiry")
+	}
+
+	response, err := challenge.Sign(&testSigner{signer: key})
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	pcrPolicyRef := ComputePcrPolicyRefFromCounterName(testPCRPolicyCounterName(t))
+	h := crypto.SHA256.New()
+	h.Write([]byte("RECOVERY-AUTHORIZATION"))
+	h.Write(pcrPolicyRef)
+	recoveryPolicyRef := h.Sum(nil)
+
+	h = crypto.SHA256.New()
+	h.Write(nonce)
+	h.Write([]byte{0, 0, 0, 60})
+	h.Write(recoveryPolicyRef)
+	verifyTestSignature(t, key, h.Sum(nil), response.Authorization())
+
+	keyName, _ := CreateTPMPublicAreaForECDSAKey(&key.PublicKey).Name()
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicySigned(keyName, recoveryPolicyRef)
+	trial.PolicyNV(testPCRPolicyCounterName(t), []byte{0, 0, 0, 0, 0, 0, 0, 5}, 0, tpm2.OpUnsignedLE)
+	h = crypto.SHA256.New()
+	h.Write([]byte("RECOVERY-APPROVAL"))
+	trial.PolicyOR(tpm2.DigestList{trial.GetDigest(), h.Sum(nil)})
+
+	h = crypto.SHA256.New()
+	h.Write(trial.GetDigest())
+	h.Write(pcrPolicyRef)
+	verifyTestSignature(t, key, h.Sum(nil), response.Approval())
+}
+
+func TestRecoveryChallengeSignWithWrongKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	_, err = newTestRecoveryChallenge(t, key, make(tpm2.Nonce, 32)).Sign(otherKey)
+	if err == nil || err.Error() != "cannot sign challenge: signer doesn't correspond to the PCR policy authorization key" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRecoveryChallengeSerialization(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	challenge := newTestRecoveryChallenge(t, key, make(tpm2.Nonce, 32))
+	b := new(bytes.Buffer)
+	if err := challenge.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expected := b.Bytes()
+	challenge2, err := ReadRecoveryChallenge(bytes.NewReader(expected))
+	if err != nil {
+		t.Fatalf("ReadRecoveryChallenge failed: %v", err)
+	}
+	b = new(bytes.Buffer)
+	if err := challenge2.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Errorf("Unexpected challenge")
+	}
+	if challenge2.Expiry() != challenge.Expiry() {
+		t.Errorf("Unexpected expiry")
+	}
+
+	response, err := challenge2.Sign(key)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	b.Reset()
+	if err := response.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	response2, err := ReadRecoveryResponse(b)
+	if err != nil {
+		t.Fatalf("ReadRecoveryResponse failed: %v", err)
+	}
+	if !reflect.DeepEqual(response, response2) {
+		t.Errorf("Unexpected response")
+	}
+}
+
+func TestReadRecoveryChallengeInvalidNonce(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	// A device must not be able to choose the length of the nonce, else it could arrange for the
+	// signed challenge to be a valid approval for an arbitrary policy.
+	challenge := NewRecoveryChallenge(CreateTPMPublicAreaForECDSAKey(&key.PublicKey), tpm2.HashAlgorithmSHA256,
+		make(tpm2.Nonce, 36), 0, nil, 0)
+	b := new(bytes.Buffer)
+	if err := challenge.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := ReadRecoveryChallenge(b); err == nil || err.Error() != "invalid nonce size" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestReadRecoveryChallengeInvalidPolicyCounterName(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	// The PCR policy counter name determines the policy ref, so it must be the name of a NV index.
+	challenge := NewRecoveryChallenge(CreateTPMPublicAreaForECDSAKey(&key.PublicKey), tpm2.HashAlgorithmSHA256,
+		make(tpm2.Nonce, 32), 0, tpm2.Name{0x01, 0x81, 0x00, 0x00}, 0)
+	b := new(bytes.Buffer)
+	if err := challenge.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := ReadRecoveryChallenge(b); err == nil || err.Error() != "invalid PCR policy counter name" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestUnsealWithRecoveryResponse(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithRecoveryResponse_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKeyBytes, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	authKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256()},
+		D:         new(big.Int).SetBytes(authKeyBytes)}
+	authKey.X, authKey.Y = elliptic.P256().ScalarBaseMult(authKeyBytes)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	// Change the PCR state so that the PCR policy is no longer satisfied.
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+		t.Errorf("PCREvent failed: %v", err)
+	}
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+		t.Fatalf("UnsealFromTPM should have failed")
+	}
+
+	session, err := k.BeginRecovery(tpm, time.Minute)
+	if err != nil {
+		t.Fatalf("BeginRecovery failed: %v", err)
+	}
+	defer session.Close()
+
+	// Serialize the challenge and response to emulate signing it elsewhere.
+	b := new(bytes.Buffer)
+	if err := session.Challenge().Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	challenge, err := ReadRecoveryChallenge(b)
+	if err != nil {
+		t.Fatalf("ReadRecoveryChallenge failed: %v", err)
+	}
+	response, err := challenge.Sign(&testSigner{signer: authKey})
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	b.Reset()
+	if err := response.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	response, err = ReadRecoveryResponse(b)
+	if err != nil {
+		t.Fatalf("ReadRecoveryResponse failed: %v", err)
+	}
+
+	unsealedKey, unsealedAuthKey, err := session.Unseal(response, "")
+	if err != nil {
+		t.Fatalf("Unseal failed: %v", err)
+	}
+	if !bytes.Equal(unsealedKey, key) {
+		t.Errorf("Unexpected key")
+	}
+	if !bytes.Equal(unsealedAuthKey, authKeyBytes) {
+		t.Errorf("Unexpected auth key")
+	}
+
+	// A response can't be used with a different session.
+	session, err = k.BeginRecovery(tpm, 0)
+	if err != nil {
+		t.Fatalf("BeginRecovery failed: %v", err)
+	}
+	defer session.Close()
+	if _, _, err := session.Unseal(response, ""); err != ErrInvalidRecoveryResponse {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
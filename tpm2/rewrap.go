@@ -0,0 +1,291 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+)
+
+// ensurePcrPolicyCounter creates a PCR policy counter at the specified handle. If there is already a NV index at the
+// handle, it is reused if it is a PCR policy counter associated with the supplied authorization key, which will be the
+// case if a related sealed key object has already been re-wrapped. On success, it returns the public area of the PCR
+// policy counter and whether it was created.
+func ensurePcrPolicyCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyName tpm2.Name, session tpm2.SessionContext) (*tpm2.NVPublic, bool, error) {
+	pub, err := createPcrPolicyCounter(tpm, handle, updateKeyName, session)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+	case err != nil:
+		return nil, false, err
+	default:
+		return pub, true, nil
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(handle, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, false, xerrors.Errorf("cannot create context for existing NV index: %w", err)
+	}
+	pub, _, err = tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, false, xerrors.Errorf("cannot read public area of existing NV index: %w", err)
+	}
+	if !pub.NameAlg.Available() {
+		return nil, false, TPMResourceExistsError{handle}
+	}
+
+	trial := util.ComputeAuthPolicy(pub.NameAlg)
+	trial.PolicyOR(computePcrPolicyCounterAuthPolicies(pub.NameAlg, updateKeyName))
+	if pub.Attrs != tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA|tpm2.AttrNVWritten) ||
+		!bytes.Equal(pub.AuthPolicy, trial.GetDigest()) {
+		return nil, false, TPMResourceExistsError{handle}
+	}
+
+	return pub, false, nil
+}
+
+// ensureBootAttemptCounter creates a boot attempt counter at the specified handle. If there is already a NV index at
+// the handle, it is reused if it is a boot attempt counter. On success, it returns the public area of the boot attempt
+// counter and whether it was created.
+func ensureBootAttemptCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, session tpm2.SessionContext) (*tpm2.NVPublic, bool, error) {
+	pub, err := createBootAttemptCounter(tpm, handle, session)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+	case err != nil:
+		return nil, false, err
+	default:
+		return pub, true, nil
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(handle, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, false, xerrors.Errorf("cannot create context for existing NV index: %w", err)
+	}
+	pub, _, err = tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, false, xerrors.Errorf("cannot read public area of existing NV index: %w", err)
+	}
+	if pub.Attrs != tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA|tpm2.AttrNVWritten) {
+		return nil, false, TPMResourceExistsError{handle}
+	}
+
+	return pub, false, nil
+}
+
+// Rewrap creates a new sealed key object for this sealed key data file under the current storage root key (SRK), and
+// atomically replaces the sealed key data file with it. This is intended to be used after the TPM has been cleared or
+// reprovisioned with ProvisionModeClear, which recreates the SRK and orphans existing sealed key objects. As the original
+// sealed key object can no longer be unsealed, the caller must supply the disk encryption key via the key argument, which
+// will typically have been obtained by unlocking the encrypted volume with its recovery key.
+//
+// If the authKey argument is supplied, it must be the private part of the key used for authorizing PCR policy updates for
+// this sealed key object, as originally returned from SealKeyToTPM or SealedKeyObject.UnsealFromTPM, and it will be
+// retained. If it is not supplied, a new key will be created. It is not possible to retain the key for version 0 sealed key
+// data files.
+//
+// The new sealed key object will be protected with a PCR policy computed from the PCRProtectionProfile supplied via the
+// pcrProfile argument. The PCR policy counter handle, PCR policy validity window and boot attempt limit of this sealed key
+// object are retained. Any NV indices that no longer exist are recreated at their original handles. If the PCR policy counter
+// already exists because a related sealed key object has already been re-wrapped with the same authorization key, it is
+// reused and the PCR policies of the related sealed key objects are not revoked. If the handle of the PCR policy counter or
+// boot attempt counter is occupied by another NV index, a TPMResourceExistsError error will be returned. Version 0 sealed
+// key data files are upgraded to the current version.
+//
+// Any PIN associated with this sealed key object is not retained, and must be set again with SealedKeyObject.ChangePIN.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is
+// incorrect, a AuthFailError error will be returned.
+//
+// If this sealed key object was not read from a file, it must be written with SealedKeyObject.Write afterwards.
+//
+// If any part of this function fails, the sealed key data file is not modified and any NV indices created by this function
+// are removed.
+//
+// On success, this function returns the private part of the key used for authorizing PCR policy updates.
+func (k *SealedKeyObject) Rewrap(tpm *Connection, key []byte, authKey PolicyAuthKey, pcrProfile *PCRProtectionProfile) (PolicyAuthKey, error) {
+	session := tpm.HmacSession()
+
+	version := k.data.version
+	if version == 0 {
+		version = currentMetadataVersion
+	}
+
+	var goAuthKey *ecdsa.PrivateKey
+	if authKey != nil {
+		if k.data.version == 0 {
+			return nil, errors.New("cannot retain the authorization key of a version 0 sealed key object")
+		}
+		var err error
+		goAuthKey, err = createECDSAPrivateKeyFromTPM(k.data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authKey))
+		if err != nil {
+			return nil, InvalidKeyFileError{fmt.Sprintf("cannot create auth key: %v", err)}
+		}
+		expectedX, expectedY := goAuthKey.Curve.ScalarBaseMult(goAuthKey.D.Bytes())
+		if expectedX.Cmp(goAuthKey.X) != 0 || expectedY.Cmp(goAuthKey.Y) != 0 {
+			return nil, errors.New("the supplied authorization key does not match the sealed key object")
+		}
+	} else {
+		var err error
+		goAuthKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot generate key for signing dynamic authorization policies: %w", err)
+		}
+	}
+	authPublicKey := createTPMPublicAreaForECDSAKey(&goAuthKey.PublicKey)
+	authKeyName, err := authPublicKey.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of signing key for dynamic policy authorization: %w", err)
+	}
+	authKey = goAuthKey.D.Bytes()
+
+	// Obtain a context for the current SRK, provisioning it if required.
+	srk := tpm.provisionedSrk
+	if srk == nil {
+		var err error
+		srk, err = provisionStoragePrimaryKey(tpm.TPMContext, session)
+		switch {
+		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot provision storage root key: %w", err)
+		}
+	}
+
+	succeeded := false
+
+	// Recreate the PCR policy counter, if there is one.
+	var pcrPolicyCounterPub *tpm2.NVPublic
+	pcrPolicyCounterCreated := false
+	if handle := k.data.staticPolicyData.pcrPolicyCounterHandle; handle != tpm2.HandleNull {
+		pcrPolicyCounterPub, pcrPolicyCounterCreated, err = ensurePcrPolicyCounter(tpm.TPMContext, handle, authKeyName, session)
+		switch {
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create PCR policy counter: %w", err)
+		}
+		if pcrPolicyCounterCreated {
+			defer func() {
+				if succeeded {
+					return
+				}
+				index, err := tpm2.CreateNVIndexResourceContextFromPublic(pcrPolicyCounterPub)
+				if err != nil {
+					return
+				}
+				tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+			}()
+		}
+	}
+
+	// Recreate the boot attempt counter, if there is one.
+	bootAttempts := k.data.dynamicPolicyData.bootAttempts
+	if bootAttempts != nil {
+		bootAttemptCounterPub, created, err := ensureBootAttemptCounter(tpm.TPMContext, bootAttempts.CounterHandle, session)
+		switch {
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create boot attempt counter: %w", err)
+		}
+		if created {
+			defer func() {
+				if succeeded {
+					return
+				}
+				index, err := tpm2.CreateNVIndexResourceContextFromPublic(bootAttemptCounterPub)
+				if err != nil {
+					return
+				}
+				tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+			}()
+
+			// The existing baseline doesn't apply to a new counter.
+			bootAttempts, _, err = bootAttempts.reset(tpm.TPMContext, session)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot compute initial boot attempt counter baseline: %w", err)
+			}
+		}
+	}
+
+	template := makeSealedKeyTemplate()
+
+	staticPolicyData, authPolicy, err := computeStaticPolicy(template.NameAlg, &staticPolicyComputeParams{
+		key:                 authPublicKey,
+		pcrPolicyCounterPub: pcrPolicyCounterPub})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute static authorization policy: %w", err)
+	}
+	template.AuthPolicy = authPolicy
+
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+	dynamicPolicyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, version, template.NameAlg, authPublicKey.NameAlg,
+		goAuthKey, pcrPolicyCounterPub, nil, pcrProfile, k.data.dynamicPolicyData.validity, bootAttempts, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+
+	sealedData, err := mu.MarshalToBytes(sealedData{Key: key, AuthPrivateKey: authKey})
+	if err != nil {
+		panic(fmt.Sprintf("cannot marshal sensitive data: %v", err))
+	}
+	sensitive := tpm2.SensitiveCreate{Data: sealedData}
+
+	priv, pub, _, _, _, err := tpm.Create(srk, &sensitive, template, nil, nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create sealed data object for key: %w", err)
+	}
+
+	// Increment a newly created PCR policy counter for the first time, as SealKeyToTPMMultiple does.
+	if pcrPolicyCounterCreated {
+		if err := incrementPcrPolicyCounter(tpm.TPMContext, version, pcrPolicyCounterPub, nil, goAuthKey, authPublicKey,
+			session); err != nil {
+			return nil, xerrors.Errorf("cannot increment PCR policy counter: %w", err)
+		}
+	}
+
+	origData := k.data
+	k.data = &keyData{
+		version:           version,
+		keyPrivate:        priv,
+		keyPublic:         pub,
+		authModeHint:      authModeNone,
+		staticPolicyData:  staticPolicyData,
+		dynamicPolicyData: dynamicPolicyData}
+	if err := k.persist(); err != nil {
+		k.data = origData
+		return nil, xerrors.Errorf("cannot write key data file: %w", err)
+	}
+
+	succeeded = true
+	return authKey, nil
+}
@@ -0,0 +1,162 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestRewrap(t *testing.T) {
+	for _, data := range []struct {
+		desc          string
+		retainAuthKey bool
+	}{
+		{
+			desc:          "RetainAuthKey",
+			retainAuthKey: true,
+		},
+		{
+			desc: "NewAuthKey",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			tpm, _ := openTPMSimulatorForTesting(t)
+			defer func() {
+				clearTPMWithPlatformAuth(t, tpm)
+				closeTPM(t, tpm)
+			}()
+
+			if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+				t.Errorf("Failed to provision TPM for test: %v", err)
+			}
+
+			key := make([]byte, 64)
+			rand.Read(key)
+
+			tmpDir, err := ioutil.TempDir("", "_TestRewrap_")
+			if err != nil {
+				t.Fatalf("Creating temporary directory failed: %v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			keyFile := filepath.Join(tmpDir, "keydata")
+			authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+			if err != nil {
+				t.Fatalf("SealKeyToTPM failed: %v", err)
+			}
+
+			// Clearing and reprovisioning the TPM orphans the sealed key object.
+			clearTPMWithPlatformAuth(t, tpm)
+			if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+				t.Errorf("Failed to provision TPM for test: %v", err)
+			}
+
+			k, err := ReadSealedKeyObject(keyFile)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+			if _, _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+				t.Fatalf("UnsealFromTPM should have failed")
+			}
+
+			var suppliedAuthKey PolicyAuthKey
+			if data.retainAuthKey {
+				suppliedAuthKey = authKey
+			}
+			newAuthKey, err := k.Rewrap(tpm, key, suppliedAuthKey, getTestPCRProfile())
+			if err != nil {
+				t.Fatalf("Rewrap failed: %v", err)
+			}
+			if data.retainAuthKey && !bytes.Equal(newAuthKey, authKey) {
+				t.Errorf("Auth key was not retained")
+			}
+
+			k, err = ReadSealedKeyObject(keyFile)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+			if k.PCRPolicyCounterHandle() != 0x01810000 {
+				t.Errorf("Unexpected PCR policy counter handle %v", k.PCRPolicyCounterHandle())
+			}
+
+			unsealedKey, unsealedAuthKey, err := k.UnsealFromTPM(tpm, "")
+			if err != nil {
+				t.Fatalf("UnsealFromTPM failed: %v", err)
+			}
+			if !bytes.Equal(unsealedKey, key) {
+				t.Errorf("Unexpected key")
+			}
+			if !bytes.Equal(unsealedAuthKey, newAuthKey) {
+				t.Errorf("Unexpected auth key")
+			}
+
+			if err := k.UpdatePCRProtectionPolicy(tpm, newAuthKey, getTestPCRProfile()); err != nil {
+				t.Errorf("UpdatePCRProtectionPolicy failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestRewrapWrongAuthKey(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestRewrapWrongAuthKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	wrongAuthKey := make(PolicyAuthKey, len(authKey))
+	copy(wrongAuthKey, authKey)
+	wrongAuthKey[0] ^= 0xff
+	if _, err := k.Rewrap(tpm, key, wrongAuthKey, getTestPCRProfile()); err == nil ||
+		err.Error() != "the supplied authorization key does not match the sealed key object" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
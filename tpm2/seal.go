@@ -51,8 +51,8 @@ func makeImportableSealedKeyTemplate() *tpm2.Public {
 	return tmpl
 }
 
-// computeSealedKeyDynamicAuthPolicy is a helper to compute a new PCR policy using the supplied
-// pcrProfile, signed with the supplied authKey.
+// computeSealedKeyDynamicAuthPolicyParams is a helper to compute the parameters for a new PCR
+// policy using the supplied pcrProfile, to be signed with the supplied authKey.
 //
 // If tpm is not nil, this function will verify that the supplied pcrProfile produces a PCR
 // selection that is supported by the TPM. If tpm is nil, it will be assumed that the target
@@ -62,12 +62,20 @@ func makeImportableSealedKeyTemplate() *tpm2.Public {
 // If tpm is not nil and counterPub is supplied, the current policy count will be read from
 // the TPM and the new PCR policy will have a count of this value + 1. If tpm is nil then
 // counterPub must also be nil, else an error will be returned.
-func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg, signAlg tpm2.HashAlgorithmId, authKey crypto.PrivateKey,
-	counterPub *tpm2.NVPublic, counterAuthPolicies tpm2.DigestList, pcrProfile *PCRProtectionProfile,
-	session tpm2.SessionContext) (*dynamicPolicyData, error) {
+//
+// If validity is supplied, the new PCR policy will have a validity window with limits computed
+// from the TPM's current clock. This requires tpm to be not nil.
+//
+// If bootAttempts is supplied, the new PCR policy will have the same boot attempt limit and
+// baseline. The baseline is only moved by resetting the boot attempt counter. This requires tpm
+// to be not nil.
+func computeSealedKeyDynamicAuthPolicyParams(tpm *tpm2.TPMContext, version uint32, alg, signAlg tpm2.HashAlgorithmId, authKey crypto.PrivateKey,
+	counterPub *tpm2.NVPublic, counterAuthPolicies tpm2.DigestList, pcrProfile *PCRProtectionProfile, validity *pcrPolicyValidityData,
+	bootAttempts *bootAttemptCounterData, session tpm2.SessionContext) (*dynamicPolicyComputeParams, error) {
 
 	var nextPolicyCount uint64
 	var counterName tpm2.Name
+	var bootAttemptCounterName tpm2.Name
 	var supportedPcrs tpm2.PCRSelectionList
 	if tpm != nil {
 		var err error
@@ -89,10 +97,31 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 		if err != nil {
 			return nil, xerrors.Errorf("cannot determine supported PCRs: %w", err)
 		}
+
+		if validity != nil {
+			validity, err = computeValidityWindowLimits(tpm, validity, session)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot compute validity window: %w", err)
+			}
+		}
+
+		if bootAttempts != nil {
+			index, _, err := readBootAttemptCounter(tpm, bootAttempts.CounterHandle, session)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot obtain boot attempt counter: %w", err)
+			}
+			bootAttemptCounterName = index.Name()
+		}
 	} else {
 		if counterPub != nil {
 			return nil, errors.New("use of policy counter requires a TPM connection")
 		}
+		if validity != nil {
+			return nil, errors.New("use of validity window requires a TPM connection")
+		}
+		if bootAttempts != nil {
+			return nil, errors.New("use of boot attempt limit requires a TPM connection")
+		}
 
 		// Defined as mandatory in the TCG PC Client Platform TPM Profile Specification for TPM 2.0
 		supportedPcrs = tpm2.PCRSelectionList{
@@ -129,16 +158,33 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 		}
 	}
 
-	// Use the PCR digests and NV index names to generate a single signed dynamic authorization policy digest
-	policyParams := dynamicPolicyComputeParams{
+	return &dynamicPolicyComputeParams{
 		key:               authKey,
 		signAlg:           signAlg,
 		pcrs:              pcrs,
 		pcrDigests:        pcrDigests,
 		policyCounterName: counterName,
-		policyCount:       nextPolicyCount}
+		policyCount:       nextPolicyCount,
+		validity:          validity,
 
-	policyData, err := computeDynamicPolicy(version, alg, &policyParams)
+		bootAttemptCounterName: bootAttemptCounterName,
+		bootAttempts:           bootAttempts}, nil
+}
+
+// computeSealedKeyDynamicAuthPolicy is a helper to compute a new PCR policy using the supplied
+// pcrProfile, signed with the supplied authKey. See computeSealedKeyDynamicAuthPolicyParams for
+// details of the arguments.
+func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg, signAlg tpm2.HashAlgorithmId, authKey crypto.PrivateKey,
+	counterPub *tpm2.NVPublic, counterAuthPolicies tpm2.DigestList, pcrProfile *PCRProtectionProfile, validity *pcrPolicyValidityData,
+	bootAttempts *bootAttemptCounterData, session tpm2.SessionContext) (*dynamicPolicyData, error) {
+	policyParams, err := computeSealedKeyDynamicAuthPolicyParams(tpm, version, alg, signAlg, authKey, counterPub, counterAuthPolicies,
+		pcrProfile, validity, bootAttempts, session)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the PCR digests and NV index names to generate a single signed dynamic authorization policy digest
+	policyData, err := computeDynamicPolicy(version, alg, policyParams)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
@@ -164,6 +210,16 @@ type KeyCreationParams struct {
 	// If set a key from elliptic.P256 must be used,
 	// if not set one is generated.
 	AuthKey *ecdsa.PrivateKey
+
+	// PCRPolicyValidity can be set to limit the validity of the PCR protection policy for the newly created sealed key
+	// file, after which it must be renewed with SealedKeyObject.UpdatePCRProtectionPolicy. This requires access to the
+	// TPM, so it is not supported by SealKeyToExternalTPMStorageKey.
+	PCRPolicyValidity *PCRPolicyValidity
+
+	// BootAttemptLimit can be set to limit the number of consecutive attempts to unseal the newly created sealed key
+	// file without a successful boot, after which SealedKeyObject.ResetBootAttemptCounter must be called. This requires
+	// access to the TPM, so it is not supported by SealKeyToExternalTPMStorageKey.
+	BootAttemptLimit *BootAttemptLimit
 }
 
 // SealKeyToExternalTPMStorageKey seals the supplied disk encryption key to the TPM storage key associated with the supplied public
@@ -178,8 +234,9 @@ type KeyCreationParams struct {
 // *os.PathError error will be returned with an underlying error of syscall.EEXIST. A wrapped *os.PathError error will be returned if
 // the file cannot be created and opened for writing.
 //
-// This function cannot create a sealed key that uses a PCR policy counter. The PCRPolicyCounterHandle field of the params argument
-// must be tpm2.HandleNull.
+// This function cannot create a sealed key that uses a PCR policy counter, a PCR policy validity window or a boot attempt
+// limit. The PCRPolicyCounterHandle field of the params argument must be tpm2.HandleNull, and the PCRPolicyValidity and
+// BootAttemptLimit fields must be nil.
 //
 // The key will be protected with a PCR policy computed from the PCRProtectionProfile supplied via the PCRProfile field of the params
 // argument.
@@ -206,7 +263,12 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 		return nil, errors.New("PCRPolicyCounter must be tpm2.HandleNull when creating an importable sealed key")
 	}
 
-	succeeded := false
+	if params.PCRPolicyValidity != nil {
+		return nil, errors.New("PCRPolicyValidity must be nil when creating an importable sealed key")
+	}
+	if params.BootAttemptLimit != nil {
+		return nil, errors.New("BootAttemptLimit must be nil when creating an importable sealed key")
+	}
 
 	// Compute metadata.
 
@@ -223,28 +285,41 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 			return nil, xerrors.Errorf("cannot generate key for signing dynamic authorization policies: %w", err)
 		}
 	}
+
+	if err := sealKeyToExternalTPMStorageKey(tpmKey, key, keyPath, goAuthKey, params.PCRProfile); err != nil {
+		return nil, err
+	}
+
+	return goAuthKey.D.Bytes(), nil
+}
+
+// sealKeyToExternalTPMStorageKey creates an importable sealed key object for the supplied disk encryption key and
+// the TPM storage key associated with the supplied public tpmKey, and writes it to a new file at the specified path.
+// The supplied authKey is used for authorizing PCR policy updates.
+func sealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath string, goAuthKey *ecdsa.PrivateKey, pcrProfile *PCRProtectionProfile) error {
+	succeeded := false
+
 	authPublicKey := createTPMPublicAreaForECDSAKey(&goAuthKey.PublicKey)
-	authKey = goAuthKey.D.Bytes()
+	authKey := PolicyAuthKey(goAuthKey.D.Bytes())
 
 	pub := makeImportableSealedKeyTemplate()
 
 	// Compute the static policy - this never changes for the lifetime of this key file
 	staticPolicyData, authPolicy, err := computeStaticPolicy(pub.NameAlg, &staticPolicyComputeParams{key: authPublicKey})
 	if err != nil {
-		return nil, xerrors.Errorf("cannot compute static authorization policy: %w", err)
+		return xerrors.Errorf("cannot compute static authorization policy: %w", err)
 	}
 
 	pub.AuthPolicy = authPolicy
 
 	// Create a dynamic authorization policy
-	pcrProfile := params.PCRProfile
 	if pcrProfile == nil {
 		pcrProfile = &PCRProtectionProfile{}
 	}
 	dynamicPolicyData, err := computeSealedKeyDynamicAuthPolicy(nil, currentMetadataVersion, pub.NameAlg, authPublicKey.NameAlg,
-		goAuthKey, nil, nil, pcrProfile, nil)
+		goAuthKey, nil, nil, pcrProfile, nil, nil, nil)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
 
 	// Clean up files on failure.
@@ -260,7 +335,7 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 	// Create the destination file
 	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot create key data file: %w", err)
+		return xerrors.Errorf("cannot create key data file: %w", err)
 	}
 	defer f.Close()
 
@@ -277,7 +352,7 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 		SeedValue: make(tpm2.Digest, pub.NameAlg.Size()),
 		Sensitive: &tpm2.SensitiveCompositeU{Bits: sealedData}}
 	if _, err := io.ReadFull(rand.Reader, sensitive.SeedValue); err != nil {
-		return nil, xerrors.Errorf("cannot create seed value: %w", err)
+		return xerrors.Errorf("cannot create seed value: %w", err)
 	}
 
 	// Compute the public ID
@@ -289,7 +364,7 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 	// Now create the importable sealed key object (duplication object).
 	_, priv, importSymSeed, err := util.CreateDuplicationObjectFromSensitive(&sensitive, pub, tpmKey, nil, nil)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot create duplication object: %w", err)
+		return xerrors.Errorf("cannot create duplication object: %w", err)
 	}
 
 	// Marshal the entire object (sealed key object and auxiliary data) to disk
@@ -303,11 +378,11 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 		dynamicPolicyData: dynamicPolicyData}
 
 	if err := data.write(f); err != nil {
-		return nil, xerrors.Errorf("cannot write key data file: %w", err)
+		return xerrors.Errorf("cannot write key data file: %w", err)
 	}
 
 	succeeded = true
-	return authKey, nil
+	return nil
 }
 
 // SealKeyRequest corresponds to a key that should be sealed by SealKeyToTPMMultiple
@@ -337,6 +412,10 @@ type SealKeyRequest struct {
 // reserved TPM 2.0 handles and localities" specification. It is recommended that the handle is in the block reserved for owner
 // objects (0x01800000 - 0x01bfffff).
 //
+// If the BootAttemptLimit field of the params argument is set, this function will also create a NV counter at the handle
+// specified by its CounterHandle field, which is shared by all keys. If the handle is already in use, a TPMResourceExistsError
+// error will be returned.
+//
 // All keys will be created with the same authorization policy, and will be protected with a PCR policy computed from the
 // PCRProtectionProfile supplied via the PCRProfile field of the params argument.
 //
@@ -350,11 +429,49 @@ type SealKeyRequest struct {
 // The authorization key can also be chosen and provided by setting
 // AuthKey in the params argument.
 func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCreationParams) (authKey PolicyAuthKey, err error) {
+	// Clean up files on failure.
+	var created []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, path := range created {
+			os.Remove(path)
+		}
+	}()
+
+	var secrets [][]byte
+	for _, key := range keys {
+		secrets = append(secrets, key.Key)
+	}
+
+	return sealToTPMMultiple(tpm, secrets, params, func(i int, data *keyData) error {
+		path := keys[i].Path
+
+		// Create the destination file
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return xerrors.Errorf("cannot create key data file %s: %w", path, err)
+		}
+		created = append(created, path)
+		defer f.Close()
+
+		if err := data.write(f); err != nil {
+			return xerrors.Errorf("cannot write key data file: %w", err)
+		}
+		return nil
+	})
+}
+
+// sealToTPMMultiple seals the supplied secrets to the storage hierarchy of the TPM with the same authorization policy, and
+// calls the supplied write function with each of the resulting sealed key objects before the PCR policy counter is
+// initialized. If any part of this function fails, any NV indices that it created are removed.
+func sealToTPMMultiple(tpm *Connection, secrets [][]byte, params *KeyCreationParams, write func(i int, data *keyData) error) (authKey PolicyAuthKey, err error) {
 	// params is mandatory.
 	if params == nil {
 		return nil, errors.New("no KeyCreationParams provided")
 	}
-	if len(keys) == 0 {
+	if len(secrets) == 0 {
 		return nil, errors.New("no keys provided")
 	}
 
@@ -430,6 +547,39 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 		}()
 	}
 
+	// Create boot attempt counter, if requested.
+	bootAttempts, err := makeBootAttemptCounterData(params.BootAttemptLimit)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid boot attempt limit: %w", err)
+	}
+	if bootAttempts != nil {
+		bootAttemptCounterPub, err := createBootAttemptCounter(tpm.TPMContext, bootAttempts.CounterHandle, session)
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return nil, TPMResourceExistsError{bootAttempts.CounterHandle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create new boot attempt counter: %w", err)
+		}
+		defer func() {
+			if succeeded {
+				return
+			}
+			index, err := tpm2.CreateNVIndexResourceContextFromPublic(bootAttemptCounterPub)
+			if err != nil {
+				return
+			}
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+		}()
+
+		// A new counter doesn't start from zero, so the baseline is the value it was initialized to.
+		bootAttempts, _, err = bootAttempts.reset(tpm.TPMContext, session)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute initial boot attempt counter baseline: %w", err)
+		}
+	}
+
 	template := makeSealedKeyTemplate()
 
 	// Compute the static policy - this never changes for the lifetime of this key file
@@ -448,35 +598,20 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	if pcrProfile == nil {
 		pcrProfile = &PCRProtectionProfile{}
 	}
+	validity, err := makePCRPolicyValidityData(params.PCRPolicyValidity)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid PCR policy validity window: %w", err)
+	}
 	dynamicPolicyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, currentMetadataVersion, template.NameAlg,
-		authPublicKey.NameAlg, goAuthKey, pcrPolicyCounterPub, nil, pcrProfile, session)
+		authPublicKey.NameAlg, goAuthKey, pcrPolicyCounterPub, nil, pcrProfile, validity, bootAttempts, session)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
 
-	// Clean up files on failure.
-	defer func() {
-		if succeeded {
-			return
-		}
-		for _, key := range keys {
-			os.Remove(key.Path)
-		}
-	}()
-
-	// Seal each key.
-	for _, key := range keys {
-		// Create the destination file
-		f, err := os.OpenFile(key.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-		if err != nil {
-			return nil, xerrors.Errorf("cannot create key data file %s: %w", key.Path, err)
-		}
-		// We'll close this at the end of this loop, but make sure it is closed if the function
-		// returns early
-		defer f.Close()
-
+	// Seal each secret.
+	for i, secret := range secrets {
 		// Create the sensitive data
-		sealedData, err := mu.MarshalToBytes(sealedData{Key: key.Key, AuthPrivateKey: authKey})
+		sealedData, err := mu.MarshalToBytes(sealedData{Key: secret, AuthPrivateKey: authKey})
 		if err != nil {
 			panic(fmt.Sprintf("cannot marshal sensitive data: %v", err))
 		}
@@ -490,7 +625,7 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 			return nil, xerrors.Errorf("cannot create sealed data object for key: %w", err)
 		}
 
-		// Marshal the entire object (sealed key object and auxiliary data) to disk
+		// Marshal the entire object (sealed key object and auxiliary data)
 		data := keyData{
 			version:           currentMetadataVersion,
 			keyPrivate:        priv,
@@ -499,11 +634,9 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 			staticPolicyData:  staticPolicyData,
 			dynamicPolicyData: dynamicPolicyData}
 
-		if err := data.write(f); err != nil {
-			return nil, xerrors.Errorf("cannot write key data file: %w", err)
+		if err := write(i, &data); err != nil {
+			return nil, err
 		}
-
-		f.Close()
 	}
 
 	// Increment the PCR policy counter for the first time.
@@ -540,6 +673,9 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 // reserved TPM 2.0 handles and localities" specification. It is recommended that the handle is in the block reserved for owner
 // objects (0x01800000 - 0x01bfffff).
 //
+// If the BootAttemptLimit field of the params argument is set, this function will also create a NV counter at the handle
+// specified by its CounterHandle field. If the handle is already in use, a TPMResourceExistsError error will be returned.
+//
 // The key will be protected with a PCR policy computed from the PCRProtectionProfile supplied via the PCRProfile field of the params
 // argument.
 //
@@ -554,27 +690,30 @@ func SealKeyToTPM(tpm *Connection, key []byte, keyPath string, params *KeyCreati
 	return SealKeyToTPMMultiple(tpm, []*SealKeyRequest{{Key: key, Path: keyPath}}, params)
 }
 
-func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyObject, authKey crypto.PrivateKey, pcrProfile *PCRProtectionProfile, session tpm2.SessionContext) error {
+// validateRelatedKeys validates the supplied sealed key objects and checks that they are all related to the first
+// one. If authKey is supplied, it is checked that it matches the dynamic authorization policy signing key. On success,
+// it returns the validated public area of the PCR policy counter.
+func validateRelatedKeys(tpm *tpm2.TPMContext, keys []*SealedKeyObject, authKey crypto.PrivateKey, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
 	primaryData := keys[0].data
 
 	// Validate the primary key object
 	pcrPolicyCounterPub, err := primaryData.validate(tpm, authKey, session)
 	if err != nil {
 		if isKeyFileError(err) {
-			return InvalidKeyFileError{err.Error()}
+			return nil, InvalidKeyFileError{err.Error()}
 		}
 		// FIXME: Turn the missing lock NV index in to ErrTPMProvisioning
-		return xerrors.Errorf("cannot validate key data: %w", err)
+		return nil, xerrors.Errorf("cannot validate key data: %w", err)
 	}
 
 	// Validate secondary key objects and make sure they are related
 	for i, k := range keys[1:] {
 		if _, err := k.data.validate(tpm, nil, session); err != nil {
 			if isKeyFileError(err) {
-				return InvalidKeyFileError{fmt.Sprintf("%v (%d)", err.Error(), i)}
+				return nil, InvalidKeyFileError{fmt.Sprintf("%v (%d)", err.Error(), i)}
 			}
 			// FIXME: Turn the missing lock NV index in to ErrTPMProvisioning
-			return xerrors.Errorf("cannot validate related key data: %w", err)
+			return nil, xerrors.Errorf("cannot validate related key data: %w", err)
 		}
 		// The metadata is valid and consistent with the object's static authorization policy.
 		// Verify that it also has the same static authorization policy as the first key object passed
@@ -582,10 +721,21 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyO
 		// and dynamic authorization policy signing key, so this is the only check required to determine
 		// if 2 keys are related.
 		if !bytes.Equal(k.data.keyPublic.AuthPolicy, primaryData.keyPublic.AuthPolicy) {
-			return InvalidKeyFileError{fmt.Sprintf("key data at index %d is not related to the primary key data", i)}
+			return nil, InvalidKeyFileError{fmt.Sprintf("key data at index %d is not related to the primary key data", i)}
 		}
 	}
 
+	return pcrPolicyCounterPub, nil
+}
+
+func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyObject, authKey crypto.PrivateKey, pcrProfile *PCRProtectionProfile, session tpm2.SessionContext) error {
+	primaryData := keys[0].data
+
+	pcrPolicyCounterPub, err := validateRelatedKeys(tpm, keys, authKey, session)
+	if err != nil {
+		return err
+	}
+
 	authPublicKey := primaryData.staticPolicyData.authPublicKey
 	v0PinIndexAuthPolicies := primaryData.staticPolicyData.v0PinIndexAuthPolicies
 
@@ -594,7 +744,8 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyO
 		pcrProfile = &PCRProtectionProfile{}
 	}
 	policyData, err := computeSealedKeyDynamicAuthPolicy(tpm, primaryData.version, primaryData.keyPublic.NameAlg, authPublicKey.NameAlg, authKey,
-		pcrPolicyCounterPub, v0PinIndexAuthPolicies, pcrProfile, session)
+		pcrPolicyCounterPub, v0PinIndexAuthPolicies, pcrProfile, primaryData.dynamicPolicyData.validity,
+		primaryData.dynamicPolicyData.bootAttempts, session)
 	if err != nil {
 		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
@@ -603,7 +754,7 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyO
 	for _, k := range keys {
 		k.data.dynamicPolicyData = policyData
 
-		if err := k.data.writeToFileAtomic(k.path); err != nil {
+		if err := k.persist(); err != nil {
 			return xerrors.Errorf("cannot write key data file: %v", err)
 		}
 	}
@@ -655,7 +806,9 @@ func (k *SealedKeyObject) UpdatePCRProtectionPolicyV0(tpm *Connection, policyUpd
 //
 // On success, the sealed key data file is updated atomically with an updated authorization policy that includes a PCR policy
 // computed from the supplied PCRProtectionProfile. If the sealed key data file was created with a PCR policy counter, the
-// previous PCR policy will be revoked.
+// previous PCR policy will be revoked. If the sealed key data file was created with a PCR policy validity window, the
+// window is renewed from the TPM's current clock. If the sealed key data file was created with a boot attempt limit, it
+// is preserved without resetting the boot attempt counter - this is done with SealedKeyObject.ResetBootAttemptCounter.
 func (k *SealedKeyObject) UpdatePCRProtectionPolicy(tpm *Connection, authKey PolicyAuthKey, pcrProfile *PCRProtectionProfile) error {
 	ecdsaAuthKey, err := createECDSAPrivateKeyFromTPM(k.data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authKey))
 	if err != nil {
@@ -0,0 +1,189 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	sealedSecretHeader uint32 = 0x55534b53
+
+	sealedSecretKeySize = 32 // AES-256
+)
+
+// sealedSecretRaw_v0 is version 0 of the serialized format of the encrypted part of SealedSecretObject. It is
+// followed by the serialized sealed key object.
+type sealedSecretRaw_v0 struct {
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// SealedSecretObject corresponds to a secret sealed with SealSecretToTPM. As the TPM can only seal small amounts
+// of data, the secret is encrypted with a randomly generated AES-256-GCM key, and this key is sealed in the embedded
+// SealedKeyObject. The embedded SealedKeyObject can be used to update the PCR policy or PIN, after which the updated
+// object must be written with SealedSecretObject.Write.
+//
+// Note that unsealing the embedded SealedKeyObject directly (eg, via SealedKeyObject.BeginRecovery) produces the key
+// used to encrypt the secret rather than the secret itself.
+type SealedSecretObject struct {
+	*SealedKeyObject
+	nonce      []byte
+	ciphertext []byte
+}
+
+// ReadSealedSecretObject loads a sealed secret object created by SealSecretToTPM from the supplied io.Reader. If the
+// sealed secret object cannot be deserialized successfully, a InvalidKeyFileError error will be returned.
+func ReadSealedSecretObject(r io.Reader) (*SealedSecretObject, error) {
+	var header uint32
+	if _, err := mu.UnmarshalFromReader(r, &header); err != nil {
+		return nil, InvalidKeyFileError{fmt.Sprintf("cannot unmarshal header: %v", err)}
+	}
+	if header != sealedSecretHeader {
+		return nil, InvalidKeyFileError{fmt.Sprintf("unexpected header (%d)", header)}
+	}
+
+	var version uint32
+	if _, err := mu.UnmarshalFromReader(r, &version); err != nil {
+		return nil, InvalidKeyFileError{fmt.Sprintf("cannot unmarshal version number: %v", err)}
+	}
+
+	switch version {
+	case 0:
+		var raw sealedSecretRaw_v0
+		if _, err := mu.UnmarshalFromReader(r, &raw); err != nil {
+			return nil, InvalidKeyFileError{fmt.Sprintf("cannot unmarshal data: %v", err)}
+		}
+		k, err := ReadSealedKeyObjectFromReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &SealedSecretObject{SealedKeyObject: k, nonce: raw.Nonce, ciphertext: raw.Ciphertext}, nil
+	default:
+		return nil, InvalidKeyFileError{fmt.Sprintf("unexpected version number (%d)", version)}
+	}
+}
+
+// Write serializes this sealed secret object to the supplied io.Writer. This is required to persist changes made to
+// the embedded SealedKeyObject, such as by SealedKeyObject.UpdatePCRProtectionPolicy or SealedKeyObject.ChangePIN.
+func (s *SealedSecretObject) Write(w io.Writer) error {
+	raw := sealedSecretRaw_v0{Nonce: s.nonce, Ciphertext: s.ciphertext}
+	if _, err := mu.MarshalToWriter(w, sealedSecretHeader, uint32(0), raw); err != nil {
+		return xerrors.Errorf("cannot marshal data: %w", err)
+	}
+	return s.SealedKeyObject.Write(w)
+}
+
+// UnsealFromTPM unseals the key used to encrypt this secret from the TPM and uses it to decrypt the secret. The errors
+// that can be returned are the same as those returned from SealedKeyObject.UnsealFromTPM. If the secret cannot be
+// decrypted, a InvalidKeyFileError error will be returned.
+//
+// On success, the secret is returned as the first return value, and the private part of the key used for authorizing
+// PCR policy updates is returned as the second return value.
+func (s *SealedSecretObject) UnsealFromTPM(tpm *Connection, pin string) (secret []byte, authKey PolicyAuthKey, err error) {
+	key, authKey, err := s.SealedKeyObject.UnsealFromTPM(tpm, pin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(key) != sealedSecretKeySize {
+		return nil, nil, InvalidKeyFileError{"unexpected secret encryption key size"}
+	}
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create AEAD cipher: %w", err)
+	}
+	if len(s.nonce) != aead.NonceSize() {
+		return nil, nil, InvalidKeyFileError{"invalid nonce size"}
+	}
+
+	secret, err = aead.Open(nil, s.nonce, s.ciphertext, nil)
+	if err != nil {
+		return nil, nil, InvalidKeyFileError{fmt.Sprintf("cannot decrypt secret: %v", err)}
+	}
+	return secret, authKey, nil
+}
+
+// SealSecretToTPM seals an arbitrary secret, such as a SSH host key or a service credential, to the storage hierarchy of the
+// TPM, and writes the resulting sealed secret object to the supplied io.Writer. This is the same as SealKeyToTPM except that it
+// isn't tied to a file, so that secrets can be bound to the same measured boot policy as a disk encryption key and stored
+// anywhere. The sealed secret object can be loaded again with ReadSealedSecretObject and the secret unsealed with
+// SealedSecretObject.UnsealFromTPM.
+//
+// As the TPM limits the size of sealed data objects to 128 bytes, the secret isn't sealed directly. Instead, a randomly
+// generated AES-256-GCM key is sealed to the TPM and the secret is encrypted with this key and written alongside it. The
+// secret can be up to 65519 bytes long.
+//
+// The params argument and the TPM resources that this function creates have the same semantics as for SealKeyToTPM. A PIN
+// can be set with SealedKeyObject.ChangePIN and the PCR policy can be updated with SealedKeyObject.UpdatePCRProtectionPolicy,
+// after which the updated sealed secret object must be written with SealedSecretObject.Write.
+//
+// If this function returns an error, anything that was written to w should be discarded.
+//
+// On success, this function returns the private part of the key used for authorizing PCR policy updates.
+func SealSecretToTPM(tpm *Connection, secret []byte, w io.Writer, params *KeyCreationParams) (authKey PolicyAuthKey, err error) {
+	key := make([]byte, sealedSecretKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, xerrors.Errorf("cannot obtain secret encryption key: %w", err)
+	}
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create AEAD cipher: %w", err)
+	}
+	if len(secret) > math.MaxUint16-aead.Overhead() {
+		return nil, errors.New("secret is too large")
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, xerrors.Errorf("cannot obtain nonce: %w", err)
+	}
+
+	sealed := &SealedSecretObject{
+		nonce:      nonce,
+		ciphertext: aead.Seal(nil, nonce, secret, nil)}
+
+	return sealToTPMMultiple(tpm, [][]byte{key}, params, func(_ int, data *keyData) error {
+		sealed.SealedKeyObject = &SealedKeyObject{data: data}
+		if err := sealed.Write(w); err != nil {
+			return xerrors.Errorf("cannot write sealed secret object: %w", err)
+		}
+		return nil
+	})
+}
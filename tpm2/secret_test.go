@@ -0,0 +1,201 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestSealedKeyObjectReadWrite(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_TestSealedKeyObjectReadWrite_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Create a sealed key object for a storage key that only exists in software.
+	storageKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := tpm2.Public{
+		Type:    tpm2.ObjectTypeECC,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrRestricted | tpm2.AttrDecrypt,
+		Params: &tpm2.PublicParamsU{
+			ECCDetail: &tpm2.ECCParams{
+				Symmetric: tpm2.SymDefObject{
+					Algorithm: tpm2.SymObjectAlgorithmAES,
+					KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+					Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}},
+				Scheme:  tpm2.ECCScheme{Scheme: tpm2.ECCSchemeNull},
+				CurveID: tpm2.ECCCurveNIST_P256,
+				KDF:     tpm2.KDFScheme{Scheme: tpm2.KDFAlgorithmNull}}},
+		Unique: &tpm2.PublicIDU{ECC: &tpm2.ECCPoint{X: storageKey.X.Bytes(), Y: storageKey.Y.Bytes()}}}
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToExternalTPMStorageKey(&template, []byte("secret"), keyFile, &KeyCreationParams{PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToExternalTPMStorageKey failed: %v", err)
+	}
+
+	f, err := os.Open(keyFile)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+
+	k, err := ReadSealedKeyObjectFromReader(f)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromReader failed: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := k.Write(&b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	k2, err := ReadSealedKeyObjectFromReader(&b)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromReader failed: %v", err)
+	}
+	if k2.Version() != k.Version() || k2.PCRPolicyCounterHandle() != k.PCRPolicyCounterHandle() {
+		t.Errorf("Unexpected sealed key object")
+	}
+
+	if _, err := ReadSealedKeyObjectFromReader(bytes.NewReader([]byte("foo"))); err == nil {
+		t.Errorf("ReadSealedKeyObjectFromReader should fail with invalid data")
+	} else if _, ok := err.(InvalidKeyFileError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSealSecretToTPM(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	// This is larger than the maximum size of a sealed data object.
+	secret := make([]byte, 200)
+	rand.Read(secret)
+
+	var b bytes.Buffer
+	authKey, err := SealSecretToTPM(tpm, secret, &b, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealSecretToTPM failed: %v", err)
+	}
+	defer func() {
+		index, err := tpm.CreateResourceContextFromTPM(0x01810000)
+		if err != nil {
+			t.Errorf("CreateResourceContextFromTPM failed: %v", err)
+			return
+		}
+		undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+	}()
+
+	k, err := ReadSealedSecretObject(&b)
+	if err != nil {
+		t.Fatalf("ReadSealedSecretObject failed: %v", err)
+	}
+
+	unsealed, unsealedAuthKey, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(unsealed, secret) {
+		t.Errorf("Unexpected secret")
+	}
+	if !bytes.Equal(unsealedAuthKey, authKey) {
+		t.Errorf("Unexpected auth key")
+	}
+
+	// Updates only modify the sealed key object in memory, and must be written by the caller.
+	if err := k.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+	if err := k.ChangePIN(tpm, "", "1234"); err != nil {
+		t.Fatalf("ChangePIN failed: %v", err)
+	}
+	b.Reset()
+	if err := k.Write(&b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	k, err = ReadSealedSecretObject(&b)
+	if err != nil {
+		t.Fatalf("ReadSealedSecretObject failed: %v", err)
+	}
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != ErrPINFail {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	unsealed, _, err = k.UnsealFromTPM(tpm, "1234")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(unsealed, secret) {
+		t.Errorf("Unexpected secret")
+	}
+}
+
+func TestReadSealedSecretObjectInvalid(t *testing.T) {
+	for _, data := range []struct {
+		desc string
+		data []byte
+		err  string
+	}{
+		{
+			desc: "InvalidHeader",
+			data: []byte{0x55, 0x53, 0x4b, 0x24, 0, 0, 0, 0},
+			err:  "invalid key data file: unexpected header (1431522084)",
+		},
+		{
+			desc: "InvalidVersion",
+			data: []byte{0x55, 0x53, 0x4b, 0x53, 0, 0, 0, 1},
+			err:  "invalid key data file: unexpected version number (1)",
+		},
+		{
+			desc: "Truncated",
+			data: []byte{0x55, 0x53, 0x4b, 0x53, 0, 0, 0, 0, 0, 12},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			_, err := ReadSealedSecretObject(bytes.NewReader(data.data))
+			if _, ok := err.(InvalidKeyFileError); !ok {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if data.err != "" && err.Error() != data.err {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
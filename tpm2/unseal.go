@@ -28,6 +28,83 @@ import (
 	"github.com/snapcore/secboot/internal/tcg"
 )
 
+// loadForUnseal checks that the TPM isn't in lockout mode and then loads the sealed key object in to the TPM,
+// mapping errors to ErrTPMLockout, ErrTPMProvisioning or InvalidKeyFileError where appropriate.
+func (k *SealedKeyObject) loadForUnseal(tpm *Connection) (tpm2.ResourceContext, error) {
+	// Check if the TPM is in lockout mode
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch properties from TPM: %w", err)
+	}
+
+	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0 {
+		return nil, ErrTPMLockout
+	}
+
+	// Load the key data
+	keyObject, err := k.data.load(tpm.TPMContext, tpm.HmacSession())
+	switch {
+	case isKeyFileError(err):
+		// A keyFileError can be as a result of an improperly provisioned TPM - detect if the object at tcg.SRKHandle is a valid primary key
+		// with the correct attributes. If it's not, then it's definitely a provisioning error. If it is, then it could still be a
+		// provisioning error because we don't know if the object was created with the same template that ProvisionTPM uses. In that case,
+		// we'll just assume an invalid key file
+		srk, err2 := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err2, tcg.SRKHandle):
+			return nil, ErrTPMProvisioning
+		case err2 != nil:
+			return nil, xerrors.Errorf("cannot create context for SRK: %w", err2)
+		}
+		ok, err2 := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, tcg.SRKTemplate, tpm.HmacSession())
+		switch {
+		case err2 != nil:
+			return nil, xerrors.Errorf("cannot determine if object at 0x%08x is a primary key in the storage hierarchy: %w", tcg.SRKHandle, err2)
+		case !ok:
+			return nil, ErrTPMProvisioning
+		}
+		// This is probably a broken key file, but it could still be a provisioning error because we don't know if the SRK object was
+		// created with the same template that ProvisionTPM uses.
+		return nil, InvalidKeyFileError{err.Error()}
+	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
+		return nil, ErrTPMProvisioning
+	case err != nil:
+		return nil, err
+	}
+
+	return keyObject, nil
+}
+
+// unsealWithPolicySession unseals the supplied loaded sealed key object using the supplied policy session, which
+// must have already been used to execute a branch of the object's authorization policy.
+func (k *SealedKeyObject) unsealWithPolicySession(tpm *Connection, keyObject tpm2.ResourceContext, policySession tpm2.SessionContext, pin string) (key []byte, authKey PolicyAuthKey, err error) {
+	// For metadata version > 0, the PIN is the auth value for the sealed key object, and the authorization
+	// policy asserts that this value is known when the policy session is used.
+	keyObject.SetAuthValue([]byte(pin))
+
+	// Unseal
+	keyData, err := tpm.Unseal(keyObject, policySession, tpm.HmacSession().IncludeAttrs(tpm2.AttrResponseEncrypt))
+	switch {
+	case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandUnseal, 1):
+		return nil, nil, InvalidKeyFileError{"the authorization policy check failed during unsealing"}
+	case isAuthFailError(err, tpm2.CommandUnseal, 1):
+		return nil, nil, ErrPINFail
+	case err != nil:
+		return nil, nil, xerrors.Errorf("cannot unseal key: %w", err)
+	}
+
+	if k.data.version == 0 {
+		return keyData, nil, nil
+	}
+
+	var sealedData sealedData
+	if _, err := mu.UnmarshalFromBytes(keyData, &sealedData); err != nil {
+		return nil, nil, InvalidKeyFileError{err.Error()}
+	}
+
+	return sealedData.Key, sealedData.AuthPrivateKey, nil
+}
+
 // UnsealFromTPM will load the TPM sealed object in to the TPM and attempt to unseal it, returning the cleartext key on success.
 // If a PIN has been set, the correct PIN must be provided via the pin argument. If the wrong PIN is provided, a ErrPINFail error
 // will be returned, and the TPM's dictionary attack counter will be incremented.
@@ -60,6 +137,9 @@ import (
 // If the metadata for the updatable part of the key file's authorization policy is not consistent with the approved policy, then a
 // InvalidKeyFileError error will be returned.
 //
+// If the key file has a boot attempt limit and the maximum number of unseal attempts have been made since the boot attempt
+// counter was last reset, a ErrBootAttemptLimitReached error will be returned.
+//
 // If the provided PIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter will be
 // incremented.
 //
@@ -70,51 +150,15 @@ import (
 // On success, the unsealed cleartext key is returned as the first return value, and the private part of the key used for
 // authorizing PCR policy updates with UpdateKeyPCRProtectionPolicy is returned as the second return value.
 func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection, pin string) (key []byte, authKey PolicyAuthKey, err error) {
-	// Check if the TPM is in lockout mode
-	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	keyObject, err := k.loadForUnseal(tpm)
 	if err != nil {
-		return nil, nil, xerrors.Errorf("cannot fetch properties from TPM: %w", err)
-	}
-
-	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0 {
-		return nil, nil, ErrTPMLockout
+		return nil, nil, err
 	}
+	defer tpm.FlushContext(keyObject)
 
 	// Use the HMAC session created when the connection was opened for parameter encryption rather than creating a new one.
 	hmacSession := tpm.HmacSession()
 
-	// Load the key data
-	keyObject, err := k.data.load(tpm.TPMContext, hmacSession)
-	switch {
-	case isKeyFileError(err):
-		// A keyFileError can be as a result of an improperly provisioned TPM - detect if the object at tcg.SRKHandle is a valid primary key
-		// with the correct attributes. If it's not, then it's definitely a provisioning error. If it is, then it could still be a
-		// provisioning error because we don't know if the object was created with the same template that ProvisionTPM uses. In that case,
-		// we'll just assume an invalid key file
-		srk, err2 := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
-		switch {
-		case tpm2.IsResourceUnavailableError(err2, tcg.SRKHandle):
-			return nil, nil, ErrTPMProvisioning
-		case err2 != nil:
-			return nil, nil, xerrors.Errorf("cannot create context for SRK: %w", err2)
-		}
-		ok, err2 := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, tcg.SRKTemplate, tpm.HmacSession())
-		switch {
-		case err2 != nil:
-			return nil, nil, xerrors.Errorf("cannot determine if object at 0x%08x is a primary key in the storage hierarchy: %w", tcg.SRKHandle, err2)
-		case !ok:
-			return nil, nil, ErrTPMProvisioning
-		}
-		// This is probably a broken key file, but it could still be a provisioning error because we don't know if the SRK object was
-		// created with the same template that ProvisionTPM uses.
-		return nil, nil, InvalidKeyFileError{err.Error()}
-	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
-		return nil, nil, ErrTPMProvisioning
-	case err != nil:
-		return nil, nil, err
-	}
-	defer tpm.FlushContext(keyObject)
-
 	// Begin and execute policy session
 	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.keyPublic.NameAlg)
 	if err != nil {
@@ -122,9 +166,21 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection, pin string) (key []byte
 	}
 	defer tpm.FlushContext(policySession)
 
+	// Record this attempt before executing the policy session so that it counts even if unsealing fails.
+	if bootAttempts := k.data.dynamicPolicyData.bootAttempts; bootAttempts != nil {
+		if err := bootAttempts.recordAttempt(tpm.TPMContext, hmacSession); err != nil {
+			if isDynamicPolicyDataError(err) {
+				return nil, nil, InvalidKeyFileError{err.Error()}
+			}
+			return nil, nil, xerrors.Errorf("cannot record unseal attempt: %w", err)
+		}
+	}
+
 	if err := executePolicySession(tpm.TPMContext, policySession, k.data.version, k.data.staticPolicyData, k.data.dynamicPolicyData, pin, hmacSession); err != nil {
 		err = xerrors.Errorf("cannot complete authorization policy assertions: %w", err)
 		switch {
+		case xerrors.Is(err, ErrBootAttemptLimitReached):
+			return nil, nil, ErrBootAttemptLimitReached
 		case isDynamicPolicyDataError(err):
 			// TODO: Add a separate error for this
 			return nil, nil, InvalidKeyFileError{err.Error()}
@@ -138,29 +194,5 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection, pin string) (key []byte
 		return nil, nil, err
 	}
 
-	// For metadata version > 0, the PIN is the auth value for the sealed key object, and the authorization
-	// policy asserts that this value is known when the policy session is used.
-	keyObject.SetAuthValue([]byte(pin))
-
-	// Unseal
-	keyData, err := tpm.Unseal(keyObject, policySession, hmacSession.IncludeAttrs(tpm2.AttrResponseEncrypt))
-	switch {
-	case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandUnseal, 1):
-		return nil, nil, InvalidKeyFileError{"the authorization policy check failed during unsealing"}
-	case isAuthFailError(err, tpm2.CommandUnseal, 1):
-		return nil, nil, ErrPINFail
-	case err != nil:
-		return nil, nil, xerrors.Errorf("cannot unseal key: %w", err)
-	}
-
-	if k.data.version == 0 {
-		return keyData, nil, nil
-	}
-
-	var sealedData sealedData
-	if _, err := mu.UnmarshalFromBytes(keyData, &sealedData); err != nil {
-		return nil, nil, InvalidKeyFileError{err.Error()}
-	}
-
-	return sealedData.Key, sealedData.AuthPrivateKey, nil
+	return k.unsealWithPolicySession(tpm, keyObject, policySession, pin)
 }
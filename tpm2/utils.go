@@ -21,8 +21,11 @@ package tpm2
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
 	"errors"
 	"fmt"
 	"math/big"
@@ -194,6 +197,61 @@ func createECDSAPrivateKeyFromTPM(public *tpm2.Public, private tpm2.ECCParameter
 		D: new(big.Int).SetBytes(private)}, nil
 }
 
+// signDigestWithECDSASigner signs the supplied digest with the supplied crypto.Signer, which must correspond
+// to the ECC key described by authPublicKey. The digest algorithm is the name algorithm of authPublicKey. The
+// signer must produce signatures in the ASN.1 format produced by *ecdsa.PrivateKey.
+func signDigestWithECDSASigner(signer crypto.Signer, authPublicKey *tpm2.Public, digest []byte) (*tpm2.Signature, error) {
+	expected, err := createECDSAPrivateKeyFromTPM(authPublicKey, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create authorization key: %w", err)
+	}
+	pubKey, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok || pubKey.Curve != expected.Curve || pubKey.X.Cmp(expected.X) != 0 || pubKey.Y.Cmp(expected.Y) != 0 {
+		return nil, errors.New("signer doesn't correspond to the PCR policy authorization key")
+	}
+
+	sig, err := signer.Sign(rand.Reader, digest, authPublicKey.NameAlg.GetHash())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign digest: %w", err)
+	}
+
+	var ecdsaSig struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(sig, &ecdsaSig); err != nil {
+		return nil, xerrors.Errorf("cannot decode signature: %w", err)
+	} else if len(rest) > 0 {
+		return nil, errors.New("cannot decode signature: trailing bytes")
+	}
+
+	return &tpm2.Signature{
+		SigAlg: tpm2.SigSchemeAlgECDSA,
+		Signature: &tpm2.SignatureU{
+			ECDSA: &tpm2.SignatureECDSA{
+				Hash:       authPublicKey.NameAlg,
+				SignatureR: ecdsaSig.R.Bytes(),
+				SignatureS: ecdsaSig.S.Bytes()}}}, nil
+}
+
+// verifyECDSASignature checks that sig is a valid signature of digest by the ECC key described by
+// authPublicKey, using the name algorithm of authPublicKey as the digest algorithm.
+func verifyECDSASignature(authPublicKey *tpm2.Public, digest []byte, sig *tpm2.Signature) error {
+	if sig.SigAlg != tpm2.SigSchemeAlgECDSA || sig.Signature.ECDSA.Hash != authPublicKey.NameAlg {
+		return errors.New("unexpected signature scheme")
+	}
+
+	key, err := createECDSAPrivateKeyFromTPM(authPublicKey, nil)
+	if err != nil {
+		return xerrors.Errorf("cannot create authorization key: %w", err)
+	}
+	r := new(big.Int).SetBytes(sig.Signature.ECDSA.SignatureR)
+	s := new(big.Int).SetBytes(sig.Signature.ECDSA.SignatureS)
+	if !ecdsa.Verify(&key.PublicKey, digest, r, s) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
 // digestListContains indicates whether the specified digest is present in the list of digests.
 func digestListContains(list tpm2.DigestList, digest tpm2.Digest) bool {
 	for _, d := range list {
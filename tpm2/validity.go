@@ -0,0 +1,169 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// Offsets of fields in TPMS_TIME_INFO, used for TPM2_PolicyCounterTimer assertions.
+	timeInfoClockOffset      uint16 = 8
+	timeInfoResetCountOffset uint16 = 16
+)
+
+// PCRPolicyValidity describes a validity window for the PCR policy of a sealed key object. Once the window has passed,
+// the sealed key object can no longer be unsealed until its PCR policy is updated with
+// SealedKeyObject.UpdatePCRProtectionPolicy (or one of the related functions), which renews the window using the same
+// parameters.
+type PCRPolicyValidity struct {
+	// Duration is how long the PCR policy remains valid for after it is computed. This is measured by the TPM's clock,
+	// which only advances whilst the TPM is powered on. If this is zero, the PCR policy doesn't expire. It has a
+	// resolution of 1 millisecond.
+	Duration time.Duration
+
+	// LimitResets indicates that the PCR policy stops being valid after the number of TPM resets specified by MaxResets.
+	LimitResets bool
+
+	// MaxResets is the number of TPM resets (which normally correspond to reboots) after the PCR policy is computed for
+	// which it remains valid, if LimitResets is true. If this is zero, the PCR policy is only valid until the next
+	// TPM reset.
+	MaxResets uint32
+}
+
+// pcrPolicyValidityData corresponds to the validity window of a PCR policy, and is part of dynamicPolicyData. It
+// contains the parameters supplied via PCRPolicyValidity so that the window can be renewed, as well as the limits
+// computed from the TPM's clock when the PCR policy was computed.
+type pcrPolicyValidityData struct {
+	Duration    uint64 // Validity period in milliseconds, or zero for no limit
+	LimitResets bool
+	MaxResets   uint32
+
+	ClockLimit      uint64 // The TPM clock value at which the PCR policy expires
+	ResetCountLimit uint32 // The maximum TPM reset count for which the PCR policy is valid
+}
+
+// makePCRPolicyValidityData converts the supplied PCRPolicyValidity in to a pcrPolicyValidityData without any computed
+// limits. This returns nil if v doesn't define a validity window.
+func makePCRPolicyValidityData(v *PCRPolicyValidity) (*pcrPolicyValidityData, error) {
+	if v == nil || (v.Duration == 0 && !v.LimitResets) {
+		return nil, nil
+	}
+	if v.Duration < 0 {
+		return nil, errors.New("invalid duration")
+	}
+	return &pcrPolicyValidityData{
+		Duration:    uint64(v.Duration / time.Millisecond),
+		LimitResets: v.LimitResets,
+		MaxResets:   v.MaxResets}, nil
+}
+
+// isEmpty indicates whether this doesn't define a validity window.
+func (d *pcrPolicyValidityData) isEmpty() bool {
+	return d.Duration == 0 && !d.LimitResets
+}
+
+// computeLimits returns a copy of this validity window with the limits computed from the supplied TPM clock information.
+func (d *pcrPolicyValidityData) computeLimits(clockInfo *tpm2.ClockInfo) (*pcrPolicyValidityData, error) {
+	out := *d
+	out.ClockLimit = 0
+	out.ResetCountLimit = 0
+
+	if d.Duration > 0 {
+		if clockInfo.Clock > math.MaxUint64-d.Duration {
+			return nil, errors.New("duration is too large")
+		}
+		out.ClockLimit = clockInfo.Clock + d.Duration
+	}
+	if d.LimitResets {
+		if clockInfo.ResetCount > math.MaxUint32-d.MaxResets {
+			return nil, errors.New("maximum number of resets is too large")
+		}
+		out.ResetCountLimit = clockInfo.ResetCount + d.MaxResets
+	}
+
+	return &out, nil
+}
+
+// hasExpired indicates whether the computed limits of this validity window have passed according to the supplied TPM clock
+// information.
+func (d *pcrPolicyValidityData) hasExpired(clockInfo *tpm2.ClockInfo) bool {
+	return (d.Duration > 0 && clockInfo.Clock >= d.ClockLimit) || (d.LimitResets && clockInfo.ResetCount > d.ResetCountLimit)
+}
+
+// computeValidityWindowLimits reads the TPM's clock and returns a copy of the supplied validity window with the limits
+// computed from it.
+func computeValidityWindowLimits(tpm *tpm2.TPMContext, validity *pcrPolicyValidityData, session tpm2.SessionContext) (*pcrPolicyValidityData, error) {
+	timeInfo, err := tpm.ReadClock(session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read clock: %w", err)
+	}
+	return validity.computeLimits(&timeInfo.ClockInfo)
+}
+
+// counterTimerAssertion describes a single TPM2_PolicyCounterTimer assertion.
+type counterTimerAssertion struct {
+	operandB  tpm2.Operand
+	offset    uint16
+	operation tpm2.ArithmeticOp
+}
+
+// assertions returns the TPM2_PolicyCounterTimer assertions that enforce the computed limits of this validity window.
+func (d *pcrPolicyValidityData) assertions() (out []counterTimerAssertion) {
+	if d.Duration > 0 {
+		operandB := make(tpm2.Operand, 8)
+		binary.BigEndian.PutUint64(operandB, d.ClockLimit)
+		out = append(out, counterTimerAssertion{operandB: operandB, offset: timeInfoClockOffset, operation: tpm2.OpUnsignedLT})
+	}
+	if d.LimitResets {
+		operandB := make(tpm2.Operand, 4)
+		binary.BigEndian.PutUint32(operandB, d.ResetCountLimit)
+		out = append(out, counterTimerAssertion{operandB: operandB, offset: timeInfoResetCountOffset, operation: tpm2.OpUnsignedLE})
+	}
+	return out
+}
+
+// trialPolicyAssertions adds the assertions that enforce this validity window to the supplied trial policy.
+func (d *pcrPolicyValidityData) trialPolicyAssertions(trial *util.TrialAuthPolicy) {
+	for _, a := range d.assertions() {
+		trial.PolicyCounterTimer(a.operandB, a.offset, a.operation)
+	}
+}
+
+// executeAssertions executes the assertions that enforce this validity window in the supplied policy session.
+func (d *pcrPolicyValidityData) executeAssertions(tpm *tpm2.TPMContext, policySession tpm2.SessionContext) error {
+	for _, a := range d.assertions() {
+		if err := tpm.PolicyCounterTimer(policySession, a.operandB, a.offset, a.operation); err != nil {
+			if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyCounterTimer) {
+				return dynamicPolicyDataError{errors.New("the PCR policy has expired")}
+			}
+			return xerrors.Errorf("PCR policy validity check failed: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestMakePCRPolicyValidityData(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		validity *PCRPolicyValidity
+		expected *PCRPolicyValidityData
+	}{
+		{
+			desc: "Nil",
+		},
+		{
+			desc:     "Empty",
+			validity: &PCRPolicyValidity{MaxResets: 5},
+		},
+		{
+			desc:     "Duration",
+			validity: &PCRPolicyValidity{Duration: 2 * time.Hour},
+			expected: &PCRPolicyValidityData{Duration: 7200000},
+		},
+		{
+			desc:     "Resets",
+			validity: &PCRPolicyValidity{LimitResets: true},
+			expected: &PCRPolicyValidityData{LimitResets: true},
+		},
+		{
+			desc:     "Both",
+			validity: &PCRPolicyValidity{Duration: time.Second, LimitResets: true, MaxResets: 3},
+			expected: &PCRPolicyValidityData{Duration: 1000, LimitResets: true, MaxResets: 3},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			validity, err := MakePCRPolicyValidityData(data.validity)
+			if err != nil {
+				t.Fatalf("MakePCRPolicyValidityData failed: %v", err)
+			}
+			if !reflect.DeepEqual(validity, data.expected) {
+				t.Errorf("Unexpected validity data: %#v", validity)
+			}
+		})
+	}
+}
+
+func TestPCRPolicyValidityComputeLimits(t *testing.T) {
+	for _, data := range []struct {
+		desc      string
+		validity  *PCRPolicyValidityData
+		clockInfo *tpm2.ClockInfo
+		expected  *PCRPolicyValidityData
+		err       string
+	}{
+		{
+			desc:      "Duration",
+			validity:  &PCRPolicyValidityData{Duration: 60000},
+			clockInfo: &tpm2.ClockInfo{Clock: 1000000, ResetCount: 10},
+			expected:  &PCRPolicyValidityData{Duration: 60000, ClockLimit: 1060000},
+		},
+		{
+			desc:      "Resets",
+			validity:  &PCRPolicyValidityData{LimitResets: true, MaxResets: 2},
+			clockInfo: &tpm2.ClockInfo{Clock: 1000000, ResetCount: 10},
+			expected:  &PCRPolicyValidityData{LimitResets: true, MaxResets: 2, ResetCountLimit: 12},
+		},
+		{
+			desc:      "Renew",
+			validity:  &PCRPolicyValidityData{Duration: 60000, LimitResets: true, ClockLimit: 5, ResetCountLimit: 1},
+			clockInfo: &tpm2.ClockInfo{Clock: 20000, ResetCount: 3},
+			expected:  &PCRPolicyValidityData{Duration: 60000, LimitResets: true, ClockLimit: 80000, ResetCountLimit: 3},
+		},
+		{
+			desc:      "DurationTooLarge",
+			validity:  &PCRPolicyValidityData{Duration: math.MaxUint64},
+			clockInfo: &tpm2.ClockInfo{Clock: 1},
+			err:       "duration is too large",
+		},
+		{
+			desc:      "ResetsTooLarge",
+			validity:  &PCRPolicyValidityData{LimitResets: true, MaxResets: math.MaxUint32},
+			clockInfo: &tpm2.ClockInfo{ResetCount: 1},
+			err:       "maximum number of resets is too large",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			validity, err := data.validity.ComputeLimits(data.clockInfo)
+			if data.err != "" {
+				if err == nil || err.Error() != data.err {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ComputeLimits failed: %v", err)
+			}
+			if !reflect.DeepEqual(validity, data.expected) {
+				t.Errorf("Unexpected validity data: %#v", validity)
+			}
+		})
+	}
+}
+
+func TestComputeDynamicPolicyWithValidity(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	pcrDigest, _ := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{
+		tpm2.HashAlgorithmSHA256: {7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")}})
+
+	base, err := ComputeDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256,
+		NewDynamicPolicyComputeParams(key, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{pcrDigest}, nil, 0))
+	if err != nil {
+		t.Fatalf("ComputeDynamicPolicy failed: %v", err)
+	}
+
+	validity := &PCRPolicyValidityData{Duration: 60000, LimitResets: true, ClockLimit: 1060000, ResetCountLimit: 12}
+	data, err := ComputeDynamicPolicy(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256,
+		NewDynamicPolicyComputeParamsWithValidity(key, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{pcrDigest}, nil, 0, validity))
+	if err != nil {
+		t.Fatalf("ComputeDynamicPolicy failed: %v", err)
+	}
+	if data.Validity() != validity {
+		t.Errorf("Unexpected validity data")
+	}
+
+	// The validity window should be enforced by 2 TPM2_PolicyCounterTimer assertions after the rest of the PCR policy.
+	extend := func(digest tpm2.Digest, operandB []byte, offset uint16, operation tpm2.ArithmeticOp) tpm2.Digest {
+		h := tpm2.HashAlgorithmSHA256.NewHash()
+		h.Write(operandB)
+		binary.Write(h, binary.BigEndian, offset)
+		binary.Write(h, binary.BigEndian, operation)
+		args := h.Sum(nil)
+
+		h = tpm2.HashAlgorithmSHA256.NewHash()
+		h.Write(digest)
+		binary.Write(h, binary.BigEndian, tpm2.CommandPolicyCounterTimer)
+		h.Write(args)
+		return h.Sum(nil)
+	}
+	expected := extend(base.AuthorizedPolicy(), []byte{0, 0, 0, 0, 0, 0x10, 0x2c, 0xa0}, 8, tpm2.OpUnsignedLT)
+	expected = extend(expected, []byte{0, 0, 0, 12}, 16, tpm2.OpUnsignedLE)
+	if !bytes.Equal(data.AuthorizedPolicy(), expected) {
+		t.Errorf("Unexpected policy digest (got %x, expected %x)", data.AuthorizedPolicy(), expected)
+	}
+
+	_, err = ComputeDynamicPolicy(0, tpm2.HashAlgorithmSHA256,
+		NewDynamicPolicyComputeParamsWithValidity(nil, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{pcrDigest}, nil, 0, validity))
+	if err == nil || err.Error() != "validity windows are not supported" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestPCRPolicyUpdateSerializationWithValidity(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	validity := &PCRPolicyValidityData{Duration: 60000, ClockLimit: 1060000}
+	update, err := NewPCRPolicyUpdate(CurrentMetadataVersion, tpm2.HashAlgorithmSHA256, CreateTPMPublicAreaForECDSAKey(&key.PublicKey),
+		NewDynamicPolicyComputeParamsWithValidity(nil, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{make(tpm2.Digest, 32)}, nil, 0, validity))
+	if err != nil {
+		t.Fatalf("NewPCRPolicyUpdate failed: %v", err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := update.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	update, err = ReadPCRPolicyUpdate(b)
+	if err != nil {
+		t.Fatalf("ReadPCRPolicyUpdate failed: %v", err)
+	}
+	if !reflect.DeepEqual(update.PolicyData().Validity(), validity) {
+		t.Errorf("Unexpected validity data")
+	}
+	v, clockLimit, resetCountLimit := update.Validity()
+	if !reflect.DeepEqual(v, &PCRPolicyValidity{Duration: time.Minute}) || clockLimit != 1060000 || resetCountLimit != 0 {
+		t.Errorf("Unexpected validity window")
+	}
+}
+
+func TestKeyDataMarshalVersion(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	authPublicKey := CreateTPMPublicAreaForECDSAKey(&key.PublicKey)
+
+	staticData, _, err := ComputeStaticPolicy(tpm2.HashAlgorithmSHA256, NewStaticPolicyComputeParams(authPublicKey, nil))
+	if err != nil {
+		t.Fatalf("ComputeStaticPolicy failed: %v", err)
+	}
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	validity := &PCRPolicyValidityData{Duration: 60000, ClockLimit: 1060000}
+
+	for _, data := range []struct {
+		desc     string
+		version  uint32
+		validity *PCRPolicyValidityData
+		expected uint32
+	}{
+		{
+			desc:     "V1",
+			version:  1,
+			expected: 2,
+		},
+		{
+			desc:     "V2",
+			version:  2,
+			expected: 2,
+		},
+		{
+			desc:     "V2WithValidity",
+			version:  2,
+			validity: validity,
+			expected: 3,
+		},
+		{
+			desc:     "V3",
+			version:  3,
+			expected: 3,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			dynamicData, err := ComputeDynamicPolicy(data.version, tpm2.HashAlgorithmSHA256,
+				NewDynamicPolicyComputeParamsWithValidity(key, tpm2.HashAlgorithmSHA256, pcrs, tpm2.DigestList{make(tpm2.Digest, 32)}, nil, 0, data.validity))
+			if err != nil {
+				t.Fatalf("ComputeDynamicPolicy failed: %v", err)
+			}
+
+			b, err := mu.MarshalToBytes(NewKeyData(data.version, authPublicKey, staticData, dynamicData))
+			if err != nil {
+				t.Fatalf("MarshalToBytes failed: %v", err)
+			}
+			if version := binary.BigEndian.Uint32(b); version != data.expected {
+				t.Errorf("Unexpected version %d", version)
+			}
+
+			var keyData KeyData
+			if _, err := mu.UnmarshalFromBytes(b, &keyData); err != nil {
+				t.Fatalf("UnmarshalFromBytes failed: %v", err)
+			}
+			if keyData.Version() != data.expected {
+				t.Errorf("Unexpected version %d", keyData.Version())
+			}
+			if !reflect.DeepEqual(keyData.DynamicPolicyData(), dynamicData) {
+				t.Errorf("Unexpected dynamic policy data")
+			}
+		})
+	}
+}
+
+func TestSealKeyToTPMWithPCRPolicyValidity(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() { closeTPM(t, tpm) }()
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithPCRPolicyValidity_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             NewPCRProtectionProfile(),
+		PCRPolicyCounterHandle: 0x01810000,
+		PCRPolicyValidity:      &PCRPolicyValidity{Duration: time.Hour, LimitResets: true}})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer func() { undefineKeyNVSpace(t, tpm, keyFile) }()
+
+	unseal := func() error {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return nil
+	}
+
+	if err := unseal(); err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+
+	// The policy is only valid until the next TPM reset.
+	tpm, tcti = resetTPMSimulator(t, tpm, tcti)
+	err = unseal()
+	if _, ok := err.(InvalidKeyFileError); !ok || err.Error() != "invalid key data file: cannot complete authorization policy "+
+		"assertions: the PCR policy has expired" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Updating the PCR policy renews the validity window.
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if err := k.UpdatePCRProtectionPolicy(tpm, authKey, NewPCRProtectionProfile()); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+	if err := unseal(); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+}
+
+func TestSealKeyToExternalTPMStorageKeyWithPCRPolicyValidity(t *testing.T) {
+	_, err := SealKeyToExternalTPMStorageKey(nil, nil, "", &KeyCreationParams{
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PCRPolicyValidity:      &PCRPolicyValidity{Duration: time.Hour}})
+	if err == nil || err.Error() != "PCRPolicyValidity must be nil when creating an importable sealed key" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}